@@ -3,7 +3,6 @@ package main
 import (
 	"encoding/base64"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"net"
 	"sync"
@@ -11,11 +10,15 @@ import (
 
 	uuid "github.com/google/uuid"
 	"github.com/linkedin/goavro/v2"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 const (
 	schemaService = "ADS"
 	schemaSignal  = "ANON_IP_ADDRS"
+	// overflowAddr replaces an anonymized address for all wallets in excess of
+	// our per-address wallet limit.
+	overflowAddr = "overflow"
 )
 
 // The Avro codec that we use to encode data before sending it to Kafka.
@@ -50,21 +53,42 @@ type kafkaMessage struct {
 // addresses and their respective meta data.
 type addrAggregator struct {
 	sync.RWMutex
-	wg          sync.WaitGroup
-	fwdInterval time.Duration
-	keyExpiry   time.Duration
-	addrs       WalletsByKeyID
-	tokenizer   tokenizer
-	inbox       chan serializer
-	outbox      chan token
-	done        chan empty
+	wg                sync.WaitGroup
+	fwdInterval       time.Duration
+	keyExpiry         time.Duration
+	maxWalletsPerAddr int
+	commitRecords     bool
+	recordRequestIDs  bool
+	// timestampPrecision is the precision of our records' timestamps.
+	timestampPrecision time.Duration
+	// We flush our window early once it reaches flushMaxRecords records or
+	// flushMaxBytes bytes.  0 means no limit.
+	flushMaxRecords int
+	flushMaxBytes   int
+	// addrWindow is our window, which we flush to our outbox every
+	// forward interval.  windows contains our additional windows, if any.
+	*addrWindow
+	windows   []*extraWindow
+	scopes    *addrScopePolicy
+	clock     clock
+	sends     *sendTimer
+	tokenizer tokenizer
+	inbox     chan serializer
+	outbox    chan token
+	done      chan empty
+	// retune tells our loop that our forward interval changed.
+	retune chan empty
 }
 
 // newAddrAggregator returns a new address aggregator.
 func newAddrAggregator() aggregator {
 	return &addrAggregator{
-		done:  make(chan empty),
-		addrs: make(WalletsByKeyID),
+		done:       make(chan empty),
+		retune:     make(chan empty, 1),
+		addrWindow: newAddrWindow(),
+		scopes:     newAddrScopePolicy(),
+		clock:      realClock{},
+		sends:      newSendTimer("aggregator_outbox"),
 	}
 }
 
@@ -75,6 +99,13 @@ func (a *addrAggregator) setConfig(c *config) {
 
 	a.fwdInterval = c.fwdInterval
 	a.keyExpiry = c.keyExpiry
+	a.maxWalletsPerAddr = c.maxWalletsPerAddr
+	a.commitRecords = c.commitRecords
+	a.recordRequestIDs = c.recordRequestIDs
+	a.timestampPrecision = c.timestampPrecision
+	a.flushMaxRecords = c.flushMaxRecords
+	a.flushMaxBytes = c.flushMaxBytes
+	a.scopes.setConfig(c)
 	l.Printf("Forward interval: %s, key expiry: %s", a.fwdInterval, a.keyExpiry)
 }
 
@@ -99,44 +130,93 @@ func (a *addrAggregator) connect(inbox chan serializer, outbox chan token) {
 // start starts the address aggregator.
 func (a *addrAggregator) start() {
 	if err := a.tokenizer.resetKey(); err != nil {
-		l.Fatalf("Failed to reset tokenizer key: %v", err)
+		fatalf(exitCrypto, "Failed to reset tokenizer key: %v", err)
 	}
-	a.wg.Add(1)
+	// We serialize and forward our addresses in a separate goroutine, so
+	// that large flushes don't stall the processing of incoming requests.
+	flushes := make(chan *addrSnapshot, 1)
+	watchChan("aggregator_flushes", flushes)
+	watchChan("aggregator_outbox", a.outbox)
+	a.wg.Add(2)
+	go func() {
+		defer a.wg.Done()
+		for s := range flushes {
+			if err := a.forward(s, a.outbox, a.sends); err != nil {
+				countErr(err)
+				l.Printf("Failed to forward addresses: %s", errFields(err))
+			}
+		}
+	}()
+
+	a.RLock() // Protect read of fwdInterval and keyExpiry.
+	fwdTicker := a.clock.newTicker(a.fwdInterval)
+	keyTicker := a.clock.newTicker(a.keyExpiry)
+	a.RUnlock()
+	estimateTicker := a.clock.newTicker(estimateInterval)
+	// Our additional windows flush their remaining addresses once our loop
+	// returns, i.e., once we stopped processing requests.
+	loopDone := make(chan empty)
+	a.startWindows(loopDone)
 
 	go func() {
 		defer a.wg.Done()
-		a.RLock() // Protect read of fwdInterval and keyExpiry.
-		fwdTicker := time.NewTicker(a.fwdInterval)
-		keyTicker := time.NewTicker(a.keyExpiry)
-		a.RUnlock()
+		defer close(loopDone)
+		defer func() { fwdTicker.stop() }()
+		defer keyTicker.stop()
+		defer estimateTicker.stop()
 
 		l.Println("Starting address aggregator loop.")
 		for {
 			select {
 			case <-a.done:
+				// Forward what we have before shutting down.
+				flushes <- a.snapshot()
+				close(flushes)
 				return
-			case <-fwdTicker.C:
-				if err := a.flush(); err != nil {
-					l.Printf("Failed to forward addresses: %v", err)
+			case <-fwdTicker.ticks():
+				// If the previous flush is still queued, we keep collecting
+				// until the next tick rather than stall.
+				if len(flushes) == 0 {
+					flushes <- a.snapshot()
 				}
-			case <-keyTicker.C:
+			case <-a.retune:
+				fwdTicker.stop()
+				a.RLock()
+				fwdTicker = a.clock.newTicker(a.fwdInterval)
+				a.RUnlock()
+			case <-keyTicker.ticks():
 				if err := a.tokenizer.resetKey(); err != nil {
-					l.Fatalf("Failed to reset tokenizer key: %v", err)
+					fatalf(exitCrypto, "Failed to reset tokenizer key: %v", err)
 				}
+			case <-estimateTicker.ticks():
+				a.updateEstimate()
 			case req := <-a.inbox:
 				switch v := req.(type) {
 				case *clientRequest:
-					if err := a.processRequest(v); err != nil {
-						l.Printf("Failed to process client request: %v", err)
+					v.dequeued = a.clock.now()
+					err := a.processRequest(v)
+					v.acknowledge(err)
+					if err != nil {
+						countErr(err)
+						l.Printf("Failed to process client request: %s", errFields(err))
+						continue
+					}
+					l.Printf("Processed request for wallet %s (request ID %q).", v.Wallet, v.RequestID)
+					// Traffic spikes shouldn't make us keep an entire
+					// forward interval's worth of records in memory.
+					if a.full() && len(flushes) == 0 {
+						l.Println("Window reached its size limit.  Flushing early.")
+						m.numEarlyFlushes.Inc()
+						flushes <- a.snapshot()
 					}
-					l.Printf("Processed request for wallet %s.", v.Wallet)
 				default:
 					// We are not prepared to process whatever data structure
 					// we were given.  Simply tokenize it and forward it right
 					// away, without aggregation.
 					t, err := a.tokenizer.tokenize(v)
 					if err != nil {
-						l.Printf("Failed to tokenize blob: %v", err)
+						countErr(err)
+						l.Printf("Failed to tokenize blob: %s", errFields(err))
 					}
 					a.outbox <- t
 					l.Println("Type not supported.  Forwarded.")
@@ -150,6 +230,7 @@ func (a *addrAggregator) start() {
 func (a *addrAggregator) stop() {
 	close(a.done)
 	a.wg.Wait()
+	a.scopes.stop()
 	l.Println("Stopped address aggregator.")
 }
 
@@ -163,10 +244,100 @@ func (a *addrAggregator) processRequest(req *clientRequest) error {
 		m.numAddrs.Set(float64(a.addrs.numAddrs()))
 	}()
 
-	rawToken, keyID, err := a.tokenizer.tokenizeAndKeyID(req)
+	token, keyID, scoped, err := a.anonymize(req)
 	if err != nil {
 		return err
 	}
+	req.pseudonym = token
+
+	// We anonymize each request once, and add it to all of our windows.
+	if a.addTo(a.addrWindow, *keyID, req, token, scoped) {
+		m.numOverflowed.Inc()
+	}
+	for _, w := range a.windows {
+		a.addTo(w.addrWindow, *keyID, req, token, scoped)
+	}
+	return nil
+}
+
+// addTo adds the given request and its anonymized address to the given
+// window.  It returns true if the address was replaced with the overflow
+// marker for the first time for the request's wallet.  The caller must hold
+// our lock.
+func (a *addrAggregator) addTo(w *addrWindow, keyID keyID, req *clientRequest, token string, scoped bool) bool {
+	wallets, exists := w.addrs[keyID]
+	if !exists {
+		// We're starting a new key ID epoch.
+		wallets = make(AddrsByWallet)
+		w.addrs[keyID] = wallets
+	}
+	addrSet, exists := wallets[req.Wallet]
+	if !exists {
+		// We have no addresses for the given wallet yet.  Create a new
+		// address set.
+		addrSet = make(AddressSet)
+		wallets[req.Wallet] = addrSet
+		w.bytes += approxRecordBytes
+	}
+	w.walletMeta(keyID, req.Wallet).requests++
+	if req.Meta != nil {
+		w.walletMeta(keyID, req.Wallet).add(req.Meta)
+	}
+	if req.ApiVersion > 0 {
+		w.walletMeta(keyID, req.Wallet).apiVersions[req.ApiVersion]++
+	}
+	if a.recordRequestIDs && req.RequestID != "" {
+		w.walletMeta(keyID, req.Wallet).addRequestID(req.RequestID)
+	}
+	if _, exists := addrSet[token]; exists {
+		// Browser retries end up here.  Rather than duplicating the
+		// address, we count its occurrences.
+		w.walletMeta(keyID, req.Wallet).addrCounts[token]++
+		return false
+	}
+
+	// If a single address (e.g., a NAT gateway or VPN exit) is shared by
+	// more wallets than we allow, the excess wallets get the overflow marker
+	// instead of the address.
+	overflowed := false
+	if a.maxWalletsPerAddr > 0 && !scoped {
+		counts, exists := w.walletsPerAddr[keyID]
+		if !exists {
+			counts = make(map[string]int)
+			w.walletsPerAddr[keyID] = counts
+		}
+		if counts[token] >= a.maxWalletsPerAddr {
+			overflowed = true
+			token = overflowAddr
+		} else {
+			counts[token]++
+		}
+	}
+	w.walletMeta(keyID, req.Wallet).addrCounts[token]++
+	if _, exists := addrSet[token]; exists {
+		// The wallet already has the overflow marker, so we counted it
+		// when it first overflowed.
+		return false
+	}
+	addrSet[token] = empty{}
+	w.bytes += addrBytes(token)
+
+	return overflowed
+}
+
+// anonymize returns the given request's anonymized address and the ID of the
+// key that we used.  If the address is in one of our address scopes, we
+// return the scope's marker instead, and true.
+func (a *addrAggregator) anonymize(req *clientRequest) (string, *keyID, bool, error) {
+	if marker, ok := a.scopes.marker(req.Addr); ok {
+		m.numScoped.With(prometheus.Labels{scopeName: marker}).Inc()
+		return marker, a.tokenizer.keyID(), true, nil
+	}
+
+	rawToken, keyID, err := a.tokenizer.tokenizeAndKeyID(req)
+	if err != nil {
+		return "", nil, false, err
+	}
 	// The tokenized IP address may not be printable, so let's encode it.
 	token := base64.StdEncoding.EncodeToString(rawToken)
 
@@ -174,50 +345,81 @@ func (a *addrAggregator) processRequest(req *clientRequest) error {
 	// byte slice back into an IP address.
 	if a.tokenizer.preservesLen() {
 		if len(rawToken) != net.IPv4len && len(rawToken) != net.IPv6len {
-			return errors.New("token is neither of length IPv4 nor IPv6")
+			return "", nil, false, newError(ErrCrypto, "token is neither of length IPv4 nor IPv6")
 		}
 		token = net.IP(rawToken).String()
 	}
+	return token, keyID, false, nil
+}
 
-	wallets, exists := a.addrs[*keyID]
+// walletMeta returns the metadata that we collected for the given wallet,
+// creating it if necessary.
+func (w *addrWindow) walletMeta(keyID keyID, walletID uuid.UUID) *walletMeta {
+	metaByWallet, exists := w.meta[keyID]
 	if !exists {
-		// We're starting a new key ID epoch.
-		wallets := make(AddrsByWallet)
-		wallets[req.Wallet] = AddressSet{
-			token: empty{},
-		}
-		a.addrs[*keyID] = wallets
-	} else {
-		// We're adding to the existing epoch.
-		addrSet, exists := wallets[req.Wallet]
-		if !exists {
-			// We have no addresses for the given wallet yet.  Create a new
-			// address set.
-			wallets[req.Wallet] = AddressSet{
-				token: empty{},
-			}
-		} else {
-			// Add address to the given wallet's address set.
-			addrSet[token] = empty{}
-		}
+		metaByWallet = make(MetaByWallet)
+		w.meta[keyID] = metaByWallet
 	}
-	return nil
+	wMeta, exists := metaByWallet[walletID]
+	if !exists {
+		wMeta = newWalletMeta()
+		metaByWallet[walletID] = wMeta
+	}
+	return wMeta
+}
+
+// addrJustification is what an address record's justification field contains.
+// We're abusing our schema's justification field by storing JSON in it.  While
+// not elegant, this lets us ingest anonymized IP addresses without modifying
+// the schema.
+type addrJustification struct {
+	KeyID uuid.UUID `json:"keyid"`
+	Addrs []string  `json:"addrs"`
+	// Requests is the number of the wallet's requests during the forward
+	// interval.
+	Requests int `json:"requests,omitempty"`
+	// AddrCounts maps each of the wallet's addresses to the number of
+	// requests that it occurred in.
+	AddrCounts map[string]int `json:"addr_counts,omitempty"`
+	Countries  []string       `json:"countries,omitempty"`
+	ConfTypes  []string       `json:"conf_types,omitempty"`
+	// ApiVersions maps ads API versions to the number of requests that the
+	// wallet made with them during the forward interval.
+	ApiVersions map[int]int `json:"api_versions,omitempty"`
+	// RequestIDs contains the IDs of the wallet's requests if we're
+	// configured to record them.
+	RequestIDs []string `json:"request_ids,omitempty"`
+	// Window identifies the forward interval whose commit record covers
+	// this message.
+	Window string `json:"window,omitempty"`
 }
 
 // compileKafkaMsg turns the given arguments into a byte slice that's ready to
-// be sent to our Kafka cluster.
-func compileKafkaMsg(keyID keyID, walletID uuid.UUID, addrs AddressSet) ([]byte, error) {
-	// We're abusing our schema's justification field by storing JSON in it.
-	// While not elegant, this lets us ingest anonymized IP addresses without
-	// modifying the schema.
-	justification := struct {
-		KeyID uuid.UUID `json:"keyid"`
-		Addrs []string  `json:"addrs"`
-	}{
+// be sent to our Kafka cluster.  The wallet's metadata may be nil, and the
+// window ID is uuid.Nil unless we emit commit records.
+func compileKafkaMsg(keyID keyID, walletID uuid.UUID, addrs AddressSet, meta *walletMeta, createdAt time.Time, window uuid.UUID) ([]byte, error) {
+	justification := &addrJustification{
 		KeyID: keyID.UUID,
 	}
+	if window != uuid.Nil {
+		justification.Window = window.String()
+	}
 
 	justification.Addrs = append(justification.Addrs, addrs.sorted()...)
+	if meta != nil {
+		justification.Requests = meta.requests
+		justification.AddrCounts = meta.addrCounts
+		justification.Countries = sortedKeys(meta.countries)
+		justification.ConfTypes = sortedKeys(meta.confTypes)
+		justification.ApiVersions = meta.apiVersions
+		justification.RequestIDs = sortedKeys(meta.requestIDs)
+	}
+	return encodeAddrRecord(walletID, justification, createdAt.UTC().Format(time.RFC3339))
+}
+
+// encodeAddrRecord returns the Avro-encoded address record of the given
+// wallet, with the given justification and creation time.
+func encodeAddrRecord(walletID uuid.UUID, justification *addrJustification, createdAt string) ([]byte, error) {
 	jsonBytes, err := json.Marshal(justification)
 	if err != nil {
 		return nil, err
@@ -229,7 +431,7 @@ func compileKafkaMsg(keyID keyID, walletID uuid.UUID, addrs AddressSet) ([]byte,
 		Service:       schemaService,
 		Signal:        schemaSignal,
 		Justification: string(jsonBytes),
-		CreatedAt:     time.Now().UTC().Format(time.RFC3339),
+		CreatedAt:     createdAt,
 	}
 	jsonBytes, err = json.Marshal(msg)
 	if err != nil {
@@ -239,31 +441,83 @@ func compileKafkaMsg(keyID keyID, walletID uuid.UUID, addrs AddressSet) ([]byte,
 	return avroEncode(ourCodec, jsonBytes)
 }
 
-// flush flushes the aggregator's addresses to the outbox.
-func (a *addrAggregator) flush() error {
+// addrSnapshot contains the addresses and metadata that the address
+// aggregator collected during one forward interval.
+type addrSnapshot struct {
+	addrs     WalletsByKeyID
+	meta      map[keyID]MetaByWallet
+	createdAt time.Time
+	// window is the snapshot's window ID if we emit commit records, and
+	// uuid.Nil otherwise.
+	window uuid.UUID
+}
+
+// snapshot returns the aggregator's addresses and metadata, and starts afresh.
+func (a *addrAggregator) snapshot() *addrSnapshot {
 	a.Lock()
 	defer a.Unlock()
 
-	if len(a.addrs) == 0 {
-		return nil
+	s := a.snapshotOf(a.addrWindow)
+	m.numWallets.Set(0)
+	m.numAddrs.Set(0)
+	return s
+}
+
+// createdAt returns the current time at the precision of our records'
+// timestamps.  The caller must hold our lock.
+func (a *addrAggregator) createdAt() time.Time {
+	return truncateTime(a.clock.now(), a.timestampPrecision)
+}
+
+// snapshotOf returns the given window's addresses and metadata, and starts the
+// window afresh.  The caller must hold our lock.
+func (a *addrAggregator) snapshotOf(w *addrWindow) *addrSnapshot {
+	s := &addrSnapshot{addrs: w.addrs, meta: w.meta, createdAt: a.createdAt()}
+	if a.commitRecords {
+		s.window = uuid.New()
 	}
+	*w = *newAddrWindow()
+	return s
+}
 
-	for keyID, wallets := range a.addrs {
+// forward turns the given snapshot into Kafka messages and sends them to the
+// given outbox.  If we emit commit records, the snapshot's messages are
+// followed by its commit record.
+func (a *addrAggregator) forward(s *addrSnapshot, outbox chan token, sends *sendTimer) error {
+	commit := newWindowCommit(s.window)
+	for keyID, wallets := range s.addrs {
 		totalAddrs := 0
 		// Compile the anonymized IP addresses that we've seen for a given
 		// wallet ID.
 		for walletID, addrSet := range wallets {
 			totalAddrs += len(addrSet)
-			kafkaMsg, err := compileKafkaMsg(keyID, walletID, addrSet)
+			kafkaMsg, err := compileKafkaMsg(keyID, walletID, addrSet, s.meta[keyID][walletID], s.createdAt, s.window)
 			if err != nil {
-				return err
+				// One bad record must not cost us the others.
+				deadLetters.add(stageSerialize, 1, err)
+				continue
 			}
-			a.outbox <- token(kafkaMsg)
+			commit.add(kafkaMsg)
+			sent := sends.start()
+			outbox <- token(kafkaMsg)
+			sent()
 		}
 		l.Printf("Forwarded %d addresses of %d wallets using key ID %s.",
 			totalAddrs, len(wallets), keyID)
 	}
-	a.addrs = make(WalletsByKeyID)
-
+	if s.window == uuid.Nil || commit.records == 0 {
+		return nil
+	}
+	commitMsg, err := commit.compile(s.createdAt)
+	if err != nil {
+		return err
+	}
+	outbox <- token(commitMsg)
+	l.Printf("Forwarded commit record for window %s with %d records.", s.window, commit.records)
 	return nil
 }
+
+// flush flushes the aggregator's addresses to the outbox.
+func (a *addrAggregator) flush() error {
+	return a.forward(a.snapshot(), a.outbox, a.sends)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	uuid "github.com/google/uuid"
+)
+
+// schemaCommitSignal is the signal of commit records, which lets consumers
+// tell them apart from address records.
+const schemaCommitSignal = "ANON_IP_ADDRS_COMMIT"
+
+// windowCommit summarizes the messages that the address aggregator forwarded
+// for one forward interval, i.e., one window.  Once all of a window's messages
+// are forwarded, we forward a commit record.  Consumers that saw messages of
+// a window but no commit record (or a commit record whose count or checksum
+// doesn't match) know that the window is incomplete, e.g., because we crashed
+// while flushing.
+type windowCommit struct {
+	window  uuid.UUID
+	records int
+	// checksum is the XOR of the SHA-256 digests of the window's messages.
+	// Unlike a digest over all messages, it doesn't depend on the order in
+	// which consumers receive the messages.
+	checksum [sha256.Size]byte
+}
+
+func newWindowCommit(window uuid.UUID) *windowCommit {
+	return &windowCommit{window: window}
+}
+
+// add adds the given message to the window.
+func (c *windowCommit) add(msg []byte) {
+	sum := sha256.Sum256(msg)
+	for i := range c.checksum {
+		c.checksum[i] ^= sum[i]
+	}
+	c.records++
+}
+
+// compile turns the commit record into a byte slice that's ready to be sent
+// to our Kafka cluster.  Commit records use the same schema as address
+// records; their wallet ID is the nil UUID.
+func (c *windowCommit) compile(createdAt time.Time) ([]byte, error) {
+	justification, err := json.Marshal(struct {
+		Window   string `json:"window"`
+		Records  int    `json:"records"`
+		Checksum string `json:"checksum"`
+	}{
+		Window:   c.window.String(),
+		Records:  c.records,
+		Checksum: hex.EncodeToString(c.checksum[:]),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	jsonBytes, err := json.Marshal(kafkaMessage{
+		WalletID:      uuid.Nil.String(),
+		Service:       schemaService,
+		Signal:        schemaCommitSignal,
+		Justification: string(justification),
+		CreatedAt:     createdAt.UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal Kafka message: %w", err)
+	}
+	return avroEncode(ourCodec, jsonBytes)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"testing"
+)
+
+func TestWindowCommitChecksum(t *testing.T) {
+	window := newV4(t)
+	c1, c2 := newWindowCommit(window), newWindowCommit(window)
+	c1.add([]byte("foo"))
+	c1.add([]byte("bar"))
+	// The checksum must not depend on the order of messages.
+	c2.add([]byte("bar"))
+	c2.add([]byte("foo"))
+	assertEqual(t, c1.checksum, c2.checksum)
+	assertEqual(t, c1.records, 2)
+}
+
+func TestAddrAggregatorCommitRecords(t *testing.T) {
+	tokenizer := newVerbatimTokenizer()
+	_ = tokenizer.resetKey()
+	a := newAddrAggregator().(*addrAggregator)
+	a.setConfig(&config{commitRecords: true})
+	a.use(tokenizer)
+	outbox := make(chan token, 10)
+	a.connect(nil, outbox)
+
+	// Empty windows don't get a commit record.
+	if err := a.flush(); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+	assertEqual(t, len(outbox), 0)
+
+	for _, addr := range []string{"1.1.1.1", "2.2.2.2"} {
+		req := &clientRequest{Addr: net.ParseIP(addr), Wallet: newV4(t)}
+		if err := a.processRequest(req); err != nil {
+			t.Fatalf("Failed to process request: %v", err)
+		}
+	}
+	if err := a.flush(); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+	assertEqual(t, len(outbox), 3)
+
+	// The window's address records come first and carry the window ID.
+	var window struct {
+		Window string `json:"window"`
+	}
+	expected := newWindowCommit(newV4(t))
+	for i := 0; i < 2; i++ {
+		msg := <-outbox
+		expected.add(msg)
+		record, _ := decodeCompatMsg(t, ourCodec, msg)
+		assertEqual(t, record["signal"], schemaSignal)
+		if err := json.Unmarshal([]byte(record["justification"].(string)), &window); err != nil {
+			t.Fatalf("Failed to unmarshal justification: %v", err)
+		}
+	}
+
+	native, _, err := ourCodec.NativeFromBinary(<-outbox)
+	if err != nil {
+		t.Fatalf("Failed to decode message: %v", err)
+	}
+	record := native.(map[string]interface{})
+	assertEqual(t, record["signal"], schemaCommitSignal)
+	var commit struct {
+		Window   string `json:"window"`
+		Records  int    `json:"records"`
+		Checksum string `json:"checksum"`
+	}
+	if err := json.Unmarshal([]byte(record["justification"].(string)), &commit); err != nil {
+		t.Fatalf("Failed to unmarshal justification: %v", err)
+	}
+	assertEqual(t, commit.Window, window.Window)
+	assertEqual(t, commit.Records, 2)
+	assertEqual(t, commit.Checksum, hex.EncodeToString(expected.checksum[:]))
+}
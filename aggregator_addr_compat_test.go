@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	uuid "github.com/google/uuid"
+	"github.com/linkedin/goavro/v2"
+)
+
+// Each directory in compatDir contains the Avro schema (schema.avsc) and an
+// example message (message.avro) of a past release.  When changing our output
+// format, add a new directory for the release that's about to go out, so that
+// the next release is tested against it.  During rolling upgrades, consumers
+// see messages of two consecutive releases, so both directions must work.
+const compatDir = "testdata/compat"
+
+// compatJustification contains the justification fields that downstream
+// consumers rely on.
+type compatJustification struct {
+	KeyID uuid.UUID `json:"keyid"`
+	Addrs []string  `json:"addrs"`
+}
+
+func decodeCompatMsg(t *testing.T, codec *goavro.Codec, msg []byte) (map[string]interface{}, compatJustification) {
+	t.Helper()
+
+	native, _, err := codec.NativeFromBinary(msg)
+	if err != nil {
+		t.Fatalf("Failed to decode Avro message: %v", err)
+	}
+	record, ok := native.(map[string]interface{})
+	if !ok {
+		t.Fatalf("Expected Avro record but got %T.", native)
+	}
+	var j compatJustification
+	if err := json.Unmarshal([]byte(record["justification"].(string)), &j); err != nil {
+		t.Fatalf("Failed to unmarshal justification: %v", err)
+	}
+	return record, j
+}
+
+func compatReleases(t *testing.T) []string {
+	t.Helper()
+
+	dirs, err := filepath.Glob(filepath.Join(compatDir, "*"))
+	if err != nil {
+		t.Fatalf("Failed to list compatibility test data: %v", err)
+	}
+	if len(dirs) == 0 {
+		t.Fatal("Expected at least one release in compatibility test data.")
+	}
+	return dirs
+}
+
+func TestCompatPreviousToCurrent(t *testing.T) {
+	for _, dir := range compatReleases(t) {
+		msg, err := os.ReadFile(filepath.Join(dir, "message.avro"))
+		if err != nil {
+			t.Fatalf("Failed to read message: %v", err)
+		}
+		// Messages of past releases must be decodable with our current
+		// schema.
+		record, j := decodeCompatMsg(t, ourCodec, msg)
+		assertEqual(t, record["service"], schemaService)
+		assertEqual(t, record["signal"], schemaSignal)
+		if _, err := uuid.Parse(record["wallet_id"].(string)); err != nil {
+			t.Errorf("%s: Expected valid wallet ID but got %q.", dir, record["wallet_id"])
+		}
+		if j.KeyID == uuid.Nil || len(j.Addrs) == 0 {
+			t.Errorf("%s: Expected key ID and addresses but got %+v.", dir, j)
+		}
+	}
+}
+
+func TestCompatCurrentToPrevious(t *testing.T) {
+	keyID := keyID{UUID: uuid.New()}
+	walletID := uuid.New()
+	addrs := AddressSet{"1.1.1.1": empty{}, "2.2.2.2": empty{}}
+	meta := newWalletMeta()
+	meta.add(&requestMeta{Country: "US", ConfType: "view"})
+
+	msg, err := compileKafkaMsg(keyID, walletID, addrs, meta, time.Now(), uuid.Nil)
+	if err != nil {
+		t.Fatalf("Failed to compile Kafka message: %v", err)
+	}
+
+	for _, dir := range compatReleases(t) {
+		schema, err := os.ReadFile(filepath.Join(dir, "schema.avsc"))
+		if err != nil {
+			t.Fatalf("Failed to read schema: %v", err)
+		}
+		codec, err := goavro.NewCodec(string(schema))
+		if err != nil {
+			t.Fatalf("Failed to create Avro codec: %v", err)
+		}
+		// Our current messages must be decodable by consumers of past
+		// releases.
+		record, j := decodeCompatMsg(t, codec, msg)
+		assertEqual(t, record["wallet_id"], walletID.String())
+		assertEqual(t, j.KeyID, keyID.UUID)
+		if !reflect.DeepEqual(j.Addrs, addrs.sorted()) {
+			t.Errorf("%s: Expected addresses %v but got %v.", dir, addrs.sorted(), j.Addrs)
+		}
+	}
+}
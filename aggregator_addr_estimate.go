@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	uuid "github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// maxEstimateSamples is the number of records that we serialize to
+	// estimate the size of the current window.  We extrapolate from these,
+	// so that estimating the size of a large window stays cheap.
+	maxEstimateSamples = 1000
+	// estimateInterval determines how often we update our size metrics.
+	estimateInterval = time.Minute
+	// Label values of our size metrics.
+	encodingAvro = "avro"
+	encodingGzip = "gzip"
+)
+
+var errNoEstimate = errors.New("aggregator does not support size estimates")
+
+// estimator is implemented by aggregators that can estimate the size of their
+// next flush.
+type estimator interface {
+	estimate() (*windowEstimate, error)
+}
+
+// windowEstimate is the projected size of a window's flush.
+type windowEstimate struct {
+	// Records is the number of address records that the flush contains.
+	Records int `json:"records"`
+	// Sampled is the number of records that we serialized to estimate the
+	// window's size.
+	Sampled int `json:"sampled"`
+	// AvroBytes is the projected size of the Avro-encoded records, and
+	// GzipBytes the projected size after gzip compression.  Kafka compresses
+	// batches rather than entire windows, so the compressed size is a lower
+	// bound.
+	AvroBytes int `json:"avro_bytes"`
+	GzipBytes int `json:"gzip_bytes"`
+}
+
+// estimate serializes a sample of the current window's records, exactly like
+// the next flush would, and extrapolates the window's size from the sample.
+// The current window is left untouched.
+func (a *addrAggregator) estimate() (*windowEstimate, error) {
+	a.RLock()
+	defer a.RUnlock()
+
+	e := &windowEstimate{Records: a.addrs.numWallets()}
+	if e.Records == 0 {
+		return e, nil
+	}
+	buf := new(bytes.Buffer)
+	zw := gzip.NewWriter(buf)
+	avroBytes := 0
+	createdAt := a.clock.now()
+sample:
+	for keyID, wallets := range a.addrs {
+		for walletID, addrSet := range wallets {
+			if e.Sampled == maxEstimateSamples {
+				break sample
+			}
+			msg, err := compileKafkaMsg(keyID, walletID, addrSet, a.meta[keyID][walletID], createdAt, uuid.Nil)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := zw.Write(msg); err != nil {
+				return nil, err
+			}
+			avroBytes += len(msg)
+			e.Sampled++
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	e.AvroBytes = avroBytes * e.Records / e.Sampled
+	e.GzipBytes = buf.Len() * e.Records / e.Sampled
+	return e, nil
+}
+
+// updateEstimate updates our size metrics.
+func (a *addrAggregator) updateEstimate() {
+	e, err := a.estimate()
+	if err != nil {
+		l.Printf("Failed to estimate window size: %v", err)
+		return
+	}
+	m.windowRecords.Set(float64(e.Records))
+	m.windowBytes.With(prometheus.Labels{encoding: encodingAvro}).Set(float64(e.AvroBytes))
+	m.windowBytes.With(prometheus.Labels{encoding: encodingGzip}).Set(float64(e.GzipBytes))
+}
+
+// estimateHandler returns a handler that responds with the projected size of
+// the given aggregator's next flush.
+func estimateHandler(a aggregator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		est, ok := a.(estimator)
+		if !ok {
+			http.Error(w, errNoEstimate.Error(), http.StatusNotImplemented)
+			return
+		}
+		e, err := est.estimate()
+		if err != nil {
+			l.Printf("Failed to estimate window size: %s", errFields(err))
+			http.Error(w, err.Error(), httpStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(e); err != nil {
+			l.Printf("Failed to encode window size estimate: %v", err)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	uuid "github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func newEstimateAggregator(t *testing.T, numWallets int) *addrAggregator {
+	t.Helper()
+
+	tokenizer := newHmacTokenizer()
+	_ = tokenizer.resetKey()
+	a := newAddrAggregator().(*addrAggregator)
+	a.use(tokenizer)
+	for i := 0; i < numWallets; i++ {
+		addr := net.ParseIP(fmt.Sprintf("1.1.%d.%d", i/256, i%256))
+		if err := a.processRequest(&clientRequest{Addr: addr, Wallet: newV4(t)}); err != nil {
+			t.Fatalf("Failed to process request: %v", err)
+		}
+	}
+	return a
+}
+
+func TestEstimate(t *testing.T) {
+	a := newEstimateAggregator(t, 0)
+	e, err := a.estimate()
+	if err != nil {
+		t.Fatalf("Failed to estimate window size: %v", err)
+	}
+	assertEqual(t, *e, windowEstimate{})
+
+	a = newEstimateAggregator(t, 3)
+	e, err = a.estimate()
+	if err != nil {
+		t.Fatalf("Failed to estimate window size: %v", err)
+	}
+	assertEqual(t, e.Records, 3)
+	assertEqual(t, e.Sampled, 3)
+	// All records have the same size, so our estimate is exact.
+	size := 0
+	for keyID, wallets := range a.addrs {
+		for walletID, addrSet := range wallets {
+			msg, err := compileKafkaMsg(keyID, walletID, addrSet, a.meta[keyID][walletID], a.clock.now(), uuid.Nil)
+			if err != nil {
+				t.Fatalf("Failed to compile Kafka message: %v", err)
+			}
+			size += len(msg)
+		}
+	}
+	assertEqual(t, e.AvroBytes, size)
+	if e.GzipBytes <= 0 || e.GzipBytes >= e.AvroBytes {
+		t.Fatalf("Expected compressed size below %d but got %d.", e.AvroBytes, e.GzipBytes)
+	}
+	// The estimate leaves the window untouched.
+	assertEqual(t, a.addrs.numWallets(), 3)
+}
+
+func TestEstimateExtrapolates(t *testing.T) {
+	a := newEstimateAggregator(t, maxEstimateSamples+500)
+	e, err := a.estimate()
+	if err != nil {
+		t.Fatalf("Failed to estimate window size: %v", err)
+	}
+	assertEqual(t, e.Records, maxEstimateSamples+500)
+	assertEqual(t, e.Sampled, maxEstimateSamples)
+	if perRecord := e.AvroBytes / e.Records; perRecord < 100 || perRecord > 500 {
+		t.Fatalf("Got implausible record size: %d", perRecord)
+	}
+}
+
+func TestEstimateMetricsAndHandler(t *testing.T) {
+	a := newEstimateAggregator(t, 2)
+	a.updateEstimate()
+	assertEqual(t, testutil.ToFloat64(m.windowRecords), float64(2))
+	e, _ := a.estimate()
+	assertEqual(t, testutil.ToFloat64(m.windowBytes.WithLabelValues(encodingAvro)), float64(e.AvroBytes))
+
+	srv := httptest.NewServer(newAdminRouter(a, nil))
+	defer srv.Close()
+	resp := makeReq(t, srv, http.MethodGet, "/debug/window-size", nil)
+	assertEqual(t, resp.StatusCode, http.StatusOK)
+	var got windowEstimate
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatalf("Failed to decode estimate: %v", err)
+	}
+	assertEqual(t, got.Records, 2)
+
+	// Aggregators that don't support estimates say so.
+	srv = httptest.NewServer(newAdminRouter(newSimpleAggregator(), nil))
+	defer srv.Close()
+	resp = makeReq(t, srv, http.MethodGet, "/debug/window-size", nil)
+	assertEqual(t, resp.StatusCode, http.StatusNotImplemented)
+}
+
+func TestEstimateOnTick(t *testing.T) {
+	c := newFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	a, inbox, _ := newClockedAggregator(t, c, time.Hour, time.Hour)
+	defer a.stop()
+
+	submitAndWait(t, inbox, "1.1.1.1")
+	c.advance(estimateInterval)
+	// The aggregator updates its metrics after receiving the tick.
+	for i := 0; testutil.ToFloat64(m.windowRecords) != 1; i++ {
+		if i == 100 {
+			t.Fatal("Aggregator didn't update its size metrics.")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
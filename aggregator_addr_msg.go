@@ -2,11 +2,14 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"sort"
 
 	uuid "github.com/google/uuid"
 )
 
+var errNotAddrRecord = errors.New("not an address record")
+
 type ourString string
 
 func (s ourString) bytes() []byte {
@@ -28,14 +31,67 @@ type AddrsByWallet map[uuid.UUID]AddressSet
 // begins, and our collection of wallet-to-address records begins afresh.
 type WalletsByKeyID map[keyID]AddrsByWallet
 
+// MetaByWallet maps a wallet ID to the request metadata that we saw for it.
+type MetaByWallet map[uuid.UUID]*walletMeta
+
+// walletMeta contains the number of a wallet's requests (in total, and per
+// anonymized address), the sets of country codes and confirmation types that
+// the requests carried, the number of requests per ads API version, and the
+// IDs of the wallet's requests.
+type walletMeta struct {
+	requests    int
+	addrCounts  map[string]int
+	countries   map[string]empty
+	confTypes   map[string]empty
+	apiVersions map[int]int
+	requestIDs  map[string]empty
+}
+
+// maxRequestIDs is the maximum number of request IDs that we keep per wallet
+// and forward interval, so a chatty wallet cannot bloat its record.
+const maxRequestIDs = 100
+
+// add adds the given request metadata to the wallet's metadata.
+func (w *walletMeta) add(meta *requestMeta) {
+	if meta.Country != "" {
+		w.countries[meta.Country] = empty{}
+	}
+	if meta.ConfType != "" {
+		w.confTypes[meta.ConfType] = empty{}
+	}
+}
+
+// addRequestID adds the given request ID to the wallet's metadata, unless we
+// already have enough of them.
+func (w *walletMeta) addRequestID(id string) {
+	if len(w.requestIDs) < maxRequestIDs {
+		w.requestIDs[id] = empty{}
+	}
+}
+
+func newWalletMeta() *walletMeta {
+	return &walletMeta{
+		addrCounts:  make(map[string]int),
+		countries:   make(map[string]empty),
+		confTypes:   make(map[string]empty),
+		apiVersions: make(map[int]int),
+		requestIDs:  make(map[string]empty),
+	}
+}
+
 // sorted returns the address set's addresses as a sorted string slice.
 func (s AddressSet) sorted() []string {
-	addrs := []string{}
-	for a := range s {
-		addrs = append(addrs, a)
+	return sortedKeys(s)
+}
+
+// sortedKeys returns the keys of the given set as a sorted string slice.
+func sortedKeys(set map[string]empty) []string {
+	keys := []string{}
+	for k := range set {
+		keys = append(keys, k)
 	}
-	sort.Strings(addrs)
-	return addrs
+	sort.Strings(keys)
+	return keys
 }
 
 // numWallets returns the total number of wallets that are currently in the
@@ -72,6 +128,132 @@ func (w WalletsByKeyID) numAddrs() int {
 	return total
 }
 
+// mergeRecords merges the given Avro-encoded address records, e.g., the
+// flushed windows of several tokenizer replicas, into one record per key ID
+// and wallet, and returns the merged records sorted by key ID and wallet.  We
+// take the union of addresses, countries, confirmation types, and request IDs,
+// and sum up request counts.  Merging is commutative and associative: no
+// matter in what order we merge records, we end up with the same records.  It
+// isn't idempotent, though: the records must cover disjoint requests, like the
+// windows of different replicas do.  Commit records only vouch for a single
+// window, so we skip them, and merged records carry a window ID only if all of
+// their parts carried the same.
+func mergeRecords(msgs [][]byte) ([][]byte, error) {
+	type recordKey struct {
+		keyID    uuid.UUID
+		walletID uuid.UUID
+	}
+	type record struct {
+		justification *addrJustification
+		createdAt     string
+	}
+
+	merged := make(map[recordKey]*record)
+	for _, msg := range msgs {
+		native, _, err := ourCodec.NativeFromBinary(msg)
+		if err != nil {
+			return nil, err
+		}
+		fields, ok := native.(map[string]any)
+		if !ok {
+			return nil, errNotAddrRecord
+		}
+		if signal, _ := fields["signal"].(string); signal != schemaSignal {
+			continue
+		}
+		walletID, err := uuid.Parse(fields["wallet_id"].(string))
+		if err != nil {
+			return nil, err
+		}
+		var j addrJustification
+		if err := json.Unmarshal([]byte(fields["justification"].(string)), &j); err != nil {
+			return nil, err
+		}
+		createdAt := fields["created_at"].(string)
+
+		key := recordKey{keyID: j.KeyID, walletID: walletID}
+		r, exists := merged[key]
+		if !exists {
+			merged[key] = &record{justification: &j, createdAt: createdAt}
+			continue
+		}
+		r.justification.merge(&j)
+		// Our timestamps are in UTC and RFC 3339, so they sort
+		// lexicographically.
+		if createdAt > r.createdAt {
+			r.createdAt = createdAt
+		}
+	}
+
+	keys := make([]recordKey, 0, len(merged))
+	for key := range merged {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].keyID != keys[j].keyID {
+			return keys[i].keyID.String() < keys[j].keyID.String()
+		}
+		return keys[i].walletID.String() < keys[j].walletID.String()
+	})
+	out := make([][]byte, 0, len(keys))
+	for _, key := range keys {
+		r := merged[key]
+		msg, err := encodeAddrRecord(key.walletID, r.justification, r.createdAt)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, msg)
+	}
+	return out, nil
+}
+
+// merge merges the given justification of the same key ID and wallet into
+// ours.
+func (j *addrJustification) merge(other *addrJustification) {
+	j.Addrs = union(j.Addrs, other.Addrs)
+	j.Requests += other.Requests
+	j.AddrCounts = sumCounts(j.AddrCounts, other.AddrCounts)
+	j.Countries = union(j.Countries, other.Countries)
+	j.ConfTypes = union(j.ConfTypes, other.ConfTypes)
+	j.ApiVersions = sumCounts(j.ApiVersions, other.ApiVersions)
+	// We keep the same request IDs no matter in what order we merge: the
+	// lowest ones, up to our limit.
+	j.RequestIDs = union(j.RequestIDs, other.RequestIDs)
+	if len(j.RequestIDs) > maxRequestIDs {
+		j.RequestIDs = j.RequestIDs[:maxRequestIDs]
+	}
+	if j.Window != other.Window {
+		j.Window = ""
+	}
+}
+
+// union returns the sorted union of the given string slices.
+func union(a, b []string) []string {
+	set := make(map[string]empty)
+	for _, s := range append(append([]string{}, a...), b...) {
+		set[s] = empty{}
+	}
+	if len(set) == 0 {
+		return nil
+	}
+	return sortedKeys(set)
+}
+
+// sumCounts returns the sum of the given counts, key by key.
+func sumCounts[K comparable](a, b map[K]int) map[K]int {
+	if len(a) == 0 && len(b) == 0 {
+		return nil
+	}
+	sum := make(map[K]int)
+	for k, n := range a {
+		sum[k] += n
+	}
+	for k, n := range b {
+		sum[k] += n
+	}
+	return sum
+}
+
 // MarshalJSON marshals the given key ID-to-wallets map and turns it into the
 // following JSON:
 //
@@ -127,11 +309,9 @@ func (a AddrsByWallet) MarshalJSON() ([]byte, error) {
 	}
 	m := &toMarshal{Addrs: make(map[string][]string)}
 	for wallet, addrSet := range a {
-		addrSlice := []string{}
-		for addr := range addrSet {
-			addrSlice = append(addrSlice, addr)
-		}
-		m.Addrs[wallet.String()] = addrSlice
+		// Sort addresses, so the resulting JSON is canonical.  The JSON
+		// encoder takes care of sorting map keys.
+		m.Addrs[wallet.String()] = addrSet.sorted()
 	}
 	return json.Marshal(m)
 }
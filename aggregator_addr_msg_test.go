@@ -6,6 +6,9 @@ import (
 	"fmt"
 	"strings"
 	"testing"
+	"time"
+
+	uuid "github.com/google/uuid"
 )
 
 func TestOurString(t *testing.T) {
@@ -119,3 +122,92 @@ func TestNumWalletsAndAddrs(t *testing.T) {
 	assertEqual(t, w.numWallets(), 5)
 	assertEqual(t, w.numAddrs(), 7)
 }
+
+func TestMergeRecords(t *testing.T) {
+	kID1, kID2 := keyID{UUID: newV4(t)}, keyID{UUID: newV4(t)}
+	wallet1, wallet2 := newV4(t), newV4(t)
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	newMeta := func(country string, addrCounts map[string]int, apiVersions map[int]int, requestID string) *walletMeta {
+		meta := newWalletMeta()
+		meta.add(&requestMeta{Country: country})
+		for addr, n := range addrCounts {
+			meta.addrCounts[addr] = n
+			meta.requests += n
+		}
+		meta.apiVersions = apiVersions
+		meta.addRequestID(requestID)
+		return meta
+	}
+	mustCompile := func(msg []byte, err error) []byte {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("Failed to compile record: %v", err)
+		}
+		return msg
+	}
+
+	// Two replicas flushed their windows, one of which came with a commit
+	// record.
+	commit, err := newWindowCommit(newV4(t)).compile(t0)
+	if err != nil {
+		t.Fatalf("Failed to compile commit record: %v", err)
+	}
+	replica1 := [][]byte{
+		mustCompile(compileKafkaMsg(kID1, wallet1, AddressSet{"1.1.1.1": empty{}, "2.2.2.2": empty{}},
+			newMeta("US", map[string]int{"1.1.1.1": 2, "2.2.2.2": 1}, map[int]int{2: 3}, "a"), t0, uuid.Nil)),
+	}
+	replica2 := [][]byte{
+		mustCompile(compileKafkaMsg(kID1, wallet1, AddressSet{"2.2.2.2": empty{}, "3.3.3.3": empty{}},
+			newMeta("DE", map[string]int{"2.2.2.2": 1, "3.3.3.3": 1}, map[int]int{2: 1, 3: 1}, "b"), t0.Add(time.Hour), uuid.Nil)),
+		mustCompile(compileKafkaMsg(kID1, wallet2, AddressSet{"1.1.1.1": empty{}}, nil, t0, uuid.Nil)),
+		mustCompile(compileKafkaMsg(kID2, wallet1, AddressSet{"4.4.4.4": empty{}}, nil, t0, uuid.Nil)),
+		commit,
+	}
+	mustMerge := func(msgs ...[]byte) [][]byte {
+		t.Helper()
+		merged, err := mergeRecords(msgs)
+		if err != nil {
+			t.Fatalf("Failed to merge records: %v", err)
+		}
+		return merged
+	}
+
+	// Merging must be commutative...
+	merged := mustMerge(append(append([][]byte{}, replica1...), replica2...)...)
+	reversed := mustMerge(append(append([][]byte{}, replica2...), replica1...)...)
+	assertEqual(t, bytes.Equal(bytes.Join(merged, nil), bytes.Join(reversed, nil)), true)
+	// ...and associative.
+	nested := mustMerge(append(mustMerge(replica2...), replica1...)...)
+	assertEqual(t, bytes.Equal(bytes.Join(merged, nil), bytes.Join(nested, nil)), true)
+
+	// We end up with one record per key ID and wallet, sans commit records.
+	assertEqual(t, len(merged), 3)
+	found := false
+	for _, msg := range merged {
+		native, _, err := ourCodec.NativeFromBinary(msg)
+		if err != nil {
+			t.Fatalf("Failed to decode merged record: %v", err)
+		}
+		record := native.(map[string]any)
+		var j addrJustification
+		if err := json.Unmarshal([]byte(record["justification"].(string)), &j); err != nil {
+			t.Fatalf("Failed to decode justification: %v", err)
+		}
+		if j.KeyID != kID1.UUID || record["wallet_id"] != wallet1.String() {
+			continue
+		}
+		found = true
+		assertEqual(t, strings.Join(j.Addrs, ","), "1.1.1.1,2.2.2.2,3.3.3.3")
+		assertEqual(t, j.Requests, 5)
+		assertEqual(t, fmt.Sprint(j.AddrCounts), "map[1.1.1.1:2 2.2.2.2:2 3.3.3.3:1]")
+		assertEqual(t, strings.Join(j.Countries, ","), "DE,US")
+		assertEqual(t, fmt.Sprint(j.ApiVersions), "map[2:4 3:1]")
+		assertEqual(t, strings.Join(j.RequestIDs, ","), "a,b")
+		assertEqual(t, record["created_at"], t0.Add(time.Hour).Format(time.RFC3339))
+	}
+	assertEqual(t, found, true)
+
+	if _, err := mergeRecords([][]byte{[]byte("foo")}); err == nil {
+		t.Fatal("Expected error for bad record but got none.")
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+
+	uuid "github.com/google/uuid"
+)
+
+const (
+	// defaultPreviewRecords and maxPreviewRecords determine how many records
+	// a flush preview contains if the caller doesn't say, and at most.
+	defaultPreviewRecords = 10
+	maxPreviewRecords     = 100
+	// redacted replaces the values that our preview must not reveal.
+	redacted = "<redacted>"
+)
+
+var (
+	errBadPreviewSize = newError(ErrValidation, "preview size must be between 1 and "+strconv.Itoa(maxPreviewRecords))
+	errNoPreview      = errors.New("aggregator does not support flush previews")
+)
+
+// previewer is implemented by aggregators that can show what their next flush
+// would look like.
+type previewer interface {
+	preview(n int) ([]map[string]any, error)
+}
+
+// preview serializes (but doesn't forward) up to n records of the current
+// window, exactly like the next flush would, and decodes them again.  Our
+// redaction policy applies to the decoded records: wallet IDs, addresses, and
+// request IDs are replaced with a placeholder, so the preview reveals the
+// records' shape but neither who made the requests nor from where.  Note that
+// addresses are only pseudonymous, and the verbatim tokenizer doesn't even
+// anonymize them.  The current window is left untouched.
+func (a *addrAggregator) preview(n int) ([]map[string]any, error) {
+	a.RLock()
+	defer a.RUnlock()
+
+	// Iterate in a deterministic order, so that repeated previews of the
+	// same window are identical.
+	keyIDs := make([]keyID, 0, len(a.addrs))
+	for keyID := range a.addrs {
+		keyIDs = append(keyIDs, keyID)
+	}
+	sort.Slice(keyIDs, func(i, j int) bool { return keyIDs[i].String() < keyIDs[j].String() })
+
+	records := []map[string]any{}
+	createdAt := a.createdAt()
+	for _, keyID := range keyIDs {
+		wallets := a.addrs[keyID]
+		walletIDs := make([]uuid.UUID, 0, len(wallets))
+		for walletID := range wallets {
+			walletIDs = append(walletIDs, walletID)
+		}
+		sort.Slice(walletIDs, func(i, j int) bool { return walletIDs[i].String() < walletIDs[j].String() })
+
+		for _, walletID := range walletIDs {
+			if len(records) == n {
+				return records, nil
+			}
+			msg, err := compileKafkaMsg(keyID, walletID, wallets[walletID], a.meta[keyID][walletID], createdAt, uuid.Nil)
+			if err != nil {
+				return nil, err
+			}
+			record, err := redactRecord(msg)
+			if err != nil {
+				return nil, err
+			}
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
+
+// redactRecord decodes the given Avro-encoded record and applies our
+// redaction policy to it.
+func redactRecord(msg []byte) (map[string]any, error) {
+	native, _, err := ourCodec.NativeFromBinary(msg)
+	if err != nil {
+		return nil, err
+	}
+	record := native.(map[string]any)
+	record["wallet_id"] = redacted
+
+	var justification map[string]any
+	if err := json.Unmarshal([]byte(record["justification"].(string)), &justification); err != nil {
+		return nil, err
+	}
+	for _, field := range []string{"addrs", "request_ids"} {
+		values, ok := justification[field].([]any)
+		if !ok {
+			continue
+		}
+		for i := range values {
+			values[i] = redacted
+		}
+	}
+	b, err := json.Marshal(justification)
+	if err != nil {
+		return nil, err
+	}
+	record["justification"] = string(b)
+	return record, nil
+}
+
+// previewHandler returns a handler that responds with a preview of the given
+// aggregator's next flush.  The query parameter "n" determines the number of
+// records.
+func previewHandler(a aggregator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, ok := a.(previewer)
+		if !ok {
+			http.Error(w, errNoPreview.Error(), http.StatusNotImplemented)
+			return
+		}
+		n := defaultPreviewRecords
+		if rawN := r.URL.Query().Get("n"); rawN != "" {
+			var err error
+			if n, err = strconv.Atoi(rawN); err != nil || n < 1 || n > maxPreviewRecords {
+				http.Error(w, errBadPreviewSize.Error(), httpStatus(errBadPreviewSize))
+				return
+			}
+		}
+		records, err := p.preview(n)
+		if err != nil {
+			l.Printf("Failed to preview flush: %s", errFields(err))
+			http.Error(w, err.Error(), httpStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(records); err != nil {
+			l.Printf("Failed to encode flush preview: %v", err)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFlushPreview(t *testing.T) {
+	tokenizer := newHmacTokenizer()
+	_ = tokenizer.resetKey()
+	a := newAddrAggregator().(*addrAggregator)
+	a.setConfig(&config{recordRequestIDs: true})
+	a.use(tokenizer)
+	for _, addr := range []string{"1.1.1.1", "2.2.2.2", "3.3.3.3"} {
+		req := &clientRequest{Addr: net.ParseIP(addr), Wallet: newV4(t), RequestID: "foo"}
+		if err := a.processRequest(req); err != nil {
+			t.Fatalf("Failed to process request: %v", err)
+		}
+	}
+
+	srv := httptest.NewServer(newAdminRouter(a, nil))
+	defer srv.Close()
+	resp := makeReq(t, srv, http.MethodGet, "/debug/flush-preview?n=2", nil)
+	assertEqual(t, resp.StatusCode, http.StatusOK)
+	var records []map[string]any
+	if err := json.NewDecoder(resp.Body).Decode(&records); err != nil {
+		t.Fatalf("Failed to decode preview: %v", err)
+	}
+	assertEqual(t, len(records), 2)
+
+	// Wallet IDs, addresses, and request IDs are redacted.
+	record := records[0]
+	assertEqual(t, record["wallet_id"], redacted)
+	assertEqual(t, record["signal"], schemaSignal)
+	var justification struct {
+		Addrs      []string `json:"addrs"`
+		RequestIDs []string `json:"request_ids"`
+	}
+	if err := json.Unmarshal([]byte(record["justification"].(string)), &justification); err != nil {
+		t.Fatalf("Failed to unmarshal justification: %v", err)
+	}
+	assertEqual(t, len(justification.Addrs), 1)
+	assertEqual(t, justification.Addrs[0], redacted)
+	assertEqual(t, justification.RequestIDs[0], redacted)
+
+	// The preview leaves the window untouched.
+	assertEqual(t, a.addrs.numWallets(), 3)
+
+	resp = makeReq(t, srv, http.MethodGet, "/debug/flush-preview?n=0", nil)
+	assertEqual(t, resp.StatusCode, http.StatusBadRequest)
+
+	// Aggregators that don't support previews say so.
+	srv = httptest.NewServer(newAdminRouter(newSimpleAggregator(), nil))
+	defer srv.Close()
+	resp = makeReq(t, srv, http.MethodGet, "/debug/flush-preview", nil)
+	assertEqual(t, resp.StatusCode, http.StatusNotImplemented)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// scopeMarkerPrefix precedes the name of an address scope, e.g.,
+	// "scope:cgnat", so that markers cannot be mistaken for anonymized
+	// addresses.
+	scopeMarkerPrefix = "scope:"
+	// We check our address scope file for changes in this interval.
+	scopeReloadInterval = time.Minute
+)
+
+var (
+	errBadScopeLine = errors.New("address scope line must have format '<name> <cidr>'")
+	errBadScopeName = errors.New("address scope name has bad format")
+
+	scopeNameFmt = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+)
+
+// addrScope represents a named set of networks, e.g., all of iCloud Private
+// Relay's egress ranges.
+type addrScope struct {
+	name string
+	nets []*net.IPNet
+}
+
+// addrScopePolicy decides if a client's address is an ordinary address that
+// we anonymize, or if it's in one of our address scopes.  Addresses behind
+// CGNAT or privacy proxies say little about a client, so we replace them with
+// the scope's marker instead.  The scopes are read from a file that contains
+// one "<name> <cidr>" pair per line, and we reload the file when it changes.
+type addrScopePolicy struct {
+	sync.RWMutex
+	path    string
+	modTime time.Time
+	scopes  []addrScope
+	done    chan empty
+}
+
+func newAddrScopePolicy() *addrScopePolicy {
+	return &addrScopePolicy{}
+}
+
+// setConfig loads the address scope file, if any, and starts watching it for
+// changes.
+func (p *addrScopePolicy) setConfig(c *config) {
+	p.stop()
+
+	p.Lock()
+	p.path = c.addrScopeFile
+	p.modTime = time.Time{}
+	p.scopes = nil
+	p.Unlock()
+	if c.addrScopeFile == "" {
+		return
+	}
+	if err := p.maybeReload(); err != nil {
+		l.Printf("Failed to load address scopes: %v", err)
+	}
+
+	p.Lock()
+	p.done = make(chan empty)
+	done := p.done
+	p.Unlock()
+	go func() {
+		ticker := time.NewTicker(scopeReloadInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := p.maybeReload(); err != nil {
+					l.Printf("Failed to reload address scopes: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// stop stops watching the address scope file.
+func (p *addrScopePolicy) stop() {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.done != nil {
+		close(p.done)
+		p.done = nil
+	}
+}
+
+// maybeReload reloads our address scope file if it changed since we last
+// loaded it.  If the file is broken, we keep using our current scopes.
+func (p *addrScopePolicy) maybeReload() error {
+	p.RLock()
+	path, modTime := p.path, p.modTime
+	p.RUnlock()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(modTime) {
+		return nil
+	}
+	scopes, err := loadAddrScopes(path)
+	if err != nil {
+		return err
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	p.scopes = scopes
+	p.modTime = info.ModTime()
+	l.Printf("Loaded %d address scope(s) from %s.", len(scopes), path)
+	return nil
+}
+
+// marker returns the marker of the first scope that contains the given
+// address, or false if no scope contains the address.
+func (p *addrScopePolicy) marker(addr net.IP) (string, bool) {
+	p.RLock()
+	defer p.RUnlock()
+
+	for _, s := range p.scopes {
+		for _, n := range s.nets {
+			if n.Contains(addr) {
+				return scopeMarkerPrefix + s.name, true
+			}
+		}
+	}
+	return "", false
+}
+
+// loadAddrScopes parses the given address scope file.  Empty lines and lines
+// starting with '#' are ignored.  Lines with the same name add to the same
+// scope.
+func loadAddrScopes(path string) ([]addrScope, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var scopes []addrScope
+	idx := make(map[string]int)
+	s := bufio.NewScanner(f)
+	for lineNum := 1; s.Scan(); lineNum++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: %w", lineNum, errBadScopeLine)
+		}
+		name, rawNet := fields[0], fields[1]
+		if !scopeNameFmt.MatchString(name) {
+			return nil, fmt.Errorf("line %d: %w", lineNum, errBadScopeName)
+		}
+		_, n, err := net.ParseCIDR(rawNet)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNum, err)
+		}
+		i, exists := idx[name]
+		if !exists {
+			i = len(scopes)
+			idx[name] = i
+			scopes = append(scopes, addrScope{name: name})
+		}
+		scopes[i].nets = append(scopes[i].nets, n)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return scopes, nil
+}
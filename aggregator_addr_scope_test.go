@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLoadAddrScopes(t *testing.T) {
+	path := writeFile(t, []byte(`
+# Carrier-grade NAT.
+cgnat 100.64.0.0/10
+
+relay 172.224.0.0/12
+relay 2a02:26f7::/32
+`), "scopes")
+	defer os.Remove(path)
+
+	scopes, err := loadAddrScopes(path)
+	if err != nil {
+		t.Fatalf("Failed to load address scopes: %v", err)
+	}
+	assertEqual(t, len(scopes), 2)
+	assertEqual(t, scopes[0].name, "cgnat")
+	assertEqual(t, len(scopes[0].nets), 1)
+	assertEqual(t, scopes[1].name, "relay")
+	assertEqual(t, len(scopes[1].nets), 2)
+
+	for content, expected := range map[string]error{
+		"cgnat":                   errBadScopeLine,
+		"cgnat 100.64.0.0/10 foo": errBadScopeLine,
+		"CGNAT 100.64.0.0/10":     errBadScopeName,
+	} {
+		path := writeFile(t, []byte(content), "scopes")
+		defer os.Remove(path)
+		if _, err := loadAddrScopes(path); !errors.Is(err, expected) {
+			t.Errorf("Expected error %v for %q but got %v.", expected, content, err)
+		}
+	}
+}
+
+func TestAddrScopePolicy(t *testing.T) {
+	path := writeFile(t, []byte("cgnat 100.64.0.0/10"), "scopes")
+	defer os.Remove(path)
+
+	p := newAddrScopePolicy()
+	p.setConfig(&config{addrScopeFile: path})
+	defer p.stop()
+
+	marker, ok := p.marker(net.ParseIP("100.64.1.1"))
+	assertEqual(t, ok, true)
+	assertEqual(t, marker, "scope:cgnat")
+	_, ok = p.marker(net.ParseIP("1.1.1.1"))
+	assertEqual(t, ok, false)
+
+	// Changes to the file must be picked up.
+	if err := os.WriteFile(path, []byte("other 1.1.1.0/24"), 0600); err != nil {
+		t.Fatalf("Failed to write address scopes: %v", err)
+	}
+	future := time.Now().Add(time.Hour)
+	if err := os.Chtimes(path, future, future); err != nil {
+		t.Fatalf("Failed to change modification time: %v", err)
+	}
+	if err := p.maybeReload(); err != nil {
+		t.Fatalf("Failed to reload address scopes: %v", err)
+	}
+	_, ok = p.marker(net.ParseIP("100.64.1.1"))
+	assertEqual(t, ok, false)
+	marker, ok = p.marker(net.ParseIP("1.1.1.1"))
+	assertEqual(t, ok, true)
+	assertEqual(t, marker, "scope:other")
+
+	// A broken file must not replace our current scopes.
+	if err := os.WriteFile(path, []byte("foo"), 0600); err != nil {
+		t.Fatalf("Failed to write address scopes: %v", err)
+	}
+	future = future.Add(time.Hour)
+	if err := os.Chtimes(path, future, future); err != nil {
+		t.Fatalf("Failed to change modification time: %v", err)
+	}
+	if err := p.maybeReload(); err == nil {
+		t.Fatal("Expected broken address scopes to fail loading.")
+	}
+	_, ok = p.marker(net.ParseIP("1.1.1.1"))
+	assertEqual(t, ok, true)
+}
+
+func TestAddrAggregatorScopes(t *testing.T) {
+	path := writeFile(t, []byte("cgnat 100.64.0.0/10"), "scopes")
+	defer os.Remove(path)
+
+	tokenizer := newVerbatimTokenizer()
+	_ = tokenizer.resetKey()
+	a := newAddrAggregator().(*addrAggregator)
+	a.setConfig(&config{addrScopeFile: path, maxWalletsPerAddr: 1})
+	defer a.scopes.stop()
+	a.use(tokenizer)
+	kID := tokenizer.keyID()
+	wallet1, wallet2 := newV4(t), newV4(t)
+
+	for _, req := range []*clientRequest{
+		{Addr: net.ParseIP("100.64.1.1"), Wallet: wallet1},
+		// Scope markers don't count against the per-address wallet limit.
+		{Addr: net.ParseIP("100.64.2.2"), Wallet: wallet2},
+		{Addr: net.ParseIP("1.1.1.1"), Wallet: wallet2},
+	} {
+		if err := a.processRequest(req); err != nil {
+			t.Fatalf("Failed to process request: %v", err)
+		}
+	}
+
+	expected := WalletsByKeyID{
+		*kID: AddrsByWallet{
+			wallet1: AddressSet{"scope:cgnat": empty{}},
+			wallet2: AddressSet{"scope:cgnat": empty{}, "1.1.1.1": empty{}},
+		},
+	}
+	if !reflect.DeepEqual(a.addrs, expected) {
+		t.Fatalf("Expected %+v but got %+v.", expected, a.addrs)
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+const (
+	// approxRecordBytes is the approximate size of an Avro-encoded address
+	// record without addresses, and approxAddrBytes the approximate size
+	// that each address adds, on top of the address itself, which appears
+	// in both the address list and the address counts.
+	approxRecordBytes = 175
+	approxAddrBytes   = 8
+)
+
+// addrBytes returns the approximate number of bytes that the given address
+// adds to its record.
+func addrBytes(addr string) int {
+	return 2*len(addr) + approxAddrBytes
+}
+
+// full returns true if our window reached the number of records or bytes at
+// which we flush it early, rather than waiting for the next forward interval.
+// We track the window's size incrementally, so unlike estimate, full is cheap
+// enough to call after each request.
+func (a *addrAggregator) full() bool {
+	a.RLock()
+	defer a.RUnlock()
+
+	if a.flushMaxRecords > 0 && a.addrs.numWallets() >= a.flushMaxRecords {
+		return true
+	}
+	return a.flushMaxBytes > 0 && a.bytes >= a.flushMaxBytes
+}
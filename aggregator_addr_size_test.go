@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	uuid "github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestWindowBytes(t *testing.T) {
+	a := newAddrAggregator().(*addrAggregator)
+	w, k, walletID := newAddrWindow(), keyID{newV4(t)}, newV4(t)
+	for _, addr := range []string{"iCFfYNdbAdYr6Ffc3kR2vw==", "TZ5l2ngVLQ2jGkL6zUBsvw==", "J87kR6XOzgeP2BujuVfuOQ=="} {
+		a.addTo(w, k, &clientRequest{Wallet: walletID}, addr, false)
+		msg, err := compileKafkaMsg(k, walletID, w.addrs[k][walletID], w.meta[k][walletID], time.Now(), uuid.Nil)
+		if err != nil {
+			t.Fatalf("Failed to compile Kafka message: %v", err)
+		}
+		// Our approximation must be within 10% of the actual size.
+		if diff := w.bytes - len(msg); diff*10 > len(msg) || -diff*10 > len(msg) {
+			t.Fatalf("Expected approximately %d bytes but got %d.", len(msg), w.bytes)
+		}
+	}
+	// Repeated addresses don't make the record grow.
+	before := w.bytes
+	a.addTo(w, k, &clientRequest{Wallet: walletID}, "iCFfYNdbAdYr6Ffc3kR2vw==", false)
+	assertEqual(t, w.bytes, before)
+}
+
+func TestEarlyFlush(t *testing.T) {
+	for _, limit := range []struct {
+		records, bytes int
+	}{
+		{records: 2},
+		{bytes: 2*approxRecordBytes + 1},
+	} {
+		c := newFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+		a, inbox, outbox := newClockedAggregator(t, c, time.Hour, 24*time.Hour)
+		a.Lock()
+		a.flushMaxRecords, a.flushMaxBytes = limit.records, limit.bytes
+		a.Unlock()
+		numEarly := testutil.ToFloat64(m.numEarlyFlushes)
+
+		// Neither the forward interval ended nor is the window full.
+		submitAndWait(t, inbox, "1.1.1.1")
+		assertEqual(t, a.full(), false)
+		assertEqual(t, len(outbox), 0)
+
+		// The second wallet fills the window, which makes us flush it
+		// before the forward interval ends.
+		submitAndWait(t, inbox, "2.2.2.2")
+		<-outbox
+		<-outbox
+		assertEqual(t, testutil.ToFloat64(m.numEarlyFlushes), numEarly+1)
+		assertEqual(t, a.full(), false)
+		a.stop()
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"time"
 
 	uuid "github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func TestCompileKafkaMsg(t *testing.T) {
@@ -21,7 +22,8 @@ func TestCompileKafkaMsg(t *testing.T) {
 		addr2: empty{},
 	}
 
-	msg, err := compileKafkaMsg(keyID, walletID, addrs)
+	createdAt := time.Date(2024, 3, 10, 7, 30, 0, 0, time.UTC)
+	msg, err := compileKafkaMsg(keyID, walletID, addrs, nil, createdAt, uuid.Nil)
 	if err != nil {
 		t.Fatalf("Expected no error but got: %v", err)
 	}
@@ -38,7 +40,7 @@ func TestCompileKafkaMsg(t *testing.T) {
 		schemaService,
 		schemaSignal,
 		justification,
-		time.Now().UTC().Format(time.RFC3339),
+		createdAt.Format(time.RFC3339),
 	)
 
 	expectedMsg, err := avroEncode(ourCodec, []byte(expectedJSON))
@@ -116,3 +118,297 @@ func TestAddrAggregatorProcess(t *testing.T) {
 		}
 	}
 }
+
+func TestMaxWalletsPerAddr(t *testing.T) {
+	tokenizer := newVerbatimTokenizer()
+	_ = tokenizer.resetKey()
+	a := newAddrAggregator().(*addrAggregator)
+	a.setConfig(&config{maxWalletsPerAddr: 2})
+	a.use(tokenizer)
+	kID := tokenizer.keyID()
+	addr1, addr2 := net.ParseIP("1.1.1.1"), net.ParseIP("2.2.2.2")
+	wallet1, wallet2, wallet3 := newV4(t), newV4(t), newV4(t)
+	numOverflowed := testutil.ToFloat64(m.numOverflowed)
+
+	for _, req := range []*clientRequest{
+		{Addr: addr1, Wallet: wallet1},
+		// Repeated requests don't count against the limit.
+		{Addr: addr1, Wallet: wallet1},
+		{Addr: addr1, Wallet: wallet2},
+		// The third wallet exceeds the limit for the first address.
+		{Addr: addr1, Wallet: wallet3},
+		{Addr: addr1, Wallet: wallet3},
+		{Addr: addr2, Wallet: wallet3},
+	} {
+		if err := a.processRequest(req); err != nil {
+			t.Fatalf("Failed to process request: %v", err)
+		}
+	}
+
+	expected := WalletsByKeyID{
+		*kID: AddrsByWallet{
+			wallet1: AddressSet{"1.1.1.1": empty{}},
+			wallet2: AddressSet{"1.1.1.1": empty{}},
+			wallet3: AddressSet{overflowAddr: empty{}, "2.2.2.2": empty{}},
+		},
+	}
+	if !reflect.DeepEqual(a.addrs, expected) {
+		t.Fatalf("Expected %+v but got %+v.", expected, a.addrs)
+	}
+	// We count repeated requests, including those of overflowed addresses.
+	assertEqual(t, a.meta[*kID][wallet1].addrCounts["1.1.1.1"], 2)
+	assertEqual(t, a.meta[*kID][wallet3].addrCounts[overflowAddr], 2)
+	assertEqual(t, a.meta[*kID][wallet3].addrCounts["2.2.2.2"], 1)
+	// We count the overflowed wallet once, despite its repeated request.
+	assertEqual(t, testutil.ToFloat64(m.numOverflowed), numOverflowed+1)
+	// The overflow marker only counts once towards the window's size.
+	assertEqual(t, a.bytes, 3*approxRecordBytes+2*addrBytes("1.1.1.1")+
+		addrBytes(overflowAddr)+addrBytes("2.2.2.2"))
+
+	// Flushing resets the per-address counts.
+	a.connect(nil, make(chan token, 10))
+	if err := a.flush(); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+	assertEqual(t, len(a.walletsPerAddr), 0)
+}
+
+func TestAddrAggregatorMeta(t *testing.T) {
+	tokenizer := newVerbatimTokenizer()
+	_ = tokenizer.resetKey()
+	a := newAddrAggregator().(*addrAggregator)
+	a.use(tokenizer)
+	outbox := make(chan token, 10)
+	a.connect(nil, outbox)
+	wallet := newV4(t)
+
+	for _, req := range []*clientRequest{
+		{Addr: net.ParseIP("1.1.1.1"), Wallet: wallet, Meta: &requestMeta{Country: "US", ConfType: "view"}},
+		{Addr: net.ParseIP("1.1.1.1"), Wallet: wallet, Meta: &requestMeta{Country: "DE", ConfType: "view"}},
+		{Addr: net.ParseIP("2.2.2.2"), Wallet: wallet},
+	} {
+		if err := a.processRequest(req); err != nil {
+			t.Fatalf("Failed to process request: %v", err)
+		}
+	}
+	if err := a.flush(); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+	assertEqual(t, len(a.meta), 0)
+
+	native, _, err := ourCodec.NativeFromBinary(<-outbox)
+	if err != nil {
+		t.Fatalf("Failed to decode message: %v", err)
+	}
+	justification := native.(map[string]interface{})["justification"].(string)
+	expected := fmt.Sprintf(`{"keyid":"%s","addrs":["1.1.1.1","2.2.2.2"],"requests":3,"addr_counts":{"1.1.1.1":2,"2.2.2.2":1},"countries":["DE","US"],"conf_types":["view"]}`,
+		tokenizer.keyID())
+	assertEqual(t, justification, expected)
+}
+
+func TestAddrAggregatorApiVersions(t *testing.T) {
+	tokenizer := newVerbatimTokenizer()
+	_ = tokenizer.resetKey()
+	a := newAddrAggregator().(*addrAggregator)
+	a.use(tokenizer)
+	outbox := make(chan token, 10)
+	a.connect(nil, outbox)
+	wallet := newV4(t)
+
+	for _, req := range []*clientRequest{
+		{Addr: net.ParseIP("1.1.1.1"), Wallet: wallet, ApiVersion: 4},
+		// Repeated requests count, too.
+		{Addr: net.ParseIP("1.1.1.1"), Wallet: wallet, ApiVersion: 4},
+		{Addr: net.ParseIP("1.1.1.1"), Wallet: wallet, ApiVersion: 5},
+		// Requests of unknown version don't count.
+		{Addr: net.ParseIP("1.1.1.1"), Wallet: wallet},
+	} {
+		if err := a.processRequest(req); err != nil {
+			t.Fatalf("Failed to process request: %v", err)
+		}
+	}
+	if err := a.flush(); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+
+	native, _, err := ourCodec.NativeFromBinary(<-outbox)
+	if err != nil {
+		t.Fatalf("Failed to decode message: %v", err)
+	}
+	justification := native.(map[string]interface{})["justification"].(string)
+	expected := fmt.Sprintf(`{"keyid":"%s","addrs":["1.1.1.1"],"requests":4,"addr_counts":{"1.1.1.1":4},"api_versions":{"4":2,"5":1}}`,
+		tokenizer.keyID())
+	assertEqual(t, justification, expected)
+}
+
+func TestAddrAggregatorFlushOnStop(t *testing.T) {
+	inbox := make(chan serializer)
+	outbox := make(chan token, 10)
+	a := newAddrAggregator()
+	a.setConfig(&config{fwdInterval: time.Hour, keyExpiry: time.Hour})
+	a.use(newVerbatimTokenizer())
+	a.connect(inbox, outbox)
+	a.start()
+
+	inbox <- &clientRequest{Addr: net.ParseIP("1.1.1.1"), Wallet: newV4(t)}
+	a.stop()
+	assertEqual(t, len(outbox), 1)
+}
+
+func TestIngestDuringFlush(t *testing.T) {
+	inbox := make(chan serializer)
+	outbox := make(chan token)
+	a := newAddrAggregator()
+	a.setConfig(&config{fwdInterval: time.Millisecond, keyExpiry: time.Hour})
+	a.use(newVerbatimTokenizer())
+	a.connect(inbox, outbox)
+	a.start()
+
+	submit := func(addr string) {
+		req := &clientRequest{Addr: net.ParseIP(addr), Wallet: newV4(t), ack: make(chan error, 1)}
+		inbox <- req
+		select {
+		case err := <-req.ack:
+			if err != nil {
+				t.Fatalf("Failed to process request: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for request to be processed.")
+		}
+	}
+
+	// Nobody reads from the outbox, so the first flush blocks.  We must still
+	// be able to process requests.
+	submit("1.1.1.1")
+	time.Sleep(10 * time.Millisecond)
+	submit("2.2.2.2")
+
+	// Unblock the flushes, so we can shut down.
+	go func() {
+		for range outbox {
+		}
+	}()
+	a.stop()
+}
+
+// newClockedAggregator returns a started address aggregator that uses the given
+// clock and the HMAC tokenizer, whose key ID changes upon rotation.
+func newClockedAggregator(t *testing.T, c clock, fwdInterval, keyExpiry time.Duration) (*addrAggregator, chan serializer, chan token) {
+	t.Helper()
+
+	inbox, outbox := make(chan serializer), make(chan token, 10)
+	a := newAddrAggregator().(*addrAggregator)
+	a.clock = c
+	a.setConfig(&config{fwdInterval: fwdInterval, keyExpiry: keyExpiry})
+	a.use(newHmacTokenizer())
+	a.connect(inbox, outbox)
+	a.start()
+	return a, inbox, outbox
+}
+
+func submitAndWait(t *testing.T, inbox chan serializer, addr string) {
+	t.Helper()
+
+	req := &clientRequest{Addr: net.ParseIP(addr), Wallet: newV4(t), ack: make(chan error, 1)}
+	inbox <- req
+	if err := <-req.ack; err != nil {
+		t.Fatalf("Failed to process request: %v", err)
+	}
+}
+
+func TestKeyRotationAtWindowBoundary(t *testing.T) {
+	c := newFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	a, inbox, outbox := newClockedAggregator(t, c, time.Hour, time.Hour)
+	defer a.stop()
+
+	// The forward interval and the key expiry end at the same time.  We
+	// must flush the window's addresses before rotating our key, so all of
+	// them end up under the key that anonymized them.
+	submitAndWait(t, inbox, "1.1.1.1")
+	submitAndWait(t, inbox, "2.2.2.2")
+	c.advance(time.Hour)
+	_, j1 := decodeCompatMsg(t, ourCodec, <-outbox)
+	_, j2 := decodeCompatMsg(t, ourCodec, <-outbox)
+	assertEqual(t, j1.KeyID, j2.KeyID)
+
+	// Addresses of the next window are anonymized using the new key.
+	submitAndWait(t, inbox, "1.1.1.1")
+	c.advance(time.Hour)
+	_, j3 := decodeCompatMsg(t, ourCodec, <-outbox)
+	if j3.KeyID == j1.KeyID {
+		t.Fatalf("Expected new key ID after rotation but got %s again.", j3.KeyID)
+	}
+}
+
+func TestFlushAcrossClockJumps(t *testing.T) {
+	// A non-UTC zone whose offset changes, e.g., due to daylight saving
+	// time, must not affect the timestamps that we forward.
+	cet, cest := time.FixedZone("CET", 3600), time.FixedZone("CEST", 7200)
+	start := time.Date(2024, 3, 31, 1, 30, 0, 0, cet)
+	c := newFakeClock(start)
+	a, inbox, outbox := newClockedAggregator(t, c, time.Hour, 24*time.Hour)
+	defer a.stop()
+
+	submitAndWait(t, inbox, "1.1.1.1")
+	c.advance(time.Hour)
+	record, _ := decodeCompatMsg(t, ourCodec, <-outbox)
+	assertEqual(t, record["created_at"], "2024-03-31T01:30:00Z")
+
+	// The wall clock steps back by a second (e.g., a leap second), and the
+	// zone switches to summer time.  Neither must cause an extra flush or
+	// skip one: flushes follow the elapsed time, not the wall clock.
+	c.jump(c.now().Add(-time.Second).In(cest))
+	submitAndWait(t, inbox, "2.2.2.2")
+	assertEqual(t, len(outbox), 0)
+	c.advance(time.Hour)
+	record, _ = decodeCompatMsg(t, ourCodec, <-outbox)
+	assertEqual(t, record["created_at"], "2024-03-31T02:29:59Z")
+}
+
+func TestAddrAggregatorRequestIDs(t *testing.T) {
+	tokenizer := newVerbatimTokenizer()
+	_ = tokenizer.resetKey()
+	a := newAddrAggregator().(*addrAggregator)
+	a.setConfig(&config{recordRequestIDs: true})
+	a.use(tokenizer)
+	outbox := make(chan token, 10)
+	a.connect(nil, outbox)
+	wallet := newV4(t)
+
+	for _, req := range []*clientRequest{
+		{Addr: net.ParseIP("1.1.1.1"), Wallet: wallet, RequestID: "b"},
+		{Addr: net.ParseIP("1.1.1.1"), Wallet: wallet, RequestID: "a"},
+		// Requests without ID don't count.
+		{Addr: net.ParseIP("1.1.1.1"), Wallet: wallet},
+	} {
+		if err := a.processRequest(req); err != nil {
+			t.Fatalf("Failed to process request: %v", err)
+		}
+	}
+	if err := a.flush(); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+
+	native, _, err := ourCodec.NativeFromBinary(<-outbox)
+	if err != nil {
+		t.Fatalf("Failed to decode message: %v", err)
+	}
+	justification := native.(map[string]interface{})["justification"].(string)
+	expected := fmt.Sprintf(`{"keyid":"%s","addrs":["1.1.1.1"],"requests":3,"addr_counts":{"1.1.1.1":3},"request_ids":["a","b"]}`,
+		tokenizer.keyID())
+	assertEqual(t, justification, expected)
+}
+
+func TestTimestampPrecision(t *testing.T) {
+	c := newFakeClock(time.Date(2024, 1, 1, 12, 34, 56, 0, time.UTC))
+	a := newAddrAggregator().(*addrAggregator)
+	a.clock = c
+	a.setConfig(&config{timestampPrecision: time.Hour})
+
+	s := a.snapshotOf(a.addrWindow)
+	assertEqual(t, s.createdAt, time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+
+	if _, _, err := parseFlags("tkzr", []string{"-timestamp-precision", "-1h"}); err == nil {
+		t.Error("Expected error but got none.")
+	}
+}
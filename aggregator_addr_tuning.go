@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// envAdminToken contains the bearer token that requests to our control
+	// endpoints must carry.  Without it, the control endpoints don't exist.
+	envAdminToken = "ADMIN_API_TOKEN"
+	// maxTuningBytes is the maximum size of a tuning request's body.
+	maxTuningBytes = 1024
+)
+
+var (
+	errNoTuning       = errors.New("aggregator does not support tuning")
+	errNoAdminToken   = newError(ErrUnauthorized, "found no valid admin token")
+	errBadTuning      = newError(ErrValidation, "tuning request has bad format")
+	errBadFwdInterval = newError(ErrValidation, fmt.Sprintf("forward interval must be at least %s", minFwdInterval))
+	errBadThreshold   = newError(ErrValidation, "flush thresholds must not be negative")
+)
+
+// tuner is implemented by aggregators whose flush interval and thresholds can
+// change while they run.
+type tuner interface {
+	tuning() *flushTuning
+	tune(*flushTuning) error
+}
+
+// flushTuning contains an aggregator's forward interval and the thresholds at
+// which it flushes early.  When tuning, unset fields remain unchanged.
+type flushTuning struct {
+	Interval   string `json:"interval,omitempty"`
+	MaxRecords *int   `json:"max_records,omitempty"`
+	MaxBytes   *int   `json:"max_bytes,omitempty"`
+}
+
+// tuning returns our current forward interval and thresholds.
+func (a *addrAggregator) tuning() *flushTuning {
+	a.RLock()
+	defer a.RUnlock()
+
+	maxRecords, maxBytes := a.flushMaxRecords, a.flushMaxBytes
+	return &flushTuning{
+		Interval:   a.fwdInterval.String(),
+		MaxRecords: &maxRecords,
+		MaxBytes:   &maxBytes,
+	}
+}
+
+// tune changes our forward interval and thresholds.  A new forward interval
+// starts right away, i.e., our next flush happens one new interval from now.
+// Changes don't survive a restart.
+func (a *addrAggregator) tune(t *flushTuning) error {
+	var interval time.Duration
+	if t.Interval != "" {
+		var err error
+		if interval, err = time.ParseDuration(t.Interval); err != nil {
+			return errBadTuning
+		}
+		if interval < minFwdInterval {
+			return errBadFwdInterval
+		}
+	}
+	if (t.MaxRecords != nil && *t.MaxRecords < 0) || (t.MaxBytes != nil && *t.MaxBytes < 0) {
+		return errBadThreshold
+	}
+
+	a.Lock()
+	if t.MaxRecords != nil {
+		a.flushMaxRecords = *t.MaxRecords
+	}
+	if t.MaxBytes != nil {
+		a.flushMaxBytes = *t.MaxBytes
+	}
+	retune := interval != 0 && interval != a.fwdInterval
+	if retune {
+		a.fwdInterval = interval
+	}
+	l.Printf("Tuned flushes: forward interval %s, max records %d, max bytes %d.",
+		a.fwdInterval, a.flushMaxRecords, a.flushMaxBytes)
+	a.Unlock()
+
+	if retune {
+		// Our loop picks up the new interval.  If it hasn't done so for
+		// a previous change yet, it will pick up this one as well.
+		select {
+		case a.retune <- empty{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// loadAdminToken returns the admin token from our environment, if any.
+func loadAdminToken() ([]byte, error) {
+	token, exists := os.LookupEnv(envAdminToken)
+	if !exists {
+		return nil, nil
+	}
+	if token == "" {
+		return nil, fmt.Errorf("environment variable %s is empty", envAdminToken)
+	}
+	l.Println("Loaded admin token.")
+	return []byte(token), nil
+}
+
+// requireAdminToken returns middleware that rejects requests unless they
+// carry the given token as bearer token.  Our control endpoints change how we
+// behave, and our debug endpoints disclose traffic, so given a token, they
+// don't rely on our admin listener's network policy alone.
+func requireAdminToken(token []byte) func(http.Handler) http.Handler {
+	// Comparing hashes makes the comparison's duration independent of the
+	// token's length.
+	want := sha256.Sum256(token)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			gotHash := sha256.Sum256([]byte(got))
+			if !ok || subtle.ConstantTimeCompare(want[:], gotHash[:]) != 1 {
+				http.Error(w, errNoAdminToken.Error(), httpStatus(errNoAdminToken))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// tuningHandler returns a handler that changes the given aggregator's forward
+// interval and thresholds, as given by the request's JSON body, and responds
+// with the resulting tuning.  GET requests leave the tuning unchanged.
+func tuningHandler(a aggregator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		t, ok := a.(tuner)
+		if !ok {
+			http.Error(w, errNoTuning.Error(), http.StatusNotImplemented)
+			return
+		}
+		if r.Method != http.MethodGet {
+			var req flushTuning
+			dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxTuningBytes))
+			dec.DisallowUnknownFields()
+			if err := dec.Decode(&req); err != nil {
+				http.Error(w, errBadTuning.Error(), httpStatus(errBadTuning))
+				return
+			}
+			if err := t.tune(&req); err != nil {
+				http.Error(w, err.Error(), httpStatus(err))
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(t.tuning()); err != nil {
+			l.Printf("Failed to encode tuning: %v", err)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func numTickers(c *fakeClock) int {
+	c.Lock()
+	defer c.Unlock()
+
+	return len(c.tickers)
+}
+
+func TestTune(t *testing.T) {
+	c := newFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	a, inbox, outbox := newClockedAggregator(t, c, time.Hour, 24*time.Hour)
+	defer a.stop()
+	tickers := numTickers(c)
+
+	submitAndWait(t, inbox, "1.1.1.1")
+	assertEqual(t, a.tune(&flushTuning{Interval: "1m"}), nil)
+	// Wait for our loop to replace its forward ticker.
+	for numTickers(c) == tickers {
+		time.Sleep(time.Millisecond)
+	}
+	// The new interval applies right away.
+	c.advance(time.Minute)
+	<-outbox
+
+	maxRecords := 10
+	assertEqual(t, a.tune(&flushTuning{MaxRecords: &maxRecords}), nil)
+	tuning := a.tuning()
+	assertEqual(t, tuning.Interval, "1m0s")
+	assertEqual(t, *tuning.MaxRecords, 10)
+	assertEqual(t, *tuning.MaxBytes, 0)
+}
+
+func TestTuneValidation(t *testing.T) {
+	a := newAddrAggregator().(*addrAggregator)
+	a.setConfig(&config{fwdInterval: time.Hour})
+	negative := -1
+	for _, test := range []struct {
+		tuning *flushTuning
+		err    error
+	}{
+		{&flushTuning{Interval: "soon"}, errBadTuning},
+		{&flushTuning{Interval: "1ms"}, errBadFwdInterval},
+		{&flushTuning{MaxRecords: &negative}, errBadThreshold},
+		{&flushTuning{MaxBytes: &negative}, errBadThreshold},
+	} {
+		assertEqual(t, errors.Is(a.tune(test.tuning), test.err), true)
+	}
+	// Invalid requests change nothing.
+	assertEqual(t, a.tuning().Interval, "1h0m0s")
+}
+
+func TestTuningHandler(t *testing.T) {
+	a := newAddrAggregator().(*addrAggregator)
+	a.setConfig(&config{fwdInterval: time.Hour})
+	srv := httptest.NewServer(newAdminRouter(a, []byte("secret")))
+	defer srv.Close()
+
+	reqPath := func(method, path, token, body string) *http.Response {
+		r, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("Failed to create HTTP request: %v", err)
+		}
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatalf("Failed to make HTTP request: %v", err)
+		}
+		return resp
+	}
+	req := func(method, token, body string) *http.Response {
+		return reqPath(method, "/control/flush", token, body)
+	}
+
+	assertEqual(t, req(http.MethodGet, "", "").StatusCode, http.StatusUnauthorized)
+	assertEqual(t, req(http.MethodPut, "wrong", `{"max_records":5}`).StatusCode, http.StatusUnauthorized)
+	assertEqual(t, req(http.MethodPut, "secret", `{"max_records":"five"}`).StatusCode, http.StatusBadRequest)
+	assertEqual(t, req(http.MethodPut, "secret", `{"interval":"1ms"}`).StatusCode, http.StatusBadRequest)
+
+	resp := req(http.MethodPut, "secret", `{"max_records":5}`)
+	assertEqual(t, resp.StatusCode, http.StatusOK)
+	var got flushTuning
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatalf("Failed to decode tuning: %v", err)
+	}
+	assertEqual(t, got.Interval, "1h0m0s")
+	assertEqual(t, *got.MaxRecords, 5)
+	assertEqual(t, a.flushMaxRecords, 5)
+
+	// The token protects all privileged endpoints but our health checks.
+	assertEqual(t, reqPath(http.MethodGet, "/debug/rejected", "", "").StatusCode, http.StatusUnauthorized)
+	assertEqual(t, reqPath(http.MethodGet, "/metrics", "wrong", "").StatusCode, http.StatusUnauthorized)
+	assertEqual(t, reqPath(http.MethodGet, "/debug/rejected", "secret", "").StatusCode, http.StatusOK)
+	assertEqual(t, reqPath(http.MethodGet, "/healthz", "", "").StatusCode, http.StatusOK)
+
+	// Without an admin token, our control endpoints don't exist.
+	srv = httptest.NewServer(newAdminRouter(a, nil))
+	defer srv.Close()
+	assertEqual(t, req(http.MethodGet, "secret", "").StatusCode, http.StatusNotFound)
+
+	// Aggregators that don't support tuning say so.
+	srv = httptest.NewServer(newAdminRouter(newSimpleAggregator(), []byte("secret")))
+	defer srv.Close()
+	assertEqual(t, req(http.MethodGet, "secret", "").StatusCode, http.StatusNotImplemented)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// addrWindow contains the addresses and metadata that the address aggregator
+// collected for a window, i.e., since the window's most recent flush.
+type addrWindow struct {
+	addrs          WalletsByKeyID
+	meta           map[keyID]MetaByWallet
+	walletsPerAddr map[keyID]map[string]int
+	// bytes is the approximate Avro-encoded size of the window's records.
+	bytes int
+}
+
+func newAddrWindow() *addrWindow {
+	return &addrWindow{
+		addrs:          make(WalletsByKeyID),
+		meta:           make(map[keyID]MetaByWallet),
+		walletsPerAddr: make(map[keyID]map[string]int),
+	}
+}
+
+// extraWindow is an additional window with its own interval and forwarder,
+// e.g., a 5-minute window for a fraud feed next to our 1-hour window for
+// analytics.  All windows see the same requests, which we anonymize once.
+type extraWindow struct {
+	*addrWindow
+	interval time.Duration
+	outbox   chan token
+	sends    *sendTimer
+}
+
+// windowed is implemented by aggregators that support additional windows.
+type windowed interface {
+	addWindow(interval time.Duration, outbox chan token)
+}
+
+// windowSpec describes an additional window: its interval and the name of the
+// forwarder that it flushes to.
+type windowSpec struct {
+	interval  time.Duration
+	forwarder string
+}
+
+// windowForwarder is the forwarder of an additional window.
+type windowForwarder struct {
+	interval time.Duration
+	f        forwarder
+}
+
+// parseWindows parses the given comma-separated list of
+// "<interval>:<forwarder>" pairs, e.g., "5m:kafka,24h:file".
+func parseWindows(s string) ([]windowSpec, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var specs []windowSpec
+	for _, pair := range strings.Split(s, ",") {
+		rawInterval, forwarder, found := strings.Cut(pair, ":")
+		if !found || forwarder == "" {
+			return nil, fmt.Errorf("invalid window %q", pair)
+		}
+		var interval durationValue
+		if err := interval.Set(rawInterval); err != nil || interval <= 0 {
+			return nil, fmt.Errorf("invalid window interval %q", rawInterval)
+		}
+		specs = append(specs, windowSpec{
+			interval:  time.Duration(interval),
+			forwarder: forwarder,
+		})
+	}
+	return specs, nil
+}
+
+// addWindow adds a window that we flush to the given outbox every interval.
+// It must be called before start.
+func (a *addrAggregator) addWindow(interval time.Duration, outbox chan token) {
+	a.Lock()
+	defer a.Unlock()
+
+	name := fmt.Sprintf("aggregator_window_%s", interval)
+	watchChan(name, outbox)
+	a.windows = append(a.windows, &extraWindow{
+		addrWindow: newAddrWindow(),
+		interval:   interval,
+		outbox:     outbox,
+		sends:      newSendTimer(name),
+	})
+	l.Printf("Added window with interval %s.", interval)
+}
+
+// startWindows starts flushing our additional windows.  Once the given
+// channel is closed, each window flushes one last time.
+func (a *addrAggregator) startWindows(loopDone chan empty) {
+	a.RLock()
+	defer a.RUnlock()
+
+	for _, w := range a.windows {
+		t := a.clock.newTicker(w.interval)
+		a.wg.Add(1)
+		go func(w *extraWindow, t ticker) {
+			defer a.wg.Done()
+			defer t.stop()
+			for {
+				select {
+				case <-loopDone:
+					a.flushWindow(w)
+					return
+				case <-t.ticks():
+					a.flushWindow(w)
+				}
+			}
+		}(w, t)
+	}
+}
+
+// flushWindow flushes the given additional window to its outbox.
+func (a *addrAggregator) flushWindow(w *extraWindow) {
+	a.Lock()
+	s := a.snapshotOf(w.addrWindow)
+	a.Unlock()
+
+	if err := a.forward(s, w.outbox, w.sends); err != nil {
+		countErr(err)
+		l.Printf("Failed to forward addresses of %s window: %s", w.interval, errFields(err))
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseWindows(t *testing.T) {
+	specs, err := parseWindows("5m:kafka,86400:file")
+	if err != nil {
+		t.Fatalf("Got unexpected error: %v", err)
+	}
+	assertEqual(t, len(specs), 2)
+	assertEqual(t, specs[0], windowSpec{interval: 5 * time.Minute, forwarder: "kafka"})
+	assertEqual(t, specs[1], windowSpec{interval: 24 * time.Hour, forwarder: "file"})
+
+	for _, s := range []string{"5m", "5m:", "foo:kafka", "0:kafka", "-1s:kafka"} {
+		if _, err := parseWindows(s); err == nil {
+			t.Errorf("Expected error for %q but got none.", s)
+		}
+	}
+}
+
+func TestParseWindowFlags(t *testing.T) {
+	comp, conf, err := parseFlags("tkzr", []string{"-aggregator", "address", "-windows", "5m:null"})
+	if err != nil {
+		t.Fatalf("Got unexpected error: %v", err)
+	}
+	assertEqual(t, len(conf.windows), 1)
+	assertEqual(t, len(comp.windows), 1)
+	assertEqual(t, comp.windows[0].interval, 5*time.Minute)
+
+	for _, args := range [][]string{
+		{"-windows", "5m:null"},
+		{"-aggregator", "address", "-windows", "5m:foo"},
+		{"-aggregator", "address", "-windows", "500ms:kafka"},
+	} {
+		if _, _, err := parseFlags("tkzr", args); err == nil {
+			t.Errorf("Expected error for %q but got none.", args)
+		}
+	}
+}
+
+func TestExtraWindow(t *testing.T) {
+	c := newFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	inbox, outbox, windowOutbox := make(chan serializer), make(chan token, 10), make(chan token, 10)
+	a := newAddrAggregator().(*addrAggregator)
+	a.clock = c
+	a.setConfig(&config{fwdInterval: time.Hour, keyExpiry: 24 * time.Hour})
+	a.use(newHmacTokenizer())
+	a.connect(inbox, outbox)
+	a.addWindow(5*time.Minute, windowOutbox)
+	a.start()
+
+	// The additional window flushes after five minutes, while our window
+	// keeps collecting.
+	submitAndWait(t, inbox, "1.1.1.1")
+	c.advance(5 * time.Minute)
+	_, j1 := decodeCompatMsg(t, ourCodec, <-windowOutbox)
+	assertEqual(t, len(outbox), 0)
+
+	submitAndWait(t, inbox, "2.2.2.2")
+	c.advance(55 * time.Minute)
+	_, j2 := decodeCompatMsg(t, ourCodec, <-windowOutbox)
+	if j2.Addrs[0] == j1.Addrs[0] {
+		t.Fatal("Expected the additional window to start afresh after its flush.")
+	}
+	// Our window has both addresses, anonymized once, with the same key.
+	_, j3 := decodeCompatMsg(t, ourCodec, <-outbox)
+	_, j4 := decodeCompatMsg(t, ourCodec, <-outbox)
+	assertEqual(t, j3.KeyID, j1.KeyID)
+	assertEqual(t, j4.KeyID, j1.KeyID)
+	addrs := map[string]bool{j3.Addrs[0]: true, j4.Addrs[0]: true}
+	if !addrs[j1.Addrs[0]] || !addrs[j2.Addrs[0]] {
+		t.Fatalf("Expected addresses %s and %s but got %v.", j1.Addrs[0], j2.Addrs[0], addrs)
+	}
+
+	// Both windows flush what they have when we stop.
+	submitAndWait(t, inbox, "3.3.3.3")
+	a.stop()
+	_, j5 := decodeCompatMsg(t, ourCodec, <-windowOutbox)
+	_, j6 := decodeCompatMsg(t, ourCodec, <-outbox)
+	assertEqual(t, j5.Addrs[0], j6.Addrs[0])
+}
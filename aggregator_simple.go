@@ -28,7 +28,7 @@ func (s *simpleAggregator) connect(inbox chan serializer, outbox chan token) {
 
 func (s *simpleAggregator) start() {
 	if err := s.t.resetKey(); err != nil {
-		l.Fatalf("Failed to reset tokenizer key: %v", err)
+		fatalf(exitCrypto, "Failed to reset tokenizer key: %v", err)
 	}
 
 	go func() {
@@ -38,8 +38,12 @@ func (s *simpleAggregator) start() {
 				return
 			case b := <-s.inbox:
 				token, err := s.t.tokenize(b)
+				if a, ok := b.(acknowledger); ok {
+					a.acknowledge(err)
+				}
 				if err != nil {
-					l.Printf("Failed to tokenize blob: %v", err)
+					countErr(err)
+					l.Printf("Failed to tokenize blob: %s", errFields(err))
 					continue
 				}
 				l.Println("Tokenized blob.")
@@ -50,7 +50,7 @@ func TestProcessBlob(t *testing.T) {
 	_ = tokenizer.resetKey()
 	c := &config{
 		keyExpiry:   time.Second,
-		fwdInterval: time.Second,
+		fwdInterval: 10 * time.Millisecond,
 	}
 
 	// Test the lifecycle of an aggregator and ensure that the data that goes
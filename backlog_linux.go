@@ -0,0 +1,29 @@
+package main
+
+import (
+	"errors"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// setListenBacklog sets the backlog of the given TCP listener.  Go always uses
+// the system's maximum, but Linux lets us call listen(2) again on a listening
+// socket to change its backlog.
+func setListenBacklog(ln net.Listener, backlog int) error {
+	tcpLn, ok := ln.(*net.TCPListener)
+	if !ok {
+		return errors.New("listener is not a TCP listener")
+	}
+	rc, err := tcpLn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var listenErr error
+	if err := rc.Control(func(fd uintptr) {
+		listenErr = unix.Listen(int(fd), backlog)
+	}); err != nil {
+		return err
+	}
+	return listenErr
+}
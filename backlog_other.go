@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+func setListenBacklog(ln net.Listener, backlog int) error {
+	return errors.New("setting the listen backlog is only supported on Linux")
+}
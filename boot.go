@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strings"
+)
+
+const (
+	// kernelCmdline contains the command line that our kernel was booted
+	// with, e.g., by nitro-cli.
+	kernelCmdline = "/proc/cmdline"
+	// bootArgPrefix marks the kernel command line parameters that are meant
+	// for us, e.g., "tkzr.forward-interval=1h" becomes the flag
+	// "-forward-interval=1h".
+	bootArgPrefix = "tkzr."
+)
+
+// bootArgs turns the parameters in the given kernel command line that are
+// meant for us into command line flags.  Other parameters are ignored.
+// Parameters without a value become boolean flags, e.g., "tkzr.commit-records"
+// becomes "-commit-records".
+func bootArgs(cmdline string) []string {
+	var args []string
+	for _, param := range strings.Fields(cmdline) {
+		if !strings.HasPrefix(param, bootArgPrefix) {
+			continue
+		}
+		if name := strings.TrimPrefix(param, bootArgPrefix); name != "" {
+			args = append(args, "-"+name)
+		}
+	}
+	return args
+}
+
+// withBootArgs prepends the flags from our kernel command line to the given
+// flags.  We read the command line before any network is up, so it's a way to
+// configure an otherwise generic image.  Flags that are passed explicitly
+// come last, and therefore take precedence.
+func withBootArgs(path string, args []string) ([]string, error) {
+	cmdline, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return args, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	boot := bootArgs(string(cmdline))
+	if len(boot) > 0 {
+		l.Printf("Read flags %q from kernel command line.", boot)
+	}
+	return append(boot, args...), nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBootArgs(t *testing.T) {
+	args := bootArgs("console=ttyS0 tkzr.forward-interval=1h tkzr. reboot=k tkzr.commit-records\n")
+	assertEqual(t, strings.Join(args, " "), "-forward-interval=1h -commit-records")
+	assertEqual(t, len(bootArgs("console=ttyS0")), 0)
+}
+
+func TestWithBootArgs(t *testing.T) {
+	// A missing kernel command line is fine.
+	args, err := withBootArgs(filepath.Join(t.TempDir(), "cmdline"), []string{"-port", "80"})
+	assertEqual(t, err, nil)
+	assertEqual(t, strings.Join(args, " "), "-port 80")
+
+	path := filepath.Join(t.TempDir(), "cmdline")
+	if err := os.WriteFile(path, []byte("tkzr.port=8443 tkzr.forward-interval=1h"), 0o600); err != nil {
+		t.Fatalf("Failed to write kernel command line: %v", err)
+	}
+	args, err = withBootArgs(path, []string{"-port", "80"})
+	assertEqual(t, err, nil)
+
+	// Explicit flags take precedence over boot flags.
+	_, conf, err := parseFlags("tkzr", args)
+	if err != nil {
+		t.Fatalf("Failed to parse flags: %v", err)
+	}
+	assertEqual(t, conf.port, uint16(80))
+	assertEqual(t, conf.fwdInterval, time.Hour)
+}
@@ -0,0 +1,414 @@
+// Package attestation verifies the attestation documents of Nitro enclaves
+// that run tokenizer, so that integrators don't have to hand-roll verifiers.
+// A Verifier fetches a document with a fresh nonce, checks that AWS's Nitro
+// Enclaves root certificate vouches for it, compares the enclave's PCRs to the
+// expected values, which must include PCR0-2, and checks that the document
+// binds the TLS certificate that the enclave presented:
+//
+//	v := &attestation.Verifier{Roots: nitroRoots, PCRs: expectedPCRs}
+//	doc, err := v.Fetch(ctx, "https://ia2.example.com")
+//
+// Verifier.VerifyAttestation plugs into client.Transport.  The root
+// certificate is available at
+// https://aws-nitro-enclaves.amazonaws.com/AWS_NitroEnclaves_Root-G1.zip, and
+// callers must check its fingerprint before trusting it.
+package attestation
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultPath is the path of the enclave runtime's attestation endpoint.
+	DefaultPath = "/enclave/attestation"
+	// coseAlgES384 is COSE's identifier of ECDSA with SHA-384, and
+	// coseHeaderAlg the protected header that contains it.
+	coseAlgES384  = -35
+	coseHeaderAlg = 1
+	// nonceLen is the length of our nonces in bytes.
+	nonceLen = 20
+	// maxDocBytes is the maximum size of an encoded attestation document.
+	maxDocBytes = 1 << 16
+	// certHashPrefix precedes the digest of the enclave's TLS certificate
+	// in a document's user data.  The enclave runtime may follow it with
+	// appKeyHashPrefix and the digest of its application's key.
+	certHashPrefix   = "sha256:"
+	appKeyHashPrefix = ";sha256:"
+)
+
+var (
+	errNoRoots       = errors.New("no root certificates to verify against")
+	errBadDocument   = errors.New("attestation document has bad format")
+	errBadAlgorithm  = errors.New("attestation document is not signed with ES384")
+	errBadSignature  = errors.New("attestation document's signature is invalid")
+	errBadNonce      = errors.New("attestation document doesn't contain our nonce")
+	errNoTLS         = errors.New("enclave presented no TLS certificate")
+	errCertBinding   = errors.New("attestation document doesn't bind the enclave's TLS certificate")
+	errBadPCRs       = errors.New("PCRs must have format '<index>=<hex SHA-384 digest>'")
+	errUnexpectedPCR = errors.New("PCR doesn't match its expected value")
+	errMissingPCR    = errors.New("expected values of PCR0, PCR1, and PCR2 are required")
+	pcrIndexFmt      = regexp.MustCompile(`^[0-8]$`)
+	// requiredPCRs are the PCRs whose expected values Verify requires:
+	// the enclave image, the kernel, and the application.
+	requiredPCRs = []int{0, 1, 2}
+)
+
+// Document contains the fields of a verified attestation document.
+type Document struct {
+	ModuleID  string
+	Timestamp time.Time
+	// PCRs maps PCR indices to their values.
+	PCRs        map[int][]byte
+	Certificate *x509.Certificate
+	// PublicKey, UserData, and Nonce are set by the enclave, and may be
+	// nil.
+	PublicKey []byte
+	UserData  []byte
+	Nonce     []byte
+}
+
+// BindsCertificate returns true if the document's user data begins with
+// "sha256:" and the SHA-256 digest of the given TLS certificate, which is how
+// the enclave runtime binds its certificate to its attestation documents.  The
+// only thing that may follow is ";sha256:" and the digest of the
+// application's key.
+func (d *Document) BindsCertificate(cert *x509.Certificate) bool {
+	digest := sha256.Sum256(cert.Raw)
+	rest, ok := bytes.CutPrefix(d.UserData, append([]byte(certHashPrefix), digest[:]...))
+	if !ok {
+		return false
+	}
+	return len(rest) == 0 ||
+		(len(rest) == len(appKeyHashPrefix)+sha256.Size && bytes.HasPrefix(rest, []byte(appKeyHashPrefix)))
+}
+
+// Verifier verifies attestation documents.
+type Verifier struct {
+	// Roots contains the certificates that attestation documents must
+	// chain up to, i.e., AWS's Nitro Enclaves root certificate.  It must be
+	// set: we never fall back to the system's roots.
+	Roots *x509.CertPool
+	// PCRs maps PCR indices to their expected values.  It must contain
+	// PCR0, PCR1, and PCR2, and we don't check PCRs that aren't set.
+	PCRs map[int][]byte
+	// Client fetches attestation documents.  If nil, http.DefaultClient is
+	// used.  The enclave's TLS certificate is typically self-signed, in
+	// which case the client must skip certificate verification, and
+	// SkipCertBinding must not be set: the attestation document then
+	// vouches for the certificate.
+	Client *http.Client
+	// Path is the path of the attestation endpoint.  If empty,
+	// DefaultPath is used.
+	Path string
+	// SkipCertBinding makes Fetch accept documents that don't bind the
+	// enclave's TLS certificate, e.g., because the enclave speaks plain
+	// HTTP behind a trusted proxy.
+	SkipCertBinding bool
+	// Now returns the time at which we verify certificates.  If nil,
+	// time.Now is used.
+	Now func() time.Time
+}
+
+func (v *Verifier) client() *http.Client {
+	if v.Client == nil {
+		return http.DefaultClient
+	}
+	return v.Client
+}
+
+func (v *Verifier) path() string {
+	if v.Path == "" {
+		return DefaultPath
+	}
+	return v.Path
+}
+
+func (v *Verifier) now() time.Time {
+	if v.Now == nil {
+		return time.Now()
+	}
+	return v.Now()
+}
+
+// VerifyAttestation fetches and verifies the attestation document of the
+// enclave at the given base URL.  It implements client.Transport's
+// VerifyAttestation.
+func (v *Verifier) VerifyAttestation(ctx context.Context, baseURL string) error {
+	_, err := v.Fetch(ctx, baseURL)
+	return err
+}
+
+// Fetch fetches the attestation document of the enclave at the given base
+// URL, with a fresh nonce, and verifies it.  Unless SkipCertBinding is set,
+// the document must bind the TLS certificate that the enclave presented.
+func (v *Verifier) Fetch(ctx context.Context, baseURL string) (*Document, error) {
+	nonce := make([]byte, nonceLen)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	url := strings.TrimSuffix(baseURL, "/") + v.path() + "?nonce=" + hex.EncodeToString(nonce)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := v.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxDocBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("attestation endpoint responded with %s", resp.Status)
+	}
+	if len(body) > maxDocBytes {
+		return nil, errBadDocument
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(body)))
+	if err != nil {
+		return nil, errBadDocument
+	}
+
+	doc, err := v.Verify(raw, nonce)
+	if err != nil {
+		return nil, err
+	}
+	if v.SkipCertBinding {
+		return doc, nil
+	}
+	if resp.TLS == nil || len(resp.TLS.PeerCertificates) == 0 {
+		return nil, errNoTLS
+	}
+	if !doc.BindsCertificate(resp.TLS.PeerCertificates[0]) {
+		return nil, errCertBinding
+	}
+	return doc, nil
+}
+
+// Verify verifies the given raw attestation document, i.e., a COSE_Sign1
+// structure.  If the given nonce isn't nil, the document must contain it.
+func (v *Verifier) Verify(raw, nonce []byte) (*Document, error) {
+	if v.Roots == nil {
+		return nil, errNoRoots
+	}
+	for _, i := range requiredPCRs {
+		if _, exists := v.PCRs[i]; !exists {
+			return nil, errMissingPCR
+		}
+	}
+	protected, payload, signature, err := parseCOSESign1(raw)
+	if err != nil {
+		return nil, err
+	}
+	doc, cabundle, err := parsePayload(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	// The CA bundle starts with the root certificate, which must be one of
+	// ours, followed by the intermediates.
+	intermediates := x509.NewCertPool()
+	for _, cert := range cabundle {
+		intermediates.AddCert(cert)
+	}
+	if _, err := doc.Certificate.Verify(x509.VerifyOptions{
+		Roots:         v.Roots,
+		Intermediates: intermediates,
+		CurrentTime:   v.now(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}); err != nil {
+		return nil, fmt.Errorf("failed to verify attestation certificate: %w", err)
+	}
+	if err := verifySignature(doc.Certificate, protected, payload, signature); err != nil {
+		return nil, err
+	}
+
+	for i, expected := range v.PCRs {
+		if !bytes.Equal(doc.PCRs[i], expected) {
+			return nil, fmt.Errorf("%w: PCR%d", errUnexpectedPCR, i)
+		}
+	}
+	if nonce != nil && !bytes.Equal(doc.Nonce, nonce) {
+		return nil, errBadNonce
+	}
+	return doc, nil
+}
+
+// parseCOSESign1 returns the protected header, payload, and signature of the
+// given COSE_Sign1 structure (RFC 9052).
+func parseCOSESign1(raw []byte) (protected, payload, signature []byte, err error) {
+	v, err := decode(raw)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	a, ok := v.([]any)
+	if !ok || len(a) != 4 {
+		return nil, nil, nil, errBadDocument
+	}
+	protected, ok1 := a[0].([]byte)
+	payload, ok2 := a[2].([]byte)
+	signature, ok3 := a[3].([]byte)
+	if !ok1 || !ok2 || !ok3 {
+		return nil, nil, nil, errBadDocument
+	}
+
+	header, err := decode(protected)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	h, ok := header.(map[any]any)
+	if !ok {
+		return nil, nil, nil, errBadDocument
+	}
+	if alg, ok := h[uint64(coseHeaderAlg)].(int64); !ok || alg != coseAlgES384 {
+		return nil, nil, nil, errBadAlgorithm
+	}
+	return protected, payload, signature, nil
+}
+
+// parsePayload parses the given attestation document payload, and returns the
+// document and its CA bundle.
+func parsePayload(payload []byte) (*Document, []*x509.Certificate, error) {
+	v, err := decode(payload)
+	if err != nil {
+		return nil, nil, err
+	}
+	m, ok := v.(map[any]any)
+	if !ok {
+		return nil, nil, errBadDocument
+	}
+	doc := &Document{PCRs: make(map[int][]byte)}
+	if doc.ModuleID, ok = m["module_id"].(string); !ok {
+		return nil, nil, errBadDocument
+	}
+	if digest, ok := m["digest"].(string); !ok || digest != "SHA384" {
+		return nil, nil, errBadDocument
+	}
+	timestamp, ok := m["timestamp"].(uint64)
+	if !ok || timestamp > 1<<62 {
+		return nil, nil, errBadDocument
+	}
+	doc.Timestamp = time.UnixMilli(int64(timestamp))
+
+	pcrs, ok := m["pcrs"].(map[any]any)
+	if !ok {
+		return nil, nil, errBadDocument
+	}
+	for k, v := range pcrs {
+		i, ok1 := k.(uint64)
+		pcr, ok2 := v.([]byte)
+		if !ok1 || !ok2 || i > 31 {
+			return nil, nil, errBadDocument
+		}
+		doc.PCRs[int(i)] = pcr
+	}
+
+	rawCert, ok := m["certificate"].([]byte)
+	if !ok {
+		return nil, nil, errBadDocument
+	}
+	if doc.Certificate, err = x509.ParseCertificate(rawCert); err != nil {
+		return nil, nil, err
+	}
+	rawBundle, ok := m["cabundle"].([]any)
+	if !ok || len(rawBundle) == 0 {
+		return nil, nil, errBadDocument
+	}
+	cabundle := make([]*x509.Certificate, 0, len(rawBundle))
+	for _, e := range rawBundle {
+		rawCert, ok := e.([]byte)
+		if !ok {
+			return nil, nil, errBadDocument
+		}
+		cert, err := x509.ParseCertificate(rawCert)
+		if err != nil {
+			return nil, nil, err
+		}
+		cabundle = append(cabundle, cert)
+	}
+
+	// The optional fields are either byte strings or null.
+	for field, dst := range map[string]*[]byte{
+		"public_key": &doc.PublicKey,
+		"user_data":  &doc.UserData,
+		"nonce":      &doc.Nonce,
+	} {
+		switch v := m[field].(type) {
+		case nil:
+		case []byte:
+			*dst = v
+		default:
+			return nil, nil, errBadDocument
+		}
+	}
+	return doc, cabundle, nil
+}
+
+// verifySignature verifies the given COSE_Sign1 signature, which must be
+// ES384 by the given certificate's key.
+func verifySignature(cert *x509.Certificate, protected, payload, signature []byte) error {
+	pub, ok := cert.PublicKey.(*ecdsa.PublicKey)
+	if !ok || pub.Curve != elliptic.P384() {
+		return errBadAlgorithm
+	}
+	if len(signature) != 96 {
+		return errBadSignature
+	}
+	// The signature covers the Sig_structure:
+	// ["Signature1", protected, external_aad, payload]
+	toBeSigned := appendHead(nil, majorArray, 4)
+	toBeSigned = appendText(toBeSigned, "Signature1")
+	toBeSigned = appendBytes(toBeSigned, protected)
+	toBeSigned = appendBytes(toBeSigned, nil)
+	toBeSigned = appendBytes(toBeSigned, payload)
+	digest := sha512.Sum384(toBeSigned)
+
+	r, s := new(big.Int).SetBytes(signature[:48]), new(big.Int).SetBytes(signature[48:])
+	if !ecdsa.Verify(pub, digest[:], r, s) {
+		return errBadSignature
+	}
+	return nil
+}
+
+// ParsePCRs turns the given comma-separated list of PCRs, e.g.,
+// "0=<hex>,1=<hex>,2=<hex>", into a map from PCR index to value.  It accepts
+// the format of tokenizer's -expected-pcrs flag.
+func ParsePCRs(s string) (map[int][]byte, error) {
+	if s == "" {
+		return nil, nil
+	}
+	pcrs := make(map[int][]byte)
+	for _, rawPCR := range strings.Split(s, ",") {
+		rawIndex, digest, found := strings.Cut(strings.TrimSpace(rawPCR), "=")
+		if !found || !pcrIndexFmt.MatchString(rawIndex) {
+			return nil, errBadPCRs
+		}
+		b, err := hex.DecodeString(digest)
+		if err != nil || len(b) != sha512.Size384 {
+			return nil, errBadPCRs
+		}
+		i, _ := strconv.Atoi(rawIndex)
+		pcrs[i] = b
+	}
+	return pcrs, nil
+}
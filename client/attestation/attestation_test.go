@@ -0,0 +1,263 @@
+package attestation
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// testPKI imitates AWS's Nitro Enclaves PKI: a root, an intermediate, and a
+// leaf that signs attestation documents.
+type testPKI struct {
+	root, intermediate, leaf *x509.Certificate
+	leafKey                  *ecdsa.PrivateKey
+}
+
+func newCert(t *testing.T, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		BasicConstraintsValid: true,
+		IsCA:                  name != "leaf",
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(raw)
+	if err != nil {
+		t.Fatalf("Failed to parse certificate: %v", err)
+	}
+	return cert, key
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	root, rootKey := newCert(t, "root", nil, nil)
+	intermediate, intermediateKey := newCert(t, "intermediate", root, rootKey)
+	leaf, leafKey := newCert(t, "leaf", intermediate, intermediateKey)
+	return &testPKI{root: root, intermediate: intermediate, leaf: leaf, leafKey: leafKey}
+}
+
+func (p *testPKI) roots() *x509.CertPool {
+	roots := x509.NewCertPool()
+	roots.AddCert(p.root)
+	return roots
+}
+
+// document returns an attestation document with the given PCR0, nonce, and
+// user data, signed by our leaf.
+func (p *testPKI) document(t *testing.T, pcr0, nonce, userData []byte) []byte {
+	t.Helper()
+
+	payload := encode(map[any]any{
+		"module_id":   "i-0123456789abcdef0-enc0123456789abcdef",
+		"digest":      "SHA384",
+		"timestamp":   uint64(time.Now().UnixMilli()),
+		"pcrs":        map[any]any{uint64(0): pcr0, uint64(1): make([]byte, 48), uint64(2): make([]byte, 48)},
+		"certificate": p.leaf.Raw,
+		"cabundle":    []any{p.root.Raw, p.intermediate.Raw},
+		"public_key":  nil,
+		"user_data":   userData,
+		"nonce":       nonce,
+	})
+	protected := encode(map[any]any{uint64(coseHeaderAlg): int64(coseAlgES384)})
+	toBeSigned := encode([]any{"Signature1", protected, []byte{}, payload})
+	digest := sha512.Sum384(toBeSigned)
+	r, s, err := ecdsa.Sign(rand.Reader, p.leafKey, digest[:])
+	if err != nil {
+		t.Fatalf("Failed to sign document: %v", err)
+	}
+	signature := make([]byte, 96)
+	r.FillBytes(signature[:48])
+	s.FillBytes(signature[48:])
+	return encode([]any{protected, map[any]any{}, payload, signature})
+}
+
+// expectedPCRs returns the PCRs of our documents with the given PCR0.
+func expectedPCRs(pcr0 []byte) map[int][]byte {
+	return map[int][]byte{0: pcr0, 1: make([]byte, 48), 2: make([]byte, 48)}
+}
+
+func TestVerify(t *testing.T) {
+	p := newTestPKI(t)
+	pcr0 := bytes.Repeat([]byte{1}, 48)
+	nonce := []byte("nonce")
+	raw := p.document(t, pcr0, nonce, []byte("user data"))
+	v := &Verifier{Roots: p.roots(), PCRs: expectedPCRs(pcr0)}
+
+	doc, err := v.Verify(raw, nonce)
+	if err != nil {
+		t.Fatalf("Failed to verify document: %v", err)
+	}
+	if !bytes.Equal(doc.PCRs[0], pcr0) || string(doc.UserData) != "user data" || doc.PublicKey != nil {
+		t.Errorf("Got unexpected document: %+v", doc)
+	}
+
+	// Tampering with any part of the document must fail verification.
+	tampered := bytes.Replace(raw, []byte("user data"), []byte("user date"), 1)
+	if _, err := v.Verify(tampered, nonce); !errors.Is(err, errBadSignature) {
+		t.Errorf("Expected bad signature but got %v.", err)
+	}
+	if _, err := v.Verify(raw, []byte("other nonce")); !errors.Is(err, errBadNonce) {
+		t.Errorf("Expected bad nonce but got %v.", err)
+	}
+	v.PCRs[0] = bytes.Repeat([]byte{2}, 48)
+	if _, err := v.Verify(raw, nonce); !errors.Is(err, errUnexpectedPCR) {
+		t.Errorf("Expected unexpected PCR but got %v.", err)
+	}
+	// We refuse to verify anything without the expected values of PCR0-2.
+	for _, pcrs := range []map[int][]byte{nil, {0: pcr0, 1: make([]byte, 48)}} {
+		v = &Verifier{Roots: p.roots(), PCRs: pcrs}
+		if _, err := v.Verify(raw, nonce); !errors.Is(err, errMissingPCR) {
+			t.Errorf("Expected missing PCR but got %v.", err)
+		}
+	}
+	// Documents must chain up to our roots, and be valid now.
+	v = &Verifier{Roots: newTestPKI(t).roots(), PCRs: expectedPCRs(pcr0)}
+	if _, err := v.Verify(raw, nil); err == nil {
+		t.Error("Expected untrusted document to fail verification.")
+	}
+	v = &Verifier{Roots: p.roots(), PCRs: expectedPCRs(pcr0), Now: func() time.Time { return time.Now().Add(2 * time.Hour) }}
+	if _, err := v.Verify(raw, nil); err == nil {
+		t.Error("Expected expired document to fail verification.")
+	}
+	v = &Verifier{}
+	if _, err := v.Verify(raw, nil); !errors.Is(err, errNoRoots) {
+		t.Errorf("Expected missing roots but got %v.", err)
+	}
+}
+
+func TestVerifyMalformed(t *testing.T) {
+	p := newTestPKI(t)
+	v := &Verifier{Roots: p.roots(), PCRs: expectedPCRs(make([]byte, 48))}
+	for _, raw := range [][]byte{
+		nil,
+		encode([]any{}),
+		encode([]any{[]byte{}, map[any]any{}, []byte{}, []byte{}}),
+		// Signed with ES256 rather than ES384.
+		encode([]any{encode(map[any]any{uint64(coseHeaderAlg): int64(-7)}), map[any]any{}, []byte{}, []byte{}}),
+		// Signed correctly, but without the mandatory fields.
+		encode([]any{encode(map[any]any{uint64(coseHeaderAlg): int64(coseAlgES384)}), map[any]any{}, encode(map[any]any{}), []byte{}}),
+	} {
+		if _, err := v.Verify(raw, nil); err == nil {
+			t.Errorf("Expected error for %x but got none.", raw)
+		}
+	}
+}
+
+func TestFetch(t *testing.T) {
+	p := newTestPKI(t)
+	var certDigest []byte
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != DefaultPath {
+			http.NotFound(w, r)
+			return
+		}
+		nonce, err := hex.DecodeString(r.URL.Query().Get("nonce"))
+		if err != nil || len(nonce) != nonceLen {
+			http.Error(w, "bad nonce", http.StatusBadRequest)
+			return
+		}
+		userData := append([]byte("sha256:"), certDigest...)
+		w.Write([]byte(base64.StdEncoding.EncodeToString(p.document(t, make([]byte, 48), nonce, userData))))
+	}))
+	defer srv.Close()
+	digest := sha256.Sum256(srv.Certificate().Raw)
+	certDigest = digest[:]
+
+	// The enclave's certificate is self-signed, so the attestation document
+	// vouches for it.
+	v := &Verifier{Roots: p.roots(), PCRs: expectedPCRs(make([]byte, 48)), Client: srv.Client()}
+	if _, err := v.Fetch(context.Background(), srv.URL+"/"); err != nil {
+		t.Fatalf("Failed to fetch document: %v", err)
+	}
+
+	// A document that binds a different certificate is rejected, unless
+	// we don't care about the binding.
+	certDigest = make([]byte, sha256.Size)
+	if _, err := v.Fetch(context.Background(), srv.URL); !errors.Is(err, errCertBinding) {
+		t.Errorf("Expected bad binding but got %v.", err)
+	}
+	v.SkipCertBinding = true
+	if err := v.VerifyAttestation(context.Background(), srv.URL); err != nil {
+		t.Errorf("Expected no error but got %v.", err)
+	}
+
+	v.Path = "/attest"
+	if _, err := v.Fetch(context.Background(), srv.URL); err == nil {
+		t.Error("Expected error for missing endpoint but got none.")
+	}
+}
+
+func TestBindsCertificate(t *testing.T) {
+	cert := newTestPKI(t).leaf
+	digest := sha256.Sum256(cert.Raw)
+	appKeyDigest := bytes.Repeat([]byte{1}, sha256.Size)
+	join := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+
+	for _, userData := range [][]byte{
+		join([]byte("sha256:"), digest[:]),
+		join([]byte("sha256:"), digest[:], []byte(";sha256:"), appKeyDigest),
+	} {
+		if !(&Document{UserData: userData}).BindsCertificate(cert) {
+			t.Errorf("Expected %q to bind certificate.", userData)
+		}
+	}
+	for _, userData := range [][]byte{
+		nil,
+		digest[:],
+		// The certificate's digest must come first.
+		join([]byte("sha256:"), appKeyDigest, []byte(";sha256:"), digest[:]),
+		join([]byte("foo"), []byte("sha256:"), digest[:]),
+		// Nothing but the application key's digest may follow.
+		join([]byte("sha256:"), digest[:], []byte("foo")),
+		join([]byte("sha256:"), digest[:], []byte(";sha256:"), appKeyDigest[1:]),
+		join([]byte("sha256:"), digest[:], []byte(";sha512:"), appKeyDigest),
+	} {
+		if (&Document{UserData: userData}).BindsCertificate(cert) {
+			t.Errorf("Expected %q not to bind certificate.", userData)
+		}
+	}
+}
+
+func TestParsePCRs(t *testing.T) {
+	digest := hex.EncodeToString(bytes.Repeat([]byte{0xab}, 48))
+	pcrs, err := ParsePCRs("0=" + digest + ", 8=" + digest)
+	if err != nil {
+		t.Fatalf("Failed to parse PCRs: %v", err)
+	}
+	if len(pcrs) != 2 || !bytes.Equal(pcrs[8], bytes.Repeat([]byte{0xab}, 48)) {
+		t.Errorf("Got unexpected PCRs: %v", pcrs)
+	}
+	for _, s := range []string{"9=" + digest, "0=abcd", "0", "0=" + digest + ",x"} {
+		if _, err := ParsePCRs(s); !errors.Is(err, errBadPCRs) {
+			t.Errorf("Expected error for %q but got %v.", s, err)
+		}
+	}
+}
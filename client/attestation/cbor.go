@@ -0,0 +1,206 @@
+package attestation
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// CBOR major types.
+const (
+	majorUint = iota
+	majorNegInt
+	majorBytes
+	majorText
+	majorArray
+	majorMap
+	majorTag
+	majorSimple
+)
+
+// maxDepth is how deeply arrays, maps, and tags may nest.  Attestation
+// documents nest three levels deep.
+const maxDepth = 16
+
+var errBadCBOR = errors.New("malformed CBOR")
+
+// decoder decodes the subset of CBOR (RFC 8949) that attestation documents
+// use: integers, byte and text strings, arrays, maps, tags, booleans, and
+// null.  We decode unsigned integers as uint64, negative integers as int64,
+// byte strings as []byte, arrays as []any, and maps as map[any]any.  Tags are
+// skipped.  Floats and indefinite lengths are unsupported.
+type decoder struct {
+	b     []byte
+	depth int
+}
+
+// decode decodes the given CBOR data item, which must not be followed by
+// anything else.
+func decode(b []byte) (any, error) {
+	d := &decoder{b: b}
+	v, err := d.value()
+	if err != nil {
+		return nil, err
+	}
+	if len(d.b) != 0 {
+		return nil, errBadCBOR
+	}
+	return v, nil
+}
+
+// head decodes a data item's initial byte and argument.
+func (d *decoder) head() (major byte, info byte, arg uint64, err error) {
+	if len(d.b) == 0 {
+		return 0, 0, 0, errBadCBOR
+	}
+	major, info = d.b[0]>>5, d.b[0]&0x1f
+	d.b = d.b[1:]
+	if info < 24 {
+		return major, info, uint64(info), nil
+	}
+	if info > 27 {
+		// Reserved values and indefinite lengths.
+		return 0, 0, 0, errBadCBOR
+	}
+	n := 1 << (info - 24)
+	if len(d.b) < n {
+		return 0, 0, 0, errBadCBOR
+	}
+	for _, c := range d.b[:n] {
+		arg = arg<<8 | uint64(c)
+	}
+	d.b = d.b[n:]
+	return major, info, arg, nil
+}
+
+func (d *decoder) value() (any, error) {
+	major, info, arg, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+	switch major {
+	case majorUint:
+		return arg, nil
+	case majorNegInt:
+		if arg > math.MaxInt64 {
+			return nil, errBadCBOR
+		}
+		return -1 - int64(arg), nil
+	case majorBytes, majorText:
+		if arg > uint64(len(d.b)) {
+			return nil, errBadCBOR
+		}
+		s := d.b[:arg:arg]
+		d.b = d.b[arg:]
+		if major == majorText {
+			return string(s), nil
+		}
+		return s, nil
+	case majorArray:
+		// Each element takes at least one byte, which keeps a bogus
+		// length from making us allocate a lot of memory.
+		if arg > uint64(len(d.b)) {
+			return nil, errBadCBOR
+		}
+		if err := d.nest(); err != nil {
+			return nil, err
+		}
+		defer d.unnest()
+		a := make([]any, 0, arg)
+		for i := uint64(0); i < arg; i++ {
+			v, err := d.value()
+			if err != nil {
+				return nil, err
+			}
+			a = append(a, v)
+		}
+		return a, nil
+	case majorMap:
+		if arg > uint64(len(d.b))/2 {
+			return nil, errBadCBOR
+		}
+		if err := d.nest(); err != nil {
+			return nil, err
+		}
+		defer d.unnest()
+		m := make(map[any]any, arg)
+		for i := uint64(0); i < arg; i++ {
+			k, err := d.value()
+			if err != nil {
+				return nil, err
+			}
+			switch k.(type) {
+			case uint64, int64, string:
+			default:
+				// We only support keys that are comparable.
+				return nil, errBadCBOR
+			}
+			if _, exists := m[k]; exists {
+				return nil, errBadCBOR
+			}
+			if m[k], err = d.value(); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	case majorTag:
+		if err := d.nest(); err != nil {
+			return nil, err
+		}
+		defer d.unnest()
+		return d.value()
+	default:
+		if info >= 24 {
+			return nil, errBadCBOR
+		}
+		switch arg {
+		case 20:
+			return false, nil
+		case 21:
+			return true, nil
+		case 22, 23:
+			// Null and undefined.
+			return nil, nil
+		}
+		return nil, errBadCBOR
+	}
+}
+
+func (d *decoder) nest() error {
+	d.depth++
+	if d.depth > maxDepth {
+		return errBadCBOR
+	}
+	return nil
+}
+
+func (d *decoder) unnest() {
+	d.depth--
+}
+
+// appendHead appends a data item's initial byte and argument, in its shortest
+// form.
+func appendHead(b []byte, major byte, arg uint64) []byte {
+	switch {
+	case arg < 24:
+		return append(b, major<<5|byte(arg))
+	case arg <= math.MaxUint8:
+		return append(b, major<<5|24, byte(arg))
+	case arg <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, major<<5|25), uint16(arg))
+	case arg <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(b, major<<5|26), uint32(arg))
+	default:
+		return binary.BigEndian.AppendUint64(append(b, major<<5|27), arg)
+	}
+}
+
+// appendBytes appends the given byte string.
+func appendBytes(b []byte, s []byte) []byte {
+	return append(appendHead(b, majorBytes, uint64(len(s))), s...)
+}
+
+// appendText appends the given text string.
+func appendText(b []byte, s string) []byte {
+	return append(appendHead(b, majorText, uint64(len(s))), s...)
+}
@@ -0,0 +1,116 @@
+package attestation
+
+import (
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+// encode encodes the given value as CBOR.  It supports the types that our
+// decoder returns, plus int.
+func encode(v any) []byte {
+	switch v := v.(type) {
+	case nil:
+		return []byte{0xf6}
+	case bool:
+		if v {
+			return []byte{0xf5}
+		}
+		return []byte{0xf4}
+	case int:
+		if v < 0 {
+			return appendHead(nil, majorNegInt, uint64(-1-v))
+		}
+		return appendHead(nil, majorUint, uint64(v))
+	case uint64:
+		return appendHead(nil, majorUint, v)
+	case int64:
+		return encode(int(v))
+	case []byte:
+		return appendBytes(nil, v)
+	case string:
+		return appendText(nil, v)
+	case []any:
+		b := appendHead(nil, majorArray, uint64(len(v)))
+		for _, e := range v {
+			b = append(b, encode(e)...)
+		}
+		return b
+	case map[any]any:
+		b := appendHead(nil, majorMap, uint64(len(v)))
+		for k, e := range v {
+			b = append(b, encode(k)...)
+			b = append(b, encode(e)...)
+		}
+		return b
+	}
+	panic("unsupported type")
+}
+
+func TestDecode(t *testing.T) {
+	// Most of the following are from RFC 8949, Appendix A.
+	for rawHex, expected := range map[string]any{
+		"00":                 uint64(0),
+		"1864":               uint64(100),
+		"1b000000e8d4a51000": uint64(1000000000000),
+		"20":                 int64(-1),
+		"3863":               int64(-100),
+		"43010203":           []byte{1, 2, 3},
+		"6449455446":         "IETF",
+		"83010203":           []any{uint64(1), uint64(2), uint64(3)},
+		"a201020304":         map[any]any{uint64(1): uint64(2), uint64(3): uint64(4)},
+		"a26161016162820203": map[any]any{"a": uint64(1), "b": []any{uint64(2), uint64(3)}},
+		"c11a514b67b0":       uint64(1363896240),
+		"f4":                 false,
+		"f5":                 true,
+		"f6":                 nil,
+	} {
+		raw, _ := hex.DecodeString(rawHex)
+		v, err := decode(raw)
+		if err != nil {
+			t.Fatalf("Failed to decode %s: %v", rawHex, err)
+		}
+		if !reflect.DeepEqual(v, expected) {
+			t.Errorf("Expected %#v for %s but got %#v.", expected, rawHex, v)
+		}
+	}
+}
+
+func TestAppendHead(t *testing.T) {
+	for arg, expected := range map[uint64]string{
+		0:       "00",
+		23:      "17",
+		24:      "1818",
+		255:     "18ff",
+		256:     "190100",
+		65536:   "1a00010000",
+		1 << 32: "1b0000000100000000",
+	} {
+		if got := hex.EncodeToString(appendHead(nil, majorUint, arg)); got != expected {
+			t.Errorf("Expected %s for %d but got %s.", expected, arg, got)
+		}
+	}
+}
+
+func TestDecodeMalformed(t *testing.T) {
+	for _, rawHex := range []string{
+		"",                                     // Nothing.
+		"18",                                   // Missing argument.
+		"4401",                                 // Truncated byte string.
+		"0000",                                 // Trailing data.
+		"5f42010243030405ff",                   // Indefinite length.
+		"f90000",                               // Float.
+		"f0",                                   // Unassigned simple value.
+		"9bffffffffffffffff",                   // Absurd array length.
+		"a2010201",                             // Truncated map.
+		"a1430102030a",                         // Byte string key.
+		"a201020103",                           // Duplicate key.
+		"3bffffffffffffffff",                   // Negative integer overflow.
+		"818181818181818181818181818181818100", // Too deep.
+	} {
+		raw, _ := hex.DecodeString(rawHex)
+		if _, err := decode(raw); err != errBadCBOR {
+			t.Errorf("Expected error for %q but got %v.", rawHex, err)
+		}
+	}
+}
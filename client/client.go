@@ -0,0 +1,230 @@
+// Package client helps Go services submit confirmation token requests to
+// tokenizer through our edge (e.g., Fastly).  Its Transport takes care of the
+// confirmation path, the ads API version, and our headers, so a service can
+// integrate in a few lines:
+//
+//	c := client.New("https://ia2.example.com", nil)
+//	err := c.Submit(ctx, walletID, &client.Meta{Country: "US"})
+//
+// Services that want more control can use Transport with their own
+// http.Client, and send GET requests to ConfirmationPath(walletID).
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	uuid "github.com/google/uuid"
+)
+
+const (
+	// DefaultApiVersion is the ads API version that we use unless told
+	// otherwise.  It's the first version whose requests may carry metadata.
+	DefaultApiVersion = 5
+
+	// RequestIDHeader carries the request's ID, which tokenizer echoes and
+	// attaches to the request's record.
+	RequestIDHeader = "X-Request-ID"
+	// CountryHeader and ConfTypeHeader carry a request's optional metadata.
+	CountryHeader  = "X-Ads-Country"
+	ConfTypeHeader = "X-Ads-Confirmation-Type"
+
+	// confirmationPrefix is the unversioned prefix of our confirmation path.
+	confirmationPrefix = "/confirmation/token/"
+	// maxErrBody is the number of bytes of an error response that we keep.
+	maxErrBody = 1 << 10
+)
+
+var errNoWallet = errors.New("wallet ID must not be nil")
+
+// ConfirmationPath returns the unversioned path that confirms the given
+// wallet.  Transport prefixes the path with its ads API version.
+func ConfirmationPath(walletID uuid.UUID) string {
+	return confirmationPrefix + walletID.String()
+}
+
+// Meta represents a request's optional metadata.
+type Meta struct {
+	// Country is an ISO 3166-1 alpha-2 code, e.g., "US".
+	Country string
+	// ConfType is the confirmation's type, e.g., "view".
+	ConfType string
+}
+
+// Transport implements an http.RoundTripper that prepares requests for
+// tokenizer: it prefixes unversioned confirmation paths with the ads API
+// version, and sets a request ID if the request has none.  If
+// VerifyAttestation is set, Transport calls it before its first request, and
+// fails all requests if the verification fails.
+type Transport struct {
+	// Base is the RoundTripper that sends our requests.  If nil,
+	// http.DefaultTransport is used.
+	Base http.RoundTripper
+	// ApiVersion is the ads API version that we request.  If 0,
+	// DefaultApiVersion is used.
+	ApiVersion int
+	// Header contains headers that we add to each request, e.g., a CSRF
+	// token.
+	Header http.Header
+	// VerifyAttestation verifies that the given base URL is served by an
+	// enclave that runs the expected image, e.g., by fetching and checking
+	// the enclave's attestation document.  It is called at most once, so a
+	// process should share a single Transport.
+	VerifyAttestation func(ctx context.Context, baseURL string) error
+
+	once      sync.Once
+	attestErr error
+}
+
+func (t *Transport) base() http.RoundTripper {
+	if t.Base == nil {
+		return http.DefaultTransport
+	}
+	return t.Base
+}
+
+func (t *Transport) apiVersion() int {
+	if t.ApiVersion == 0 {
+		return DefaultApiVersion
+	}
+	return t.ApiVersion
+}
+
+// attest verifies the enclave's attestation once, and returns the outcome.
+func (t *Transport) attest(r *http.Request) error {
+	if t.VerifyAttestation == nil {
+		return nil
+	}
+	t.once.Do(func() {
+		baseURL := r.URL.Scheme + "://" + r.URL.Host
+		if err := t.VerifyAttestation(r.Context(), baseURL); err != nil {
+			t.attestErr = fmt.Errorf("failed to verify attestation: %w", err)
+		}
+	})
+	return t.attestErr
+}
+
+// RoundTrip implements http.RoundTripper.  Like any RoundTripper, it doesn't
+// modify the given request but a copy of it.
+func (t *Transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if err := t.attest(r); err != nil {
+		if r.Body != nil {
+			r.Body.Close()
+		}
+		return nil, err
+	}
+
+	r = r.Clone(r.Context())
+	if strings.HasPrefix(r.URL.Path, confirmationPrefix) {
+		r.URL.Path = fmt.Sprintf("/v%d%s", t.apiVersion(), r.URL.Path)
+		r.URL.RawPath = ""
+	}
+	for name, values := range t.Header {
+		for _, v := range values {
+			r.Header.Add(name, v)
+		}
+	}
+	if r.Header.Get(RequestIDHeader) == "" {
+		r.Header.Set(RequestIDHeader, newRequestID())
+	}
+	return t.base().RoundTrip(r)
+}
+
+// newRequestID returns a random, hex-encoded request ID.
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		// Tokenizer generates an ID for requests that have none.
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// Error represents a response that tokenizer rejected.
+type Error struct {
+	StatusCode int
+	// Message is tokenizer's error message, e.g., "wallet ID has bad
+	// format".
+	Message string
+	// RetryAfter is set if tokenizer asked us to retry later, e.g., because
+	// the wallet exceeded its rate limit.
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("tokenizer responded with %d: %s", e.StatusCode, e.Message)
+}
+
+// Temporary returns true if the request may succeed if retried later.
+func (e *Error) Temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests ||
+		e.StatusCode == http.StatusServiceUnavailable || e.RetryAfter > 0
+}
+
+// Client submits confirmation token requests to tokenizer.
+type Client struct {
+	baseURL string
+	http    *http.Client
+}
+
+// New returns a client that submits requests to the given base URL, e.g.,
+// "https://ia2.example.com", via the given Transport.  If t is nil, a
+// Transport with default settings is used.
+func New(baseURL string, t *Transport) *Client {
+	if t == nil {
+		t = &Transport{}
+	}
+	return &Client{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		http:    &http.Client{Transport: t},
+	}
+}
+
+// Submit asks tokenizer to confirm the given wallet.  The metadata is
+// optional.  If tokenizer rejects the request, the returned error is an
+// *Error.
+func (c *Client) Submit(ctx context.Context, walletID uuid.UUID, meta *Meta) error {
+	if walletID == uuid.Nil {
+		return errNoWallet
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		c.baseURL+ConfirmationPath(walletID), nil)
+	if err != nil {
+		return err
+	}
+	if meta != nil {
+		if meta.Country != "" {
+			req.Header.Set(CountryHeader, meta.Country)
+		}
+		if meta.ConfType != "" {
+			req.Header.Set(ConfTypeHeader, meta.ConfType)
+		}
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrBody))
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	e := &Error{
+		StatusCode: resp.StatusCode,
+		Message:    strings.TrimSpace(string(body)),
+	}
+	if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+		e.RetryAfter = time.Duration(secs) * time.Second
+	}
+	return e
+}
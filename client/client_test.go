@@ -0,0 +1,146 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	uuid "github.com/google/uuid"
+)
+
+func TestSubmit(t *testing.T) {
+	walletID := uuid.New()
+	var got *http.Request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+	}))
+	defer srv.Close()
+
+	c := New(srv.URL+"/", &Transport{
+		ApiVersion: 3,
+		Header:     http.Header{"X-Csrf-Token": []string{"foo"}},
+	})
+	if err := c.Submit(context.Background(), walletID, &Meta{Country: "US"}); err != nil {
+		t.Fatalf("Failed to submit request: %v", err)
+	}
+	if expected := "/v3/confirmation/token/" + walletID.String(); got.URL.Path != expected {
+		t.Errorf("Expected path %q but got %q.", expected, got.URL.Path)
+	}
+	if got.Header.Get(CountryHeader) != "US" || got.Header.Get(ConfTypeHeader) != "" {
+		t.Errorf("Got unexpected metadata headers: %v", got.Header)
+	}
+	if got.Header.Get("X-Csrf-Token") != "foo" {
+		t.Error("Expected static header but got none.")
+	}
+	if len(got.Header.Get(RequestIDHeader)) != 32 {
+		t.Errorf("Got unexpected request ID %q.", got.Header.Get(RequestIDHeader))
+	}
+
+	if err := c.Submit(context.Background(), uuid.Nil, nil); err != errNoWallet {
+		t.Errorf("Expected %v but got %v.", errNoWallet, err)
+	}
+}
+
+func TestTransport(t *testing.T) {
+	var got *http.Request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+	}))
+	defer srv.Close()
+
+	c := &http.Client{Transport: &Transport{}}
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/version", nil)
+	req.Header.Set(RequestIDHeader, "edge-1234")
+	if _, err := c.Do(req); err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	// Only confirmation paths are versioned, and we keep request IDs.
+	if got.URL.Path != "/version" {
+		t.Errorf("Got unexpected path %q.", got.URL.Path)
+	}
+	if got.Header.Get(RequestIDHeader) != "edge-1234" {
+		t.Errorf("Got unexpected request ID %q.", got.Header.Get(RequestIDHeader))
+	}
+	// The caller's request remains untouched.
+	if req.URL.Path != "/version" || len(req.Header) != 1 {
+		t.Error("Transport modified the caller's request.")
+	}
+
+	req, _ = http.NewRequest(http.MethodGet, srv.URL+ConfirmationPath(uuid.Nil), nil)
+	if _, err := c.Do(req); err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	if expected := "/v5" + ConfirmationPath(uuid.Nil); got.URL.Path != expected {
+		t.Errorf("Expected path %q but got %q.", expected, got.URL.Path)
+	}
+}
+
+func TestAttestation(t *testing.T) {
+	var numRequests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&numRequests, 1)
+	}))
+	defer srv.Close()
+
+	var numVerified int32
+	var baseURL string
+	errBadPCRs := errors.New("unexpected PCRs")
+	newClient := func(err error) *Client {
+		return New(srv.URL, &Transport{
+			VerifyAttestation: func(ctx context.Context, u string) error {
+				atomic.AddInt32(&numVerified, 1)
+				baseURL = u
+				return err
+			},
+		})
+	}
+
+	// We verify the attestation only once.
+	c := newClient(nil)
+	for i := 0; i < 3; i++ {
+		if err := c.Submit(context.Background(), uuid.New(), nil); err != nil {
+			t.Fatalf("Failed to submit request: %v", err)
+		}
+	}
+	if numVerified != 1 || numRequests != 3 {
+		t.Errorf("Expected 1 verification and 3 requests but got %d and %d.", numVerified, numRequests)
+	}
+	if baseURL != srv.URL {
+		t.Errorf("Expected base URL %q but got %q.", srv.URL, baseURL)
+	}
+
+	// If the verification fails, so do all requests.
+	c = newClient(errBadPCRs)
+	for i := 0; i < 2; i++ {
+		if err := c.Submit(context.Background(), uuid.New(), nil); !errors.Is(err, errBadPCRs) {
+			t.Errorf("Expected %v but got %v.", errBadPCRs, err)
+		}
+	}
+	if numVerified != 2 || numRequests != 3 {
+		t.Errorf("Expected 2 verifications and 3 requests but got %d and %d.", numVerified, numRequests)
+	}
+}
+
+func TestError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "2")
+		http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+
+	err := New(srv.URL, nil).Submit(context.Background(), uuid.New(), nil)
+	var e *Error
+	if !errors.As(err, &e) {
+		t.Fatalf("Expected *Error but got %v.", err)
+	}
+	if e.StatusCode != http.StatusTooManyRequests || e.Message != "rate limit exceeded" {
+		t.Errorf("Got unexpected error: %v", e)
+	}
+	if e.RetryAfter != 2*time.Second || !e.Temporary() {
+		t.Errorf("Expected temporary error with Retry-After but got %+v.", e)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import "time"
+
+// clock abstracts away the passage of time, so that tests can control it.
+// Components that depend on time take a clock instead of calling the time
+// package directly.  In production, we use realClock.
+type clock interface {
+	now() time.Time
+	newTicker(d time.Duration) ticker
+}
+
+// ticker is the subset of time.Ticker that we use.
+type ticker interface {
+	ticks() <-chan time.Time
+	stop()
+}
+
+// realClock implements a clock that's backed by the time package.
+type realClock struct{}
+
+func (realClock) now() time.Time {
+	return time.Now()
+}
+
+func (realClock) newTicker(d time.Duration) ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) ticks() <-chan time.Time {
+	return t.C
+}
+
+func (t realTicker) stop() {
+	t.Stop()
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock implements a clock that only moves when a test tells it to, i.e.,
+// it's frozen by default.  advance moves the clock forward and fires the
+// tickers that are due, in the order of their deadlines.  Each tick blocks
+// until the ticker's owner received it, so once advance returns, the owner
+// has seen all ticks.  jump changes the wall clock without firing tickers,
+// like an NTP step or a leap second would.
+type fakeClock struct {
+	sync.Mutex
+	wall    time.Time
+	elapsed time.Duration
+	tickers []*fakeTicker
+}
+
+type fakeTicker struct {
+	c      chan time.Time
+	period time.Duration
+	next   time.Duration
+	done   chan empty
+	once   sync.Once
+}
+
+func newFakeClock(t time.Time) *fakeClock {
+	return &fakeClock{wall: t}
+}
+
+func (c *fakeClock) now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.wall
+}
+
+func (c *fakeClock) newTicker(d time.Duration) ticker {
+	c.Lock()
+	defer c.Unlock()
+
+	t := &fakeTicker{
+		c:      make(chan time.Time),
+		period: d,
+		next:   c.elapsed + d,
+		done:   make(chan empty),
+	}
+	c.tickers = append(c.tickers, t)
+	return t
+}
+
+// advance moves the clock forward by the given duration.
+func (c *fakeClock) advance(d time.Duration) {
+	target := c.elapsedNow() + d
+	for {
+		c.Lock()
+		var due *fakeTicker
+		for _, t := range c.tickers {
+			if t.stopped() || t.next > target {
+				continue
+			}
+			if due == nil || t.next < due.next {
+				due = t
+			}
+		}
+		if due == nil {
+			c.wall = c.wall.Add(target - c.elapsed)
+			c.elapsed = target
+			c.Unlock()
+			return
+		}
+		c.wall = c.wall.Add(due.next - c.elapsed)
+		c.elapsed = due.next
+		due.next += due.period
+		now := c.wall
+		c.Unlock()
+
+		select {
+		case due.c <- now:
+		case <-due.done:
+		}
+	}
+}
+
+// jump sets the wall clock to the given time.
+func (c *fakeClock) jump(t time.Time) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.wall = t
+}
+
+func (c *fakeClock) elapsedNow() time.Duration {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.elapsed
+}
+
+func (t *fakeTicker) ticks() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTicker) stop() {
+	t.once.Do(func() { close(t.done) })
+}
+
+func (t *fakeTicker) stopped() bool {
+	select {
+	case <-t.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := newFakeClock(start)
+	fast, slow := c.newTicker(time.Second), c.newTicker(2*time.Second)
+
+	var ticks []string
+	done := make(chan empty)
+	go func() {
+		defer close(done)
+		for len(ticks) < 3 {
+			select {
+			case <-fast.ticks():
+				ticks = append(ticks, "fast")
+			case <-slow.ticks():
+				ticks = append(ticks, "slow")
+			}
+		}
+	}()
+	// Tickers that are due at the same time fire in the order in which they
+	// were created.
+	c.advance(2 * time.Second)
+	<-done
+	assertEqual(t, len(ticks), 3)
+	assertEqual(t, ticks[0], "fast")
+	assertEqual(t, ticks[1], "fast")
+	assertEqual(t, ticks[2], "slow")
+	assertEqual(t, c.now(), start.Add(2*time.Second))
+
+	// Jumping doesn't fire tickers, and stopped tickers don't block advance.
+	c.jump(start)
+	assertEqual(t, c.now(), start)
+	fast.stop()
+	slow.stop()
+	c.advance(time.Hour)
+	assertEqual(t, c.now(), start.Add(time.Hour))
+}
@@ -0,0 +1,97 @@
+// Command verify-attestation fetches and verifies the attestation document of
+// a tokenizer enclave, e.g.:
+//
+//	verify-attestation -url https://ia2.example.com \
+//		-roots root.pem -pcrs 0=<hex>,1=<hex>,2=<hex>
+//
+// It prints the verified document's fields as JSON, and exits with a non-zero
+// code if verification fails.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/brave/tokenizer/client/attestation"
+)
+
+type result struct {
+	ModuleID  string            `json:"module_id"`
+	Timestamp time.Time         `json:"timestamp"`
+	PCRs      map[string]string `json:"pcrs"`
+	UserData  string            `json:"user_data,omitempty"`
+}
+
+func run() error {
+	url := flag.String("url", "", "Base URL of the enclave, e.g., https://ia2.example.com.")
+	rootsFile := flag.String("roots", "", "Path to AWS's Nitro Enclaves root certificate, in PEM format.")
+	rawPCRs := flag.String("pcrs", "", "Comma-separated list of expected PCRs, which must include PCR0-2, e.g., '0=<hex>,1=<hex>,2=<hex>'.")
+	path := flag.String("path", attestation.DefaultPath, "Path of the attestation endpoint.")
+	skipBinding := flag.Bool("skip-cert-binding", false,
+		"Don't require the document to bind the enclave's TLS certificate, and verify the certificate like any other instead.")
+	timeout := flag.Duration("timeout", 10*time.Second, "Timeout for fetching the document.")
+	flag.Parse()
+
+	if *url == "" || *rootsFile == "" || *rawPCRs == "" {
+		return errors.New("-url, -roots, and -pcrs are required")
+	}
+	rawRoots, err := os.ReadFile(*rootsFile)
+	if err != nil {
+		return err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(rawRoots) {
+		return errors.New("failed to parse root certificates")
+	}
+	pcrs, err := attestation.ParsePCRs(*rawPCRs)
+	if err != nil {
+		return err
+	}
+
+	// Unless we skip the binding, the attestation document vouches for the
+	// enclave's (typically self-signed) certificate.
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: !*skipBinding}
+	v := &attestation.Verifier{
+		Roots:           roots,
+		PCRs:            pcrs,
+		Client:          &http.Client{Transport: transport},
+		Path:            *path,
+		SkipCertBinding: *skipBinding,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	doc, err := v.Fetch(ctx, *url)
+	if err != nil {
+		return err
+	}
+
+	r := result{
+		ModuleID:  doc.ModuleID,
+		Timestamp: doc.Timestamp.UTC(),
+		PCRs:      make(map[string]string),
+		UserData:  hex.EncodeToString(doc.UserData),
+	}
+	for i, pcr := range doc.PCRs {
+		r.PCRs[fmt.Sprint(i)] = hex.EncodeToString(pcr)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Fprintf(os.Stderr, "Verification failed: %v\n", err)
+		os.Exit(1)
+	}
+}
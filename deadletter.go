@@ -0,0 +1,69 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// The stages at which records become dead letters: the aggregator failed
+	// to serialize them, a flusher failed to encode them in its flush format,
+	// or a sink rejected them.
+	stageSerialize = "serialize"
+	stageEncode    = "encode"
+	stageSink      = "sink"
+	// We log up to deadLetterLogBurst dead letters in a row, and
+	// deadLetterLogRate per second after that.
+	deadLetterLogRate  = 1.0
+	deadLetterLogBurst = 10
+)
+
+// deadLetters accounts for the records that we failed to serialize or that a
+// sink rejected for good.
+var deadLetters = newDeadLetterLog()
+
+// deadLetterLog counts dead letters by stage, and logs a rate-limited sample
+// of them, so that data loss is observable without flooding our logs.  We
+// never log the records themselves: they contain wallet IDs.
+type deadLetterLog struct {
+	sync.Mutex
+	bucket bucket
+	now    func() time.Time
+}
+
+func newDeadLetterLog() *deadLetterLog {
+	return &deadLetterLog{
+		bucket: bucket{tokens: deadLetterLogBurst},
+		now:    time.Now,
+	}
+}
+
+// add accounts for the given number of records that became dead letters at the
+// given stage, because of the given error.
+func (d *deadLetterLog) add(stage string, records int, err error) {
+	m.numDeadLetters.With(prometheus.Labels{deadLetterStage: stage}).Add(float64(records))
+	if d.sample() {
+		l.Printf("Dropped %d records at %s stage: %v", records, stage, err)
+	}
+}
+
+// sample returns true if we may log another dead letter.
+func (d *deadLetterLog) sample() bool {
+	d.Lock()
+	defer d.Unlock()
+
+	now := d.now()
+	if !d.bucket.last.IsZero() {
+		d.bucket.tokens = math.Min(deadLetterLogBurst,
+			d.bucket.tokens+now.Sub(d.bucket.last).Seconds()*deadLetterLogRate)
+	}
+	d.bucket.last = now
+	if d.bucket.tokens < 1 {
+		return false
+	}
+	d.bucket.tokens--
+	return true
+}
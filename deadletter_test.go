@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestDeadLetterLog(t *testing.T) {
+	now := time.Now()
+	d := newDeadLetterLog()
+	d.now = func() time.Time { return now }
+	numDead := testutil.ToFloat64(m.numDeadLetters.WithLabelValues(stageSink))
+
+	// We count all dead letters, but only log a burst of them.
+	for i := 0; i < deadLetterLogBurst; i++ {
+		assertEqual(t, d.sample(), true)
+	}
+	assertEqual(t, d.sample(), false)
+	d.add(stageSink, 3, errors.New("message too large"))
+	assertEqual(t, testutil.ToFloat64(m.numDeadLetters.WithLabelValues(stageSink)), numDead+3)
+
+	// Our bucket refills over time.
+	now = now.Add(time.Second)
+	assertEqual(t, d.sample(), true)
+	assertEqual(t, d.sample(), false)
+}
+
+func TestSinkRejection(t *testing.T) {
+	s := &mockSink{err: &rejectedError{rejected: []int{1}, err: errors.New("message too large")}}
+	f := newRetryingFlusher(s, 10)
+	numDead := testutil.ToFloat64(m.numDeadLetters.WithLabelValues(stageSink))
+	numFailures := testutil.ToFloat64(m.numFlushFailures.WithLabelValues(s.String()))
+
+	// Rejected tokens become dead letters, and we don't retry them.
+	f.flush([]any{token("foo"), token("bar")})
+	assertEqual(t, f.numPending(), 0)
+	assertEqual(t, f.ready(), nil)
+	assertEqual(t, testutil.ToFloat64(m.numDeadLetters.WithLabelValues(stageSink)), numDead+1)
+	assertEqual(t, testutil.ToFloat64(m.numFlushFailures.WithLabelValues(s.String())), numFailures)
+}
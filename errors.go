@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Errors that we encounter while processing requests belong to one of the
+// following classes.  The class determines the HTTP status code that we
+// respond with, the label that we use for the error in our Prometheus
+// metrics, and the fields that we log.  Use errors.Is to check if an error
+// belongs to a given class.
+var (
+	ErrValidation   = errors.New("validation")
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrForbidden    = errors.New("forbidden")
+	ErrRateLimited  = errors.New("rate_limited")
+	ErrTooLarge     = errors.New("too_large")
+	ErrGone         = errors.New("gone")
+	ErrOverloaded   = errors.New("overloaded")
+	ErrDownstream   = errors.New("downstream")
+	ErrCrypto       = errors.New("crypto")
+)
+
+// errInternal is the class of errors that don't belong to any of the above
+// classes.
+const errInternal = "internal"
+
+// errClasses maps each error class to its HTTP status code.
+var errClasses = []struct {
+	class  error
+	status int
+}{
+	{ErrValidation, http.StatusBadRequest},
+	{ErrUnauthorized, http.StatusUnauthorized},
+	{ErrForbidden, http.StatusForbidden},
+	{ErrRateLimited, http.StatusTooManyRequests},
+	{ErrTooLarge, http.StatusRequestEntityTooLarge},
+	{ErrGone, http.StatusGone},
+	{ErrOverloaded, http.StatusServiceUnavailable},
+	{ErrDownstream, http.StatusInternalServerError},
+	{ErrCrypto, http.StatusInternalServerError},
+}
+
+// classError assigns an error to one of our error classes.  Its message is
+// the message of the underlying error, so clients see the same error messages
+// as before.
+type classError struct {
+	class error
+	err   error
+}
+
+func (e *classError) Error() string {
+	return e.err.Error()
+}
+
+func (e *classError) Unwrap() error {
+	return e.err
+}
+
+func (e *classError) Is(target error) bool {
+	return target == e.class
+}
+
+// newError returns a new error of the given class with the given message.
+func newError(class error, msg string) error {
+	return &classError{class: class, err: errors.New(msg)}
+}
+
+// wrapError assigns the given error to the given class.
+func wrapError(class, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &classError{class: class, err: err}
+}
+
+// errClass returns the name of the given error's class.
+func errClass(err error) string {
+	for _, c := range errClasses {
+		if errors.Is(err, c.class) {
+			return c.class.Error()
+		}
+	}
+	return errInternal
+}
+
+// httpStatus returns the HTTP status code that we respond with for the given
+// error.
+func httpStatus(err error) int {
+	for _, c := range errClasses {
+		if errors.Is(err, c.class) {
+			return c.status
+		}
+	}
+	return http.StatusInternalServerError
+}
+
+// errFields returns the given error as log fields.
+func errFields(err error) string {
+	return fmt.Sprintf("class=%s err=%q", errClass(err), err)
+}
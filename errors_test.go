@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestErrClasses(t *testing.T) {
+	cases := []struct {
+		err    error
+		class  string
+		status int
+	}{
+		{errBadWalletFmt, "validation", http.StatusBadRequest},
+		{errBadSignature, "unauthorized", http.StatusUnauthorized},
+		{errUntrustedPeer, "forbidden", http.StatusForbidden},
+		{errRateLimited, "rate_limited", http.StatusTooManyRequests},
+		{errOverloaded, "overloaded", http.StatusServiceUnavailable},
+		{errNotProcessed, "downstream", http.StatusInternalServerError},
+		{errNoKey, "crypto", http.StatusInternalServerError},
+		{errors.New("foo"), errInternal, http.StatusInternalServerError},
+		// Wrapping an error must not change its class.
+		{fmt.Errorf("foo: %w", errBadCountry), "validation", http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		assertEqual(t, errClass(c.err), c.class)
+		assertEqual(t, httpStatus(c.err), c.status)
+	}
+}
+
+func TestWrapError(t *testing.T) {
+	assertEqual(t, wrapError(ErrDownstream, nil), nil)
+
+	inner := errors.New("broker unavailable")
+	err := wrapError(ErrDownstream, inner)
+	// The wrapped error keeps its message and identity.
+	assertEqual(t, err.Error(), inner.Error())
+	assertEqual(t, errors.Is(err, inner), true)
+	assertEqual(t, errors.Is(err, ErrDownstream), true)
+	assertEqual(t, errors.Is(err, ErrValidation), false)
+	assertEqual(t, errFields(err), `class=downstream err="broker unavailable"`)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// Our process exit codes tell our supervisor (and the wrappers around
+// nitro-cli) why we exited, so they can decide whether to restart us or to
+// page a human.
+const (
+	// exitDrained means that we shut down cleanly after a signal.
+	exitDrained = 0
+	// exitInternal is what log.Fatal uses, i.e., any reason that isn't
+	// covered by a more specific code.
+	exitInternal = 1
+	// exitConfig means that our configuration is invalid.  Restarting won't
+	// help.
+	exitConfig = 2
+	// exitCrypto means that we failed to initialize our cryptographic keys,
+	// e.g., because we ran out of randomness.
+	exitCrypto = 3
+	// exitListener means that we failed to listen on (or serve) one of our
+	// sockets, e.g., because the port is taken.
+	exitListener = 4
+	// exitWatchdog means that our watchdog killed us because we failed to
+	// shut down in time.  We should simply be restarted.
+	exitWatchdog = 5
+
+	// drainTimeout determines how long we give ourselves to shut down before
+	// our watchdog kills us.  It exceeds the time that the Web receiver
+	// waits for in-flight requests plus the time that our forwarders get for
+	// their final flush.
+	drainTimeout = shutdownTimeout + finalFlushTimeout + time.Second*10
+)
+
+// exit exits the process.  Tests replace it.
+var exit = os.Exit
+
+// fatalf logs the given message and exits with the given code.
+func fatalf(code int, format string, v ...any) {
+	_ = l.Output(2, fmt.Sprintf(format, v...))
+	exit(code)
+}
+
+// watchdog exits with exitWatchdog unless the returned function is called
+// within the given duration.  We use it to make sure that we don't hang while
+// shutting down.
+func watchdog(d time.Duration) func() {
+	t := time.AfterFunc(d, func() {
+		fatalf(exitWatchdog, "Failed to shut down within %s.  Giving up.", d)
+	})
+	return func() { t.Stop() }
+}
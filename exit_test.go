@@ -0,0 +1,25 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestWatchdog(t *testing.T) {
+	codes := make(chan int, 1)
+	exit = func(code int) { codes <- code }
+	defer func() { exit = os.Exit }()
+
+	// A watchdog that's stopped in time doesn't fire.
+	stop := watchdog(time.Hour)
+	stop()
+
+	_ = watchdog(time.Millisecond)
+	select {
+	case code := <-codes:
+		assertEqual(t, code, exitWatchdog)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Watchdog didn't fire.")
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdh"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// sink writes batches of tokens to some output, e.g., Kafka or stdout.  Our
+// flusher takes care of batching, metrics, and shutdown, so a new output only
+// needs to implement sink.  Sinks that need our configuration can implement
+// configurer, and sinks that depend on something that may not be available
+// can implement readinessChecker.
+type sink interface {
+	flush(ctx context.Context, batch []token) error
+	// String returns the sink's name, for our logs.
+	String() string
+}
+
+// rejectedError is returned by sinks that wrote a batch except for the tokens
+// that they rejected for good, e.g., because the tokens exceed the broker's
+// message size limit.  Retrying these tokens wouldn't help.
+type rejectedError struct {
+	// rejected contains the indices of the rejected tokens.
+	rejected []int
+	err      error
+}
+
+func (e *rejectedError) Error() string {
+	return fmt.Sprintf("sink rejected %d tokens: %v", len(e.rejected), e.err)
+}
+
+func (e *rejectedError) Unwrap() error {
+	return e.err
+}
+
+// flusher implements a forwarder that caches tokens and hands them to its sink
+// in batches.
+type flusher struct {
+	sync.RWMutex
+	wg         sync.WaitGroup
+	sink       sink
+	tokenCache *cache
+	// batched determines if we batch tokens according to our Kafka config.
+	// If not, we hand each token to the sink as soon as we get it.
+	batched bool
+	// format is the format in which we hand batches to the sink, and
+	// compression the algorithm that we compress them with.
+	format      string
+	compression string
+	// envelope determines if we wrap each record in an envelope, and
+	// anonymization is our tokenizer's name, for the envelope.
+	envelope      bool
+	anonymization string
+	// timestampPrecision is the precision of the envelope's flush time.
+	timestampPrecision time.Duration
+	// recipient is the public key that we encrypt payloads to, if any.
+	recipient *ecdh.PublicKey
+	// signer signs payloads, if set.
+	signer *flushSigner
+	// retryBuffer is the number of tokens that we keep buffered while we
+	// retry failed flushes.  0 disables retries.  We give up on batches
+	// after retention, unless it's 0.
+	retryBuffer int
+	retention   time.Duration
+	out         chan token
+	done        chan empty
+	// flushErr is the outcome of our most recent flush.
+	flushErr error
+	// memLimit caps what we hold in memory.
+	memLimit memoryLimit
+	// workers contains our workers, if we have more than one.  ordered
+	// determines if we guarantee per-wallet ordering, and isWorker is set
+	// if we are another flusher's worker.
+	workers  []*flusher
+	ordered  bool
+	isWorker bool
+
+	// The following fields are only used by our goroutine.  pending
+	// contains the batches that wait for a retry, oldest first.
+	pending        []*pendingBatch
+	pendingTokens  int
+	pendingBytes   int
+	cached         int
+	cachedBytes    int
+	spill          *spillQueue
+	failedRetries  int
+	retryScheduled bool
+	retryTimer     *time.Timer
+	minBackoff     time.Duration
+	maxBackoff     time.Duration
+	// stopTimeout is how long our final flush may take.  Once it's over,
+	// we cancel ctx, which our sink's flushes use.
+	stopTimeout time.Duration
+	ctx         context.Context
+	cancel      context.CancelFunc
+}
+
+func newFlusher(s sink, batched bool) *flusher {
+	f := &flusher{
+		sink:        s,
+		tokenCache:  newCache(),
+		batched:     batched,
+		out:         make(chan token),
+		done:        make(chan empty),
+		retryTimer:  time.NewTimer(maxRetryBackoff),
+		minBackoff:  minRetryBackoff,
+		maxBackoff:  maxRetryBackoff,
+		stopTimeout: finalFlushTimeout,
+	}
+	f.ctx, f.cancel = context.WithCancel(context.Background())
+	f.retryTimer.Stop()
+	return f
+}
+
+func (f *flusher) setConfig(c *config) {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.batched {
+		f.tokenCache.conf = c.kafkaConfig
+	} else {
+		// A batch of size and age 0 is flushed as soon as it has a token.
+		f.tokenCache.conf = &kafkaConfig{}
+	}
+	f.format = c.flushFormat
+	f.compression = c.flushCompression
+	f.envelope = c.flushEnvelope
+	f.anonymization = c.tokenizer
+	f.timestampPrecision = c.timestampPrecision
+	f.recipient = c.flushRecipient
+	f.signer = c.flushSigner
+	f.retryBuffer = c.flushRetryBuffer
+	f.retention = c.flushRetention
+	f.memLimit = memoryLimit{
+		records: c.flushMemoryRecords,
+		bytes:   c.flushMemoryBytes,
+		policy:  c.flushDropPolicy,
+	}
+	// Our workers share our sink, which we configure.
+	if s, ok := f.sink.(configurer); ok && !f.isWorker {
+		s.setConfig(c)
+	}
+	if c.flushWorkers > 1 && !f.isWorker {
+		if f.workers == nil {
+			f.newWorkers(c)
+		}
+		return
+	}
+	// Our sink's name may depend on its configuration.
+	if c.flushSpillDir != "" && f.spill == nil {
+		var err error
+		if f.spill, err = newSpillQueue(c.flushSpillDir, c.flushSpillMaxBytes, f.sink.String()); err != nil {
+			fatalf(exitCrypto, "Failed to create spill queue: %v", err)
+		}
+	}
+}
+
+func (f *flusher) outbox() chan token {
+	return f.out
+}
+
+func (f *flusher) start() {
+	if len(f.workers) > 0 {
+		f.startWorkers()
+		return
+	}
+	f.tokenCache.start()
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+		defer f.tokenCache.stop()
+		defer f.retryTimer.Stop()
+		for {
+			in := f.out
+			if f.blocked() {
+				in = nil
+			}
+			select {
+			case <-f.done:
+				// Don't lose the tokens that we haven't forwarded yet,
+				// and give our pending batches one last chance.
+				f.flush(f.drainCache())
+				if err := f.sendPending(); err != nil {
+					f.giveUpPending(err)
+				}
+				return
+			case token := <-in:
+				if !f.admit(token) {
+					continue
+				}
+				f.cached++
+				f.cachedBytes += len(token)
+				f.tokenCache.submit(token)
+				f.maybeFlush()
+			case <-f.retryTimer.C:
+				f.retry()
+			}
+		}
+	}()
+}
+
+// stop stops the forwarder after flushing the tokens that it still caches and
+// retrying its pending batches.  If our sink doesn't acknowledge them within
+// our stop timeout, we give up on them, so that a broken sink cannot keep us
+// from shutting down.
+func (f *flusher) stop() {
+	if len(f.workers) > 0 {
+		f.stopWorkers()
+		return
+	}
+	t := time.AfterFunc(f.stopTimeout, f.cancel)
+	defer t.Stop()
+	close(f.done)
+	f.wg.Wait()
+}
+
+// ready returns nil if our sink is ready and our most recent flush (if any)
+// succeeded.
+func (f *flusher) ready() error {
+	if s, ok := f.sink.(readinessChecker); ok {
+		if err := s.ready(); err != nil {
+			return err
+		}
+	}
+	if len(f.workers) > 0 {
+		return f.workersReady()
+	}
+	f.RLock()
+	defer f.RUnlock()
+
+	return wrapError(ErrDownstream, f.flushErr)
+}
+
+func (f *flusher) maybeFlush() {
+	elems, err := f.tokenCache.retrieve()
+	if err != nil {
+		return
+	}
+	f.cached, f.cachedBytes = 0, 0
+	f.flush(elems)
+}
+
+// drainCache returns all of our cached tokens, regardless of our cache's size
+// and age.
+func (f *flusher) drainCache() []any {
+	f.cached, f.cachedBytes = 0, 0
+	return f.tokenCache.drain()
+}
+
+// flush hands the given tokens to our sink.  If that fails, we keep the batch
+// for a retry.
+func (f *flusher) flush(elems []any) {
+	if len(elems) == 0 {
+		return
+	}
+	batch := make([]token, len(elems))
+	for i, e := range elems {
+		batch[i] = e.(token)
+	}
+
+	f.RLock()
+	format, compression, recipient, signer := f.format, f.compression, f.recipient, f.signer
+	var env *envelope
+	if f.envelope {
+		env = newEnvelope(f.anonymization, truncateTime(time.Now(), f.timestampPrecision))
+	}
+	f.RUnlock()
+	payload, records := encodeBatch(format, batch, env)
+	if records == 0 {
+		return
+	}
+	payload, ratio, err := compressBatch(compression, payload)
+	if err == nil {
+		payload, err = encryptBatch(recipient, payload)
+	}
+	if err == nil {
+		payload = signer.signBatch(payload)
+	}
+	if err != nil {
+		// Retrying wouldn't help if we cannot even prepare the batch.
+		f.setFlushErr(err)
+		f.giveUp(records, err)
+		return
+	}
+	if _, exists := compressors[compression]; exists {
+		m.compressionRatio.With(prometheus.Labels{sinkName: f.sink.String()}).Set(ratio)
+	}
+
+	b := newPendingBatch(payload, records)
+	if f.numPending() > 0 {
+		// Don't overtake the batches that wait for a retry.
+		f.enqueue(b)
+		return
+	}
+	if err := f.send(b); err != nil {
+		f.enqueue(b)
+	}
+}
+
+// send hands the given batch to our sink.  Our sink returns once it received
+// an acknowledgment, e.g., from all of Kafka's in-sync replicas.
+func (f *flusher) send(b *pendingBatch) error {
+	err := f.sink.flush(withBatchID(f.ctx, b.id), b.payload)
+	tokens := b.tokens
+	var rejected *rejectedError
+	if errors.As(err, &rejected) {
+		// The rest of the batch made it.  A payload token contains either
+		// one record or all of them.
+		n := len(rejected.rejected) * b.tokens / len(b.payload)
+		deadLetters.add(stageSink, n, rejected.err)
+		tokens -= n
+		err = nil
+	}
+	f.setFlushErr(err)
+	if err != nil {
+		err = wrapError(ErrDownstream, err)
+		countErr(err)
+		l.Printf("Failed to forward tokens to %s: %s", f.sink, errFields(err))
+		return err
+	}
+
+	l.Printf("Flushed %d tokens to %s.", tokens, f.sink)
+	m.numForwarded.With(prometheus.Labels{
+		outcome:  success,
+		sinkName: f.sink.String(),
+	}).Add(float64(tokens))
+	return nil
+}
+
+func (f *flusher) setFlushErr(err error) {
+	f.Lock()
+	defer f.Unlock()
+
+	f.flushErr = err
+}
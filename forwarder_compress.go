@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// compressNone makes the flusher hand payloads to its sink uncompressed.
+	compressNone = "none"
+	// compressGzip and compressZstd make the flusher compress each payload
+	// with gzip and zstd, respectively.
+	compressGzip = "gzip"
+	compressZstd = "zstd"
+)
+
+// compressors maps compression algorithms (other than none) to the functions
+// that compress a payload with the algorithm.
+var compressors = map[string]func([]byte) ([]byte, error){
+	compressGzip: gzipCompress,
+	compressZstd: zstdCompress,
+}
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdErr     error
+)
+
+// parseCompression returns an error if the given compression algorithm is
+// unsupported.
+func parseCompression(algo string) error {
+	if _, exists := compressors[algo]; algo != compressNone && !exists {
+		return fmt.Errorf("unsupported flush compression %q", algo)
+	}
+	return nil
+}
+
+func gzipCompress(payload []byte) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	zw := gzip.NewWriter(buf)
+	if _, err := zw.Write(payload); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// zstdCompress compresses the given payload with an encoder that we share
+// across flushes.  The encoder is safe for concurrent use.
+func zstdCompress(payload []byte) ([]byte, error) {
+	zstdOnce.Do(func() {
+		zstdEncoder, zstdErr = zstd.NewWriter(nil)
+	})
+	if zstdErr != nil {
+		return nil, zstdErr
+	}
+	return zstdEncoder.EncodeAll(payload, nil), nil
+}
+
+// compressBatch compresses each token of the given batch with the given
+// algorithm.  It returns the compressed batch and its compression ratio, i.e.,
+// the batch's uncompressed size divided by its compressed size.  Without
+// compression, the ratio is 1.
+func compressBatch(algo string, batch []token) ([]token, float64, error) {
+	compress, exists := compressors[algo]
+	if !exists {
+		return batch, 1, nil
+	}
+	var rawBytes, compressedBytes int
+	compressed := make([]token, len(batch))
+	for i, t := range batch {
+		c, err := compress(t)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to compress batch: %w", err)
+		}
+		rawBytes += len(t)
+		compressedBytes += len(c)
+		compressed[i] = c
+	}
+	if compressedBytes == 0 {
+		return compressed, 1, nil
+	}
+	return compressed, float64(rawBytes) / float64(compressedBytes), nil
+}
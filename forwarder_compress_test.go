@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestParseCompression(t *testing.T) {
+	for _, algo := range []string{compressNone, compressGzip, compressZstd} {
+		if err := parseCompression(algo); err != nil {
+			t.Errorf("Got unexpected error for %q: %v", algo, err)
+		}
+	}
+	if err := parseCompression("lz4"); err == nil {
+		t.Error("Expected error but got none.")
+	}
+	if _, _, err := parseFlags("tkzr", []string{"-flush-compression", "foo"}); err == nil {
+		t.Error("Expected error but got none.")
+	}
+}
+
+func TestCompressBatch(t *testing.T) {
+	payload := bytes.Repeat([]byte("foobar"), 100)
+	batch := []token{payload, payload}
+
+	decompress := map[string]func([]byte) ([]byte, error){
+		compressGzip: func(b []byte) ([]byte, error) {
+			zr, err := gzip.NewReader(bytes.NewReader(b))
+			if err != nil {
+				return nil, err
+			}
+			return io.ReadAll(zr)
+		},
+		compressZstd: func(b []byte) ([]byte, error) {
+			zr, err := zstd.NewReader(nil)
+			if err != nil {
+				return nil, err
+			}
+			defer zr.Close()
+			return zr.DecodeAll(b, nil)
+		},
+	}
+	for algo, decompress := range decompress {
+		compressed, ratio, err := compressBatch(algo, batch)
+		if err != nil {
+			t.Fatalf("Failed to compress batch with %s: %v", algo, err)
+		}
+		assertEqual(t, len(compressed), 2)
+		assertEqual(t, ratio > 1, true)
+		for _, c := range compressed {
+			d, err := decompress(c)
+			if err != nil {
+				t.Fatalf("Failed to decompress %s payload: %v", algo, err)
+			}
+			assertEqual(t, bytes.Equal(d, payload), true)
+		}
+	}
+
+	// Without compression, the batch is left untouched.
+	uncompressed, ratio, err := compressBatch(compressNone, batch)
+	if err != nil {
+		t.Fatalf("Failed to compress batch: %v", err)
+	}
+	assertEqual(t, &uncompressed[0][0], &batch[0][0])
+	assertEqual(t, ratio, 1.0)
+}
+
+func TestFlusherCompression(t *testing.T) {
+	s := &mockSink{}
+	f := newFlusher(s, false)
+	f.setConfig(&config{flushFormat: formatAvro, flushCompression: compressZstd})
+	payload := token(bytes.Repeat([]byte("foobar"), 100))
+	f.flush([]any{payload})
+	assertEqual(t, s.numBatches(), 1)
+	assertEqual(t, len(s.batches[0][0]) < len(payload), true)
+
+	ratio := testutil.ToFloat64(m.compressionRatio.With(prometheus.Labels{sinkName: s.String()}))
+	assertEqual(t, ratio > 1, true)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+)
+
+// We encrypt payloads with HPKE (RFC 9180) in base mode, using the suite
+// DHKEM(X25519, HKDF-SHA256), HKDF-SHA256, and AES-128-GCM.  Go's standard
+// library only gained HPKE in Go 1.26, so we implement the little that we
+// need ourselves.  Our ciphertexts are the encapsulated key followed by the
+// sealed payload, like those of the single-shot Seal in Go's crypto/hpke.
+const (
+	hpkeKemID  = 0x0020
+	hpkeKdfID  = 0x0001
+	hpkeAeadID = 0x0001
+	// hpkeInfo binds our ciphertexts to their purpose.  Consumers must pass
+	// the same info when decrypting.
+	hpkeInfo = "brave tokenizer flush v1"
+
+	hpkeModeBase  = 0x00
+	hpkeKeySize   = 16
+	hpkeNonceSize = 12
+)
+
+// The suite IDs that HPKE's key derivation uses for the KEM, and for the
+// key schedule.
+var (
+	kemSuiteID  = binary.BigEndian.AppendUint16([]byte("KEM"), hpkeKemID)
+	hpkeSuiteID = binary.BigEndian.AppendUint16(binary.BigEndian.AppendUint16(
+		binary.BigEndian.AppendUint16([]byte("HPKE"), hpkeKemID), hpkeKdfID), hpkeAeadID)
+)
+
+// parseRecipient parses the given base64-encoded X25519 public key.  An empty
+// key means that we don't encrypt.
+func parseRecipient(s string) (*ecdh.PublicKey, error) {
+	if s == "" {
+		return nil, nil
+	}
+	raw, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("recipient key is not base64-encoded: %w", err)
+	}
+	pub, err := ecdh.X25519().NewPublicKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("recipient key is not an X25519 public key: %w", err)
+	}
+	return pub, nil
+}
+
+// hkdfExtract and hkdfExpand implement HKDF-SHA256 (RFC 5869).
+func hkdfExtract(salt, ikm []byte) []byte {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(ikm)
+	return mac.Sum(nil)
+}
+
+func hkdfExpand(prk, info []byte, length int) []byte {
+	var out, block []byte
+	for i := byte(1); len(out) < length; i++ {
+		mac := hmac.New(sha256.New, prk)
+		mac.Write(block)
+		mac.Write(info)
+		mac.Write([]byte{i})
+		block = mac.Sum(nil)
+		out = append(out, block...)
+	}
+	return out[:length]
+}
+
+// labeledExtract and labeledExpand implement HPKE's labeled key derivation
+// for the given suite ID.
+func labeledExtract(suiteID, salt []byte, label string, ikm []byte) []byte {
+	labeled := append([]byte("HPKE-v1"), suiteID...)
+	labeled = append(labeled, label...)
+	return hkdfExtract(salt, append(labeled, ikm...))
+}
+
+func labeledExpand(suiteID, prk []byte, label string, info []byte, length int) []byte {
+	labeled := binary.BigEndian.AppendUint16(nil, uint16(length))
+	labeled = append(labeled, "HPKE-v1"...)
+	labeled = append(labeled, suiteID...)
+	labeled = append(labeled, label...)
+	return hkdfExpand(prk, append(labeled, info...), length)
+}
+
+// hpkeKeySchedule derives the key and base nonce of base mode from the given
+// KEM shared secret.
+func hpkeKeySchedule(sharedSecret []byte, info string) ([]byte, []byte) {
+	context := []byte{hpkeModeBase}
+	context = append(context, labeledExtract(hpkeSuiteID, nil, "psk_id_hash", nil)...)
+	context = append(context, labeledExtract(hpkeSuiteID, nil, "info_hash", []byte(info))...)
+	secret := labeledExtract(hpkeSuiteID, sharedSecret, "secret", nil)
+	key := labeledExpand(hpkeSuiteID, secret, "key", context, hpkeKeySize)
+	nonce := labeledExpand(hpkeSuiteID, secret, "base_nonce", context, hpkeNonceSize)
+	return key, nonce
+}
+
+// hpkeContext returns the AEAD and nonce of base mode for the given KEM shared
+// secret.  As we seal a single message per context, its sequence number is 0
+// and the nonce is the base nonce.
+func hpkeContext(sharedSecret []byte, info string) (cipher.AEAD, []byte, error) {
+	key, nonce := hpkeKeySchedule(sharedSecret, info)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	return aead, nonce, nil
+}
+
+// kemSharedSecret derives DHKEM's shared secret from the given Diffie-Hellman
+// output, the encapsulated key, and the recipient's public key.
+func kemSharedSecret(dh, enc []byte, recipient *ecdh.PublicKey) []byte {
+	kemContext := append(append([]byte{}, enc...), recipient.Bytes()...)
+	prk := labeledExtract(kemSuiteID, nil, "eae_prk", dh)
+	return labeledExpand(kemSuiteID, prk, "shared_secret", kemContext, sha256.Size)
+}
+
+// hpkeSeal encrypts the given plaintext to the given recipient, and returns the
+// encapsulated key followed by the ciphertext.
+func hpkeSeal(recipient *ecdh.PublicKey, info string, plaintext []byte) ([]byte, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return hpkeSealWith(ephemeral, recipient, info, plaintext)
+}
+
+// hpkeSealWith is like hpkeSeal but takes the ephemeral key, so that we can
+// test against known answers.
+func hpkeSealWith(ephemeral *ecdh.PrivateKey, recipient *ecdh.PublicKey, info string, plaintext []byte) ([]byte, error) {
+	dh, err := ephemeral.ECDH(recipient)
+	if err != nil {
+		return nil, err
+	}
+	enc := ephemeral.PublicKey().Bytes()
+	aead, nonce, err := hpkeContext(kemSharedSecret(dh, enc, recipient), info)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(enc, nonce, plaintext, nil), nil
+}
+
+// encryptBatch encrypts each token of the given batch to the given recipient.
+// If the recipient is nil, the batch is left untouched.
+func encryptBatch(recipient *ecdh.PublicKey, batch []token) ([]token, error) {
+	if recipient == nil {
+		return batch, nil
+	}
+	encrypted := make([]token, len(batch))
+	for i, t := range batch {
+		c, err := hpkeSeal(recipient, hpkeInfo, t)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encrypt batch: %w", err)
+		}
+		encrypted[i] = c
+	}
+	return encrypted, nil
+}
@@ -0,0 +1,48 @@
+//go:build go1.26
+
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/hpke"
+	"crypto/rand"
+	"testing"
+)
+
+// TestHPKEInterop makes sure that consumers can decrypt our payloads with Go's
+// crypto/hpke, and that we can decrypt its payloads.
+func TestHPKEInterop(t *testing.T) {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	hpkePriv, err := hpke.NewDHKEMPrivateKey(priv)
+	if err != nil {
+		t.Fatalf("Failed to create HPKE private key: %v", err)
+	}
+	hpkePub, err := hpke.NewDHKEMPublicKey(priv.PublicKey())
+	if err != nil {
+		t.Fatalf("Failed to create HPKE public key: %v", err)
+	}
+	plaintext := []byte("foobar")
+
+	ciphertext, err := hpkeSeal(priv.PublicKey(), hpkeInfo, plaintext)
+	if err != nil {
+		t.Fatalf("Failed to seal: %v", err)
+	}
+	opened, err := hpke.Open(hpkePriv, hpke.HKDFSHA256(), hpke.AES128GCM(), []byte(hpkeInfo), ciphertext)
+	if err != nil {
+		t.Fatalf("Failed to open with crypto/hpke: %v", err)
+	}
+	assertEqual(t, string(opened), string(plaintext))
+
+	ciphertext, err = hpke.Seal(hpkePub, hpke.HKDFSHA256(), hpke.AES128GCM(), []byte(hpkeInfo), plaintext)
+	if err != nil {
+		t.Fatalf("Failed to seal with crypto/hpke: %v", err)
+	}
+	opened, err = hpkeOpen(priv, hpkeInfo, ciphertext)
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	assertEqual(t, string(opened), string(plaintext))
+}
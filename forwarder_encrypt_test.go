@@ -0,0 +1,194 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+// hpkeOpen decrypts the given ciphertext, which hpkeSeal encrypted to the
+// given private key's public key.
+func hpkeOpen(priv *ecdh.PrivateKey, info string, ciphertext []byte) ([]byte, error) {
+	encSize := len(priv.PublicKey().Bytes())
+	if len(ciphertext) < encSize {
+		return nil, errors.New("ciphertext is too short")
+	}
+	enc, sealed := ciphertext[:encSize], ciphertext[encSize:]
+	ephemeral, err := ecdh.X25519().NewPublicKey(enc)
+	if err != nil {
+		return nil, err
+	}
+	dh, err := priv.ECDH(ephemeral)
+	if err != nil {
+		return nil, err
+	}
+	aead, nonce, err := hpkeContext(kemSharedSecret(dh, enc, priv.PublicKey()), info)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, nonce, sealed, nil)
+}
+
+func newRecipient(t *testing.T) *ecdh.PrivateKey {
+	t.Helper()
+
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	return priv
+}
+
+func TestParseRecipient(t *testing.T) {
+	priv := newRecipient(t)
+	pub, err := parseRecipient(base64.StdEncoding.EncodeToString(priv.PublicKey().Bytes()))
+	if err != nil {
+		t.Fatalf("Failed to parse recipient: %v", err)
+	}
+	assertEqual(t, pub.Equal(priv.PublicKey()), true)
+
+	pub, err = parseRecipient("")
+	assertEqual(t, err, nil)
+	assertEqual(t, pub, (*ecdh.PublicKey)(nil))
+	for _, bad := range []string{"foo!", base64.StdEncoding.EncodeToString([]byte("foo"))} {
+		if _, err := parseRecipient(bad); err == nil {
+			t.Errorf("Expected error for %q but got none.", bad)
+		}
+	}
+}
+
+func TestHkdf(t *testing.T) {
+	// Test case 1 of RFC 5869, Appendix A.
+	ikm := make([]byte, 22)
+	for i := range ikm {
+		ikm[i] = 0x0b
+	}
+	salt := []byte{0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c}
+	info := []byte{0xf0, 0xf1, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8, 0xf9}
+	prk := hkdfExtract(salt, ikm)
+	assertEqual(t, hex.EncodeToString(prk), "077709362c2e32df0ddc3f0dc47bba6390b6c73bb50f9c3122ec844ad7c2b3e5")
+	okm := hkdfExpand(prk, info, 42)
+	assertEqual(t, hex.EncodeToString(okm),
+		"3cb25f25faacd57a90434f64d0362f2a2d2d0a90cf1a5a4c5db02d56ecc4c5bf34007208d5b887185865")
+}
+
+func TestHPKEKnownAnswer(t *testing.T) {
+	// Base mode test vector of RFC 9180, Appendix A.1.1, for
+	// DHKEM(X25519, HKDF-SHA256), HKDF-SHA256, and AES-128-GCM.
+	unhex := func(s string) []byte {
+		t.Helper()
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			t.Fatalf("Failed to decode hex: %v", err)
+		}
+		return b
+	}
+	info := string(unhex("4f6465206f6e2061204772656369616e2055726e"))
+	skE, err := ecdh.X25519().NewPrivateKey(unhex("52c4a758a802cd8b936eceea314432798d5baf2d7e9235dc084ab1b9cfa2f736"))
+	if err != nil {
+		t.Fatalf("Failed to parse ephemeral key: %v", err)
+	}
+	skR, err := ecdh.X25519().NewPrivateKey(unhex("4612c550263fc8ad58375df3f557aac531d26850903e55a9f23f21d8534e8ac8"))
+	if err != nil {
+		t.Fatalf("Failed to parse recipient key: %v", err)
+	}
+	enc := unhex("37fda3567bdbd628e88668c3c8d7e97d1d1253b6d4ea6d44c150f741f1bf4431")
+	assertEqual(t, hex.EncodeToString(skR.PublicKey().Bytes()),
+		"3948cfe0ad1ddb695d780e59077195da6c56506b027329794ab02bca80815c4d")
+	assertEqual(t, hex.EncodeToString(skE.PublicKey().Bytes()), hex.EncodeToString(enc))
+
+	// Encapsulation.
+	dh, err := skE.ECDH(skR.PublicKey())
+	if err != nil {
+		t.Fatalf("Failed to compute DH: %v", err)
+	}
+	sharedSecret := kemSharedSecret(dh, enc, skR.PublicKey())
+	assertEqual(t, hex.EncodeToString(sharedSecret),
+		"fe0e18c9f024ce43799ae393c7e8fe8fce9d218875e8227b0187c04e7d2ea1fc")
+
+	// Key schedule.
+	key, nonce := hpkeKeySchedule(sharedSecret, info)
+	assertEqual(t, hex.EncodeToString(key), "4531685d41d65f03dc48f6b8302c05b0")
+	assertEqual(t, hex.EncodeToString(nonce), "56d890e5accaaf011cff4b7d")
+	aead, _, err := hpkeContext(sharedSecret, info)
+	if err != nil {
+		t.Fatalf("Failed to create context: %v", err)
+	}
+	pt := unhex("4265617574792069732074727574682c20747275746820626561757479")
+	ct := aead.Seal(nil, nonce, pt, unhex("436f756e742d30"))
+	assertEqual(t, hex.EncodeToString(ct),
+		"f938558b5d72f1a23810b4be2ab4f84331acc02fc97babc53a52ae8218a355a96d8770ac83d07bea87e13c512a")
+
+	// Our single-shot seal is the encapsulated key followed by the
+	// plaintext, sealed without additional data.
+	sealed, err := hpkeSealWith(skE, skR.PublicKey(), info, pt)
+	if err != nil {
+		t.Fatalf("Failed to seal: %v", err)
+	}
+	assertEqual(t, hex.EncodeToString(sealed[:len(enc)]), hex.EncodeToString(enc))
+	opened, err := aead.Open(nil, nonce, sealed[len(enc):], nil)
+	if err != nil {
+		t.Fatalf("Failed to open with known key: %v", err)
+	}
+	assertEqual(t, string(opened), string(pt))
+}
+
+func TestEncryptBatch(t *testing.T) {
+	priv := newRecipient(t)
+	batch := []token{token("foo"), token("bar")}
+
+	encrypted, err := encryptBatch(priv.PublicKey(), batch)
+	if err != nil {
+		t.Fatalf("Failed to encrypt batch: %v", err)
+	}
+	assertEqual(t, len(encrypted), 2)
+	for i, c := range encrypted {
+		plaintext, err := hpkeOpen(priv, hpkeInfo, c)
+		if err != nil {
+			t.Fatalf("Failed to decrypt token: %v", err)
+		}
+		assertEqual(t, string(plaintext), string(batch[i]))
+	}
+	// Each token is encrypted with a fresh ephemeral key.
+	again, _ := encryptBatch(priv.PublicKey(), batch)
+	assertEqual(t, string(again[0]) != string(encrypted[0]), true)
+
+	// Other recipients and other infos can't decrypt.
+	if _, err := hpkeOpen(newRecipient(t), hpkeInfo, encrypted[0]); err == nil {
+		t.Error("Expected error for the wrong key but got none.")
+	}
+	if _, err := hpkeOpen(priv, "foo", encrypted[0]); err == nil {
+		t.Error("Expected error for the wrong info but got none.")
+	}
+
+	// Without a recipient, the batch is left untouched.
+	plain, err := encryptBatch(nil, batch)
+	assertEqual(t, err, nil)
+	assertEqual(t, &plain[0][0], &batch[0][0])
+}
+
+func TestFlusherEncryption(t *testing.T) {
+	priv := newRecipient(t)
+	rawPub := base64.StdEncoding.EncodeToString(priv.PublicKey().Bytes())
+	_, c, err := parseFlags("tkzr", []string{"-flush-recipient", rawPub})
+	if err != nil {
+		t.Fatalf("Failed to parse flags: %v", err)
+	}
+	if _, _, err := parseFlags("tkzr", []string{"-flush-recipient", "foo"}); err == nil {
+		t.Error("Expected error but got none.")
+	}
+
+	s := &mockSink{}
+	f := newFlusher(s, false)
+	f.setConfig(c)
+	f.flush([]any{token("foo")})
+	assertEqual(t, s.numBatches(), 1)
+	plaintext, err := hpkeOpen(priv, hpkeInfo, s.batches[0][0])
+	if err != nil {
+		t.Fatalf("Failed to decrypt token: %v", err)
+	}
+	assertEqual(t, string(plaintext), "foo")
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"time"
+
+	uuid "github.com/google/uuid"
+	"github.com/linkedin/goavro/v2"
+)
+
+// envelopeSchemaVersion is the version of our records' schema, including the
+// layout of their justification.  Bump it whenever the records change in a
+// way that consumers must know about.
+const envelopeSchemaVersion = 1
+
+// instanceID identifies this tokenizer process, so that consumers can tell
+// apart the records of several enclaves, and of restarts.
+var instanceID = uuid.New()
+
+// The Avro codec of the envelopes that wrap our Avro-encoded records.  The
+// record field contains the original record, encoded with ourCodec.
+var envelopeCodec = func() *goavro.Codec {
+	codec, err := goavro.NewCodec(`{
+	"type": "record",
+	"name": "Envelope",
+	"fields": [
+		{ "name": "schema_version", "type": "int" },
+		{ "name": "instance_id", "type": "string" },
+		{ "name": "anonymization", "type": "string" },
+		{ "name": "key_epoch", "type": "string" },
+		{ "name": "flushed_at", "type": "string" },
+		{ "name": "record", "type": "bytes" }
+	]}`)
+	if err != nil {
+		l.Fatalf("Failed to create Avro codec: %v", err)
+	}
+	return codec
+}()
+
+// envelope contains the metadata that consumers need to handle schema
+// evolution and key rotations.  The key epoch is the ID of the key that
+// anonymized the record's addresses, and empty for commit records.
+type envelope struct {
+	SchemaVersion int    `json:"schema_version"`
+	InstanceID    string `json:"instance_id"`
+	Anonymization string `json:"anonymization"`
+	KeyEpoch      string `json:"key_epoch,omitempty"`
+	FlushedAt     string `json:"flushed_at"`
+}
+
+// newEnvelope returns the envelope of a flush at the given time, by the given
+// tokenizer.  Its key epoch is left to each record.
+func newEnvelope(anonymization string, flushedAt time.Time) *envelope {
+	return &envelope{
+		SchemaVersion: envelopeSchemaVersion,
+		InstanceID:    instanceID.String(),
+		Anonymization: anonymization,
+		FlushedAt:     flushedAt.UTC().Format(time.RFC3339),
+	}
+}
+
+// forRecord returns a copy of the envelope for the given record.
+func (e *envelope) forRecord(r *flatRecord) *envelope {
+	c := *e
+	c.KeyEpoch = r.KeyID
+	return &c
+}
+
+// wrap returns the given Avro-encoded record, wrapped in an Avro-encoded
+// envelope.
+func (e *envelope) wrap(t token, r *flatRecord) (token, error) {
+	c := e.forRecord(r)
+	return envelopeCodec.BinaryFromNative(nil, map[string]interface{}{
+		"schema_version": int32(c.SchemaVersion),
+		"instance_id":    c.InstanceID,
+		"anonymization":  c.Anonymization,
+		"key_epoch":      c.KeyEpoch,
+		"flushed_at":     c.FlushedAt,
+		"record":         []byte(t),
+	})
+}
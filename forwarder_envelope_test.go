@@ -0,0 +1,106 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	uuid "github.com/google/uuid"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// newEnvelopeTestRecords returns an address record of the given key ID and a
+// commit record.
+func newEnvelopeTestRecords(t *testing.T, kID keyID) []token {
+	window := newV4(t)
+	msg, err := compileKafkaMsg(kID, newV4(t), AddressSet{"1.1.1.1": empty{}}, nil, time.Now(), window)
+	if err != nil {
+		t.Fatalf("Failed to compile Kafka message: %v", err)
+	}
+	commit := newWindowCommit(window)
+	commit.add(msg)
+	commitMsg, err := commit.compile(time.Now())
+	if err != nil {
+		t.Fatalf("Failed to compile commit record: %v", err)
+	}
+	return []token{msg, commitMsg}
+}
+
+func TestAvroEnvelope(t *testing.T) {
+	kID := keyID{UUID: newV4(t)}
+	records := newEnvelopeTestRecords(t, kID)
+	flushedAt := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	env := newEnvelope("cryptopan", flushedAt)
+
+	batch, n := encodeBatch(formatAvro, records, env)
+	assertEqual(t, n, 2)
+	assertEqual(t, len(batch), 2)
+	for i, wrapped := range batch {
+		native, rest, err := envelopeCodec.NativeFromBinary(wrapped)
+		if err != nil {
+			t.Fatalf("Failed to decode envelope: %v", err)
+		}
+		assertEqual(t, len(rest), 0)
+		e := native.(map[string]interface{})
+		assertEqual(t, e["schema_version"], any(int32(envelopeSchemaVersion)))
+		assertEqual(t, e["instance_id"], any(instanceID.String()))
+		assertEqual(t, e["anonymization"], any("cryptopan"))
+		assertEqual(t, e["flushed_at"], any("2024-01-01T00:00:00Z"))
+		// The envelope contains the original record.
+		assertEqual(t, string(e["record"].([]byte)), string(records[i]))
+		// Commit records belong to no key epoch.
+		if i == 0 {
+			assertEqual(t, e["key_epoch"], any(kID.String()))
+		} else {
+			assertEqual(t, e["key_epoch"], any(""))
+		}
+	}
+	// Without an envelope, Avro batches are left untouched.
+	batch, n = encodeBatch(formatAvro, records, nil)
+	assertEqual(t, n, 2)
+	assertEqual(t, &batch[0][0], &records[0][0])
+}
+
+func TestBatchEnvelope(t *testing.T) {
+	kID := keyID{UUID: newV4(t)}
+	records := newEnvelopeTestRecords(t, kID)
+	env := newEnvelope("hmac", time.Now())
+
+	batch, n := encodeBatch(formatProtobuf, records, env)
+	assertEqual(t, n, 2)
+	msgs := decodeProtobufBatch(t, batch[0])
+	assertEqual(t, len(msgs[0][pbEnvelope]), 1)
+	e := decodeProtobufBatch(t, protowire.AppendBytes(nil, msgs[0][pbEnvelope][0].([]byte)))[0]
+	assertEqual(t, e[pbSchemaVersion][0], uint64(envelopeSchemaVersion))
+	assertEqual(t, string(e[pbInstanceID][0].([]byte)), instanceID.String())
+	assertEqual(t, string(e[pbAnonymization][0].([]byte)), "hmac")
+	assertEqual(t, string(e[pbKeyEpoch][0].([]byte)), kID.String())
+	assertEqual(t, len(e[pbFlushedAt]), 1)
+
+	batch, n = encodeBatch(formatMsgpack, records, env)
+	assertEqual(t, n, 2)
+	decoded, _ := decodeMsgpack(t, batch[0])
+	for i, r := range decoded.([]any) {
+		m := r.(map[any]any)["envelope"].(map[any]any)
+		assertEqual(t, m["schema_version"], any(int64(envelopeSchemaVersion)))
+		assertEqual(t, m["anonymization"], any("hmac"))
+		_, hasKeyEpoch := m["key_epoch"]
+		assertEqual(t, hasKeyEpoch, i == 0)
+	}
+}
+
+func TestFlusherEnvelope(t *testing.T) {
+	s := &mockSink{}
+	f := newFlusher(s, false)
+	f.setConfig(&config{flushFormat: formatAvro, flushEnvelope: true, tokenizer: tokenizerHmac})
+	f.flush([]any{newEnvelopeTestRecords(t, keyID{UUID: uuid.New()})[0]})
+	assertEqual(t, s.numBatches(), 1)
+	native, _, err := envelopeCodec.NativeFromBinary(s.batches[0][0])
+	if err != nil {
+		t.Fatalf("Failed to decode envelope: %v", err)
+	}
+	assertEqual(t, native.(map[string]interface{})["anonymization"], any(tokenizerHmac))
+
+	if _, _, err := parseFlags("tkzr", []string{"-flush-envelope"}); err == nil {
+		t.Error("Expected error for the simple aggregator but got none.")
+	}
+}
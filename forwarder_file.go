@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+)
+
+// fileSink implements a sink that writes one JSON record per line (ndjson) to
+// stdout or to a file.  Avro-encoded tokens, e.g., the address aggregator's
+// records, are decoded; other tokens are written as {"token": <base64>}.  It
+// lets developers exercise the entire pipeline locally.
+type fileSink struct {
+	sync.Mutex
+	path string
+	w    io.Writer
+	f    *os.File
+}
+
+func newFileForwarder() forwarder {
+	return newFlusher(&fileSink{w: os.Stdout}, false)
+}
+
+// setConfig opens our output file, if we're configured to write to one.
+func (s *fileSink) setConfig(c *config) {
+	s.Lock()
+	defer s.Unlock()
+
+	if c.outputFile == "" || c.outputFile == s.path {
+		return
+	}
+	f, err := os.OpenFile(c.outputFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		fatalf(exitConfig, "Failed to open output file: %v", err)
+	}
+	if s.f != nil {
+		s.f.Close()
+	}
+	s.path, s.w, s.f = c.outputFile, f, f
+}
+
+func (s *fileSink) flush(ctx context.Context, batch []token) error {
+	s.Lock()
+	defer s.Unlock()
+
+	w := bufio.NewWriter(s.w)
+	enc := json.NewEncoder(w)
+	for _, t := range batch {
+		var record any = struct {
+			Token []byte `json:"token"`
+		}{t}
+		if native, rest, err := ourCodec.NativeFromBinary(t); err == nil && len(rest) == 0 {
+			record = native
+		}
+		if err := enc.Encode(record); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+func (s *fileSink) String() string {
+	if s.path == "" {
+		return "stdout (ndjson)"
+	}
+	return s.path
+}
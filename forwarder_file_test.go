@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileSink(t *testing.T) {
+	msg, err := avroEncode(ourCodec, []byte(`{"wallet_id":"foo","service":"bar","signal":"baz",`+
+		`"score":0,"justification":"{}","created_at":"2022-01-01T00:00:00Z"}`))
+	if err != nil {
+		t.Fatalf("Failed to encode our JSON to Avro: %v", err)
+	}
+	buf := new(bytes.Buffer)
+	s := &fileSink{w: buf}
+	if err := s.flush(context.Background(), []token{msg, token("\x00\x01")}); err != nil {
+		t.Fatalf("Failed to flush tokens: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assertEqual(t, len(lines), 2)
+	record := make(map[string]any)
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatalf("Failed to unmarshal record: %v", err)
+	}
+	assertEqual(t, record["wallet_id"], "foo")
+	assertEqual(t, lines[1], `{"token":"AAE="}`)
+}
+
+func TestFileSinkOutputFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.ndjson")
+	s := &fileSink{w: os.Stdout}
+	s.setConfig(&config{outputFile: path})
+	assertEqual(t, s.String(), path)
+
+	for i := 0; i < 2; i++ {
+		if err := s.flush(context.Background(), []token{token("\x00")}); err != nil {
+			t.Fatalf("Failed to flush tokens: %v", err)
+		}
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read output file: %v", err)
+	}
+	assertEqual(t, string(content), "{\"token\":\"AA==\"}\n{\"token\":\"AA==\"}\n")
+}
+
+func TestParseLocal(t *testing.T) {
+	comp, _, err := parseFlags("tkzr", []string{"-local"})
+	if err != nil {
+		t.Fatalf("Got unexpected error: %v", err)
+	}
+	if _, ok := comp.r.(*multiReceiver).receivers[0].(*webReceiver); !ok {
+		t.Errorf("Expected Web receiver but got %T.", comp.r.(*multiReceiver).receivers[0])
+	}
+	if _, ok := comp.a.(*addrAggregator); !ok {
+		t.Errorf("Expected address aggregator but got %T.", comp.a)
+	}
+	if _, ok := comp.f.(*flusher).sink.(*fileSink); !ok {
+		t.Errorf("Expected file forwarder but got %s.", comp.f.(*flusher).sink)
+	}
+
+	// Explicitly set flags take precedence.
+	comp, _, err = parseFlags("tkzr", []string{"-local", "-forwarder", "null"})
+	if err != nil {
+		t.Fatalf("Got unexpected error: %v", err)
+	}
+	if _, ok := comp.f.(*flusher).sink.(nullSink); !ok {
+		t.Errorf("Expected null forwarder but got %s.", comp.f.(*flusher).sink)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+const (
+	// formatAvro makes the flusher hand our Avro-encoded records to its
+	// sink as they are, one token per record.
+	formatAvro = "avro"
+	// formatProtobuf makes the flusher encode each batch as length-delimited
+	// protobuf messages.
+	formatProtobuf = "protobuf"
+	// formatMsgpack makes the flusher encode each batch as a MessagePack
+	// array of records.
+	formatMsgpack = "msgpack"
+)
+
+var errNotARecord = errors.New("token is not an address or commit record")
+
+// batchEncoders maps batch formats (other than Avro) to the functions that
+// encode a batch of Avro-encoded records in the format.
+var batchEncoders = map[string]func([]*flatRecord) ([]byte, error){
+	formatProtobuf: encodeProtobufBatch,
+	formatMsgpack:  encodeMsgpackBatch,
+}
+
+// parseFlushFormat returns an error if the given batch format is unsupported.
+func parseFlushFormat(format string) error {
+	if _, exists := batchEncoders[format]; format != formatAvro && !exists {
+		return fmt.Errorf("unsupported flush format %q", format)
+	}
+	return nil
+}
+
+// flatRecord is an address or commit record whose justification is decoded
+// into fields of its own, for formats that are meant to be strongly typed.
+type flatRecord struct {
+	WalletID    string         `json:"wallet_id"`
+	Service     string         `json:"service"`
+	Signal      string         `json:"signal"`
+	Score       int32          `json:"score"`
+	KeyID       string         `json:"keyid,omitempty"`
+	Addrs       []string       `json:"addrs,omitempty"`
+	Requests    int            `json:"requests,omitempty"`
+	AddrCounts  map[string]int `json:"addr_counts,omitempty"`
+	Countries   []string       `json:"countries,omitempty"`
+	ConfTypes   []string       `json:"conf_types,omitempty"`
+	ApiVersions map[int]int    `json:"api_versions,omitempty"`
+	RequestIDs  []string       `json:"request_ids,omitempty"`
+	Window      string         `json:"window,omitempty"`
+	Records     int            `json:"records,omitempty"`
+	Checksum    string         `json:"checksum,omitempty"`
+	CreatedAt   string         `json:"created_at"`
+	Envelope    *envelope      `json:"envelope,omitempty"`
+}
+
+// sortedCounts returns the keys of the given counts, sorted.
+func sortedCounts(counts map[string]int) []string {
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// flattenRecord decodes the given Avro-encoded record, including the JSON in
+// its justification field.
+func flattenRecord(t token) (*flatRecord, error) {
+	record, ok := decodeRecord(t)
+	if !ok {
+		return nil, errNotARecord
+	}
+	var r flatRecord
+	justification, _ := record["justification"].(string)
+	if err := json.Unmarshal([]byte(justification), &r); err != nil {
+		return nil, fmt.Errorf("failed to decode justification: %w", err)
+	}
+	r.WalletID, _ = record["wallet_id"].(string)
+	r.Service, _ = record["service"].(string)
+	r.Signal, _ = record["signal"].(string)
+	r.Score, _ = record["score"].(int32)
+	r.CreatedAt, _ = record["created_at"].(string)
+	return &r, nil
+}
+
+// encodeBatch encodes the given batch of Avro-encoded records in the given
+// format.  Formats other than Avro turn the batch into a single token.  If
+// the given envelope isn't nil, each record is wrapped in it.  Records that
+// we fail to encode become dead letters, so encodeBatch also returns the
+// number of records in the encoded batch.
+func encodeBatch(format string, batch []token, env *envelope) ([]token, int) {
+	encode, exists := batchEncoders[format]
+	if !exists && env == nil {
+		return batch, len(batch)
+	}
+	records := make([]*flatRecord, 0, len(batch))
+	tokens := make([]token, 0, len(batch))
+	for _, t := range batch {
+		r, err := flattenRecord(t)
+		if err != nil {
+			deadLetters.add(stageEncode, 1, err)
+			continue
+		}
+		records = append(records, r)
+		tokens = append(tokens, t)
+	}
+	if !exists {
+		wrapped := make([]token, 0, len(tokens))
+		for i, t := range tokens {
+			w, err := env.wrap(t, records[i])
+			if err != nil {
+				deadLetters.add(stageEncode, 1, err)
+				continue
+			}
+			wrapped = append(wrapped, w)
+		}
+		return wrapped, len(wrapped)
+	}
+	if len(records) == 0 {
+		return nil, 0
+	}
+	if env != nil {
+		for _, r := range records {
+			r.Envelope = env.forRecord(r)
+		}
+	}
+	payload, err := encode(records)
+	if err == nil && len(payload) == 0 {
+		err = errors.New("encoded batch is empty")
+	}
+	if err != nil {
+		deadLetters.add(stageEncode, len(records), err)
+		return nil, 0
+	}
+	return []token{payload}, len(records)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"sort"
+)
+
+// msgpackWriter encodes the subset of MessagePack that our records need:
+// maps, arrays, strings, and integers.  See:
+// https://github.com/msgpack/msgpack/blob/master/spec.md
+type msgpackWriter struct {
+	b []byte
+}
+
+// header writes a type's header: its fixed-size variant if n fits into the
+// fix mask, and otherwise its 16-bit or 32-bit variant.
+func (w *msgpackWriter) header(n int, fix, fixMax, type16, type32 byte) {
+	switch {
+	case n <= int(fixMax):
+		w.b = append(w.b, fix|byte(n))
+	case n <= math.MaxUint16:
+		w.b = append(w.b, type16)
+		w.b = binary.BigEndian.AppendUint16(w.b, uint16(n))
+	default:
+		w.b = append(w.b, type32)
+		w.b = binary.BigEndian.AppendUint32(w.b, uint32(n))
+	}
+}
+
+func (w *msgpackWriter) mapHeader(n int) {
+	w.header(n, 0x80, 0x0f, 0xde, 0xdf)
+}
+
+func (w *msgpackWriter) arrayHeader(n int) {
+	w.header(n, 0x90, 0x0f, 0xdc, 0xdd)
+}
+
+func (w *msgpackWriter) str(s string) {
+	if len(s) > 0x1f && len(s) <= math.MaxUint8 {
+		w.b = append(w.b, 0xd9, byte(len(s)))
+	} else {
+		w.header(len(s), 0xa0, 0x1f, 0xda, 0xdb)
+	}
+	w.b = append(w.b, s...)
+}
+
+func (w *msgpackWriter) int(i int64) {
+	switch {
+	case i >= 0 && i <= 0x7f:
+		w.b = append(w.b, byte(i))
+	case i >= -32 && i < 0:
+		w.b = append(w.b, byte(i))
+	case i >= math.MinInt32 && i <= math.MaxInt32:
+		w.b = append(w.b, 0xd2)
+		w.b = binary.BigEndian.AppendUint32(w.b, uint32(i))
+	default:
+		w.b = append(w.b, 0xd3)
+		w.b = binary.BigEndian.AppendUint64(w.b, uint64(i))
+	}
+}
+
+func (w *msgpackWriter) strs(s []string) {
+	w.arrayHeader(len(s))
+	for _, e := range s {
+		w.str(e)
+	}
+}
+
+// encodeMsgpackBatch encodes the given records as a MessagePack array of
+// maps.  The maps use the same keys as our JSON, and omit empty fields.
+func encodeMsgpackBatch(records []*flatRecord) ([]byte, error) {
+	w := &msgpackWriter{}
+	w.arrayHeader(len(records))
+	for _, r := range records {
+		// Each field encodes its key and value.
+		var fields []func()
+		addStr := func(key, value string) {
+			if value != "" {
+				fields = append(fields, func() { w.str(key); w.str(value) })
+			}
+		}
+		addStrs := func(key string, values []string) {
+			if len(values) > 0 {
+				fields = append(fields, func() { w.str(key); w.strs(values) })
+			}
+		}
+		addInt := func(key string, value int64) {
+			if value != 0 {
+				fields = append(fields, func() { w.str(key); w.int(value) })
+			}
+		}
+
+		addStr("wallet_id", r.WalletID)
+		addStr("service", r.Service)
+		addStr("signal", r.Signal)
+		addInt("score", int64(r.Score))
+		addStr("keyid", r.KeyID)
+		addStrs("addrs", r.Addrs)
+		addInt("requests", int64(r.Requests))
+		if len(r.AddrCounts) > 0 {
+			fields = append(fields, func() {
+				w.str("addr_counts")
+				w.mapHeader(len(r.AddrCounts))
+				for _, addr := range sortedCounts(r.AddrCounts) {
+					w.str(addr)
+					w.int(int64(r.AddrCounts[addr]))
+				}
+			})
+		}
+		addStrs("countries", r.Countries)
+		addStrs("conf_types", r.ConfTypes)
+		if len(r.ApiVersions) > 0 {
+			fields = append(fields, func() {
+				w.str("api_versions")
+				versions := make([]int, 0, len(r.ApiVersions))
+				for v := range r.ApiVersions {
+					versions = append(versions, v)
+				}
+				sort.Ints(versions)
+				w.mapHeader(len(versions))
+				for _, v := range versions {
+					w.int(int64(v))
+					w.int(int64(r.ApiVersions[v]))
+				}
+			})
+		}
+		addStrs("request_ids", r.RequestIDs)
+		addStr("window", r.Window)
+		addInt("records", int64(r.Records))
+		addStr("checksum", r.Checksum)
+		addStr("created_at", r.CreatedAt)
+		if e := r.Envelope; e != nil {
+			fields = append(fields, func() {
+				w.str("envelope")
+				n := 4
+				if e.KeyEpoch != "" {
+					n++
+				}
+				w.mapHeader(n)
+				w.str("schema_version")
+				w.int(int64(e.SchemaVersion))
+				w.str("instance_id")
+				w.str(e.InstanceID)
+				w.str("anonymization")
+				w.str(e.Anonymization)
+				if e.KeyEpoch != "" {
+					w.str("key_epoch")
+					w.str(e.KeyEpoch)
+				}
+				w.str("flushed_at")
+				w.str(e.FlushedAt)
+			})
+		}
+
+		w.mapHeader(len(fields))
+		for _, f := range fields {
+			f()
+		}
+	}
+	return w.b, nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+	"time"
+
+	uuid "github.com/google/uuid"
+)
+
+// decodeMsgpack decodes the MessagePack value at the start of the given bytes,
+// and returns the value and the remaining bytes.  It supports the subset of
+// MessagePack that encodeMsgpackBatch produces.
+func decodeMsgpack(t *testing.T, b []byte) (any, []byte) {
+	t.Helper()
+
+	// length returns the length that follows a 16-bit or 32-bit header.
+	length := func(size int) int {
+		if size == 2 {
+			n := int(binary.BigEndian.Uint16(b[1:]))
+			b = b[3:]
+			return n
+		}
+		n := int(binary.BigEndian.Uint32(b[1:]))
+		b = b[5:]
+		return n
+	}
+	var n int
+	switch c := b[0]; {
+	case c <= 0x7f:
+		return int64(c), b[1:]
+	case c >= 0xe0:
+		return int64(int8(c)), b[1:]
+	case c == 0xd2:
+		return int64(int32(binary.BigEndian.Uint32(b[1:]))), b[5:]
+	case c == 0xd3:
+		return int64(binary.BigEndian.Uint64(b[1:])), b[9:]
+	case c&0xe0 == 0xa0, c == 0xd9, c == 0xda, c == 0xdb:
+		switch c {
+		case 0xd9:
+			n, b = int(b[1]), b[2:]
+		case 0xda:
+			n = length(2)
+		case 0xdb:
+			n = length(4)
+		default:
+			n, b = int(c&0x1f), b[1:]
+		}
+		return string(b[:n]), b[n:]
+	case c&0xf0 == 0x90, c == 0xdc, c == 0xdd:
+		switch c {
+		case 0xdc:
+			n = length(2)
+		case 0xdd:
+			n = length(4)
+		default:
+			n, b = int(c&0x0f), b[1:]
+		}
+		a := make([]any, n)
+		for i := range a {
+			a[i], b = decodeMsgpack(t, b)
+		}
+		return a, b
+	case c&0xf0 == 0x80, c == 0xde, c == 0xdf:
+		switch c {
+		case 0xde:
+			n = length(2)
+		case 0xdf:
+			n = length(4)
+		default:
+			n, b = int(c&0x0f), b[1:]
+		}
+		m := make(map[any]any, n)
+		for i := 0; i < n; i++ {
+			var k, v any
+			k, b = decodeMsgpack(t, b)
+			v, b = decodeMsgpack(t, b)
+			m[k] = v
+		}
+		return m, b
+	}
+	t.Fatalf("Got unexpected type byte %#x.", b[0])
+	return nil, nil
+}
+
+func TestMsgpackWriter(t *testing.T) {
+	long := string(make([]byte, math.MaxUint16+1))
+	for _, v := range []any{
+		int64(0), int64(127), int64(128), int64(-1), int64(-32), int64(-33),
+		int64(math.MaxInt32), int64(math.MaxInt32 + 1), int64(math.MinInt64),
+		"", "foo", string(make([]byte, 32)), string(make([]byte, 256)), long,
+	} {
+		w := &msgpackWriter{}
+		switch v := v.(type) {
+		case int64:
+			w.int(v)
+		case string:
+			w.str(v)
+		}
+		got, rest := decodeMsgpack(t, w.b)
+		assertEqual(t, len(rest), 0)
+		assertEqual(t, got, v)
+	}
+
+	w := &msgpackWriter{}
+	w.strs(make([]string, 16))
+	got, rest := decodeMsgpack(t, w.b)
+	assertEqual(t, len(rest), 0)
+	assertEqual(t, len(got.([]any)), 16)
+}
+
+func TestMsgpackBatch(t *testing.T) {
+	walletID, kID, window := newV4(t), keyID{UUID: newV4(t)}, newV4(t)
+	meta := newWalletMeta()
+	meta.apiVersions[4] = 2
+	meta.apiVersions[3] = 1
+	meta.requests = 3
+	meta.addrCounts = map[string]int{"1.1.1.1": 2, "2.2.2.2": 1}
+	createdAt := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	msg, err := compileKafkaMsg(kID, walletID, AddressSet{"1.1.1.1": empty{}, "2.2.2.2": empty{}},
+		meta, createdAt, window)
+	if err != nil {
+		t.Fatalf("Failed to compile Kafka message: %v", err)
+	}
+	commit := newWindowCommit(window)
+	commit.add(msg)
+	commitMsg, err := commit.compile(createdAt)
+	if err != nil {
+		t.Fatalf("Failed to compile commit record: %v", err)
+	}
+
+	batch, n := encodeBatch(formatMsgpack, []token{msg, commitMsg}, nil)
+	assertEqual(t, n, 2)
+	assertEqual(t, len(batch), 1)
+	decoded, rest := decodeMsgpack(t, batch[0])
+	assertEqual(t, len(rest), 0)
+	records := decoded.([]any)
+	assertEqual(t, len(records), 2)
+
+	record := records[0].(map[any]any)
+	assertEqual(t, record["wallet_id"], any(walletID.String()))
+	assertEqual(t, record["signal"], any(schemaSignal))
+	assertEqual(t, record["keyid"], any(kID.String()))
+	assertEqual(t, len(record["addrs"].([]any)), 2)
+	assertEqual(t, record["window"], any(window.String()))
+	assertEqual(t, record["created_at"], any("2024-01-01T00:00:00Z"))
+	assertEqual(t, record["requests"], any(int64(3)))
+	assertEqual(t, record["addr_counts"].(map[any]any)["1.1.1.1"], any(int64(2)))
+	versions := record["api_versions"].(map[any]any)
+	assertEqual(t, len(versions), 2)
+	assertEqual(t, versions[int64(4)], any(int64(2)))
+	// Empty fields are omitted.
+	_, ok := record["records"]
+	assertEqual(t, ok, false)
+
+	commitRecord := records[1].(map[any]any)
+	assertEqual(t, commitRecord["wallet_id"], any(uuid.Nil.String()))
+	assertEqual(t, commitRecord["signal"], any(schemaCommitSignal))
+	assertEqual(t, commitRecord["records"], any(int64(1)))
+
+	// Tokens that aren't records can't be encoded.
+	// Tokens that aren't records become dead letters.
+	batch, n = encodeBatch(formatMsgpack, []token{token("foo"), msg}, nil)
+	assertEqual(t, n, 1)
+	assertEqual(t, len(batch), 1)
+}
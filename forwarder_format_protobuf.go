@@ -0,0 +1,140 @@
+package main
+
+import (
+	"sort"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The field numbers of the Record message in proto/record.proto.
+const (
+	pbWalletID protowire.Number = iota + 1
+	pbService
+	pbSignal
+	pbScore
+	pbKeyID
+	pbAddrs
+	pbCountries
+	pbConfTypes
+	pbApiVersions
+	pbRequestIDs
+	pbWindow
+	pbRecords
+	pbChecksum
+	pbCreatedAt
+	pbEnvelope
+	pbRequests
+	pbAddrCounts
+)
+
+// The field numbers of the Envelope message in proto/record.proto.
+const (
+	pbSchemaVersion protowire.Number = iota + 1
+	pbInstanceID
+	pbAnonymization
+	pbKeyEpoch
+	pbFlushedAt
+)
+
+// The field numbers of map entries.
+const (
+	pbMapKey protowire.Number = iota + 1
+	pbMapValue
+)
+
+// encodeProtobufBatch encodes the given records as length-delimited Record
+// messages (see proto/record.proto).  The encoding is deterministic: map
+// entries are sorted by key.
+func encodeProtobufBatch(records []*flatRecord) ([]byte, error) {
+	var batch []byte
+	for _, r := range records {
+		batch = protowire.AppendBytes(batch, marshalProtobufRecord(r))
+	}
+	return batch, nil
+}
+
+// protobufMessage helps marshal a message.  Like proto3, it omits fields that
+// have their default value.
+type protobufMessage []byte
+
+func (b *protobufMessage) appendString(num protowire.Number, s string) {
+	if s == "" {
+		return
+	}
+	*b = protowire.AppendTag(*b, num, protowire.BytesType)
+	*b = protowire.AppendString(*b, s)
+}
+
+func (b *protobufMessage) appendInt(num protowire.Number, i int64) {
+	if i == 0 {
+		return
+	}
+	*b = protowire.AppendTag(*b, num, protowire.VarintType)
+	*b = protowire.AppendVarint(*b, uint64(i))
+}
+
+func marshalProtobufEnvelope(e *envelope) []byte {
+	var b protobufMessage
+	b.appendInt(pbSchemaVersion, int64(e.SchemaVersion))
+	b.appendString(pbInstanceID, e.InstanceID)
+	b.appendString(pbAnonymization, e.Anonymization)
+	b.appendString(pbKeyEpoch, e.KeyEpoch)
+	b.appendString(pbFlushedAt, e.FlushedAt)
+	return b
+}
+
+func marshalProtobufRecord(r *flatRecord) []byte {
+	var m protobufMessage
+	m.appendString(pbWalletID, r.WalletID)
+	m.appendString(pbService, r.Service)
+	m.appendString(pbSignal, r.Signal)
+	m.appendInt(pbScore, int64(r.Score))
+	m.appendString(pbKeyID, r.KeyID)
+	for _, s := range r.Addrs {
+		m = protowire.AppendTag(m, pbAddrs, protowire.BytesType)
+		m = protowire.AppendString(m, s)
+	}
+	for _, s := range r.Countries {
+		m = protowire.AppendTag(m, pbCountries, protowire.BytesType)
+		m = protowire.AppendString(m, s)
+	}
+	for _, s := range r.ConfTypes {
+		m = protowire.AppendTag(m, pbConfTypes, protowire.BytesType)
+		m = protowire.AppendString(m, s)
+	}
+	versions := make([]int, 0, len(r.ApiVersions))
+	for v := range r.ApiVersions {
+		versions = append(versions, v)
+	}
+	sort.Ints(versions)
+	for _, v := range versions {
+		var entry []byte
+		entry = protowire.AppendTag(entry, pbMapKey, protowire.VarintType)
+		entry = protowire.AppendVarint(entry, uint64(v))
+		entry = protowire.AppendTag(entry, pbMapValue, protowire.VarintType)
+		entry = protowire.AppendVarint(entry, uint64(r.ApiVersions[v]))
+		m = protowire.AppendTag(m, pbApiVersions, protowire.BytesType)
+		m = protowire.AppendBytes(m, entry)
+	}
+	for _, s := range r.RequestIDs {
+		m = protowire.AppendTag(m, pbRequestIDs, protowire.BytesType)
+		m = protowire.AppendString(m, s)
+	}
+	m.appendString(pbWindow, r.Window)
+	m.appendInt(pbRecords, int64(r.Records))
+	m.appendString(pbChecksum, r.Checksum)
+	m.appendString(pbCreatedAt, r.CreatedAt)
+	m.appendInt(pbRequests, int64(r.Requests))
+	for _, addr := range sortedCounts(r.AddrCounts) {
+		var entry protobufMessage
+		entry.appendString(pbMapKey, addr)
+		entry.appendInt(pbMapValue, int64(r.AddrCounts[addr]))
+		m = protowire.AppendTag(m, pbAddrCounts, protowire.BytesType)
+		m = protowire.AppendBytes(m, entry)
+	}
+	if r.Envelope != nil {
+		m = protowire.AppendTag(m, pbEnvelope, protowire.BytesType)
+		m = protowire.AppendBytes(m, marshalProtobufEnvelope(r.Envelope))
+	}
+	return m
+}
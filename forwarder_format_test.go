@@ -0,0 +1,143 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	uuid "github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// pbFields maps the field numbers of a protobuf message to their raw values:
+// uint64 for varints and []byte for length-delimited fields.
+type pbFields map[protowire.Number][]any
+
+// decodeProtobufBatch decodes the given batch of length-delimited messages.
+func decodeProtobufBatch(t *testing.T, batch []byte) []pbFields {
+	t.Helper()
+
+	var msgs []pbFields
+	for len(batch) > 0 {
+		msg, n := protowire.ConsumeBytes(batch)
+		if n < 0 {
+			t.Fatalf("Failed to consume message: %v", protowire.ParseError(n))
+		}
+		batch = batch[n:]
+		fields := make(pbFields)
+		for len(msg) > 0 {
+			num, typ, n := protowire.ConsumeTag(msg)
+			if n < 0 {
+				t.Fatalf("Failed to consume tag: %v", protowire.ParseError(n))
+			}
+			msg = msg[n:]
+			switch typ {
+			case protowire.VarintType:
+				v, n := protowire.ConsumeVarint(msg)
+				fields[num] = append(fields[num], v)
+				msg = msg[n:]
+			case protowire.BytesType:
+				v, n := protowire.ConsumeBytes(msg)
+				fields[num] = append(fields[num], v)
+				msg = msg[n:]
+			default:
+				t.Fatalf("Got unexpected wire type %d.", typ)
+			}
+		}
+		msgs = append(msgs, fields)
+	}
+	return msgs
+}
+
+func TestParseFlushFormat(t *testing.T) {
+	for _, format := range []string{formatAvro, formatProtobuf, formatMsgpack} {
+		if err := parseFlushFormat(format); err != nil {
+			t.Errorf("Got unexpected error for %q: %v", format, err)
+		}
+	}
+	if err := parseFlushFormat("foo"); err == nil {
+		t.Error("Expected error but got none.")
+	}
+	if _, _, err := parseFlags("tkzr", []string{"-flush-format", formatProtobuf}); err == nil {
+		t.Error("Expected error for the simple aggregator but got none.")
+	}
+}
+
+func TestProtobufBatch(t *testing.T) {
+	walletID, kID, window := newV4(t), keyID{UUID: newV4(t)}, newV4(t)
+	meta := newWalletMeta()
+	meta.apiVersions[4] = 2
+	meta.apiVersions[3] = 1
+	meta.requests = 3
+	meta.addrCounts = map[string]int{"1.1.1.1": 2, "2.2.2.2": 1}
+	createdAt := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	msg, err := compileKafkaMsg(kID, walletID, AddressSet{"1.1.1.1": empty{}, "2.2.2.2": empty{}},
+		meta, createdAt, window)
+	if err != nil {
+		t.Fatalf("Failed to compile Kafka message: %v", err)
+	}
+	commit := newWindowCommit(window)
+	commit.add(msg)
+	commitMsg, err := commit.compile(createdAt)
+	if err != nil {
+		t.Fatalf("Failed to compile commit record: %v", err)
+	}
+
+	batch, n := encodeBatch(formatProtobuf, []token{msg, commitMsg}, nil)
+	assertEqual(t, n, 2)
+	assertEqual(t, len(batch), 1)
+	msgs := decodeProtobufBatch(t, batch[0])
+	assertEqual(t, len(msgs), 2)
+
+	record := msgs[0]
+	assertEqual(t, string(record[pbWalletID][0].([]byte)), walletID.String())
+	assertEqual(t, string(record[pbSignal][0].([]byte)), schemaSignal)
+	assertEqual(t, string(record[pbKeyID][0].([]byte)), kID.String())
+	assertEqual(t, len(record[pbAddrs]), 2)
+	assertEqual(t, string(record[pbAddrs][1].([]byte)), "2.2.2.2")
+	assertEqual(t, string(record[pbWindow][0].([]byte)), window.String())
+	assertEqual(t, string(record[pbCreatedAt][0].([]byte)), "2024-01-01T00:00:00Z")
+	assertEqual(t, record[pbRequests][0], uint64(3))
+	assertEqual(t, len(record[pbAddrCounts]), 2)
+	entry := decodeProtobufBatch(t, protowire.AppendBytes(nil, record[pbAddrCounts][0].([]byte)))[0]
+	assertEqual(t, string(entry[pbMapKey][0].([]byte)), "1.1.1.1")
+	assertEqual(t, entry[pbMapValue][0], uint64(2))
+	// Map entries are sorted by key.
+	assertEqual(t, len(record[pbApiVersions]), 2)
+	entry = decodeProtobufBatch(t, protowire.AppendBytes(nil, record[pbApiVersions][0].([]byte)))[0]
+	assertEqual(t, entry[pbMapKey][0], uint64(3))
+	assertEqual(t, entry[pbMapValue][0], uint64(1))
+
+	commitRecord := msgs[1]
+	assertEqual(t, string(commitRecord[pbWalletID][0].([]byte)), uuid.Nil.String())
+	assertEqual(t, string(commitRecord[pbSignal][0].([]byte)), schemaCommitSignal)
+	assertEqual(t, commitRecord[pbRecords][0], uint64(1))
+	assertEqual(t, len(commitRecord[pbChecksum]), 1)
+
+	// Tokens that aren't records can't be encoded.
+	// Tokens that aren't records become dead letters.
+	numDead := testutil.ToFloat64(m.numDeadLetters.WithLabelValues(stageEncode))
+	batch, n = encodeBatch(formatProtobuf, []token{token("foo")}, nil)
+	assertEqual(t, n, 0)
+	assertEqual(t, len(batch), 0)
+	assertEqual(t, testutil.ToFloat64(m.numDeadLetters.WithLabelValues(stageEncode)), numDead+1)
+	// Avro batches are left untouched.
+	batch, n = encodeBatch(formatAvro, []token{msg, commitMsg}, nil)
+	assertEqual(t, n, 2)
+	assertEqual(t, len(batch), 2)
+}
+
+func TestFlusherFormat(t *testing.T) {
+	s := &mockSink{}
+	f := newFlusher(s, false)
+	f.setConfig(&config{flushFormat: formatProtobuf})
+	msg, err := compileKafkaMsg(keyID{UUID: newV4(t)}, newV4(t), AddressSet{"1.1.1.1": empty{}},
+		nil, time.Now(), uuid.Nil)
+	if err != nil {
+		t.Fatalf("Failed to compile Kafka message: %v", err)
+	}
+	f.flush([]any{token(msg), token(msg)})
+	assertEqual(t, s.numBatches(), 1)
+	assertEqual(t, len(s.batches[0]), 1)
+	assertEqual(t, len(decodeProtobufBatch(t, s.batches[0][0])), 2)
+}
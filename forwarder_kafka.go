@@ -8,24 +8,31 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/prometheus/client_golang/prometheus"
+	uuid "github.com/google/uuid"
 	"github.com/segmentio/kafka-go"
 )
 
 const (
-	defaultBatchPeriod = time.Second * 30
-	defaultBatchSize   = 1000
-	envKafkaClientCert = "KAFKA_CLIENT_CERT"
-	envKafkaClientKey  = "KAFKA_CLIENT_KEY"
-	envKafkaInterCert  = "KAFKA_INTERMEDIATE_CERT"
-	envKafkaInterChain = "KAFKA_INTERMEDIATE_CHAIN"
-	envKafkaRootCert   = "KAFKA_ROOT_CERT"
-	envKafkaBroker     = "KAFKA_BROKERS"
-	envKafkaTopic      = "KAFKA_TOPIC"
+	defaultBatchPeriod  = time.Second * 30
+	defaultBatchSize    = 1000
+	envKafkaClientCert  = "KAFKA_CLIENT_CERT"
+	envKafkaClientKey   = "KAFKA_CLIENT_KEY"
+	envKafkaInterCert   = "KAFKA_INTERMEDIATE_CERT"
+	envKafkaInterChain  = "KAFKA_INTERMEDIATE_CHAIN"
+	envKafkaRootCert    = "KAFKA_ROOT_CERT"
+	envKafkaBroker      = "KAFKA_BROKERS"
+	envKafkaTopic       = "KAFKA_TOPIC"
+	envKafkaKeyByWallet = "KAFKA_KEY_BY_WALLET"
+	// Each message carries the idempotency key of its batch and its index
+	// in the batch, so that consumers can discard the duplicates that our
+	// retries may cause.
+	batchIDHeader    = "tokenizer-batch-id"
+	batchIndexHeader = "tokenizer-batch-index"
 	// amazonRootCACert is the certificate of one of Amazon's root CAs.  The
 	// certificate chain that we encounter when connecting to our Kafka broker
 	// goes up to this CA.  The root certificates are available at:
@@ -57,7 +64,10 @@ sSi6
 -----END CERTIFICATE-----`
 )
 
-var errEnvVarUnset = errors.New("environment variable unset")
+var (
+	errEnvVarUnset = errors.New("environment variable unset")
+	errNoWriter    = newError(ErrDownstream, "Kafka writer not yet created")
+)
 
 // kafkaWriter defines an interface that's implemented by kafka-go's
 // kafka.Writer (which we use in production) and by dummyKafkaWriter (which we
@@ -73,110 +83,199 @@ type kafkaConfig struct {
 	serverCerts *x509.CertPool
 	broker      net.Addr
 	topic       string
+	// inputTopic and consumerGroup are only used by the Kafka receiver.
+	inputTopic    string
+	consumerGroup string
+	// schemaRegistry is the URL of a Confluent Schema Registry.  If set, we
+	// send messages in Confluent's wire format.
+	schemaRegistry string
+	// versionTopics maps ads API versions to topics other than topic.
+	versionTopics versionTopics
+	// keyByWallet determines if we key messages by wallet ID, so that all of
+	// a wallet's records land on the same partition.
+	keyByWallet bool
 }
 
-// kafkaForwarder implements a forwarder that sends tokenized data to a Kafka
-// broker.
-type kafkaForwarder struct {
+// kafkaSink implements a sink that sends tokenized data to a Kafka broker.
+type kafkaSink struct {
 	sync.RWMutex
-	tokenCache *cache
-	conf       *kafkaConfig
-	writer     kafkaWriter
-	out        chan token
-	done       chan empty
+	writer        kafkaWriter
+	registry      *schemaRegistry
+	topic         string
+	versionTopics versionTopics
+	keyByWallet   bool
 }
 
 func newKafkaForwarder() forwarder {
-	return &kafkaForwarder{
-		tokenCache: newCache(),
-		out:        make(chan token),
-		done:       make(chan empty),
-	}
+	return newFlusher(&kafkaSink{}, true)
 }
 
-func (k *kafkaForwarder) setConfig(c *config) {
+func (k *kafkaSink) setConfig(c *config) {
 	k.Lock()
 	defer k.Unlock()
 
-	k.tokenCache.conf = c.kafkaConfig
-	k.conf = c.kafkaConfig
+	if c.kafkaConfig != nil {
+		k.writer = newKafkaWriter(c.kafkaConfig)
+		k.topic = c.kafkaConfig.topic
+		k.versionTopics = c.kafkaConfig.versionTopics
+		k.keyByWallet = c.kafkaConfig.keyByWallet
+		if c.kafkaConfig.schemaRegistry != "" {
+			k.registry = newSchemaRegistry(c.kafkaConfig.schemaRegistry, c.kafkaConfig.topic)
+		}
+	}
 }
 
-func (k *kafkaForwarder) outbox() chan token {
-	return k.out
-}
+// ready returns nil if we have a Kafka writer.
+func (k *kafkaSink) ready() error {
+	k.RLock()
+	defer k.RUnlock()
 
-func (k *kafkaForwarder) start() {
-	k.Lock()
-	k.writer = newKafkaWriter(k.conf)
-	k.Unlock()
-
-	k.tokenCache.start()
-	go func() {
-		defer k.tokenCache.stop()
-		for {
-			select {
-			case <-k.done:
-				return
-			case token := <-k.out:
-				k.tokenCache.submit(token)
-				k.maybeFlush()
-			}
-		}
-	}()
+	if k.writer == nil {
+		return errNoWriter
+	}
+	return nil
 }
 
-func (k *kafkaForwarder) stop() {
-	close(k.done)
-}
+// flush sends the given tokens to Kafka.
+func (k *kafkaSink) flush(ctx context.Context, batch []token) error {
+	k.RLock()
+	defer k.RUnlock()
 
-func (k *kafkaForwarder) maybeFlush() {
-	elems, err := k.tokenCache.retrieve()
-	if err != nil {
-		return
+	if k.writer == nil {
+		return errNoWriter
 	}
-
-	// Turn tokens into Kafka messages.
-	kafkaMsgs := make([]kafka.Message, len(elems))
-	for i, e := range elems {
-		kafkaMsgs[i].Key = nil
-		kafkaMsgs[i].Value = e.(token)
+	id, hasID := batchID(ctx)
+	kafkaMsgs := make([]kafka.Message, len(batch))
+	for i, t := range batch {
+		kafkaMsgs[i].Value = t
+		if hasID {
+			kafkaMsgs[i].Headers = []kafka.Header{
+				{Key: batchIDHeader, Value: []byte(id.String())},
+				{Key: batchIndexHeader, Value: []byte(strconv.Itoa(i))},
+			}
+		}
+		if len(k.versionTopics) > 0 {
+			kafkaMsgs[i].Topic = k.versionTopics.topicFor(t, k.topic)
+		}
+		if k.keyByWallet {
+			kafkaMsgs[i].Key = walletKey(t)
+		}
+	}
+	if k.registry != nil {
+		id, err := k.registry.schemaID(ctx)
+		if err != nil {
+			return err
+		}
+		for i, t := range batch {
+			kafkaMsgs[i].Value = toWireFormat(id, t)
+		}
 	}
-	batchSize := len(kafkaMsgs)
+	return asRejected(k.writer.WriteMessages(ctx, kafkaMsgs...))
+}
 
-	err = k.writer.WriteMessages(context.Background(), kafkaMsgs...)
-	if err != nil {
-		l := prometheus.Labels{
-			outcome: failBecause(fmt.Errorf("failed to forward tokens: %v", err)),
+// asRejected turns the given error into a rejectedError if Kafka rejected
+// some of our messages for good, and wrote the rest.  Other errors are
+// returned as they are, so that we retry the batch.
+func asRejected(err error) error {
+	var writeErrs kafka.WriteErrors
+	if !errors.As(err, &writeErrs) || writeErrs.Count() == 0 {
+		return err
+	}
+	var rejected []int
+	for i, e := range writeErrs {
+		if e == nil {
+			continue
+		}
+		var kafkaErr kafka.Error
+		if !errors.As(e, &kafkaErr) || kafkaErr.Temporary() {
+			return err
 		}
-		m.numForwarded.With(l).Add(float64(batchSize))
-		return
+		rejected = append(rejected, i)
 	}
+	return &rejectedError{rejected: rejected, err: err}
+}
 
-	l.Printf("Flushed %d tokens to Kafka.", batchSize)
-	m.numForwarded.With(prometheus.Labels{
-		outcome: success,
-	}).Add(float64(batchSize))
+func (k *kafkaSink) String() string {
+	return "Kafka"
 }
 
 func newKafkaWriter(conf *kafkaConfig) *kafka.Writer {
 	w := &kafka.Writer{
 		Addr:  conf.broker,
 		Topic: conf.topic,
+		// We only consider a batch delivered once all in-sync replicas
+		// have it.  Otherwise, we would lose batches that the broker
+		// loses.
+		RequiredAcks: kafka.RequireAll,
 		Transport: &kafka.Transport{
-			TLS: &tls.Config{
-				Certificates: []tls.Certificate{*conf.clientCert},
-				// As of 2022-12-21, our Kafka broker does not support TLS 1.3,
-				// which is why we're enforcing at least 1.2.
-				MinVersion: tls.VersionTLS12,
-				RootCAs:    conf.serverCerts,
-			},
+			TLS: newKafkaTLSConfig(conf),
 		},
 	}
+	// If we route records by API version, each message carries its topic,
+	// which kafka-go only permits if the writer has no topic.
+	if len(conf.versionTopics) > 0 {
+		w.Topic = ""
+		l.Printf("Routing records by API version: %v", conf.versionTopics)
+	}
+	// Murmur2Balancer partitions keyed messages like Kafka's Java client,
+	// so downstream jobs can rely on the same wallet-to-partition mapping.
+	if conf.keyByWallet {
+		w.Balancer = kafka.Murmur2Balancer{}
+	}
 	l.Printf("Created Kafka writer for %q using topic %q.", conf.broker, conf.topic)
 	return w
 }
 
+// decodeRecord returns the given token's Avro record, or false if the token
+// isn't one of our records.
+func decodeRecord(t token) (map[string]interface{}, bool) {
+	native, _, err := ourCodec.NativeFromBinary(t)
+	if err != nil {
+		return nil, false
+	}
+	record, ok := native.(map[string]interface{})
+	return record, ok
+}
+
+// flushesPlainAvro returns true if forwarders flush our Avro records as they
+// are, i.e., without changing their format, and without compressing,
+// encrypting, signing, or wrapping them.  Keying records by wallet and sending
+// them to per-version topics requires decoding them.
+func flushesPlainAvro(c *config) bool {
+	return c.flushFormat == formatAvro &&
+		c.flushCompression == compressNone &&
+		!c.flushEnvelope &&
+		c.flushRecipient == nil &&
+		c.flushSigner == nil
+}
+
+// walletKey returns the message key of the given address record: its wallet
+// ID.  Tokens that aren't address records, e.g., commit records (whose wallet
+// ID is the nil UUID), have no key, so they're spread over all partitions.
+func walletKey(t token) []byte {
+	record, ok := decodeRecord(t)
+	if !ok {
+		return nil
+	}
+	walletID, _ := record["wallet_id"].(string)
+	if walletID == "" || walletID == uuid.Nil.String() {
+		return nil
+	}
+	return []byte(walletID)
+}
+
+// newKafkaTLSConfig returns the TLS configuration that we use to talk to our
+// Kafka broker, both as producer and as consumer.
+func newKafkaTLSConfig(conf *kafkaConfig) *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{*conf.clientCert},
+		// As of 2022-12-21, our Kafka broker does not support TLS 1.3,
+		// which is why we're enforcing at least 1.2.
+		MinVersion: tls.VersionTLS12,
+		RootCAs:    conf.serverCerts,
+	}
+}
+
 func loadKafkaCerts() (*tls.Certificate, *x509.CertPool, error) {
 	clientCertPath, exists := os.LookupEnv(envKafkaClientCert)
 	if !exists {
@@ -263,13 +362,38 @@ func loadKafkaConfig() (*kafkaConfig, error) {
 		return nil, errEnvVarUnset
 	}
 
+	// The input topic and consumer group are optional because only the Kafka
+	// receiver needs them.
+	inputTopic := os.Getenv(envKafkaInputTopic)
+	consumerGroup, exists := os.LookupEnv(envKafkaConsumerGroup)
+	if !exists {
+		consumerGroup = defaultConsumerGroup
+	}
+
+	versionTopics, err := parseVersionTopics(os.Getenv(envKafkaVersionTopics))
+	if err != nil {
+		return nil, err
+	}
+	keyByWallet := false
+	if rawKeyByWallet := os.Getenv(envKafkaKeyByWallet); rawKeyByWallet != "" {
+		if keyByWallet, err = strconv.ParseBool(rawKeyByWallet); err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", envKafkaKeyByWallet, err)
+		}
+	}
+
 	l.Println("Loaded Kafka config.")
 	return &kafkaConfig{
-		batchSize:   defaultBatchSize,
-		batchPeriod: defaultBatchPeriod,
-		clientCert:  clientCert,
-		serverCerts: serverCerts,
-		broker:      kafka.TCP(broker),
-		topic:       topic,
+		batchSize:     defaultBatchSize,
+		batchPeriod:   defaultBatchPeriod,
+		clientCert:    clientCert,
+		serverCerts:   serverCerts,
+		broker:        kafka.TCP(broker),
+		topic:         topic,
+		inputTopic:    inputTopic,
+		consumerGroup: consumerGroup,
+		// The Schema Registry is optional, too.
+		schemaRegistry: os.Getenv(envKafkaSchemaRegistry),
+		versionTopics:  versionTopics,
+		keyByWallet:    keyByWallet,
 	}, nil
 }
@@ -11,6 +11,7 @@ var errCacheNotReady = errors.New("cache not yet ready")
 type cache struct {
 	in     chan any
 	out    chan []any
+	evict  chan any
 	length chan int
 	done   chan empty
 	age    chan time.Time
@@ -21,6 +22,7 @@ func newCache() *cache {
 	return &cache{
 		in:     make(chan any),
 		out:    make(chan []any),
+		evict:  make(chan any),
 		length: make(chan int),
 		done:   make(chan empty),
 		age:    make(chan time.Time),
@@ -34,7 +36,15 @@ func (c *cache) start() {
 			elems = []any{}
 		)
 		for {
+			// We can only evict our oldest element if we have one.
+			var evict chan any
+			var oldest any
+			if len(elems) > 0 {
+				evict, oldest = c.evict, elems[0]
+			}
 			select {
+			case evict <- oldest:
+				elems = elems[1:]
 			case e := <-c.in:
 				if len(elems) == 0 {
 					age = time.Now()
@@ -70,6 +80,17 @@ func (c *cache) retrieve() ([]any, error) {
 	return nil, errCacheNotReady
 }
 
+// evictOldest removes our oldest element and returns it.  The cache must not be
+// empty.
+func (c *cache) evictOldest() any {
+	return <-c.evict
+}
+
+// drain returns all cached elements, regardless of the cache's size and age.
+func (c *cache) drain() []any {
+	return <-c.out
+}
+
 func (c *cache) isReady() bool {
 	age := <-c.age
 	if age.IsZero() {
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	envKafkaSchemaRegistry = "KAFKA_SCHEMA_REGISTRY_URL"
+	// registryContentType is the content type of the Schema Registry's API.
+	registryContentType = "application/vnd.schemaregistry.v1+json"
+	registryTimeout     = time.Second * 10
+	// wireFormatMagic is the first byte of each message in Confluent's wire
+	// format.  It's followed by the big-endian, 4-byte schema ID, and the
+	// Avro-encoded record.
+	wireFormatMagic = 0
+)
+
+// schemaRegistry registers our Avro schema with a Confluent Schema Registry,
+// under the subject "<topic>-value".  Registering a schema that the registry
+// already knows returns its existing ID, so registering doubles as fetching.
+// We remember the ID once we have it.
+type schemaRegistry struct {
+	sync.Mutex
+	url     string
+	subject string
+	schema  string
+	client  *http.Client
+	id      uint32
+	haveID  bool
+}
+
+func newSchemaRegistry(registryURL, topic string) *schemaRegistry {
+	return &schemaRegistry{
+		url:     strings.TrimSuffix(registryURL, "/"),
+		subject: topic + "-value",
+		schema:  ourCodec.Schema(),
+		client:  &http.Client{Timeout: registryTimeout},
+	}
+}
+
+// schemaID returns our schema's ID, registering the schema if we don't have
+// its ID yet.
+func (s *schemaRegistry) schemaID(ctx context.Context) (uint32, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.haveID {
+		return s.id, nil
+	}
+	body, err := json.Marshal(struct {
+		Schema string `json:"schema"`
+	}{s.schema})
+	if err != nil {
+		return 0, err
+	}
+	endpoint := fmt.Sprintf("%s/subjects/%s/versions", s.url, url.PathEscape(s.subject))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", registryContentType)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to register schema: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return 0, fmt.Errorf("schema registry responded with %d: %s", resp.StatusCode, msg)
+	}
+	var result struct {
+		ID uint32 `json:"id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return 0, fmt.Errorf("failed to decode schema registry response: %w", err)
+	}
+	l.Printf("Registered schema for subject %q with ID %d.", s.subject, result.ID)
+	s.id, s.haveID = result.ID, true
+	return s.id, nil
+}
+
+// toWireFormat prefixes the given Avro-encoded record with the given schema
+// ID, as per Confluent's wire format.
+func toWireFormat(id uint32, record []byte) []byte {
+	msg := make([]byte, 5, 5+len(record))
+	msg[0] = wireFormatMagic
+	binary.BigEndian.PutUint32(msg[1:5], id)
+	return append(msg, record...)
+}
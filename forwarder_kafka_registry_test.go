@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+)
+
+func TestToWireFormat(t *testing.T) {
+	msg := toWireFormat(0x01020304, []byte("foo"))
+	if !bytes.Equal(msg, []byte("\x00\x01\x02\x03\x04foo")) {
+		t.Fatalf("Got unexpected wire format: %x", msg)
+	}
+}
+
+func TestSchemaRegistry(t *testing.T) {
+	numRequests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		numRequests++
+		var body struct {
+			Schema string `json:"schema"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("Failed to decode request body: %v", err)
+		}
+		if r.Method != http.MethodPost ||
+			r.URL.Path != "/subjects/foobar-value/versions" ||
+			r.Header.Get("Content-Type") != registryContentType ||
+			body.Schema != ourCodec.Schema() {
+			t.Errorf("Got unexpected request: %s %s", r.Method, r.URL.Path)
+		}
+		_, _ = w.Write([]byte(`{"id":42}`))
+	}))
+	defer srv.Close()
+
+	conf := createKafkaConf(t)
+	conf.schemaRegistry = srv.URL + "/"
+	k := &kafkaSink{}
+	k.setConfig(&config{kafkaConfig: conf})
+	writer := &recordingKafkaWriter{}
+	k.writer = writer
+
+	for i := 0; i < 2; i++ {
+		if err := k.flush(context.Background(), []token{token("foo")}); err != nil {
+			t.Fatalf("Failed to flush: %v", err)
+		}
+	}
+	// We only register our schema once.
+	assertEqual(t, numRequests, 1)
+	assertEqual(t, len(writer.msgs), 2)
+	if !bytes.Equal(writer.msgs[0].Value, toWireFormat(42, []byte("foo"))) {
+		t.Fatalf("Got unexpected message: %x", writer.msgs[0].Value)
+	}
+}
+
+func TestSchemaRegistryFailure(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error_code":409}`, http.StatusConflict)
+	}))
+	defer srv.Close()
+
+	conf := createKafkaConf(t)
+	conf.schemaRegistry = srv.URL
+	k := &kafkaSink{}
+	k.setConfig(&config{kafkaConfig: conf})
+	writer := &recordingKafkaWriter{}
+	k.writer = writer
+
+	if err := k.flush(context.Background(), []token{token("foo")}); err == nil {
+		t.Fatal("Expected error but got none.")
+	}
+	// We must not send messages that consumers can't decode.
+	assertEqual(t, len(writer.msgs), 0)
+}
+
+// recordingKafkaWriter implements kafkaWriter and remembers the messages that
+// it was asked to write.
+type recordingKafkaWriter struct {
+	sync.Mutex
+	msgs []kafka.Message
+}
+
+func (r *recordingKafkaWriter) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	r.Lock()
+	defer r.Unlock()
+	r.msgs = append(r.msgs, msgs...)
+	return nil
+}
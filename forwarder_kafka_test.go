@@ -2,11 +2,18 @@ package main
 
 import (
 	"context"
+	"crypto/ecdh"
+	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"os"
+	"strconv"
+	"sync"
 	"testing"
+	"time"
 
+	uuid "github.com/google/uuid"
 	"github.com/segmentio/kafka-go"
 )
 
@@ -50,12 +57,6 @@ DGGv8fpHLT0qXYQOaAIgcATqqJSvvK81W6YdqLGDGqf6l+BX9CdwDWh/tRISDeI=
 `)
 )
 
-type dummyKafkaWriter struct{}
-
-func (d *dummyKafkaWriter) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
-	return nil
-}
-
 func createKafkaConf(t *testing.T) *kafkaConfig {
 	clientKeyPair, err := tls.X509KeyPair(clientCert, clientKey)
 	if err != nil {
@@ -111,26 +112,139 @@ func TestLoadKafkaConfig(t *testing.T) {
 	}
 }
 
-func TestFlush(t *testing.T) {
-	maxBatchSize := 2
-	k := newKafkaForwarder().(*kafkaForwarder)
-	k.writer = &dummyKafkaWriter{}
-	k.setConfig(&config{
-		kafkaConfig: &kafkaConfig{
-			batchPeriod: defaultBatchPeriod,
-			batchSize:   maxBatchSize,
-		},
-	})
-	k.tokenCache.start()
-	defer k.tokenCache.stop()
-
-	k.tokenCache.submit(token([]byte("foo")))
-	k.maybeFlush()
-	k.tokenCache.submit(token([]byte("bar")))
-	k.maybeFlush()
-	assertEqual(t, k.tokenCache.len(), maxBatchSize)
-
-	k.tokenCache.submit(token([]byte("foo")))
-	k.maybeFlush()
-	assertEqual(t, k.tokenCache.len(), 0)
+func TestKafkaSink(t *testing.T) {
+	writer := &countingKafkaWriter{}
+	k := &kafkaSink{}
+	assertEqual(t, k.ready(), errNoWriter)
+	assertEqual(t, k.flush(context.Background(), []token{token("foo")}), errNoWriter)
+
+	k.setConfig(&config{kafkaConfig: createKafkaConf(t)})
+	assertEqual(t, k.ready(), nil)
+	k.writer = writer
+	if err := k.flush(context.Background(), []token{token("foo"), token("bar")}); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+	assertEqual(t, writer.n, 2)
+}
+
+// countingKafkaWriter implements kafkaWriter and counts the messages that it
+// was asked to write.
+type countingKafkaWriter struct {
+	sync.Mutex
+	n int
+}
+
+func (c *countingKafkaWriter) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	c.Lock()
+	defer c.Unlock()
+	c.n += len(msgs)
+	return nil
+}
+
+func TestWalletKey(t *testing.T) {
+	walletID := newV4(t)
+	msg, err := compileKafkaMsg(keyID{UUID: newV4(t)}, walletID, AddressSet{"1.1.1.1": empty{}},
+		nil, time.Now(), uuid.Nil)
+	if err != nil {
+		t.Fatalf("Failed to compile Kafka message: %v", err)
+	}
+	assertEqual(t, string(walletKey(msg)), walletID.String())
+
+	commit, err := newWindowCommit(newV4(t)).compile(time.Now())
+	if err != nil {
+		t.Fatalf("Failed to compile commit record: %v", err)
+	}
+	if walletKey(commit) != nil || walletKey(token("foo")) != nil {
+		t.Fatal("Expected no key for tokens that aren't address records.")
+	}
+}
+
+func TestFlushesPlainAvro(t *testing.T) {
+	plain := func() *config {
+		return &config{flushFormat: formatAvro, flushCompression: compressNone}
+	}
+	assertEqual(t, flushesPlainAvro(plain()), true)
+
+	// Anything that changes a record's bytes keeps us from decoding it.
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	for _, change := range []func(c *config){
+		func(c *config) { c.flushFormat = formatProtobuf },
+		func(c *config) { c.flushCompression = compressGzip },
+		func(c *config) { c.flushEnvelope = true },
+		func(c *config) { c.flushRecipient = priv.PublicKey() },
+		func(c *config) { c.flushSigner = &flushSigner{} },
+	} {
+		c := plain()
+		change(c)
+		assertEqual(t, flushesPlainAvro(c), false)
+	}
+}
+
+func TestKafkaSinkKeyByWallet(t *testing.T) {
+	conf := createKafkaConf(t)
+	conf.keyByWallet = true
+	if _, ok := newKafkaWriter(conf).Balancer.(kafka.Murmur2Balancer); !ok {
+		t.Fatal("Expected Murmur2 balancer.")
+	}
+
+	k := &kafkaSink{}
+	k.setConfig(&config{kafkaConfig: conf})
+	writer := &recordingKafkaWriter{}
+	k.writer = writer
+	walletID := newV4(t)
+	msg, err := compileKafkaMsg(keyID{UUID: newV4(t)}, walletID, AddressSet{"1.1.1.1": empty{}},
+		nil, time.Now(), uuid.Nil)
+	if err != nil {
+		t.Fatalf("Failed to compile Kafka message: %v", err)
+	}
+	if err := k.flush(context.Background(), []token{msg}); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+	assertEqual(t, string(writer.msgs[0].Key), walletID.String())
+}
+
+func TestKafkaSinkBatchID(t *testing.T) {
+	conf := createKafkaConf(t)
+	assertEqual(t, newKafkaWriter(conf).RequiredAcks, kafka.RequireAll)
+
+	k := &kafkaSink{}
+	k.setConfig(&config{kafkaConfig: conf})
+	writer := &recordingKafkaWriter{}
+	k.writer = writer
+	id := newV4(t)
+	if err := k.flush(withBatchID(context.Background(), id), []token{token("foo"), token("bar")}); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+	for i, msg := range writer.msgs {
+		assertEqual(t, len(msg.Headers), 2)
+		assertEqual(t, msg.Headers[0].Key, batchIDHeader)
+		assertEqual(t, string(msg.Headers[0].Value), id.String())
+		assertEqual(t, msg.Headers[1].Key, batchIndexHeader)
+		assertEqual(t, string(msg.Headers[1].Value), strconv.Itoa(i))
+	}
+}
+
+func TestAsRejected(t *testing.T) {
+	// Kafka rejected one message for good and wrote the other.
+	err := asRejected(kafka.WriteErrors{nil, kafka.MessageSizeTooLarge})
+	var rejected *rejectedError
+	if !errors.As(err, &rejected) {
+		t.Fatalf("Expected rejectedError but got %v.", err)
+	}
+	assertEqual(t, len(rejected.rejected), 1)
+	assertEqual(t, rejected.rejected[0], 1)
+
+	// Temporary errors make us retry the batch.
+	for _, err := range []error{
+		kafka.WriteErrors{kafka.MessageSizeTooLarge, kafka.LeaderNotAvailable},
+		errors.New("connection refused"),
+		nil,
+	} {
+		if errors.As(asRejected(err), &rejected) {
+			t.Fatalf("Expected %v to be retried.", err)
+		}
+	}
 }
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// envKafkaVersionTopics maps ads API versions to Kafka topics, e.g.,
+// "3=ads-v3,4=ads-v4".  Records of versions without a topic go to the topic
+// in KAFKA_TOPIC.
+const envKafkaVersionTopics = "KAFKA_TOPICS_BY_API_VERSION"
+
+// versionTopics maps ads API versions to Kafka topics, so that the ads team
+// can migrate consumers version by version.
+type versionTopics map[int]string
+
+// parseVersionTopics parses the given comma-separated list of
+// "<API version>=<topic>" pairs.
+func parseVersionTopics(s string) (versionTopics, error) {
+	topics := make(versionTopics)
+	if s == "" {
+		return topics, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		rawVersion, topic, found := strings.Cut(pair, "=")
+		if !found || topic == "" || !isValidApiVersion(rawVersion) {
+			return nil, fmt.Errorf("invalid API version topic %q", pair)
+		}
+		version, _ := strconv.Atoi(rawVersion)
+		if _, exists := topics[version]; exists {
+			return nil, fmt.Errorf("duplicate API version %d", version)
+		}
+		topics[version] = topic
+	}
+	return topics, nil
+}
+
+// topicFor returns the topic of the given address record, or the given default
+// topic if the record's API version has no topic of its own.  A wallet that
+// made requests with several API versions during a forward interval, e.g.,
+// because its browser was upgraded, is routed by the most recent version.
+// Tokens that aren't address records, e.g., commit records, go to the
+// default topic.
+func (v versionTopics) topicFor(t token, defaultTopic string) string {
+	record, ok := decodeRecord(t)
+	if !ok {
+		return defaultTopic
+	}
+	rawJustification, _ := record["justification"].(string)
+	var justification struct {
+		ApiVersions map[int]int `json:"api_versions"`
+	}
+	if err := json.Unmarshal([]byte(rawJustification), &justification); err != nil {
+		return defaultTopic
+	}
+	latest := 0
+	for version := range justification.ApiVersions {
+		if version > latest {
+			latest = version
+		}
+	}
+	if topic, exists := v[latest]; exists {
+		return topic
+	}
+	return defaultTopic
+}
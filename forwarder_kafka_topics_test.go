@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	uuid "github.com/google/uuid"
+)
+
+func TestParseVersionTopics(t *testing.T) {
+	topics, err := parseVersionTopics("3=ads-v3,4=ads-v4")
+	if err != nil {
+		t.Fatalf("Got unexpected error: %v", err)
+	}
+	assertEqual(t, len(topics), 2)
+	assertEqual(t, topics[3], "ads-v3")
+	assertEqual(t, topics[4], "ads-v4")
+
+	topics, err = parseVersionTopics("")
+	if err != nil {
+		t.Fatalf("Got unexpected error: %v", err)
+	}
+	assertEqual(t, len(topics), 0)
+
+	for _, s := range []string{"3", "3=", "0=foo", "foo=bar", "3=foo,3=bar"} {
+		if _, err := parseVersionTopics(s); err == nil {
+			t.Errorf("Expected error for %q but got none.", s)
+		}
+	}
+}
+
+// compileVersionedMsg returns an address record of a wallet that made one
+// request with each of the given API versions.
+func compileVersionedMsg(t *testing.T, versions ...int) token {
+	t.Helper()
+
+	meta := newWalletMeta()
+	for _, v := range versions {
+		meta.apiVersions[v]++
+	}
+	msg, err := compileKafkaMsg(keyID{UUID: newV4(t)}, newV4(t), AddressSet{"1.1.1.1": empty{}},
+		meta, time.Now(), uuid.Nil)
+	if err != nil {
+		t.Fatalf("Failed to compile Kafka message: %v", err)
+	}
+	return msg
+}
+
+func TestTopicFor(t *testing.T) {
+	topics := versionTopics{3: "ads-v3", 4: "ads-v4"}
+
+	assertEqual(t, topics.topicFor(compileVersionedMsg(t, 3), "default"), "ads-v3")
+	assertEqual(t, topics.topicFor(compileVersionedMsg(t, 4), "default"), "ads-v4")
+	// Wallets that used several versions are routed by the most recent one.
+	assertEqual(t, topics.topicFor(compileVersionedMsg(t, 3, 4), "default"), "ads-v4")
+	// Versions without a topic, records without a version, and tokens that
+	// aren't records go to the default topic.
+	assertEqual(t, topics.topicFor(compileVersionedMsg(t, 2), "default"), "default")
+	assertEqual(t, topics.topicFor(compileVersionedMsg(t), "default"), "default")
+	assertEqual(t, topics.topicFor(token("foo"), "default"), "default")
+}
+
+func TestKafkaSinkVersionTopics(t *testing.T) {
+	conf := createKafkaConf(t)
+	conf.versionTopics = versionTopics{4: "ads-v4"}
+	assertEqual(t, newKafkaWriter(conf).Topic, "")
+
+	k := &kafkaSink{}
+	k.setConfig(&config{kafkaConfig: conf})
+	writer := &recordingKafkaWriter{}
+	k.writer = writer
+	batch := []token{compileVersionedMsg(t, 4), compileVersionedMsg(t, 3)}
+	if err := k.flush(context.Background(), batch); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+	assertEqual(t, writer.msgs[0].Topic, "ads-v4")
+	assertEqual(t, writer.msgs[1].Topic, conf.topic)
+}
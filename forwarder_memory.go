@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Once a flusher holds as many records or bytes in memory as it may, i.e., in
+// its cache and among the batches that wait for a retry, its drop policy
+// determines what happens to new tokens.
+const (
+	// dropOldest makes the flusher drop its oldest records to make room.
+	dropOldest = "drop-oldest"
+	// dropNewest makes the flusher drop new records.
+	dropNewest = "drop-newest"
+	// dropBlock makes the flusher stop taking new records until it has room
+	// again, which makes the aggregator, and eventually our receivers, wait.
+	dropBlock = "block"
+)
+
+var dropPolicies = map[string]empty{
+	dropOldest: {},
+	dropNewest: {},
+	dropBlock:  {},
+}
+
+// parseDropPolicy returns an error if the given drop policy is unsupported.
+func parseDropPolicy(policy string) error {
+	if _, exists := dropPolicies[policy]; !exists {
+		return fmt.Errorf("unsupported drop policy %q", policy)
+	}
+	return nil
+}
+
+// memoryLimit is the number of records and bytes that a flusher may hold in
+// memory.  0 means no limit.
+type memoryLimit struct {
+	records int
+	bytes   int
+	policy  string
+}
+
+// exceeds returns true if holding the given number of additional records and
+// bytes would exceed our memory limit.
+func (f *flusher) exceeds(records, bytes int) bool {
+	f.RLock()
+	limit := f.memLimit
+	f.RUnlock()
+
+	if limit.records > 0 && f.cached+f.pendingTokens+records > limit.records {
+		return true
+	}
+	return limit.bytes > 0 && f.cachedBytes+f.pendingBytes+bytes > limit.bytes
+}
+
+// admit returns true if we may hold the given token in memory, possibly after
+// dropping our oldest records.
+func (f *flusher) admit(t token) bool {
+	if !f.exceeds(1, len(t)) {
+		return true
+	}
+	f.RLock()
+	policy := f.memLimit.policy
+	f.RUnlock()
+
+	if policy != dropOldest {
+		// If we block, we only take tokens once we have room for one
+		// more record, but we cannot know its size in advance.
+		if policy == dropNewest {
+			f.drop(1)
+		}
+		return policy == dropBlock
+	}
+	// Our pending batches are older than the records in our cache.
+	for f.exceeds(1, len(t)) && len(f.pending) > 0 {
+		f.drop(f.popPending().tokens)
+	}
+	for f.exceeds(1, len(t)) && f.cached > 0 {
+		e := f.tokenCache.evictOldest().(token)
+		f.cached--
+		f.cachedBytes -= len(e)
+		f.drop(1)
+	}
+	if f.exceeds(1, len(t)) {
+		// The token alone exceeds our limit.
+		f.drop(1)
+		return false
+	}
+	return true
+}
+
+// blocked returns true if we must stop taking tokens, because our drop policy
+// is to block and we have no room for another record.  Before blocking, we
+// flush our cache, which may well free enough memory.
+func (f *flusher) blocked() bool {
+	f.RLock()
+	policy := f.memLimit.policy
+	f.RUnlock()
+
+	if policy != dropBlock || !f.exceeds(1, 1) {
+		return false
+	}
+	if f.cached > 0 {
+		f.flush(f.drainCache())
+	}
+	return f.exceeds(1, 1)
+}
+
+// drop accounts for the given number of records that we dropped because of
+// our memory limit.
+func (f *flusher) drop(records int) {
+	m.numMemoryDropped.With(prometheus.Labels{sinkName: f.sink.String()}).Add(float64(records))
+}
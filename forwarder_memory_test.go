@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func newLimitedFlusher(s sink, records int, policy string) *flusher {
+	f := newFlusher(s, true)
+	f.setConfig(&config{
+		kafkaConfig:        &kafkaConfig{batchSize: 100, batchPeriod: time.Hour},
+		flushRetryBuffer:   10,
+		flushMemoryRecords: records,
+		flushDropPolicy:    policy,
+	})
+	f.minBackoff, f.maxBackoff = time.Hour, time.Hour
+	return f
+}
+
+func TestDropPolicies(t *testing.T) {
+	for policy, expected := range map[string][]string{
+		dropNewest: {"foo", "bar"},
+		dropOldest: {"bar", "baz"},
+	} {
+		s := &mockSink{}
+		f := newLimitedFlusher(s, 2, policy)
+		dropped := m.numMemoryDropped.WithLabelValues(s.String())
+		numDropped := testutil.ToFloat64(dropped)
+		f.start()
+
+		f.outbox() <- token("foo")
+		f.outbox() <- token("bar")
+		f.outbox() <- token("baz")
+		f.stop()
+
+		assertEqual(t, s.numBatches(), 1)
+		assertEqual(t, len(s.batches[0]), len(expected))
+		for i, tkn := range expected {
+			assertEqual(t, string(s.batches[0][i]), tkn)
+		}
+		assertEqual(t, testutil.ToFloat64(dropped), numDropped+1)
+	}
+}
+
+func TestDropOldestPending(t *testing.T) {
+	s := &mockSink{err: errors.New("bridge is down")}
+	f := newLimitedFlusher(s, 1, dropOldest)
+	dropped := m.numMemoryDropped.WithLabelValues(s.String())
+	numDropped := testutil.ToFloat64(dropped)
+
+	f.flush([]any{token("foo")})
+	assertEqual(t, len(f.pending), 1)
+	// Our pending batch is older than the new token, so it has to go.
+	assertEqual(t, f.admit(token("bar")), true)
+	assertEqual(t, len(f.pending), 0)
+	assertEqual(t, f.pendingTokens, 0)
+	assertEqual(t, f.pendingBytes, 0)
+	assertEqual(t, testutil.ToFloat64(dropped), numDropped+1)
+
+	// A token that exceeds our limit on its own is dropped.
+	f.memLimit = memoryLimit{bytes: 2, policy: dropOldest}
+	assertEqual(t, f.admit(token("bar")), false)
+	assertEqual(t, testutil.ToFloat64(dropped), numDropped+2)
+}
+
+func TestBlockPolicy(t *testing.T) {
+	s := &mockSink{err: errors.New("bridge is down")}
+	f := newLimitedFlusher(s, 1, dropBlock)
+
+	assertEqual(t, f.blocked(), false)
+	f.flush([]any{token("foo")})
+	// We hold as much as we may until our sink takes the pending batch.
+	assertEqual(t, f.blocked(), true)
+	s.setErr(nil)
+	f.retry()
+	assertEqual(t, f.blocked(), false)
+	assertEqual(t, s.numBatches(), 1)
+}
+
+func TestParseDropPolicy(t *testing.T) {
+	for policy := range dropPolicies {
+		assertEqual(t, parseDropPolicy(policy), nil)
+	}
+	assertEqual(t, parseDropPolicy("drop-everything") != nil, true)
+}
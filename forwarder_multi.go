@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// fanOutBuffer is the number of tokens that each of the multi forwarder's
+// forwarders may fall behind the others before it slows them down.
+const fanOutBuffer = 1000
+
+// multiForwarder implements a forwarder that hands each token to several
+// forwarders at once, e.g., the Kafka forwarder and the stdout forwarder.
+// Each forwarder batches, flushes, and fails independently of the others,
+// and its metrics carry its sink's name.
+type multiForwarder struct {
+	wg         sync.WaitGroup
+	names      []string
+	forwarders []forwarder
+	queues     []chan token
+	out        chan token
+	done       chan empty
+}
+
+// newMultiForwarder returns a forwarder that runs the forwarders with the
+// given names.  The given map provides a constructor for each name.
+func newMultiForwarder(names []string, newForwarders map[string]func() forwarder) forwarder {
+	mf := &multiForwarder{
+		names: names,
+		out:   make(chan token),
+		done:  make(chan empty),
+	}
+	for _, name := range names {
+		mf.forwarders = append(mf.forwarders, newForwarders[name]())
+		mf.queues = append(mf.queues, make(chan token, fanOutBuffer))
+	}
+	return mf
+}
+
+func (mf *multiForwarder) setConfig(c *config) {
+	for _, f := range mf.forwarders {
+		f.setConfig(c)
+	}
+}
+
+func (mf *multiForwarder) outbox() chan token {
+	return mf.out
+}
+
+func (mf *multiForwarder) start() {
+	for i, f := range mf.forwarders {
+		watchChan(mf.names[i]+"_queue", mf.queues[i])
+		f.start()
+		mf.wg.Add(1)
+		go mf.feed(mf.queues[i], f.outbox())
+	}
+	mf.wg.Add(1)
+	go func() {
+		defer mf.wg.Done()
+		defer func() {
+			for _, q := range mf.queues {
+				close(q)
+			}
+		}()
+		for {
+			select {
+			case <-mf.done:
+				return
+			case t := <-mf.out:
+				for _, q := range mf.queues {
+					q <- t
+				}
+			}
+		}
+	}()
+}
+
+// feed hands the tokens in the given queue to the given forwarder's outbox,
+// until the queue is closed.
+func (mf *multiForwarder) feed(queue chan token, outbox chan token) {
+	defer mf.wg.Done()
+	for t := range queue {
+		outbox <- t
+	}
+}
+
+// stop stops the forwarders after handing them all queued tokens, so that
+// they get to flush them.  The forwarders flush at the same time, so that a
+// slow sink doesn't eat into the others' time.
+func (mf *multiForwarder) stop() {
+	close(mf.done)
+	mf.wg.Wait()
+	stopAll(mf.forwarders)
+}
+
+// stopAll stops the given forwarders at the same time, and returns once all of
+// them have stopped.
+func stopAll(forwarders []forwarder) {
+	var wg sync.WaitGroup
+	for _, f := range forwarders {
+		wg.Add(1)
+		go func(f forwarder) {
+			defer wg.Done()
+			f.stop()
+		}(f)
+	}
+	wg.Wait()
+}
+
+// ready returns nil if all of our forwarders are ready.
+func (mf *multiForwarder) ready() error {
+	for i, f := range mf.forwarders {
+		checker, ok := f.(readinessChecker)
+		if !ok {
+			continue
+		}
+		if err := checker.ready(); err != nil {
+			return fmt.Errorf("%s: %w", mf.names[i], err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestMultiForwarder(t *testing.T) {
+	sinks := map[string]*mockSink{"foo": {}, "bar": {}}
+	newForwarders := map[string]func() forwarder{
+		"foo": func() forwarder { return newFlusher(sinks["foo"], false) },
+		"bar": func() forwarder { return newFlusher(sinks["bar"], false) },
+	}
+	mf := newMultiForwarder([]string{"foo", "bar"}, newForwarders).(*multiForwarder)
+	mf.setConfig(&config{})
+	mf.start()
+
+	// Each forwarder gets every token, even if another one fails.
+	sinks["bar"].err = errors.New("broker is down")
+	mf.outbox() <- token("foo")
+	mf.outbox() <- token("bar")
+	mf.stop()
+	assertEqual(t, sinks["foo"].numBatches(), 2)
+	assertEqual(t, sinks["bar"].numBatches(), 0)
+
+	// We're only ready if all of our forwarders are.
+	err := mf.ready()
+	assertEqual(t, errors.Is(err, ErrDownstream), true)
+	assertEqual(t, err.Error(), "bar: broker is down")
+}
+
+func TestParseMultiForwarder(t *testing.T) {
+	comp, _, err := parseFlags("tkzr", []string{"-forwarder", "stdout,null"})
+	if err != nil {
+		t.Fatalf("Failed to parse flags: %v", err)
+	}
+	_, ok := comp.f.(*multiForwarder)
+	assertEqual(t, ok, true)
+
+	if _, _, err := parseFlags("tkzr", []string{"-forwarder", "stdout,stdout"}); err == nil {
+		t.Fatal("Expected error for duplicate forwarder but got none.")
+	}
+}
@@ -0,0 +1,19 @@
+package main
+
+import "context"
+
+// nullSink implements a sink that discards all data.  It's useful for load
+// tests, and for running tokenizer without an output.
+type nullSink struct{}
+
+func newNullForwarder() forwarder {
+	return newFlusher(nullSink{}, false)
+}
+
+func (s nullSink) flush(ctx context.Context, batch []token) error {
+	return nil
+}
+
+func (s nullSink) String() string {
+	return "null"
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	uuid "github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// defaultRetryBuffer is the default number of tokens that each flusher
+	// keeps buffered while it retries failed flushes.
+	defaultRetryBuffer = 100000
+	// defaultRetention is the default time after which we give up on a
+	// batch that our sink didn't acknowledge.
+	defaultRetention = time.Hour
+	// finalFlushTimeout is how long each flusher's final flush may take
+	// when we're shutting down.
+	finalFlushTimeout = time.Second * 10
+	// Our backoff starts at minRetryBackoff, doubles after each failed
+	// retry, and is capped at maxRetryBackoff.
+	minRetryBackoff = time.Second
+	maxRetryBackoff = time.Minute * 2
+)
+
+var (
+	errRetryBufferFull  = errors.New("retry buffer full")
+	errRetentionExpired = errors.New("retention expired")
+)
+
+// batchIDKey is the context key of the idempotency key of the batch that's
+// being flushed.
+type batchIDKey struct{}
+
+func withBatchID(ctx context.Context, id uuid.UUID) context.Context {
+	return context.WithValue(ctx, batchIDKey{}, id)
+}
+
+// batchID returns the idempotency key of the batch that the given context
+// belongs to, if any.  Sinks that can attach metadata to what they write
+// should attach it, so that consumers can discard batches that they already
+// received: a flush may fail after our sink wrote (parts of) the batch, in
+// which case we send the batch again.
+func batchID(ctx context.Context) (uuid.UUID, bool) {
+	id, ok := ctx.Value(batchIDKey{}).(uuid.UUID)
+	return id, ok
+}
+
+// pendingBatch is a batch that's ready for our sink, i.e., it's encoded,
+// compressed, encrypted, and signed as configured.  We keep the payload
+// rather than the tokens, so that a retried payload is identical to the
+// original, including its envelope's flush time and its signature.
+type pendingBatch struct {
+	// id is the batch's idempotency key.
+	id      uuid.UUID
+	created time.Time
+	payload []token
+	// tokens is the number of tokens in the payload.
+	tokens int
+}
+
+func newPendingBatch(payload []token, tokens int) *pendingBatch {
+	return &pendingBatch{
+		id:      uuid.New(),
+		created: time.Now(),
+		payload: payload,
+		tokens:  tokens,
+	}
+}
+
+// retryBackoff returns how long we wait before our next retry, after the
+// given number of failed retries.  We pick a random duration between half
+// and all of the exponential backoff, so that flushers that failed at the
+// same time don't retry at the same time.
+func retryBackoff(failed int, min, max time.Duration) time.Duration {
+	d := min
+	for i := 0; i < failed && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// enqueue adds the given batch to the batches that wait for a retry.  If we
+// then buffer more tokens than we may, we spill our oldest batches if we have
+// a spill queue, and give up on them otherwise.
+func (f *flusher) enqueue(b *pendingBatch) {
+	f.RLock()
+	maxTokens := f.retryBuffer
+	f.RUnlock()
+
+	f.pending = append(f.pending, b)
+	f.pendingTokens += b.tokens
+	f.pendingBytes += batchSize(b.payload)
+	for f.pendingTokens > maxTokens && len(f.pending) > 0 {
+		f.spillOrGiveUp(f.popPending())
+	}
+	if f.numPending() > 0 && !f.retryScheduled {
+		f.scheduleRetry()
+	}
+}
+
+// numPending returns the number of batches that wait for a retry, in memory
+// or spilled.
+func (f *flusher) numPending() int {
+	return len(f.pending) + f.spill.len()
+}
+
+func (f *flusher) spillOrGiveUp(b *pendingBatch) {
+	if f.spill == nil {
+		f.giveUp(b.tokens, errRetryBufferFull)
+		return
+	}
+	evicted, err := f.spill.push(b)
+	for _, e := range evicted {
+		f.giveUp(e.tokens, errSpillFull)
+	}
+	if err != nil {
+		f.giveUp(b.tokens, err)
+	}
+}
+
+func (f *flusher) scheduleRetry() {
+	f.retryTimer.Reset(retryBackoff(f.failedRetries, f.minBackoff, f.maxBackoff))
+	f.retryScheduled = true
+}
+
+// retry hands our pending batches to our sink, oldest first, and schedules
+// another retry if the sink fails again.
+func (f *flusher) retry() {
+	f.retryScheduled = false
+	f.expire()
+	if err := f.sendPending(); err != nil {
+		f.failedRetries++
+		f.scheduleRetry()
+		return
+	}
+	f.failedRetries = 0
+}
+
+// expire gives up on the pending batches that are older than our retention.
+func (f *flusher) expire() {
+	f.RLock()
+	retention := f.retention
+	f.RUnlock()
+
+	if retention == 0 {
+		return
+	}
+	for f.spill.len() > 0 && time.Since(f.spill.oldest().created) > retention {
+		f.giveUp(f.spill.oldest().tokens, errRetentionExpired)
+		f.spill.remove()
+	}
+	for len(f.pending) > 0 && time.Since(f.pending[0].created) > retention {
+		f.giveUp(f.popPending().tokens, errRetentionExpired)
+	}
+}
+
+// sendPending hands our pending batches to our sink, oldest first, until the
+// sink fails.  Our spilled batches are older than the ones in memory.
+func (f *flusher) sendPending() error {
+	for f.spill.len() > 0 {
+		b, err := f.spill.load(f.spill.oldest())
+		if err != nil {
+			f.giveUp(f.spill.oldest().tokens, err)
+			f.spill.remove()
+			continue
+		}
+		m.numFlushRetries.With(prometheus.Labels{sinkName: f.sink.String()}).Inc()
+		if err := f.send(b); err != nil {
+			return err
+		}
+		f.spill.remove()
+	}
+	for len(f.pending) > 0 {
+		b := f.pending[0]
+		m.numFlushRetries.With(prometheus.Labels{sinkName: f.sink.String()}).Inc()
+		if err := f.send(b); err != nil {
+			return err
+		}
+		f.popPending()
+	}
+	return nil
+}
+
+// giveUpPending gives up on all of our pending batches, e.g., because we're
+// shutting down.
+func (f *flusher) giveUpPending(err error) {
+	for f.spill.len() > 0 {
+		f.giveUp(f.spill.oldest().tokens, err)
+		f.spill.remove()
+	}
+	for _, b := range f.pending {
+		f.giveUp(b.tokens, err)
+	}
+	f.pending, f.pendingTokens, f.pendingBytes = nil, 0, 0
+}
+
+// popPending removes our oldest pending batch from memory, and returns it.
+func (f *flusher) popPending() *pendingBatch {
+	b := f.pending[0]
+	f.pending = f.pending[1:]
+	f.pendingTokens -= b.tokens
+	f.pendingBytes -= batchSize(b.payload)
+	return b
+}
+
+// giveUp accounts for the given number of tokens that we failed to forward
+// for good.
+func (f *flusher) giveUp(tokens int, err error) {
+	m.numForwarded.With(prometheus.Labels{
+		outcome:  failBecause(fmt.Errorf("failed to forward tokens: %v", err)),
+		sinkName: f.sink.String(),
+	}).Add(float64(tokens))
+	m.numFlushFailures.With(prometheus.Labels{sinkName: f.sink.String()}).Inc()
+	l.Printf("Giving up on %d tokens for %s: %v", tokens, f.sink, err)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	for failed, max := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		d := retryBackoff(failed, time.Second, 5*time.Second)
+		if d < max/2 || d > max {
+			t.Fatalf("Expected backoff between %s and %s but got %s.", max/2, max, d)
+		}
+	}
+	// Many failed retries must not overflow our backoff.
+	if d := retryBackoff(1000, time.Second, 5*time.Second); d < 2500*time.Millisecond || d > 5*time.Second {
+		t.Fatalf("Expected capped backoff but got %s.", d)
+	}
+}
+
+func newRetryingFlusher(s sink, retryBuffer int) *flusher {
+	f := newFlusher(s, false)
+	f.setConfig(&config{flushRetryBuffer: retryBuffer})
+	f.minBackoff, f.maxBackoff = time.Millisecond, 10*time.Millisecond
+	return f
+}
+
+func TestFlushRetry(t *testing.T) {
+	s := &mockSink{err: errors.New("bridge is down")}
+	f := newRetryingFlusher(s, 10)
+	retries := m.numFlushRetries.WithLabelValues(s.String())
+	failures := m.numFlushFailures.WithLabelValues(s.String())
+	numRetries, numFailures := testutil.ToFloat64(retries), testutil.ToFloat64(failures)
+	f.start()
+
+	f.outbox() <- token("foo")
+	f.outbox() <- token("bar")
+	for testutil.ToFloat64(retries) < numRetries+2 {
+		time.Sleep(time.Millisecond)
+	}
+	assertEqual(t, errors.Is(f.ready(), ErrDownstream), true)
+	s.setErr(nil)
+	for s.numBatches() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	f.stop()
+
+	// Both batches made it, in order, and we didn't give up on either.
+	assertEqual(t, string(s.batches[0][0]), "foo")
+	assertEqual(t, string(s.batches[1][0]), "bar")
+	assertEqual(t, f.ready(), nil)
+	assertEqual(t, testutil.ToFloat64(failures), numFailures)
+}
+
+func TestRetryBufferFull(t *testing.T) {
+	s := &mockSink{err: errors.New("bridge is down")}
+	f := newRetryingFlusher(s, 2)
+	failures := m.numFlushFailures.WithLabelValues(s.String())
+	numFailures := testutil.ToFloat64(failures)
+
+	f.flush([]any{token("foo")})
+	f.flush([]any{token("bar")})
+	f.flush([]any{token("baz")})
+	// We gave up on our oldest batch to make room for the newest.
+	assertEqual(t, len(f.pending), 2)
+	assertEqual(t, f.pendingTokens, 2)
+	assertEqual(t, string(f.pending[0].payload[0]), "bar")
+	assertEqual(t, testutil.ToFloat64(failures), numFailures+1)
+
+	// Without a retry buffer, we give up right away.
+	f = newRetryingFlusher(s, 0)
+	f.flush([]any{token("foo")})
+	assertEqual(t, len(f.pending), 0)
+	assertEqual(t, testutil.ToFloat64(failures), numFailures+2)
+}
+
+func TestGiveUpOnStop(t *testing.T) {
+	s := &mockSink{err: errors.New("bridge is down")}
+	f := newRetryingFlusher(s, 10)
+	f.minBackoff, f.maxBackoff = time.Hour, time.Hour
+	failures := m.numFlushFailures.WithLabelValues(s.String())
+	numFailures := testutil.ToFloat64(failures)
+	f.start()
+
+	f.outbox() <- token("foo")
+	f.stop()
+	assertEqual(t, s.numBatches(), 0)
+	assertEqual(t, testutil.ToFloat64(failures), numFailures+1)
+}
+
+func TestRetention(t *testing.T) {
+	s := &mockSink{err: errors.New("bridge is down")}
+	f := newRetryingFlusher(s, 10)
+	f.retention = time.Minute
+	failures := m.numFlushFailures.WithLabelValues(s.String())
+	numFailures := testutil.ToFloat64(failures)
+
+	f.flush([]any{token("foo")})
+	f.flush([]any{token("bar")})
+	f.pending[0].created = time.Now().Add(-2 * time.Minute)
+	// We give up on the expired batch, and keep retrying the other.
+	f.retry()
+	assertEqual(t, len(f.pending), 1)
+	assertEqual(t, string(f.pending[0].payload[0]), "bar")
+	assertEqual(t, testutil.ToFloat64(failures), numFailures+1)
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	s := &mockSink{err: errors.New("bridge is down")}
+	f := newRetryingFlusher(s, 10)
+
+	f.flush([]any{token("foo")})
+	s.setErr(nil)
+	f.retry()
+	f.flush([]any{token("bar")})
+	// A retried batch keeps its idempotency key, and each batch has its
+	// own.
+	assertEqual(t, len(s.ids), 3)
+	assertEqual(t, s.ids[0], s.ids[1])
+	if s.ids[1] == s.ids[2] {
+		t.Fatal("Expected batches to have different idempotency keys.")
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	// signatureContext precedes each payload that we sign, so that our
+	// signatures cannot be mistaken for signatures over anything else.
+	signatureContext = "brave tokenizer flush signature v1\x00"
+	// keyHashTimeout determines how long we wait for our key's digest to
+	// be registered.
+	keyHashTimeout = time.Second * 10
+)
+
+// flushSigner signs flushed payloads with a key that we generate at startup
+// and that never leaves the enclave.  Consumers can verify that a payload
+// came from an attested tokenizer, rather than from the parent instance, if
+// the key's digest is part of our attestation documents.
+type flushSigner struct {
+	key ed25519.PrivateKey
+}
+
+func newFlushSigner() (*flushSigner, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate signing key: %w", err)
+	}
+	return &flushSigner{key: key}, nil
+}
+
+// publicKey returns our base64-encoded Ed25519 public key.
+func (s *flushSigner) publicKey() string {
+	return base64.StdEncoding.EncodeToString(s.key.Public().(ed25519.PublicKey))
+}
+
+// keyHash returns the base64-encoded SHA-256 digest of our public key.
+func (s *flushSigner) keyHash() string {
+	sum := sha256.Sum256(s.key.Public().(ed25519.PublicKey))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// signBatch prefixes each token of the given batch with our signature over the
+// token.  If the signer is nil, the batch is left untouched.
+func (s *flushSigner) signBatch(batch []token) []token {
+	if s == nil {
+		return batch
+	}
+	signed := make([]token, len(batch))
+	for i, t := range batch {
+		msg := append([]byte(signatureContext), t...)
+		signed[i] = append(ed25519.Sign(s.key, msg), t...)
+	}
+	return signed
+}
+
+// registerKeyHash posts the digest of our public key to the given URL, e.g.,
+// an endpoint that includes the digest in our attestation documents.
+func (s *flushSigner) registerKeyHash(url string) error {
+	client := &http.Client{Timeout: keyHashTimeout}
+	resp, err := client.Post(url, "text/plain", bytes.NewBufferString(s.keyHash()))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("key hash registration responded with %d", resp.StatusCode)
+	}
+	return nil
+}
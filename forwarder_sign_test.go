@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// verifySigned verifies the given signed token with the given base64-encoded
+// public key, and returns the token's payload.
+func verifySigned(t *testing.T, rawPub string, signed token) []byte {
+	t.Helper()
+
+	pub, err := base64.StdEncoding.DecodeString(rawPub)
+	if err != nil {
+		t.Fatalf("Failed to decode public key: %v", err)
+	}
+	sig, payload := signed[:ed25519.SignatureSize], signed[ed25519.SignatureSize:]
+	if !ed25519.Verify(pub, append([]byte(signatureContext), payload...), sig) {
+		t.Fatal("Signature is invalid.")
+	}
+	return payload
+}
+
+func TestSignBatch(t *testing.T) {
+	s, err := newFlushSigner()
+	if err != nil {
+		t.Fatalf("Failed to create signer: %v", err)
+	}
+	batch := []token{token("foo"), token("bar")}
+	signed := s.signBatch(batch)
+	assertEqual(t, len(signed), 2)
+	for i, st := range signed {
+		assertEqual(t, string(verifySigned(t, s.publicKey(), st)), string(batch[i]))
+	}
+
+	// A signature doesn't cover other payloads.
+	pub, _ := base64.StdEncoding.DecodeString(s.publicKey())
+	sig := signed[0][:ed25519.SignatureSize]
+	assertEqual(t, ed25519.Verify(pub, append([]byte(signatureContext), "baz"...), sig), false)
+
+	// Without a signer, the batch is left untouched.
+	var none *flushSigner
+	unsigned := none.signBatch(batch)
+	assertEqual(t, &unsigned[0][0], &batch[0][0])
+}
+
+func TestRegisterKeyHash(t *testing.T) {
+	s, err := newFlushSigner()
+	if err != nil {
+		t.Fatalf("Failed to create signer: %v", err)
+	}
+	status := http.StatusOK
+	var body []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = io.ReadAll(r.Body)
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	if err := s.registerKeyHash(srv.URL); err != nil {
+		t.Fatalf("Failed to register key hash: %v", err)
+	}
+	pub, _ := base64.StdEncoding.DecodeString(s.publicKey())
+	sum := sha256.Sum256(pub)
+	assertEqual(t, string(body), base64.StdEncoding.EncodeToString(sum[:]))
+
+	status = http.StatusInternalServerError
+	if err := s.registerKeyHash(srv.URL); err == nil {
+		t.Error("Expected error but got none.")
+	}
+}
+
+func TestFlusherSignature(t *testing.T) {
+	_, c, err := parseFlags("tkzr", []string{"-sign-flushes"})
+	if err != nil {
+		t.Fatalf("Failed to parse flags: %v", err)
+	}
+	if _, _, err := parseFlags("tkzr", []string{"-key-hash-url", "http://127.0.0.1"}); err == nil {
+		t.Error("Expected error but got none.")
+	}
+
+	s := &mockSink{}
+	f := newFlusher(s, false)
+	f.setConfig(c)
+	f.flush([]any{token("foo")})
+	assertEqual(t, s.numBatches(), 1)
+	assertEqual(t, string(verifySigned(t, c.flushSigner.publicKey(), s.batches[0][0])), "foo")
+
+	// Our /version endpoint publishes the public key.
+	w := newWebReceiver().(*webReceiver)
+	w.setConfig(c)
+	srv := httptest.NewServer(w.router)
+	defer srv.Close()
+	resp := makeReq(t, srv, http.MethodGet, "/version", nil)
+	var v versionInfo
+	if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+		t.Fatalf("Failed to decode version information: %v", err)
+	}
+	assertEqual(t, v.SigningKey, c.flushSigner.publicKey())
+}
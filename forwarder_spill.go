@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	uuid "github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// defaultSpillMaxBytes is the default size limit of each flusher's
+	// spill queue.
+	defaultSpillMaxBytes = 64 << 20
+	// Spilled batches are named "spill-<queue ID>-<sequence number>".
+	spillFilePrefix = "spill-"
+)
+
+var (
+	errSpillFull    = errors.New("spill queue full")
+	errSpillCorrupt = errors.New("spilled batch is corrupt")
+)
+
+// spillQueue keeps the batches that don't fit in a flusher's retry buffer in
+// a directory that should be on a tmpfs, so that a sink that's down for
+// longer than our memory allows doesn't make us lose data.  Each batch is a
+// file, encrypted with a key that only exists in our memory: even if the
+// directory isn't on a tmpfs, what we spill is useless to anyone outside the
+// enclave, and to our next incarnation.  If the queue reaches its size limit,
+// we evict the oldest batches.  A spill queue is only used by its flusher's
+// goroutine.
+type spillQueue struct {
+	id       uuid.UUID
+	dir      string
+	maxBytes int64
+	aead     cipher.AEAD
+	seq      uint64
+	size     int64
+	// entries contains our batches, oldest first.
+	entries []*spillEntry
+	// sink is our flusher's sink name, for our metrics.
+	sink string
+}
+
+// spillEntry describes a spilled batch.  We keep everything but the payload
+// in memory.
+type spillEntry struct {
+	path    string
+	id      uuid.UUID
+	created time.Time
+	tokens  int
+	size    int64
+}
+
+// newSpillQueue returns a spill queue in the given directory, with a fresh
+// key.
+func newSpillQueue(dir string, maxBytes int64, sink string) (*spillQueue, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &spillQueue{
+		id:       uuid.New(),
+		dir:      dir,
+		maxBytes: maxBytes,
+		aead:     aead,
+		sink:     sink,
+	}, nil
+}
+
+// len returns the number of spilled batches.  A nil queue is empty.
+func (q *spillQueue) len() int {
+	if q == nil {
+		return 0
+	}
+	return len(q.entries)
+}
+
+// oldest returns our oldest batch's entry.  The queue must not be empty.
+func (q *spillQueue) oldest() *spillEntry {
+	return q.entries[0]
+}
+
+// push spills the given batch.  To make room for it, we evict our oldest
+// batches, which we return, so that the caller can account for them.
+func (q *spillQueue) push(b *pendingBatch) ([]*spillEntry, error) {
+	nonce := make([]byte, q.aead.NonceSize(), q.aead.NonceSize()+q.aead.Overhead()+batchSize(b.payload))
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	ciphertext := q.aead.Seal(nonce, nonce, marshalPayload(b.payload), b.id[:])
+	size := int64(len(ciphertext))
+	if size > q.maxBytes {
+		return nil, errSpillFull
+	}
+	var evicted []*spillEntry
+	for q.size+size > q.maxBytes {
+		evicted = append(evicted, q.oldest())
+		q.remove()
+	}
+
+	q.seq++
+	path := filepath.Join(q.dir, fmt.Sprintf("%s%s-%010d", spillFilePrefix, q.id, q.seq))
+	if err := os.WriteFile(path, ciphertext, 0o600); err != nil {
+		os.Remove(path)
+		return evicted, err
+	}
+	q.entries = append(q.entries, &spillEntry{
+		path:    path,
+		id:      b.id,
+		created: b.created,
+		tokens:  b.tokens,
+		size:    size,
+	})
+	q.addBytes(size)
+	return evicted, nil
+}
+
+// load reads and decrypts the given entry's batch.
+func (q *spillQueue) load(e *spillEntry) (*pendingBatch, error) {
+	ciphertext, err := os.ReadFile(e.path)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < q.aead.NonceSize() {
+		return nil, errSpillCorrupt
+	}
+	nonce, ciphertext := ciphertext[:q.aead.NonceSize()], ciphertext[q.aead.NonceSize():]
+	plaintext, err := q.aead.Open(nil, nonce, ciphertext, e.id[:])
+	if err != nil {
+		return nil, errSpillCorrupt
+	}
+	payload, err := unmarshalPayload(plaintext)
+	if err != nil {
+		return nil, err
+	}
+	return &pendingBatch{id: e.id, created: e.created, payload: payload, tokens: e.tokens}, nil
+}
+
+// remove deletes our oldest batch.  The queue must not be empty.
+func (q *spillQueue) remove() {
+	e := q.oldest()
+	if err := os.Remove(e.path); err != nil {
+		l.Printf("Failed to remove spilled batch: %v", err)
+	}
+	q.entries = q.entries[1:]
+	q.addBytes(-e.size)
+}
+
+// addBytes accounts for the given number of bytes.  A flusher's workers each
+// have their own queue, so our metric adds up their sizes.
+func (q *spillQueue) addBytes(n int64) {
+	q.size += n
+	m.flushSpillBytes.With(prometheus.Labels{sinkName: q.sink}).Add(float64(n))
+}
+
+// batchSize returns the total size of the given payload's tokens.
+func batchSize(payload []token) int {
+	n := 0
+	for _, t := range payload {
+		n += len(t)
+	}
+	return n
+}
+
+// marshalPayload encodes the given payload as its number of tokens, followed
+// by each token's length and bytes, all lengths as unsigned varints.
+func marshalPayload(payload []token) []byte {
+	b := make([]byte, 0, binary.MaxVarintLen64*(len(payload)+1)+batchSize(payload))
+	b = binary.AppendUvarint(b, uint64(len(payload)))
+	for _, t := range payload {
+		b = binary.AppendUvarint(b, uint64(len(t)))
+		b = append(b, t...)
+	}
+	return b
+}
+
+func unmarshalPayload(b []byte) ([]token, error) {
+	n, read := binary.Uvarint(b)
+	if read <= 0 || n > uint64(len(b)) {
+		return nil, errSpillCorrupt
+	}
+	b = b[read:]
+	payload := make([]token, 0, n)
+	for i := uint64(0); i < n; i++ {
+		size, read := binary.Uvarint(b)
+		if read <= 0 || size > uint64(len(b)-read) {
+			return nil, errSpillCorrupt
+		}
+		b = b[read:]
+		payload = append(payload, token(b[:size]))
+		b = b[size:]
+	}
+	if len(b) != 0 {
+		return nil, errSpillCorrupt
+	}
+	return payload, nil
+}
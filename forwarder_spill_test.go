@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestMarshalPayload(t *testing.T) {
+	for _, payload := range [][]token{
+		{},
+		{token("")},
+		{token("foo"), token("bar"), token(bytes.Repeat([]byte("x"), 300))},
+	} {
+		got, err := unmarshalPayload(marshalPayload(payload))
+		if err != nil {
+			t.Fatalf("Failed to unmarshal payload: %v", err)
+		}
+		assertEqual(t, len(got), len(payload))
+		for i := range payload {
+			assertEqual(t, string(got[i]), string(payload[i]))
+		}
+	}
+
+	b := marshalPayload([]token{token("foo")})
+	for _, corrupt := range [][]byte{nil, b[:len(b)-1], append(b, 0), {0xff}} {
+		if _, err := unmarshalPayload(corrupt); err == nil {
+			t.Fatalf("Expected error for corrupt payload %x.", corrupt)
+		}
+	}
+}
+
+func TestSpillQueue(t *testing.T) {
+	dir := t.TempDir()
+	b1 := newPendingBatch([]token{token("foo")}, 1)
+	b2 := newPendingBatch([]token{token("bar"), token("baz")}, 2)
+	q, err := newSpillQueue(dir, 1000, "mock")
+	if err != nil {
+		t.Fatalf("Failed to create spill queue: %v", err)
+	}
+	assertEqual(t, (*spillQueue)(nil).len(), 0)
+
+	for _, b := range []*pendingBatch{b1, b2} {
+		if evicted, err := q.push(b); err != nil || len(evicted) != 0 {
+			t.Fatalf("Failed to spill batch: %v", err)
+		}
+	}
+	assertEqual(t, q.len(), 2)
+	// What we spill is encrypted.
+	ciphertext, err := os.ReadFile(q.oldest().path)
+	if err != nil {
+		t.Fatalf("Failed to read spilled batch: %v", err)
+	}
+	if bytes.Contains(ciphertext, []byte("foo")) {
+		t.Fatal("Expected spilled batch to be encrypted.")
+	}
+	b, err := q.load(q.oldest())
+	if err != nil {
+		t.Fatalf("Failed to load spilled batch: %v", err)
+	}
+	assertEqual(t, b.id, b1.id)
+	assertEqual(t, b.tokens, 1)
+	assertEqual(t, string(b.payload[0]), "foo")
+
+	// Tampered batches fail to load.
+	ciphertext[len(ciphertext)-1] ^= 1
+	if err := os.WriteFile(q.oldest().path, ciphertext, 0o600); err != nil {
+		t.Fatalf("Failed to write spilled batch: %v", err)
+	}
+	if _, err := q.load(q.oldest()); !errors.Is(err, errSpillCorrupt) {
+		t.Fatalf("Expected %v but got %v.", errSpillCorrupt, err)
+	}
+
+	// Once the queue is full, we evict the oldest batches.
+	q.maxBytes = q.size
+	evicted, err := q.push(newPendingBatch([]token{token("qux")}, 1))
+	if err != nil {
+		t.Fatalf("Failed to spill batch: %v", err)
+	}
+	assertEqual(t, len(evicted), 1)
+	assertEqual(t, evicted[0].id, b1.id)
+	assertEqual(t, q.len(), 2)
+	if _, err := os.Stat(evicted[0].path); !os.IsNotExist(err) {
+		t.Fatal("Expected evicted batch to be removed.")
+	}
+	// Batches that are larger than the entire queue are rejected.
+	q.maxBytes = 1
+	if _, err := q.push(b2); !errors.Is(err, errSpillFull) {
+		t.Fatalf("Expected %v but got %v.", errSpillFull, err)
+	}
+}
+
+func TestFlusherSpill(t *testing.T) {
+	dir := t.TempDir()
+	s := &mockSink{err: errors.New("bridge is down")}
+	f := newFlusher(s, false)
+	f.setConfig(&config{
+		flushRetryBuffer:   1,
+		flushSpillDir:      dir,
+		flushSpillMaxBytes: defaultSpillMaxBytes,
+	})
+
+	f.flush([]any{token("foo")})
+	f.flush([]any{token("bar")})
+	f.flush([]any{token("baz")})
+	// Our retry buffer only has room for one batch, so we spilled the
+	// others.
+	assertEqual(t, len(f.pending), 1)
+	assertEqual(t, f.spill.len(), 2)
+
+	// Once our sink recovers, we replay our batches, oldest first.
+	s.setErr(nil)
+	f.retry()
+	assertEqual(t, f.numPending(), 0)
+	assertEqual(t, s.numBatches(), 3)
+	for i, want := range []string{"foo", "bar", "baz"} {
+		assertEqual(t, string(s.batches[i][0]), want)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("Failed to read spill directory: %v", err)
+	}
+	assertEqual(t, len(entries), 0)
+}
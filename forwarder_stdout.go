@@ -1,40 +1,24 @@
 package main
 
-import "fmt"
+import (
+	"context"
+	"fmt"
+)
 
-// stdoutForwarder implements a forwarder that prints all data to stdout.
-type stdoutForwarder struct {
-	out  chan token
-	done chan empty
-}
+// stdoutSink implements a sink that prints all data to stdout.
+type stdoutSink struct{}
 
 func newStdoutForwarder() forwarder {
-	return &stdoutForwarder{
-		out:  make(chan token),
-		done: make(chan empty),
-	}
-}
-
-func (s *stdoutForwarder) setConfig(c *config) {}
-
-func (s *stdoutForwarder) outbox() chan token {
-	return s.out
+	return newFlusher(stdoutSink{}, false)
 }
 
-func (s *stdoutForwarder) start() {
-	go func() {
-		for {
-			select {
-			case <-s.done:
-				return
-			case t := <-s.out:
-				l.Println("Received token from aggregator.")
-				fmt.Println(string(t))
-			}
-		}
-	}()
+func (s stdoutSink) flush(ctx context.Context, batch []token) error {
+	for _, t := range batch {
+		fmt.Println(string(t))
+	}
+	return nil
 }
 
-func (s *stdoutForwarder) stop() {
-	close(s.done)
+func (s stdoutSink) String() string {
+	return "stdout"
 }
@@ -1,9 +1,57 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"sync"
 	"testing"
+	"time"
+
+	uuid "github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
+// mockSink implements a sink that remembers the batches that it was asked to
+// flush and the IDs of all attempts, and fails with err if set.
+type mockSink struct {
+	sync.Mutex
+	batches [][]token
+	ids     []uuid.UUID
+	err     error
+}
+
+func (s *mockSink) flush(ctx context.Context, batch []token) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if id, ok := batchID(ctx); ok {
+		s.ids = append(s.ids, id)
+	}
+	if s.err != nil {
+		return s.err
+	}
+	s.batches = append(s.batches, batch)
+	return nil
+}
+
+func (s *mockSink) String() string {
+	return "mock"
+}
+
+func (s *mockSink) setErr(err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.err = err
+}
+
+func (s *mockSink) numBatches() int {
+	s.Lock()
+	defer s.Unlock()
+
+	return len(s.batches)
+}
+
 func TestForwarderStartStop(t *testing.T) {
 	c := &config{
 		kafkaConfig: createKafkaConf(t),
@@ -15,3 +63,103 @@ func TestForwarderStartStop(t *testing.T) {
 		f.stop()
 	}
 }
+
+func TestFlush(t *testing.T) {
+	maxBatchSize := 2
+	s := &mockSink{}
+	f := newFlusher(s, true)
+	f.setConfig(&config{
+		kafkaConfig: &kafkaConfig{
+			batchPeriod: defaultBatchPeriod,
+			batchSize:   maxBatchSize,
+		},
+	})
+	f.tokenCache.start()
+	defer f.tokenCache.stop()
+
+	f.tokenCache.submit(token([]byte("foo")))
+	f.maybeFlush()
+	f.tokenCache.submit(token([]byte("bar")))
+	f.maybeFlush()
+	assertEqual(t, f.tokenCache.len(), maxBatchSize)
+	assertEqual(t, s.numBatches(), 0)
+
+	f.tokenCache.submit(token([]byte("foo")))
+	f.maybeFlush()
+	assertEqual(t, f.tokenCache.len(), 0)
+	assertEqual(t, s.numBatches(), 1)
+	assertEqual(t, len(s.batches[0]), 3)
+	assertEqual(t, f.ready(), nil)
+
+	// Failed flushes make us unready until the next flush succeeds.
+	s.setErr(errors.New("broker is down"))
+	f.flush([]any{token("foo")})
+	assertEqual(t, errors.Is(f.ready(), ErrDownstream), true)
+	s.setErr(nil)
+	f.flush([]any{token("foo")})
+	assertEqual(t, f.ready(), nil)
+}
+
+func TestUnbatchedFlush(t *testing.T) {
+	s := &mockSink{}
+	f := newFlusher(s, false)
+	f.setConfig(&config{})
+	f.start()
+
+	f.outbox() <- token("foo")
+	f.outbox() <- token("bar")
+	f.stop()
+	assertEqual(t, s.numBatches(), 2)
+}
+
+func TestFlushOnStop(t *testing.T) {
+	s := &mockSink{}
+	f := newFlusher(s, true)
+	f.setConfig(&config{kafkaConfig: &kafkaConfig{
+		batchPeriod: defaultBatchPeriod,
+		batchSize:   defaultBatchSize,
+	}})
+	f.start()
+
+	// Our batch is neither large nor old enough to be flushed, so only
+	// stopping the forwarder flushes it.
+	f.outbox() <- token("foo")
+	f.outbox() <- token("bar")
+	f.stop()
+
+	assertEqual(t, s.numBatches(), 1)
+	assertEqual(t, len(s.batches[0]), 2)
+}
+
+// blockingSink implements a sink whose flushes block until their context is
+// done.
+type blockingSink struct {
+	flushing chan empty
+}
+
+func (s *blockingSink) flush(ctx context.Context, batch []token) error {
+	s.flushing <- empty{}
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (s *blockingSink) String() string {
+	return "blocking"
+}
+
+func TestStopTimeout(t *testing.T) {
+	s := &blockingSink{flushing: make(chan empty, 1)}
+	f := newFlusher(s, false)
+	f.setConfig(&config{flushRetryBuffer: 10})
+	f.stopTimeout = 10 * time.Millisecond
+	failures := m.numFlushFailures.WithLabelValues(s.String())
+	numFailures := testutil.ToFloat64(failures)
+	f.start()
+
+	// A sink that hangs cannot keep us from stopping: we give up on the
+	// batch once our stop timeout is over.
+	f.outbox() <- token("foo")
+	<-s.flushing
+	f.stop()
+	assertEqual(t, testutil.ToFloat64(failures), numFailures+1)
+}
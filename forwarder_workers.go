@@ -0,0 +1,114 @@
+package main
+
+import (
+	"hash/fnv"
+)
+
+// Flushers with more than one worker hand their tokens to worker flushers
+// that share their sink.  Each worker batches, encodes, compresses, and sends
+// its tokens independently of the others, so that encoding and compressing
+// large batches doesn't make us fall behind at peak traffic.  Without
+// per-wallet ordering, workers take tokens from our outbox as they become
+// idle.  With per-wallet ordering, we hand each token to the worker that's
+// responsible for the token's wallet, so that a wallet's records reach the
+// sink in the order in which we got them.  Tokens without a wallet, e.g.,
+// commit records, go to our first worker.
+
+// newWorkers creates the given number of workers.  Our retry buffer and spill
+// queue limits apply to all of our workers together, so each worker gets an
+// even share.  The caller must hold our lock.
+func (f *flusher) newWorkers(c *config) {
+	f.ordered = c.flushOrdered
+	workerConf := *c
+	workerConf.flushRetryBuffer = int(shareOf(int64(c.flushRetryBuffer), c.flushWorkers))
+	workerConf.flushSpillMaxBytes = shareOf(c.flushSpillMaxBytes, c.flushWorkers)
+	for i := 0; i < c.flushWorkers; i++ {
+		w := newFlusher(f.sink, f.batched)
+		w.isWorker = true
+		if !f.ordered {
+			w.out = f.out
+		}
+		w.setConfig(&workerConf)
+		f.workers = append(f.workers, w)
+	}
+}
+
+// shareOf returns each of the given number of workers' share of the given
+// limit.  A positive limit leaves each worker a share of at least 1.
+func shareOf(limit int64, workers int) int64 {
+	share := limit / int64(workers)
+	if limit > 0 && share == 0 {
+		return 1
+	}
+	return share
+}
+
+// startWorkers starts our workers and, if we guarantee per-wallet ordering,
+// hands each token to the worker that's responsible for its wallet.
+func (f *flusher) startWorkers() {
+	for _, w := range f.workers {
+		w.start()
+	}
+	if !f.ordered {
+		return
+	}
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+		for {
+			select {
+			case <-f.done:
+				return
+			case t := <-f.out:
+				w := f.workers[workerFor(t, len(f.workers))]
+				select {
+				case w.out <- t:
+				case <-f.done:
+					// We're shutting down.  The worker gets the
+					// token unless it stops first, e.g., because
+					// it's blocked by its memory limit.
+					select {
+					case w.out <- t:
+					case <-w.done:
+					}
+					return
+				}
+			}
+		}
+	}()
+}
+
+// stopWorkers stops our workers, which flush at the same time, and then waits
+// until we stopped handing them tokens.
+func (f *flusher) stopWorkers() {
+	close(f.done)
+	workers := make([]forwarder, len(f.workers))
+	for i, w := range f.workers {
+		workers[i] = w
+	}
+	stopAll(workers)
+	f.wg.Wait()
+}
+
+// workersReady returns nil if none of our workers' most recent flushes
+// failed.
+func (f *flusher) workersReady() error {
+	for _, w := range f.workers {
+		if err := w.ready(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// workerFor returns the index of the worker (out of the given number) that's
+// responsible for the given token's wallet.
+func workerFor(t token, n int) int {
+	key := walletKey(t)
+	if key == nil {
+		return 0
+	}
+	h := fnv.New32a()
+	h.Write(key)
+	return int(h.Sum32() % uint32(n))
+}
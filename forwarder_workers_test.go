@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	uuid "github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestFlushWorkers(t *testing.T) {
+	s := &mockSink{}
+	f := newFlusher(s, false)
+	f.setConfig(&config{flushWorkers: 4})
+	assertEqual(t, len(f.workers), 4)
+	f.start()
+
+	for i := 0; i < 100; i++ {
+		f.outbox() <- token(fmt.Sprintf("%d", i))
+	}
+	f.stop()
+	// Our workers flushed all tokens exactly once.
+	seen := make(map[string]bool)
+	for _, batch := range s.batches {
+		for _, t := range batch {
+			seen[string(t)] = true
+		}
+	}
+	assertEqual(t, len(seen), 100)
+	assertEqual(t, f.ready(), nil)
+}
+
+func TestOrderedFlushWorkers(t *testing.T) {
+	s := &mockSink{}
+	f := newFlusher(s, false)
+	f.setConfig(&config{flushWorkers: 4, flushOrdered: true})
+	f.start()
+
+	// Each wallet's records are numbered by their address.
+	kID, wallets := keyID{newV4(t)}, []uuid.UUID{newV4(t), newV4(t), newV4(t), newV4(t), newV4(t)}
+	for i := 0; i < 20; i++ {
+		for _, walletID := range wallets {
+			addr := fmt.Sprintf("1.1.1.%d", i)
+			msg, err := compileKafkaMsg(kID, walletID, AddressSet{addr: empty{}}, nil, time.Now(), uuid.Nil)
+			if err != nil {
+				t.Fatalf("Failed to compile Kafka message: %v", err)
+			}
+			f.outbox() <- token(msg)
+		}
+	}
+	f.stop()
+
+	next := make(map[string]int)
+	for _, batch := range s.batches {
+		for _, rec := range batch {
+			r, err := flattenRecord(rec)
+			if err != nil {
+				t.Fatalf("Failed to decode record: %v", err)
+			}
+			assertEqual(t, r.Addrs[0], fmt.Sprintf("1.1.1.%d", next[r.WalletID]))
+			next[r.WalletID]++
+		}
+	}
+	assertEqual(t, len(next), len(wallets))
+}
+
+func TestStopBlockedWorkers(t *testing.T) {
+	s := &mockSink{err: errors.New("bridge is down")}
+	f := newFlusher(s, true)
+	f.setConfig(&config{
+		kafkaConfig:        &kafkaConfig{batchSize: 1, batchPeriod: time.Hour},
+		flushRetryBuffer:   10,
+		flushMemoryRecords: 1,
+		flushDropPolicy:    dropBlock,
+		flushWorkers:       2,
+		flushOrdered:       true,
+	})
+	f.start()
+
+	// Tokens without a wallet go to our first worker, which blocks after
+	// the first token, so we're stuck handing it the second.  That must
+	// not keep us from shutting down.
+	f.outbox() <- token("foo")
+	f.outbox() <- token("bar")
+	stopped := make(chan empty)
+	go func() {
+		f.stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second * 5):
+		t.Fatal("Expected flusher with blocked workers to stop.")
+	}
+}
+
+func TestWorkerFor(t *testing.T) {
+	msg, err := compileKafkaMsg(keyID{newV4(t)}, newV4(t), AddressSet{"1.1.1.1": empty{}}, nil, time.Now(), uuid.Nil)
+	if err != nil {
+		t.Fatalf("Failed to compile Kafka message: %v", err)
+	}
+	// A wallet always maps to the same worker, and tokens without a wallet
+	// map to the first.
+	w := workerFor(msg, 8)
+	if w < 0 || w >= 8 {
+		t.Fatalf("Expected worker in [0, 8) but got %d.", w)
+	}
+	assertEqual(t, workerFor(msg, 8), w)
+	assertEqual(t, workerFor(token("foo"), 8), 0)
+}
+
+func TestFlushWorkerLimits(t *testing.T) {
+	f := newFlusher(&mockSink{}, false)
+	f.setConfig(&config{
+		flushWorkers:       4,
+		flushRetryBuffer:   100,
+		flushSpillDir:      t.TempDir(),
+		flushSpillMaxBytes: 1000,
+	})
+	// Our workers share our limits, rather than each getting them in full.
+	for _, w := range f.workers {
+		assertEqual(t, w.retryBuffer, 25)
+		assertEqual(t, w.spill.maxBytes, int64(250))
+	}
+
+	// Our metric accounts for all of our workers' spilled batches.
+	spilled := m.flushSpillBytes.WithLabelValues(f.sink.String())
+	before := testutil.ToFloat64(spilled)
+	var total int64
+	for _, w := range f.workers[:2] {
+		if _, err := w.spill.push(newPendingBatch([]token{token("foo")}, 1)); err != nil {
+			t.Fatalf("Failed to spill batch: %v", err)
+		}
+		total += w.spill.size
+	}
+	assertEqual(t, testutil.ToFloat64(spilled), before+float64(total))
+
+	assertEqual(t, shareOf(0, 4), int64(0))
+	assertEqual(t, shareOf(3, 4), int64(1))
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var errShuttingDown = newError(ErrOverloaded, "shutting down")
+
+// health keeps track of the components that can tell if they're ready to
+// process requests.  Both the Web receiver and our privileged endpoints
+// expose it, so that load balancers and the parent instance can stop sending
+// traffic to a tokenizer that's wedged.
+var health = newReadiness()
+
+// readinessChecker is implemented by components that depend on something that
+// may not be available, e.g., a key or a Kafka broker.  ready returns nil if
+// the component is ready to process requests.
+type readinessChecker interface {
+	ready() error
+}
+
+// readiness aggregates the readiness of our components.
+type readiness struct {
+	sync.RWMutex
+	checks   map[string]readinessChecker
+	draining bool
+}
+
+func newReadiness() *readiness {
+	return &readiness{checks: make(map[string]readinessChecker)}
+}
+
+// use replaces our readiness checks with the given components' checks.
+// Components that don't implement readinessChecker are ignored.
+func (r *readiness) use(components map[string]any) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.checks = make(map[string]readinessChecker)
+	r.draining = false
+	for name, c := range components {
+		if checker, ok := c.(readinessChecker); ok {
+			r.checks[name] = checker
+		}
+	}
+}
+
+// drain marks us as not ready because we're shutting down.
+func (r *readiness) drain() {
+	r.Lock()
+	defer r.Unlock()
+
+	r.draining = true
+}
+
+// failures returns a sorted list of the checks that failed, or nil if we're
+// ready.
+func (r *readiness) failures() []string {
+	r.RLock()
+	defer r.RUnlock()
+
+	if r.draining {
+		return []string{errShuttingDown.Error()}
+	}
+	var failures []string
+	for name, checker := range r.checks {
+		if err := checker.ready(); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+	sort.Strings(failures)
+	return failures
+}
+
+// healthzHandler tells the caller that we're alive, i.e., able to respond to
+// HTTP requests.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// readyzHandler tells the caller if we're ready to process requests.  If
+// we're not, the response body lists the reasons.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if failures := health.failures(); failures != nil {
+		http.Error(w, strings.Join(failures, "\n"), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type dummyChecker struct {
+	err error
+}
+
+func (d *dummyChecker) ready() error {
+	return d.err
+}
+
+func TestReadiness(t *testing.T) {
+	r := newReadiness()
+	checker := &dummyChecker{}
+	r.use(map[string]any{
+		"foo": checker,
+		// Components that don't implement readinessChecker are ignored.
+		"bar": struct{}{},
+	})
+	assertEqual(t, len(r.failures()), 0)
+
+	checker.err = errors.New("not ready")
+	assertEqual(t, strings.Join(r.failures(), "\n"), "foo: not ready")
+
+	// Once we're draining, we're no longer ready, regardless of our
+	// components.
+	checker.err = nil
+	r.drain()
+	assertEqual(t, strings.Join(r.failures(), "\n"), errShuttingDown.Error())
+
+	// Using new components resets our state.
+	r.use(map[string]any{})
+	assertEqual(t, len(r.failures()), 0)
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	defer health.use(map[string]any{})
+	srv := httptest.NewServer(newTestRouter(make(chan serializer)))
+	defer srv.Close()
+
+	// Without a key, our tokenizer isn't ready yet.
+	tkzr := newCryptoPAnTokenizer()
+	health.use(map[string]any{"tokenizer": tkzr})
+	resp := makeReq(t, srv, http.MethodGet, "/healthz", nil)
+	assertEqual(t, resp.StatusCode, http.StatusOK)
+	resp = makeReq(t, srv, http.MethodGet, "/readyz", nil)
+	assertEqual(t, resp.StatusCode, http.StatusServiceUnavailable)
+	body, _ := io.ReadAll(resp.Body)
+	assertEqual(t, strings.TrimSpace(string(body)), "tokenizer: "+errNoKey.Error())
+
+	if err := tkzr.resetKey(); err != nil {
+		t.Fatalf("Failed to reset key: %v", err)
+	}
+	resp = makeReq(t, srv, http.MethodGet, "/readyz", nil)
+	assertEqual(t, resp.StatusCode, http.StatusOK)
+
+	// The admin router exposes the same endpoints.
+	admin := httptest.NewServer(newAdminRouter(nil, nil))
+	defer admin.Close()
+	resp = makeReq(t, admin, http.MethodGet, "/readyz", nil)
+	assertEqual(t, resp.StatusCode, http.StatusOK)
+}
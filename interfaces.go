@@ -15,6 +15,9 @@ package main
 //                 ┗━━━━━━━━━━━┛
 
 import (
+	"crypto/ecdh"
+	"crypto/tls"
+	"net"
 	"time"
 
 	uuid "github.com/google/uuid"
@@ -31,12 +34,118 @@ func (b blob) bytes() []byte {
 // structure.  Considering that we have few and simple components for now,
 // that's acceptable.
 type config struct {
-	kafkaConfig      *kafkaConfig
-	fwdInterval      time.Duration
-	keyExpiry        time.Duration
-	port             uint16
-	prometheusPort   uint16
-	exposePrometheus bool
+	kafkaConfig       *kafkaConfig
+	fwdInterval       time.Duration
+	keyExpiry         time.Duration
+	port              uint16
+	prometheusPort    uint16
+	exposePrometheus  bool
+	addrHeader        string
+	trustedProxies    int
+	trustedNets       []*net.IPNet
+	edgeAuth          *edgeAuthConfig
+	webTLSConfig      *tls.Config
+	walletRate        float64
+	walletBurst       int
+	dedupWindow       time.Duration
+	dedupSize         int
+	rejectNonPublic   bool
+	maxWalletsPerAddr int
+	addrScopeFile     string
+	udpPort           uint16
+	udpAddr           string
+	unixSocket        string
+	httpTuning        httpTuning
+	inboxSize         int
+	commitRecords     bool
+	recordRequestIDs  bool
+	sunsets           map[int]time.Time
+	csrf              *csrfConfig
+	// overflowDir is the directory of the Web receiver's overflow buffer, or
+	// empty if the buffer is disabled.
+	overflowDir      string
+	overflowMaxBytes int64
+	// profileDir is the directory in which our profiler keeps its profiles,
+	// and profileThreshold is the p99 latency that triggers a capture.
+	profileDir       string
+	profileThreshold time.Duration
+	// outputFile is the file forwarder's output file, or empty for stdout.
+	outputFile string
+	// cryptoPAnVectors is the path to a file with Crypto-PAn test vectors.
+	// If set, we verify the vectors and exit.
+	cryptoPAnVectors string
+	// windows contains the address aggregator's additional windows.
+	windows []windowSpec
+	// flushFormat is the format in which forwarders flush batches.
+	flushFormat string
+	// flushCompression is the algorithm that forwarders compress batches
+	// with.
+	flushCompression string
+	// flushEnvelope determines if forwarders wrap each record in an
+	// envelope with metadata.
+	flushEnvelope bool
+	// timestampPrecision is the precision that we truncate our records'
+	// timestamps to, so that they cannot be correlated with edge logs.
+	timestampPrecision time.Duration
+	// flushRecipient is the public key that forwarders encrypt each
+	// payload to, if any.
+	flushRecipient *ecdh.PublicKey
+	// flushSigner signs each flushed payload, if set, and keyHashURL is
+	// where we register the digest of its public key.
+	flushSigner *flushSigner
+	keyHashURL  string
+	// flushRetryBuffer is the number of tokens that each forwarder keeps
+	// buffered while it retries failed flushes.
+	flushRetryBuffer int
+	// flushRetention is the time after which forwarders give up on
+	// unacknowledged batches, or 0 for no limit.
+	flushRetention time.Duration
+	// flushSpillDir is the directory in which forwarders spill the batches
+	// that don't fit in their retry buffer, or empty if spilling is
+	// disabled.
+	flushSpillDir      string
+	flushSpillMaxBytes int64
+	// flushWorkers is the number of workers that each forwarder flushes
+	// with, and flushOrdered determines if forwarders with several workers
+	// keep each wallet's records in order.
+	flushWorkers int
+	flushOrdered bool
+	// flushMemoryRecords and flushMemoryBytes cap what each flusher holds
+	// in memory, and flushDropPolicy determines what happens once a
+	// flusher reaches the cap.
+	flushMemoryRecords int
+	flushMemoryBytes   int
+	flushDropPolicy    string
+	// flushMaxRecords and flushMaxBytes make the address aggregator flush
+	// its window early once it reaches that many records or bytes.
+	flushMaxRecords int
+	flushMaxBytes   int
+	// tokenizer is the name of the tokenizer that we use.
+	tokenizer    string
+	expectedPCRs map[string]string
+	// echoWallet is the test wallet whose requests are answered with the
+	// anonymized address, or uuid.Nil if debug echo mode is disabled.
+	echoWallet uuid.UUID
+}
+
+// httpTuning contains the knobs of our HTTP servers.  The zero value
+// represents net/http's defaults.
+type httpTuning struct {
+	disableHTTP2      bool
+	disableKeepAlives bool
+	// Timeouts protect us from clients that hold on to connections without
+	// making progress, e.g., slowloris attacks.
+	readHeaderTimeout time.Duration
+	readTimeout       time.Duration
+	writeTimeout      time.Duration
+	// idleTimeout determines how long we keep idle keep-alive connections
+	// open.
+	idleTimeout time.Duration
+	// maxHeaderBytes limits the size of request headers.
+	maxHeaderBytes int
+	// listenBacklog is the maximum number of pending connections, or 0 for
+	// the operating system's default.
+	listenBacklog int
 }
 
 type components struct {
@@ -44,6 +153,9 @@ type components struct {
 	a aggregator
 	t tokenizer
 	f forwarder
+	// windows contains the forwarders of the aggregator's additional
+	// windows, if any.
+	windows []windowForwarder
 }
 
 type keyID struct {
@@ -55,6 +167,12 @@ type serializer interface {
 	bytes() []byte
 }
 
+// acknowledger allows for telling a receiver if the data that it sent was
+// processed successfully.
+type acknowledger interface {
+	acknowledge(error)
+}
+
 // configurer allows for setting the configuration.
 type configurer interface {
 	setConfig(*config)
@@ -6,10 +6,16 @@ import (
 	"fmt"
 	"log"
 	"math"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/go-chi/chi/v5"
 	uuid "github.com/google/uuid"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
@@ -21,13 +27,24 @@ const (
 
 	forwarderStdout = "stdout"
 	forwarderKafka  = "kafka"
+	forwarderNull   = "null"
+	forwarderFile   = "file"
 
 	receiverWeb   = "web"
 	receiverStdin = "stdin"
+	receiverKafka = "kafka"
+	receiverVsock = "vsock"
+	receiverUDP   = "udp"
+	receiverUnix  = "unix"
 
 	aggregatorSimple = "simple"
 	aggregatorAddr   = "address"
 
+	// minFwdInterval is the shortest forward interval that we accept when
+	// forwarding to Kafka, i.e., in production.  Shorter intervals would
+	// result in tiny batches.
+	minFwdInterval = time.Second
+
 	defaultTokenizer  = tokenizerHmac
 	defaultForwarder  = forwarderStdout
 	defaultReceiver   = receiverStdin
@@ -42,6 +59,10 @@ var (
 	ourReceivers  = map[string]func() receiver{
 		receiverStdin: newStdinReceiver,
 		receiverWeb:   newWebReceiver,
+		receiverKafka: newKafkaReceiver,
+		receiverVsock: newVsockReceiver,
+		receiverUDP:   newUDPReceiver,
+		receiverUnix:  newUnixReceiver,
 	}
 	ourAggregators = map[string]func() aggregator{
 		aggregatorSimple: newSimpleAggregator,
@@ -50,6 +71,8 @@ var (
 	ourForwarders = map[string]func() forwarder{
 		forwarderStdout: newStdoutForwarder,
 		forwarderKafka:  newKafkaForwarder,
+		forwarderNull:   newNullForwarder,
+		forwarderFile:   newFileForwarder,
 	}
 	ourTokenizers = map[string]func() tokenizer{
 		tokenizerHmac:      newHmacTokenizer,
@@ -64,29 +87,115 @@ func bootstrap(c *config, comp *components, done chan empty) {
 	comp.a.setConfig(c)
 	comp.r.setConfig(c)
 	comp.f.setConfig(c)
+	for _, w := range comp.windows {
+		w.f.setConfig(c)
+	}
 
 	// Tell the aggregator what tokenizer to use.
 	comp.a.use(comp.t)
 	// Tell the aggregator where to get data and where to send it to.
 	comp.a.connect(comp.r.inbox(), comp.f.outbox())
+	// Let our readiness endpoint know what components to ask.
+	components := map[string]any{
+		"tokenizer": comp.t,
+		"forwarder": comp.f,
+	}
+	for _, w := range comp.windows {
+		comp.a.(windowed).addWindow(w.interval, w.f.outbox())
+		components[fmt.Sprintf("forwarder_%s", w.interval)] = w.f
+	}
+	health.use(components)
 
 	// Start all components.
 	comp.a.start()
-	defer comp.a.stop()
 	comp.r.start()
-	defer comp.r.stop()
 	comp.f.start()
-	defer comp.f.stop()
+	for _, w := range comp.windows {
+		w.f.start()
+	}
 
 	l.Println("Done bootstrapping.  Now waiting for channel to close.")
 	<-done
+
+	// Stop all components in the order in which data flows through them, so
+	// that each component can hand its pending data to the next one: the
+	// receiver drains in-flight requests, the aggregator flushes its
+	// addresses, and the forwarder flushes its tokens.
+	l.Println("Shutting down.")
+	defer watchdog(drainTimeout)()
+	health.drain()
+	comp.r.stop()
+	comp.a.stop()
+	// Our forwarders flush independently of each other, so they may as well
+	// do so at the same time, which keeps our shutdown within our drain
+	// timeout.
+	forwarders := []forwarder{comp.f}
+	for _, w := range comp.windows {
+		forwarders = append(forwarders, w.f)
+	}
+	stopAll(forwarders)
+}
+
+// waitForSignal returns a channel that's closed once we receive SIGTERM or
+// SIGINT.
+func waitForSignal() chan empty {
+	done := make(chan empty)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		sig := <-sigs
+		l.Printf("Received signal %q.", sig)
+		signal.Stop(sigs)
+		close(done)
+	}()
+	return done
+}
+
+// durationValue implements flag.Value for durations.  For backwards
+// compatibility, it interprets plain integers as seconds; everything else must
+// be a duration as understood by time.ParseDuration, e.g., "250ms".
+type durationValue time.Duration
+
+func (d *durationValue) String() string {
+	return time.Duration(*d).String()
+}
+
+func (d *durationValue) Set(s string) error {
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		*d = durationValue(time.Duration(secs) * time.Second)
+		return nil
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = durationValue(v)
+	return nil
 }
 
 func parseFlags(progname string, args []string) (*components, *config, error) {
 	var err error
-	var exposePrometheus bool
-	var tokenizer, forwarder, aggregator, receiver string
-	var rawFwdInterval, rawKeyExpiry, port, prometheusPort int
+	var exposePrometheus, rejectNonPublic, disableHTTP2, disableKeepAlives, commitRecords, recordRequestIDs bool
+	var tokenizer, rawForwarders, aggregator, rawReceivers, addrHeader, trustedCIDRs string
+	var tlsCert, tlsKey, clientCA, addrScopeFile, unixSocket, udpAddr, echoWallet, sunsets, expectedPCRs string
+	var csrfOrigins, csrfRoutes, overflowDir, profileDir, outputFile, cryptoPAnVectors, rawWindows, flushFormat string
+	var flushCompression, flushRecipient, keyHashURL, flushSpillDir, flushDropPolicy string
+	var flushEnvelope, signFlushes, flushOrdered bool
+	var local bool
+	var profileThreshold durationValue
+	var overflowMaxBytes, flushSpillMaxBytes int64
+	var csrfDoubleSubmit bool
+	var port, udpPort, prometheusPort, trustedProxies, walletBurst int
+	var dedupSize, maxWalletsPerAddr, listenBacklog, maxHeaderBytes, inboxSize, flushRetryBuffer int
+	var flushMaxRecords, flushMaxBytes, flushWorkers, flushMemoryRecords, flushMemoryBytes int
+	var fwdInterval = durationValue(5 * time.Minute)
+	var keyExpiry = durationValue(6 * 30 * 24 * time.Hour)
+	var dedupWindow, idleTimeout, timestampPrecision durationValue
+	var flushRetention = durationValue(defaultRetention)
+	var readHeaderTimeout = durationValue(defaultReadHeaderTimeout)
+	var readTimeout = durationValue(defaultReadTimeout)
+	var writeTimeout = durationValue(defaultWriteTimeout)
+	var walletRate float64
 
 	fs := flag.NewFlagSet(progname, flag.ContinueOnError)
 
@@ -94,23 +203,166 @@ func parseFlags(progname string, args []string) (*components, *config, error) {
 		"Expose Prometheus metrics.")
 	fs.IntVar(&prometheusPort, "prometheus-port", 9090,
 		"Make Prometheus metrics available at http://0.0.0.0:<port>/metrics.")
-	fs.IntVar(&rawFwdInterval, "forward-interval", 60*5,
-		"Number of seconds after which data is forwarded to backend.")
-	fs.IntVar(&rawKeyExpiry, "key-expiry", 60*60*24*30*6,
-		"Number of seconds after which keys are rotated.")
+	fs.Var(&fwdInterval, "forward-interval",
+		"Duration (e.g., 500ms) or number of seconds after which data is forwarded to backend.")
+	fs.StringVar(&flushFormat, "flush-format", formatAvro,
+		"Format of the batches that forwarders flush: 'avro' (one Avro record per token), 'protobuf' (length-delimited messages per batch; see proto/record.proto), or 'msgpack' (an array of maps per batch).")
+	fs.StringVar(&flushCompression, "flush-compression", compressNone,
+		"Algorithm that forwarders compress each flushed payload with: 'none', 'gzip', or 'zstd'.")
+	fs.BoolVar(&flushEnvelope, "flush-envelope", false,
+		"Wrap each flushed record in an envelope with our schema version, instance ID, tokenizer, key epoch, and flush time.")
+	fs.Var(&timestampPrecision, "timestamp-precision",
+		"Duration (e.g., 1h) that the timestamps of forwarded records are truncated to.  0 means second precision.")
+	fs.StringVar(&flushRecipient, "flush-recipient", "",
+		"Base64-encoded X25519 public key of the consumer that forwarders encrypt each flushed payload to, using HPKE.")
+	fs.BoolVar(&signFlushes, "sign-flushes", false,
+		"Sign each flushed payload with an Ed25519 key that we generate at startup.  The /version endpoint publishes the public key.")
+	fs.StringVar(&keyHashURL, "key-hash-url", "",
+		"URL that we post the base64-encoded SHA-256 digest of our signing key to at startup, e.g., an endpoint that includes it in attestation documents.")
+	fs.IntVar(&flushRetryBuffer, "flush-retry-buffer", defaultRetryBuffer,
+		"Number of tokens that each forwarder (across its workers) keeps buffered while it retries failed flushes with exponential backoff.  0 disables retries.")
+	fs.Var(&flushRetention, "flush-retention",
+		"Duration after which forwarders give up on batches that their sink didn't acknowledge.  0 means no limit.")
+	fs.StringVar(&flushSpillDir, "flush-spill-dir", "",
+		"Directory (preferably on a tmpfs) in which forwarders spill encrypted batches that don't fit in their retry buffer.  If empty, they give up on these batches.")
+	fs.Int64Var(&flushSpillMaxBytes, "flush-spill-max-bytes", defaultSpillMaxBytes,
+		"Maximum size in bytes of each forwarder's spilled batches, across its workers.  Once reached, forwarders give up on their oldest batches.")
+	fs.IntVar(&flushWorkers, "flush-workers", 1,
+		"Number of workers that each forwarder batches, encodes, compresses, and sends tokens with.")
+	fs.BoolVar(&flushOrdered, "flush-ordered", false,
+		"Make forwarders with several workers send each wallet's records in the order in which they got them.")
+	fs.IntVar(&flushMemoryRecords, "flush-memory-records", 0,
+		"Number of records that each forwarder may hold in memory, i.e., in its current batch and among the batches that wait for a retry.  0 means no limit.")
+	fs.IntVar(&flushMemoryBytes, "flush-memory-bytes", 0,
+		"Number of bytes that each forwarder may hold in memory.  0 means no limit.")
+	fs.StringVar(&flushDropPolicy, "flush-drop-policy", dropOldest,
+		"What forwarders do once they reach their memory limit: 'drop-oldest' (drop their oldest records), 'drop-newest' (drop new records), or 'block' (stop taking records until they have room).")
+	fs.IntVar(&flushMaxRecords, "flush-max-records", 0,
+		"Number of records at which the address aggregator flushes its window before the forward interval ends.  0 means no limit.")
+	fs.IntVar(&flushMaxBytes, "flush-max-bytes", 0,
+		"Approximate Avro-encoded size in bytes at which the address aggregator flushes its window before the forward interval ends.  0 means no limit.")
+	fs.StringVar(&rawWindows, "windows", "",
+		"Comma-separated list of additional address aggregator windows as '<interval>:<forwarder>' pairs, e.g., '5m:kafka'.  Each window sees all requests and flushes to its own forwarder.")
+	fs.Var(&keyExpiry, "key-expiry",
+		"Duration (e.g., 24h) or number of seconds after which keys are rotated.")
 	fs.IntVar(&port, "port", 8080,
-		"Port the Web receiver should listen on.")
+		"Port the Web receiver (or the vsock receiver) should listen on.")
+	fs.BoolVar(&disableHTTP2, "disable-http2", false,
+		"Make the Web receiver speak HTTP/1.1 only, even over TLS.")
+	fs.BoolVar(&disableKeepAlives, "disable-keep-alives", false,
+		"Make the Web receiver close connections after each request.")
+	fs.Var(&readHeaderTimeout, "read-header-timeout",
+		"Duration or number of seconds that HTTP clients have to send their request headers.  0 means no limit.")
+	fs.Var(&readTimeout, "read-timeout",
+		"Duration or number of seconds that HTTP clients have to send their entire request.  0 means no limit.")
+	fs.Var(&writeTimeout, "write-timeout",
+		"Duration or number of seconds that we have to write a response.  0 means no limit.")
+	fs.IntVar(&maxHeaderBytes, "max-header-bytes", defaultMaxHeaderBytes,
+		"Maximum size of HTTP request headers in bytes.")
+	fs.Var(&idleTimeout, "idle-timeout",
+		"Duration or number of seconds after which the Web receiver closes idle keep-alive connections.  0 means Go's default.")
+	fs.IntVar(&listenBacklog, "listen-backlog", 0,
+		"Maximum number of pending connections of the Web receiver.  0 means the operating system's default.")
+	fs.IntVar(&inboxSize, "inbox-size", defaultInboxSize,
+		"Number of requests that may wait for the aggregator before the Web receiver responds with 503.")
+	fs.IntVar(&udpPort, "udp-port", 5140,
+		"UDP port the UDP receiver should listen on.")
+	fs.StringVar(&udpAddr, "udp-addr", defaultUDPAddr,
+		"IP address the UDP receiver should listen on.  UDP senders can be spoofed, so only expose the receiver to trusted networks.")
+	fs.StringVar(&unixSocket, "unix-socket", defaultUnixSocket,
+		"Path of the unix socket the unix socket receiver should listen on.")
+	fs.StringVar(&addrHeader, "addr-header", fastlyClientIP,
+		"The HTTP header that the Web receiver takes the client's IP address from.")
+	fs.IntVar(&trustedProxies, "trusted-proxies", 0,
+		"Number of proxies in front of the Web receiver that append to X-Forwarded-For.")
+	fs.StringVar(&trustedCIDRs, "trusted-cidrs", "",
+		"Comma-separated networks (e.g., 10.0.0.0/8) that the Web receiver accepts requests from.  "+
+			"If empty, requests are accepted from anywhere.")
+	fs.StringVar(&tlsCert, "tls-cert", "",
+		"Path to the Web receiver's TLS certificate.  If unset, the Web receiver speaks plain HTTP.")
+	fs.StringVar(&tlsKey, "tls-key", "",
+		"Path to the Web receiver's TLS key.")
+	fs.StringVar(&clientCA, "client-ca", "",
+		"Path to CA certificates.  If set, the Web receiver requires client certificates signed by these CAs.")
+	fs.Float64Var(&walletRate, "wallet-rate", 0,
+		"Number of requests per second that the Web receiver allows per wallet.  0 means no limit.")
+	fs.IntVar(&walletBurst, "wallet-burst", 10,
+		"Number of requests that a wallet may make in a row before being rate-limited.")
+	fs.Var(&dedupWindow, "dedup-window",
+		"Duration or number of seconds during which the Web receiver skips duplicate wallet/address pairs.  0 disables deduplication.")
+	fs.StringVar(&addrScopeFile, "addr-scope-file", "",
+		"Path to a file with '<name> <cidr>' lines.  The address aggregator replaces addresses in these networks with the marker 'scope:<name>'.")
+	fs.BoolVar(&commitRecords, "commit-records", false,
+		"Follow each forward interval's messages with a commit record that contains the interval's window ID, record count, and checksum.")
+	fs.BoolVar(&recordRequestIDs, "record-request-ids", false,
+		"Include the IDs of each wallet's requests (from the X-Request-ID header) in the records that the address aggregator forwards.")
+	fs.StringVar(&sunsets, "sunset-api-versions", "",
+		"Comma-separated list of '<version>=<YYYY-MM-DD>' sunsets of ads API versions.  Until its sunset, the Web receiver marks a version as deprecated; afterwards, it responds with 410.")
+	fs.StringVar(&overflowDir, "overflow-dir", "",
+		"Directory (ideally on a tmpfs) in which the Web receiver buffers requests that exceed its inbox.  Buffered requests are fed back to the aggregator once it has caught up.  Empty disables the buffer.")
+	fs.Int64Var(&overflowMaxBytes, "overflow-max-bytes", defaultOverflowMaxBytes,
+		"Maximum size in bytes of the requests in the Web receiver's overflow buffer, before compression.")
+	fs.StringVar(&profileDir, "profile-dir", "",
+		"Directory (ideally on a tmpfs) in which we keep the CPU and heap profiles that we capture when the Web receiver's p99 latency exceeds -profile-p99-threshold.")
+	fs.Var(&profileThreshold, "profile-p99-threshold",
+		"Duration or number of seconds of p99 confirmation token latency above which we capture profiles.  0 disables profiling.")
+	fs.StringVar(&csrfOrigins, "csrf-origins", "",
+		"Comma-separated list of origins, e.g., 'https://example.com', that may make browser requests to the Web receiver's CSRF-protected routes.  Requests from other origins get a 403.")
+	fs.BoolVar(&csrfDoubleSubmit, "csrf-double-submit", false,
+		"Require requests to the Web receiver's CSRF-protected routes to carry the same token in the '"+csrfCookie+"' cookie and the '"+csrfHeader+"' header.")
+	fs.StringVar(&csrfRoutes, "csrf-routes", routeToken,
+		"Comma-separated list of the Web receiver's routes that are CSRF-protected: '"+routeToken+"' and/or '"+routeVersion+"'.")
+	fs.StringVar(&expectedPCRs, "expected-pcrs", "",
+		"Comma-separated list of '<index>=<hex digest>' PCR values that our enclave image is expected to have.  The Web receiver's /version endpoint shows them.")
+	fs.StringVar(&echoWallet, "debug-echo-wallet", "",
+		"Wallet ID of a test wallet whose requests the Web receiver answers with the anonymized address.  Never use in production.")
+	fs.IntVar(&dedupSize, "dedup-size", 100000,
+		"Maximum number of wallet/address pairs that the Web receiver remembers for deduplication.")
+	fs.BoolVar(&rejectNonPublic, "reject-non-public", false,
+		"Reject requests whose client IP address is private, loopback, link-local, or otherwise not publicly routable.")
+	fs.IntVar(&maxWalletsPerAddr, "max-wallets-per-addr", 0,
+		"Maximum number of wallets per anonymized address in a forward interval.  Excess wallets get an overflow marker.  0 means no limit.")
+	fs.StringVar(&cryptoPAnVectors, "verify-cryptopan-vectors", "",
+		"Path to a file with Crypto-PAn test vectors, e.g., testdata/cryptopan/vectors.json.  If set, verify that we anonymize each vector's input to its output, and exit.")
+	fs.BoolVar(&local, "local", false,
+		"Run the entire pipeline locally: unless set explicitly, use the Web receiver, the address aggregator, and the file forwarder.")
+	fs.StringVar(&outputFile, "output-file", "",
+		"File to which the file forwarder appends its ndjson records.  Empty means stdout.")
 	fs.StringVar(&tokenizer, "tokenizer", defaultTokenizer,
 		"The name of the tokenizer to use.")
-	fs.StringVar(&forwarder, "forwarder", defaultForwarder,
-		"The name of the forwarder to use.")
+	fs.StringVar(&rawForwarders, "forwarder", defaultForwarder,
+		"Comma-separated list of the forwarders to use, e.g., 'kafka,stdout'.  Each token goes to all of them.")
 	fs.StringVar(&aggregator, "aggregator", defaultAggregator,
 		"The name of the aggregator to use.")
-	fs.StringVar(&receiver, "receiver", defaultReceiver,
-		"The name of the receiver to use.")
+	fs.StringVar(&rawReceivers, "receiver", defaultReceiver,
+		"Comma-separated names of the receivers to use, e.g., \"web,kafka\".")
 	if err := fs.Parse(args); err != nil {
 		return nil, nil, err
 	}
+	if local {
+		// Flags that were set explicitly take precedence over our local
+		// defaults.
+		isSet := make(map[string]bool)
+		fs.Visit(func(f *flag.Flag) { isSet[f.Name] = true })
+		if !isSet["receiver"] {
+			rawReceivers = receiverWeb
+		}
+		if !isSet["aggregator"] {
+			aggregator = aggregatorAddr
+		}
+		if !isSet["forwarder"] {
+			rawForwarders = forwarderFile
+		}
+	}
+	receivers := strings.Split(rawReceivers, ",")
+	usesReceiver := func(name string) bool {
+		for _, r := range receivers {
+			if r == name {
+				return true
+			}
+		}
+		return false
+	}
 
 	c := &config{}
 	// Parse configuration flags.
@@ -118,85 +370,399 @@ func parseFlags(progname string, args []string) (*components, *config, error) {
 		return nil, nil, fmt.Errorf("port must be in interval [1, %d]", math.MaxUint16)
 	}
 	c.port = uint16(port)
-	c.keyExpiry, err = time.ParseDuration(fmt.Sprintf("%ds", rawKeyExpiry))
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to parse key expiration: %w", err)
+	if udpPort < 1 || udpPort > math.MaxUint16 {
+		return nil, nil, fmt.Errorf("UDP port must be in interval [1, %d]", math.MaxUint16)
 	}
-	c.fwdInterval, err = time.ParseDuration(fmt.Sprintf("%ds", rawFwdInterval))
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to parse forward interval: %w", err)
+	c.udpPort = uint16(udpPort)
+	if net.ParseIP(udpAddr) == nil {
+		return nil, nil, errors.New("UDP address must be an IP address")
+	}
+	c.udpAddr = udpAddr
+	c.unixSocket = unixSocket
+	if inboxSize < 1 {
+		return nil, nil, errors.New("inbox size must be positive")
+	}
+	c.inboxSize = inboxSize
+	c.overflowMaxBytes = overflowMaxBytes
+	c.outputFile = outputFile
+	c.cryptoPAnVectors = cryptoPAnVectors
+	c.profileThreshold = time.Duration(profileThreshold)
+	if profileDir != "" {
+		if info, err := os.Stat(profileDir); err != nil || !info.IsDir() {
+			return nil, nil, fmt.Errorf("profile directory %q does not exist", profileDir)
+		}
+		c.profileDir = profileDir
+	}
+	if overflowDir != "" {
+		if info, err := os.Stat(overflowDir); err != nil || !info.IsDir() {
+			return nil, nil, fmt.Errorf("overflow directory %q does not exist", overflowDir)
+		}
+		c.overflowDir = overflowDir
+	}
+	if idleTimeout < 0 || readHeaderTimeout < 0 || readTimeout < 0 || writeTimeout < 0 {
+		return nil, nil, errors.New("HTTP timeouts must not be negative")
+	}
+	if listenBacklog < 0 || maxHeaderBytes < 0 {
+		return nil, nil, errors.New("listen backlog and maximum header bytes must not be negative")
+	}
+	c.httpTuning = httpTuning{
+		disableHTTP2:      disableHTTP2,
+		disableKeepAlives: disableKeepAlives,
+		readHeaderTimeout: time.Duration(readHeaderTimeout),
+		readTimeout:       time.Duration(readTimeout),
+		writeTimeout:      time.Duration(writeTimeout),
+		idleTimeout:       time.Duration(idleTimeout),
+		maxHeaderBytes:    maxHeaderBytes,
+		listenBacklog:     listenBacklog,
+	}
+	c.keyExpiry = time.Duration(keyExpiry)
+	c.fwdInterval = time.Duration(fwdInterval)
+	if c.keyExpiry <= 0 || c.fwdInterval <= 0 {
+		return nil, nil, errors.New("key expiry and forward interval must be positive")
+	}
+	forwarders := strings.Split(rawForwarders, ",")
+	usesForwarder := func(name string) bool {
+		for _, f := range forwarders {
+			if f == name {
+				return true
+			}
+		}
+		return false
+	}
+	if usesForwarder(forwarderKafka) && c.fwdInterval < minFwdInterval {
+		return nil, nil, fmt.Errorf("forward interval must be at least %s when forwarding to Kafka", minFwdInterval)
+	}
+	if err := parseFlushFormat(flushFormat); err != nil {
+		return nil, nil, err
+	}
+	if flushFormat != formatAvro && aggregator != aggregatorAddr {
+		return nil, nil, errors.New("only the address aggregator's records can be flushed in formats other than Avro")
+	}
+	c.flushFormat = flushFormat
+	if err := parseCompression(flushCompression); err != nil {
+		return nil, nil, err
+	}
+	c.flushCompression = flushCompression
+	if flushEnvelope && aggregator != aggregatorAddr {
+		return nil, nil, errors.New("only the address aggregator's records can be wrapped in envelopes")
+	}
+	c.flushEnvelope = flushEnvelope
+	if timestampPrecision < 0 {
+		return nil, nil, errors.New("timestamp precision must not be negative")
+	}
+	c.timestampPrecision = time.Duration(timestampPrecision)
+	if c.flushRecipient, err = parseRecipient(flushRecipient); err != nil {
+		return nil, nil, err
+	}
+	if keyHashURL != "" && !signFlushes {
+		return nil, nil, errors.New("-key-hash-url requires -sign-flushes")
+	}
+	if signFlushes {
+		if c.flushSigner, err = newFlushSigner(); err != nil {
+			return nil, nil, err
+		}
+	}
+	c.keyHashURL = keyHashURL
+	if flushRetryBuffer < 0 {
+		return nil, nil, errors.New("flush retry buffer must not be negative")
+	}
+	c.flushRetryBuffer = flushRetryBuffer
+	if flushRetention < 0 {
+		return nil, nil, errors.New("flush retention must not be negative")
+	}
+	c.flushRetention = time.Duration(flushRetention)
+	if flushSpillDir != "" {
+		if info, err := os.Stat(flushSpillDir); err != nil || !info.IsDir() {
+			return nil, nil, fmt.Errorf("spill directory %q does not exist", flushSpillDir)
+		}
+		c.flushSpillDir = flushSpillDir
+	}
+	if flushSpillMaxBytes <= 0 {
+		return nil, nil, errors.New("spill size limit must be positive")
+	}
+	c.flushSpillMaxBytes = flushSpillMaxBytes
+	if flushWorkers < 1 {
+		return nil, nil, errors.New("forwarders need at least one flush worker")
+	}
+	c.flushWorkers, c.flushOrdered = flushWorkers, flushOrdered
+	if flushMemoryRecords < 0 || flushMemoryBytes < 0 {
+		return nil, nil, errors.New("forwarder memory limits must not be negative")
+	}
+	if err := parseDropPolicy(flushDropPolicy); err != nil {
+		return nil, nil, err
 	}
-	if forwarder == forwarderKafka {
+	c.flushMemoryRecords, c.flushMemoryBytes, c.flushDropPolicy = flushMemoryRecords, flushMemoryBytes, flushDropPolicy
+	if flushMaxRecords < 0 || flushMaxBytes < 0 {
+		return nil, nil, errors.New("flush size limits must not be negative")
+	}
+	if (flushMaxRecords > 0 || flushMaxBytes > 0) && aggregator != aggregatorAddr {
+		return nil, nil, errors.New("only the address aggregator supports flush size limits")
+	}
+	c.flushMaxRecords, c.flushMaxBytes = flushMaxRecords, flushMaxBytes
+	if c.windows, err = parseWindows(rawWindows); err != nil {
+		return nil, nil, err
+	}
+	if len(c.windows) > 0 && aggregator != aggregatorAddr {
+		return nil, nil, errors.New("only the address aggregator supports additional windows")
+	}
+	windowsUseKafka := false
+	for _, w := range c.windows {
+		if w.forwarder != forwarderKafka {
+			continue
+		}
+		windowsUseKafka = true
+		if w.interval < minFwdInterval {
+			return nil, nil, fmt.Errorf("window interval must be at least %s when forwarding to Kafka", minFwdInterval)
+		}
+	}
+	if usesForwarder(forwarderKafka) || windowsUseKafka || usesReceiver(receiverKafka) {
 		c.kafkaConfig, err = loadKafkaConfig()
 		if err != nil {
 			return nil, nil, fmt.Errorf("failed to parse Kafka config: %w", err)
 		}
+		// The Schema Registry's wire format refers to our Avro schema.
+		if c.kafkaConfig.schemaRegistry != "" && c.flushFormat != formatAvro {
+			return nil, nil, errors.New("the Schema Registry requires the Avro flush format")
+		}
+		if c.kafkaConfig.schemaRegistry != "" && c.flushCompression != compressNone {
+			return nil, nil, errors.New("the Schema Registry requires uncompressed flushes")
+		}
+		if c.kafkaConfig.schemaRegistry != "" && c.flushEnvelope {
+			return nil, nil, errors.New("the Schema Registry does not support envelopes")
+		}
+		if c.kafkaConfig.schemaRegistry != "" && c.flushRecipient != nil {
+			return nil, nil, errors.New("the Schema Registry requires unencrypted flushes")
+		}
+		if c.kafkaConfig.schemaRegistry != "" && c.flushSigner != nil {
+			return nil, nil, errors.New("the Schema Registry requires unsigned flushes")
+		}
+		// Keys and per-version topics come from decoding each record.
+		if c.kafkaConfig.keyByWallet && !flushesPlainAvro(c) {
+			return nil, nil, fmt.Errorf("%s requires plain Avro flushes", envKafkaKeyByWallet)
+		}
+		if len(c.kafkaConfig.versionTopics) > 0 && !flushesPlainAvro(c) {
+			return nil, nil, fmt.Errorf("%s requires plain Avro flushes", envKafkaVersionTopics)
+		}
+	}
+	if usesReceiver(receiverKafka) && c.kafkaConfig.inputTopic == "" {
+		return nil, nil, errNoInputTopic
+	}
+	if usesReceiver(receiverWeb) || usesReceiver(receiverVsock) {
+		c.edgeAuth, err = loadEdgeAuthConfig()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to load edge authentication config: %w", err)
+		}
+	}
+	if usesReceiver(receiverVsock) && trustedCIDRs != "" {
+		return nil, nil, errors.New("vsock receiver does not support trusted networks")
+	}
+	if usesReceiver(receiverWeb) {
+		c.webTLSConfig, err = loadWebTLSConfig(tlsCert, tlsKey, clientCA)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to load TLS config: %w", err)
+		}
 	}
 	if prometheusPort < 1 || prometheusPort > math.MaxUint16 {
 		return nil, nil, fmt.Errorf("Prometheus port must be in interval [1, %d]", math.MaxUint16)
 	}
-	if exposePrometheus && receiver == receiverWeb && prometheusPort == port {
+	if exposePrometheus && usesReceiver(receiverWeb) && prometheusPort == port {
 		return nil, nil, errors.New("Prometheus port and Web receiver port must not be the same")
 	}
 	c.prometheusPort = uint16(prometheusPort)
 	c.exposePrometheus = exposePrometheus
+	if trustedProxies < 0 {
+		return nil, nil, errors.New("number of trusted proxies must not be negative")
+	}
+	c.rejectNonPublic = rejectNonPublic
+	c.addrHeader = addrHeader
+	c.trustedProxies = trustedProxies
+	if walletRate < 0 || walletBurst < 1 {
+		return nil, nil, errors.New("wallet rate must not be negative and burst must be positive")
+	}
+	c.walletRate = walletRate
+	c.walletBurst = walletBurst
+	if dedupWindow < 0 || dedupSize < 1 {
+		return nil, nil, errors.New("dedup window must not be negative and size must be positive")
+	}
+	if maxWalletsPerAddr < 0 {
+		return nil, nil, errors.New("maximum number of wallets per address must not be negative")
+	}
+	c.maxWalletsPerAddr = maxWalletsPerAddr
+	if addrScopeFile != "" {
+		if _, err := loadAddrScopes(addrScopeFile); err != nil {
+			return nil, nil, fmt.Errorf("failed to load address scopes: %w", err)
+		}
+	}
+	c.addrScopeFile = addrScopeFile
+	c.commitRecords = commitRecords
+	c.recordRequestIDs = recordRequestIDs
+	if c.sunsets, err = parseSunsets(sunsets); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse API version sunsets: %w", err)
+	}
+	if c.csrf, err = parseCSRFConfig(csrfOrigins, csrfDoubleSubmit, csrfRoutes); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse CSRF config: %w", err)
+	}
+	if c.expectedPCRs, err = parsePCRs(expectedPCRs); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse expected PCRs: %w", err)
+	}
+	if echoWallet != "" {
+		if c.echoWallet, err = uuid.Parse(echoWallet); err != nil {
+			return nil, nil, fmt.Errorf("failed to parse debug echo wallet: %w", err)
+		}
+		l.Printf("Warning: Debug echo mode is enabled for wallet %s.", c.echoWallet)
+	}
+	c.dedupWindow = time.Duration(dedupWindow)
+	c.dedupSize = dedupSize
+	c.trustedNets, err = parseCIDRs(trustedCIDRs)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse trusted networks: %w", err)
+	}
 
 	// Initialize the chosen receiver, tokenizer, aggregator, and forwarder.
 	newTokenizer, exists := ourTokenizers[tokenizer]
 	if !exists {
 		return nil, nil, errors.New("tokenizer does not exist")
 	}
-	newForwarder, exists := ourForwarders[forwarder]
-	if !exists {
-		return nil, nil, errors.New("forwarder does not exist")
+	c.tokenizer = tokenizer
+	newForwarders := make(map[string]func() forwarder)
+	for _, f := range forwarders {
+		newForwarder, exists := ourForwarders[f]
+		if !exists {
+			return nil, nil, errors.New("forwarder does not exist")
+		}
+		if _, exists := newForwarders[f]; exists {
+			return nil, nil, errors.New("forwarder must not be used more than once")
+		}
+		newForwarders[f] = newForwarder
 	}
 	newAggregator, exists := ourAggregators[aggregator]
 	if !exists {
 		return nil, nil, errors.New("aggregator does not exist")
 	}
-	newReceiver, exists := ourReceivers[receiver]
-	if !exists {
-		return nil, nil, errors.New("receiver does not exist")
+	newReceivers := make(map[string]func() receiver)
+	for _, r := range receivers {
+		newReceiver, exists := ourReceivers[r]
+		if !exists {
+			return nil, nil, errors.New("receiver does not exist")
+		}
+		if _, exists := newReceivers[r]; exists {
+			return nil, nil, errors.New("receiver must not be used more than once")
+		}
+		newReceivers[r] = newReceiver
 	}
 	l.Printf("Using receiver=%s, aggregator=%s, tokenizer=%s, forwarder=%s.",
-		receiver, aggregator, tokenizer, forwarder)
+		rawReceivers, aggregator, tokenizer, rawForwarders)
 
+	// A single forwarder doesn't need to share its tokens.
+	var f forwarder
+	if len(forwarders) == 1 {
+		f = newForwarders[forwarders[0]]()
+	} else {
+		f = newMultiForwarder(forwarders, newForwarders)
+	}
 	comp := &components{
 		a: newAggregator(),
-		f: newForwarder(),
-		r: newReceiver(),
+		f: f,
+		r: newMultiReceiver(receivers, newReceivers),
 		t: newTokenizer(),
 	}
+	for _, w := range c.windows {
+		newForwarder, exists := ourForwarders[w.forwarder]
+		if !exists {
+			return nil, nil, errors.New("window forwarder does not exist")
+		}
+		comp.windows = append(comp.windows, windowForwarder{interval: w.interval, f: newForwarder()})
+	}
 	return comp, c, nil
 }
 
-// exposeMetrics starts an HTTP server at the given port.  The server exposes
-// an endpoint for Prometheus metrics.  Note that tokenizer is meant to be run
-// inside a Kubernetes pod.  Access to this port is therefore handled by a
-// Kubernetes service.  If we are configured to expose Prometheus metrics *and*
-// use the Web receiver, we need two Kubernetes services: one that is publicly
-// accessible (the Web receiver) and one that's private (the Prometheus
-// metrics).
-func exposeMetrics(port uint16) {
-	http.Handle("/metrics", promhttp.Handler())
-	l.Printf("Exposing Prometheus metrics at :%d.", port)
-	l.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", port), nil))
+// newAdminRouter returns a router for privileged endpoints, e.g., our
+// Prometheus metrics and a preview of the given aggregator's next flush.
+// Privileged endpoints live on their own router (and listener), separate from
+// the Web receiver's public endpoints, so that we cannot accidentally expose
+// them.  Given an admin token, all privileged endpoints but our health checks
+// require it, and we expose our control endpoints.
+func newAdminRouter(a aggregator, adminToken []byte) *chi.Mux {
+	r := chi.NewRouter()
+	// Orchestrators check our health without credentials.
+	r.Get("/healthz", healthzHandler)
+	r.Get("/readyz", readyzHandler)
+	r.Group(func(r chi.Router) {
+		if adminToken != nil {
+			r.Use(requireAdminToken(adminToken))
+			r.Get("/control/flush", tuningHandler(a))
+			r.Put("/control/flush", tuningHandler(a))
+		}
+		r.Handle("/metrics", promhttp.Handler())
+		r.Get("/debug/flush-preview", previewHandler(a))
+		r.Get("/debug/window-size", estimateHandler(a))
+		r.Get("/debug/rejected", rejections.handler)
+		r.Get("/debug/profiles", autoProfiler.listHandler)
+		r.Get("/debug/profiles/{name}", autoProfiler.getHandler)
+	})
+	return r
+}
+
+// exposeAdmin starts an HTTP server at the given port.  The server exposes our
+// privileged endpoints.  Note that tokenizer is meant to be run inside a
+// Kubernetes pod.  Access to this port is therefore handled by a Kubernetes
+// service.  If we are configured to expose Prometheus metrics *and* use the
+// Web receiver, we need two Kubernetes services: one that is publicly
+// accessible (the Web receiver) and one that's private (the privileged
+// endpoints).
+func exposeAdmin(port uint16, tuning httpTuning, a aggregator, adminToken []byte) {
+	srv := &http.Server{
+		Addr:    fmt.Sprintf(":%d", port),
+		Handler: newAdminRouter(a, adminToken),
+	}
+	tuning.applyTimeouts(srv)
+	l.Printf("Exposing privileged endpoints at :%d.", port)
+	fatalf(exitListener, "Failed to serve privileged endpoints: %v", srv.ListenAndServe())
 }
 
 func main() {
-	comp, conf, err := parseFlags(os.Args[0], os.Args[1:])
+	args, err := withBootArgs(kernelCmdline, os.Args[1:])
+	if err != nil {
+		fatalf(exitConfig, "Failed to read kernel command line: %v", err)
+	}
+	comp, conf, err := parseFlags(os.Args[0], args)
 	if err != nil {
 		if errors.Is(err, flag.ErrHelp) {
 			os.Exit(1)
 		}
-		l.Fatal(err)
+		fatalf(exitConfig, "Invalid configuration: %v", err)
+	}
+	// We keep the admin token out of our configuration, which we log.
+	adminToken, err := loadAdminToken()
+	if err != nil {
+		fatalf(exitConfig, "Failed to load admin token: %v", err)
+	}
+	if conf.cryptoPAnVectors != "" {
+		n, err := verifyCryptoPAnVectors(conf.cryptoPAnVectors)
+		if err != nil {
+			fatalf(exitCrypto, "Failed to verify Crypto-PAn test vectors: %v", err)
+		}
+		l.Printf("All %d Crypto-PAn test vectors match.", n)
+		exit(exitDrained)
+	}
+	if conf.flushSigner != nil {
+		l.Printf("Signing flushes with public key %s.", conf.flushSigner.publicKey())
+		if conf.keyHashURL != "" {
+			if err := conf.flushSigner.registerKeyHash(conf.keyHashURL); err != nil {
+				fatalf(exitCrypto, "Failed to register signing key hash: %v", err)
+			}
+		}
 	}
 	if conf.exposePrometheus {
-		go exposeMetrics(conf.prometheusPort)
+		go exposeAdmin(conf.prometheusPort, conf.httpTuning, comp.a, adminToken)
 	}
 	if err := maxSoftFdLimit(); err != nil {
 		l.Printf("Failed to maximize soft fd limit: %v", err)
 	}
 	l.Printf("Config: %+v", conf)
-	bootstrap(conf, comp, make(chan empty))
+	autoProfiler.setConfig(conf)
+	autoProfiler.start()
+	bootstrap(conf, comp, waitForSignal())
+	l.Println("Shut down cleanly.")
+	exit(exitDrained)
 }
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"net/http"
+	"net/http/httptest"
 	"reflect"
 	"strings"
 	"testing"
@@ -24,10 +26,64 @@ func TestParseFlags(t *testing.T) {
 		{
 			[]string{"-forward-interval", "1", "-key-expiry", "2", "-port", "80"},
 			&config{
-				fwdInterval:    time.Second,
-				keyExpiry:      time.Second * 2,
-				port:           80,
-				prometheusPort: 9090,
+				fwdInterval:      time.Second,
+				keyExpiry:        time.Second * 2,
+				port:             80,
+				udpPort:          5140,
+				udpAddr:          defaultUDPAddr,
+				unixSocket:       defaultUnixSocket,
+				inboxSize:        defaultInboxSize,
+				overflowMaxBytes: defaultOverflowMaxBytes,
+				httpTuning: httpTuning{
+					readHeaderTimeout: defaultReadHeaderTimeout,
+					readTimeout:       defaultReadTimeout,
+					writeTimeout:      defaultWriteTimeout,
+					maxHeaderBytes:    defaultMaxHeaderBytes,
+				},
+				prometheusPort:     9090,
+				addrHeader:         fastlyClientIP,
+				walletBurst:        10,
+				dedupSize:          100000,
+				tokenizer:          defaultTokenizer,
+				flushFormat:        formatAvro,
+				flushCompression:   compressNone,
+				flushRetryBuffer:   defaultRetryBuffer,
+				flushRetention:     defaultRetention,
+				flushSpillMaxBytes: defaultSpillMaxBytes,
+				flushWorkers:       1,
+				flushDropPolicy:    dropOldest,
+			},
+		},
+		{
+			[]string{"-forward-interval", "250ms", "-key-expiry", "1h", "-dedup-window", "2s"},
+			&config{
+				fwdInterval:      250 * time.Millisecond,
+				keyExpiry:        time.Hour,
+				port:             8080,
+				udpPort:          5140,
+				udpAddr:          defaultUDPAddr,
+				unixSocket:       defaultUnixSocket,
+				inboxSize:        defaultInboxSize,
+				overflowMaxBytes: defaultOverflowMaxBytes,
+				httpTuning: httpTuning{
+					readHeaderTimeout: defaultReadHeaderTimeout,
+					readTimeout:       defaultReadTimeout,
+					writeTimeout:      defaultWriteTimeout,
+					maxHeaderBytes:    defaultMaxHeaderBytes,
+				},
+				prometheusPort:     9090,
+				addrHeader:         fastlyClientIP,
+				walletBurst:        10,
+				dedupWindow:        2 * time.Second,
+				dedupSize:          100000,
+				tokenizer:          defaultTokenizer,
+				flushFormat:        formatAvro,
+				flushCompression:   compressNone,
+				flushRetryBuffer:   defaultRetryBuffer,
+				flushRetention:     defaultRetention,
+				flushSpillMaxBytes: defaultSpillMaxBytes,
+				flushWorkers:       1,
+				flushDropPolicy:    dropOldest,
 			},
 		},
 	}
@@ -48,6 +104,37 @@ func TestParseFlags(t *testing.T) {
 	}
 }
 
+func TestParseBadIntervals(t *testing.T) {
+	for _, args := range [][]string{
+		{"-forward-interval", "0"},
+		{"-forward-interval", "foo"},
+		{"-key-expiry", "-1s"},
+		{"-forward-interval", "500ms", "-forwarder", "kafka"},
+	} {
+		if _, _, err := parseFlags("tkzr", args); err == nil {
+			t.Errorf("Expected error for %q but got none.", args)
+		}
+	}
+}
+
+func TestParseReceivers(t *testing.T) {
+	comp, _, err := parseFlags("tkzr", []string{"-receiver", "stdin,web"})
+	if err != nil {
+		t.Fatalf("Got unexpected error: %v", err)
+	}
+	assertEqual(t, len(comp.r.(*multiReceiver).receivers), 2)
+
+	for _, args := range [][]string{
+		{"-receiver", "foo"},
+		{"-receiver", "stdin,stdin"},
+		{"-receiver", "web,"},
+	} {
+		if _, _, err := parseFlags("tkzr", args); err == nil {
+			t.Errorf("Expected error for %q but got none.", args)
+		}
+	}
+}
+
 func TestBootstrap(t *testing.T) {
 	done := make(chan empty)
 	go func() {
@@ -64,3 +151,22 @@ func TestBootstrap(t *testing.T) {
 	}()
 	close(done)
 }
+
+func TestRouterSeparation(t *testing.T) {
+	public := httptest.NewServer(newTestRouter(make(chan serializer)))
+	defer public.Close()
+	admin := httptest.NewServer(newAdminRouter(nil, nil))
+	defer admin.Close()
+
+	// Privileged endpoints must only be reachable via the admin router.
+	resp := makeReq(t, admin, http.MethodGet, "/metrics", nil)
+	assertEqual(t, resp.StatusCode, http.StatusOK)
+	resp = makeReq(t, public, http.MethodGet, "/metrics", nil)
+	assertEqual(t, resp.StatusCode, http.StatusNotFound)
+
+	// ...and vice versa.
+	resp = makeReq(t, admin, http.MethodGet, "/version", nil)
+	assertEqual(t, resp.StatusCode, http.StatusNotFound)
+	resp = makeReq(t, public, http.MethodGet, "/version", nil)
+	assertEqual(t, resp.StatusCode, http.StatusOK)
+}
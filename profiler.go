@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime/pprof"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	// latencyWindowSize is the number of recent handler latencies that we
+	// compute our p99 over.
+	latencyWindowSize = 1024
+	// defaultProfileDuration is how long we capture CPU profiles for.
+	defaultProfileDuration = time.Second * 10
+	// profileCheckInterval determines how often we compare our p99 latency
+	// to the threshold.
+	profileCheckInterval = time.Second * 10
+	// profileCooldown is the minimum time between two captures, so that a
+	// lasting breach doesn't make us profile all the time.
+	profileCooldown = time.Minute * 5
+	// maxProfiles is the number of captures that we keep.  Older captures
+	// are deleted.
+	maxProfiles = 5
+	// Profiles are named "<kind>-<unix time>.pprof".
+	profileSuffix = ".pprof"
+)
+
+var errNoProfile = errors.New("profile does not exist")
+
+// latencies keeps track of the Web receiver's recent handler latencies.
+var latencies = newLatencyWindow()
+
+// autoProfiler captures profiles when the Web receiver gets slow.
+var autoProfiler = newProfiler()
+
+// latencyWindow is a ring buffer of recent latencies.
+type latencyWindow struct {
+	sync.Mutex
+	samples []time.Duration
+	next    int
+}
+
+func newLatencyWindow() *latencyWindow {
+	return &latencyWindow{samples: make([]time.Duration, 0, latencyWindowSize)}
+}
+
+func (w *latencyWindow) add(d time.Duration) {
+	w.Lock()
+	defer w.Unlock()
+
+	if len(w.samples) < latencyWindowSize {
+		w.samples = append(w.samples, d)
+		return
+	}
+	w.samples[w.next] = d
+	w.next = (w.next + 1) % latencyWindowSize
+}
+
+// p99 returns the 99th percentile of our latencies, or 0 if we have none.
+func (w *latencyWindow) p99() time.Duration {
+	w.Lock()
+	sorted := append([]time.Duration(nil), w.samples...)
+	w.Unlock()
+
+	if len(sorted) == 0 {
+		return 0
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[len(sorted)*99/100]
+}
+
+// profiler captures a CPU and a heap profile whenever the Web receiver's p99
+// handler latency exceeds a threshold, and keeps the most recent captures in
+// a directory that should be on a tmpfs.  Our privileged endpoints expose
+// the profiles, so we can see what a slow enclave was busy with.
+type profiler struct {
+	sync.Mutex
+	dir         string
+	threshold   time.Duration
+	duration    time.Duration
+	lastCapture time.Time
+	window      *latencyWindow
+	now         func() time.Time
+	done        chan empty
+}
+
+func newProfiler() *profiler {
+	return &profiler{
+		duration: defaultProfileDuration,
+		window:   latencies,
+		now:      time.Now,
+		done:     make(chan empty),
+	}
+}
+
+func (p *profiler) setConfig(c *config) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.dir = c.profileDir
+	p.threshold = c.profileThreshold
+}
+
+func (p *profiler) enabled() bool {
+	p.Lock()
+	defer p.Unlock()
+
+	return p.dir != "" && p.threshold > 0
+}
+
+func (p *profiler) start() {
+	if !p.enabled() {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(profileCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.done:
+				return
+			case <-ticker.C:
+				p.check()
+			}
+		}
+	}()
+}
+
+func (p *profiler) stop() {
+	close(p.done)
+}
+
+// check captures profiles if our p99 latency exceeds the threshold, and we're
+// not in our cooldown period.
+func (p *profiler) check() {
+	p.Lock()
+	now := p.now()
+	p99 := p.window.p99()
+	if p99 <= p.threshold || (!p.lastCapture.IsZero() && now.Sub(p.lastCapture) < profileCooldown) {
+		p.Unlock()
+		return
+	}
+	p.lastCapture = now
+	p.Unlock()
+
+	l.Printf("p99 latency of %s exceeds %s.  Capturing profiles.", p99, p.threshold)
+	if err := p.capture(now); err != nil {
+		l.Printf("Failed to capture profiles: %v", err)
+	}
+	if err := p.prune(); err != nil {
+		l.Printf("Failed to prune profiles: %v", err)
+	}
+}
+
+// capture captures a CPU profile (which takes our profile duration) and then
+// a heap profile.
+func (p *profiler) capture(now time.Time) error {
+	suffix := fmt.Sprintf("-%d%s", now.Unix(), profileSuffix)
+	cpu, err := os.Create(filepath.Join(p.dir, "cpu"+suffix))
+	if err != nil {
+		return err
+	}
+	defer cpu.Close()
+	if err := pprof.StartCPUProfile(cpu); err != nil {
+		return err
+	}
+	select {
+	case <-time.After(p.duration):
+	case <-p.done:
+	}
+	pprof.StopCPUProfile()
+
+	heap, err := os.Create(filepath.Join(p.dir, "heap"+suffix))
+	if err != nil {
+		return err
+	}
+	defer heap.Close()
+	return pprof.WriteHeapProfile(heap)
+}
+
+// profiles returns the names of our profiles, oldest first.
+func (p *profiler) profiles() ([]string, error) {
+	p.Lock()
+	dir := p.dir
+	p.Unlock()
+
+	if dir == "" {
+		return []string{}, nil
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), profileSuffix) {
+			names = append(names, e.Name())
+		}
+	}
+	// Sort by capture time, and then by kind.
+	captureTime := func(name string) string {
+		_, t, _ := strings.Cut(name, "-")
+		return t
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if ti, tj := captureTime(names[i]), captureTime(names[j]); ti != tj {
+			return ti < tj
+		}
+		return names[i] < names[j]
+	})
+	return names, nil
+}
+
+// prune deletes all but our most recent captures.
+func (p *profiler) prune() error {
+	names, err := p.profiles()
+	if err != nil {
+		return err
+	}
+	// Each capture consists of a CPU and a heap profile.
+	for len(names) > maxProfiles*2 {
+		if err := os.Remove(filepath.Join(p.dir, names[0])); err != nil {
+			return err
+		}
+		names = names[1:]
+	}
+	return nil
+}
+
+// listHandler responds with the names of our profiles.
+func (p *profiler) listHandler(w http.ResponseWriter, r *http.Request) {
+	names, err := p.profiles()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(names); err != nil {
+		l.Printf("Failed to encode profile names: %v", err)
+	}
+}
+
+// getHandler responds with the requested profile.  We only serve the files
+// that listHandler lists.
+func (p *profiler) getHandler(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	names, err := p.profiles()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, n := range names {
+		if n == name {
+			w.Header().Set("Content-Type", "application/octet-stream")
+			http.ServeFile(w, r, filepath.Join(p.dir, name))
+			return
+		}
+	}
+	http.Error(w, errNoProfile.Error(), http.StatusNotFound)
+}
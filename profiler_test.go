@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestLatencyWindow(t *testing.T) {
+	w := newLatencyWindow()
+	assertEqual(t, w.p99(), time.Duration(0))
+	for i := 1; i <= 100; i++ {
+		w.add(time.Duration(i) * time.Millisecond)
+	}
+	assertEqual(t, w.p99(), 100*time.Millisecond)
+
+	// Old latencies make room for new ones.
+	for i := 0; i < latencyWindowSize; i++ {
+		w.add(time.Millisecond)
+	}
+	assertEqual(t, w.p99(), time.Millisecond)
+}
+
+func newTestProfiler(t *testing.T) *profiler {
+	p := newProfiler()
+	p.window = newLatencyWindow()
+	p.duration = time.Millisecond
+	p.setConfig(&config{profileDir: t.TempDir(), profileThreshold: time.Second})
+	return p
+}
+
+func TestProfiler(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	p := newTestProfiler(t)
+	p.now = func() time.Time { return now }
+
+	// We're fast enough, so there's nothing to capture.
+	p.window.add(time.Millisecond)
+	p.check()
+	names, _ := p.profiles()
+	assertEqual(t, len(names), 0)
+
+	p.window.add(2 * time.Second)
+	p.check()
+	names, _ = p.profiles()
+	assertEqual(t, len(names), 2)
+	assertEqual(t, names[0], fmt.Sprintf("cpu-%d%s", now.Unix(), profileSuffix))
+	assertEqual(t, names[1], fmt.Sprintf("heap-%d%s", now.Unix(), profileSuffix))
+
+	// We don't capture again during our cooldown.
+	now = now.Add(time.Minute)
+	p.check()
+	names, _ = p.profiles()
+	assertEqual(t, len(names), 2)
+
+	// The admin API lists and serves our profiles, and nothing else.
+	if err := os.WriteFile(filepath.Join(p.dir, "secret"), []byte("foo"), 0o600); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	r := chi.NewRouter()
+	r.Get("/debug/profiles", p.listHandler)
+	r.Get("/debug/profiles/{name}", p.getHandler)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+	resp := makeReq(t, srv, http.MethodGet, "/debug/profiles", nil)
+	var listed []string
+	if err := json.NewDecoder(resp.Body).Decode(&listed); err != nil {
+		t.Fatalf("Failed to decode profile names: %v", err)
+	}
+	assertEqual(t, len(listed), 2)
+	resp = makeReq(t, srv, http.MethodGet, "/debug/profiles/"+names[1], nil)
+	assertEqual(t, resp.StatusCode, http.StatusOK)
+	resp = makeReq(t, srv, http.MethodGet, "/debug/profiles/secret", nil)
+	assertEqual(t, resp.StatusCode, http.StatusNotFound)
+}
+
+func TestProfilerPrune(t *testing.T) {
+	p := newTestProfiler(t)
+	for i := 0; i < maxProfiles+2; i++ {
+		for _, kind := range []string{"cpu", "heap"} {
+			name := fmt.Sprintf("%s-%d%s", kind, 1700000000+i, profileSuffix)
+			if err := os.WriteFile(filepath.Join(p.dir, name), nil, 0o600); err != nil {
+				t.Fatalf("Failed to write profile: %v", err)
+			}
+		}
+	}
+	if err := p.prune(); err != nil {
+		t.Fatalf("Failed to prune profiles: %v", err)
+	}
+	names, _ := p.profiles()
+	assertEqual(t, len(names), maxProfiles*2)
+	assertEqual(t, names[0], fmt.Sprintf("cpu-%d%s", 1700000002, profileSuffix))
+}
@@ -9,10 +9,18 @@ import (
 
 const (
 	// Label keys and values.
-	httpCode = "code"
-	httpBody = "body"
-	outcome  = "outcome"
-	success  = "success"
+	httpCode        = "code"
+	httpBody        = "body"
+	dropReason      = "reason"
+	scopeName       = "scope"
+	receiverName    = "receiver"
+	errClassName    = "class"
+	chanName        = "channel"
+	outcome         = "outcome"
+	sinkName        = "sink"
+	deadLetterStage = "stage"
+	encoding        = "encoding"
+	success         = "success"
 
 	// Our Prometheus namespace.
 	ns = "tokenizer"
@@ -29,6 +37,74 @@ type metrics struct {
 	webResponses *prometheus.CounterVec
 	numForwarded *prometheus.CounterVec
 	numTokenized *prometheus.CounterVec
+	// The number of requests that the Web receiver skipped because it
+	// recently saw the same wallet/address pair.
+	numDeduplicated prometheus.Counter
+	// The number of events that the Web receiver got over streams, by
+	// outcome: success or the error class of the rejection.
+	numStreamEvents *prometheus.CounterVec
+	// The number of requests that the Web receiver rejected because the
+	// client's address isn't publicly routable.
+	numNonPublicAddrs prometheus.Counter
+	// The number of wallets whose address the address aggregator replaced
+	// with the overflow marker.
+	numOverflowed prometheus.Counter
+	// The number of addresses that the address aggregator replaced with an
+	// address scope marker, by marker.
+	numScoped *prometheus.CounterVec
+	// The number of requests that each receiver handed over to the
+	// aggregator, by receiver.
+	numReceived *prometheus.CounterVec
+	// The number of records that the UDP receiver received.
+	numDatagramRecords *prometheus.CounterVec
+	// The number of requests that the Web receiver rejected because its
+	// inbox was full.
+	numOverloaded prometheus.Counter
+	// The number of requests that the Web receiver buffered in its overflow
+	// buffer because its inbox was full, and the buffer's size in bytes.
+	numSpilled prometheus.Counter
+	spillBytes prometheus.Gauge
+	// The projected number of records and size in bytes of the address
+	// aggregator's next flush, by encoding.
+	windowRecords prometheus.Gauge
+	windowBytes   *prometheus.GaugeVec
+	// The compression ratio of each sink's most recent flush.
+	compressionRatio *prometheus.GaugeVec
+	// The number of batches that each flusher retried, and the number of
+	// batches that it gave up on, by sink.
+	numFlushRetries  *prometheus.CounterVec
+	numFlushFailures *prometheus.CounterVec
+	// The number of times that the address aggregator flushed its window
+	// before the forward interval ended, because the window was full.
+	numEarlyFlushes prometheus.Counter
+	// The number of records that we failed to serialize or that a sink
+	// rejected, by stage.
+	numDeadLetters *prometheus.CounterVec
+	// The number of records that flushers dropped because of their memory
+	// limit, by sink.
+	numMemoryDropped *prometheus.CounterVec
+	// The size of each flusher's spill queue in bytes, by sink.
+	flushSpillBytes *prometheus.GaugeVec
+	// The sampled time that sends to our channels blocked, by channel.
+	chanSendSeconds *prometheus.HistogramVec
+	// The time that the Web receiver's handlers took, and the time that
+	// requests waited in the inbox until the aggregator picked them up, by
+	// route and API version.
+	webLatency   *prometheus.HistogramVec
+	webInboxWait *prometheus.HistogramVec
+	// The number of Kafka messages that the Kafka receiver consumed.
+	numConsumed *prometheus.CounterVec
+	// The number of currently open inbound connections, and the number of
+	// inbound connections that died, by reason.
+	numOpenConns prometheus.Gauge
+	connDrops    *prometheus.CounterVec
+	// The number of errors that we encountered while processing requests,
+	// by error class.
+	numErrors *prometheus.CounterVec
+	// The number of panics that the Web receiver recovered from.
+	numPanics prometheus.Counter
+	// The number of requests of deprecated ads API versions, by version.
+	numDeprecated *prometheus.CounterVec
 }
 
 // failBecause turns the given error into a string that's ready to be used as a
@@ -38,6 +114,11 @@ func failBecause(err error) string {
 	return fmt.Sprintf("fail (%s)", err.Error())
 }
 
+// countErr counts the given error in the error class that it belongs to.
+func countErr(err error) {
+	m.numErrors.With(prometheus.Labels{errClassName: errClass(err)}).Inc()
+}
+
 // init initializes our Prometheus metrics.
 func init() {
 	m.numWallets = promauto.NewGauge(prometheus.GaugeOpts{
@@ -59,13 +140,162 @@ func init() {
 		},
 		[]string{httpCode, httpBody},
 	)
+	m.numDeduplicated = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: ns,
+		Name:      "num_deduplicated",
+		Help:      "The number of duplicate wallet/address pairs that the Web receiver skipped",
+	})
+	m.numStreamEvents = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: ns,
+			Name:      "num_stream_events",
+			Help:      "The number of events that the Web receiver got over streams, by outcome",
+		},
+		[]string{outcome},
+	)
+	m.numNonPublicAddrs = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: ns,
+		Name:      "num_non_public_addrs",
+		Help:      "The number of private, loopback, link-local, or bogon addresses that the Web receiver rejected",
+	})
+	m.numOverflowed = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: ns,
+		Name:      "num_overflowed",
+		Help:      "The number of wallets that exceeded the per-address wallet limit",
+	})
+	m.numScoped = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: ns,
+			Name:      "num_scoped",
+			Help:      "The number of addresses that the address aggregator replaced with an address scope marker",
+		},
+		[]string{scopeName},
+	)
+	m.numReceived = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: ns,
+			Name:      "num_received",
+			Help:      "The number of requests that each receiver handed over to the aggregator",
+		},
+		[]string{receiverName},
+	)
+	m.numDatagramRecords = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: ns,
+			Name:      "num_datagram_records",
+			Help:      "(Un)successfully parsed records of the UDP receiver",
+		},
+		[]string{outcome},
+	)
+	m.numOverloaded = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: ns,
+		Name:      "num_overloaded",
+		Help:      "The number of requests that the Web receiver rejected because its inbox was full",
+	})
+	m.numSpilled = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: ns,
+		Name:      "num_spilled",
+		Help:      "The number of requests that the Web receiver buffered in its overflow buffer because its inbox was full",
+	})
+	m.spillBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: ns,
+		Name:      "overflow_bytes",
+		Help:      "The size of the Web receiver's overflow buffer in bytes",
+	})
+	m.windowRecords = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: ns,
+		Name:      "window_estimated_records",
+		Help:      "The projected number of records of the address aggregator's next flush",
+	})
+	m.windowBytes = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: ns,
+			Name:      "window_estimated_bytes",
+			Help:      "The projected size in bytes of the address aggregator's next flush, by encoding",
+		},
+		[]string{encoding},
+	)
+	m.compressionRatio = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: ns,
+			Name:      "flush_compression_ratio",
+			Help:      "The uncompressed size divided by the compressed size of the most recent flush, by sink",
+		},
+		[]string{sinkName},
+	)
+	m.numFlushRetries = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: ns,
+			Name:      "num_flush_retries",
+			Help:      "The number of times that we retried flushing a batch, by sink",
+		},
+		[]string{sinkName},
+	)
+	m.numFlushFailures = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: ns,
+			Name:      "num_flush_failures",
+			Help:      "The number of batches that we gave up on flushing, by sink",
+		},
+		[]string{sinkName},
+	)
+	m.numDeadLetters = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: ns,
+			Name:      "num_dead_letters",
+			Help:      "The number of records that we failed to serialize or that a sink rejected, by stage",
+		},
+		[]string{deadLetterStage},
+	)
+	m.numMemoryDropped = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: ns,
+			Name:      "num_memory_dropped",
+			Help:      "The number of records that we dropped because a flusher reached its memory limit, by sink",
+		},
+		[]string{sinkName},
+	)
+	m.flushSpillBytes = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: ns,
+			Name:      "flush_spill_bytes",
+			Help:      "The size of the spilled batches that wait for a retry in bytes, by sink",
+		},
+		[]string{sinkName},
+	)
+	m.numEarlyFlushes = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: ns,
+		Name:      "num_early_flushes",
+		Help:      "The number of times that the address aggregator flushed its window early because it reached its size limit",
+	})
+	m.numConsumed = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: ns,
+			Name:      "num_consumed",
+			Help:      "(Un)successfully processed Kafka messages of the Kafka receiver",
+		},
+		[]string{outcome},
+	)
+	m.numOpenConns = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: ns,
+		Name:      "num_open_conns",
+		Help:      "The number of currently open connections to the Web receiver",
+	})
+	m.connDrops = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: ns,
+			Name:      "conn_drops",
+			Help:      "Inbound connections to the Web receiver that died, by reason",
+		},
+		[]string{dropReason},
+	)
 	m.numForwarded = promauto.NewCounterVec(
 		prometheus.CounterOpts{
 			Namespace: ns,
 			Name:      "num_forwarded",
-			Help:      "(Un)successfully forwarded tokens using Kafka",
+			Help:      "(Un)successfully forwarded tokens, by sink",
 		},
-		[]string{outcome},
+		[]string{outcome, sinkName},
 	)
 	m.numTokenized = promauto.NewCounterVec(
 		prometheus.CounterOpts{
@@ -75,4 +305,53 @@ func init() {
 		},
 		[]string{outcome},
 	)
+	m.chanSendSeconds = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: ns,
+			Name:      "channel_send_seconds",
+			Help:      "The sampled time that sends to a channel blocked, by channel",
+			Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 10),
+		},
+		[]string{chanName},
+	)
+	prometheus.MustRegister(saturation)
+	m.webLatency = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: ns,
+			Name:      "web_latency_seconds",
+			Help:      "The time that the Web receiver's handlers took, by route and API version",
+			Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 16),
+		},
+		[]string{routeName, apiVersion},
+	)
+	m.webInboxWait = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: ns,
+			Name:      "web_inbox_wait_seconds",
+			Help:      "The time that requests waited in the Web receiver's inbox, by route and API version",
+			Buckets:   prometheus.ExponentialBuckets(0.0001, 2, 16),
+		},
+		[]string{routeName, apiVersion},
+	)
+	m.numDeprecated = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: ns,
+			Name:      "num_deprecated",
+			Help:      "The number of requests of deprecated ads API versions, by version",
+		},
+		[]string{apiVersion},
+	)
+	m.numPanics = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: ns,
+		Name:      "num_panics",
+		Help:      "The number of panics that the Web receiver recovered from",
+	})
+	m.numErrors = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: ns,
+			Name:      "num_errors",
+			Help:      "The number of errors that we encountered while processing requests, by error class",
+		},
+		[]string{errClassName},
+	)
 }
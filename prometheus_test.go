@@ -8,9 +8,22 @@ import (
 	"testing"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
 )
 
+// sampleCount returns the number of observations of the given histogram.
+func sampleCount(t *testing.T, o prometheus.Observer) uint64 {
+	t.Helper()
+
+	var metric dto.Metric
+	if err := o.(prometheus.Metric).Write(&metric); err != nil {
+		t.Fatalf("Failed to read histogram: %v", err)
+	}
+	return metric.GetHistogram().GetSampleCount()
+}
+
 func TestMetrics(t *testing.T) {
 	done := make(chan empty)
 	rc := newWebReceiver()
@@ -54,8 +67,8 @@ func TestMetrics(t *testing.T) {
 	// Make sure that we collected all HTTP responses by code and body.
 	labels := m.webResponses.WithLabelValues
 	assertEqual(t, testutil.ToFloat64(labels("200", "")), float64(2))
-	assertEqual(t, testutil.ToFloat64(labels("400", errBadFastlyAddrFormat.Error())), float64(1))
-	assertEqual(t, testutil.ToFloat64(labels("400", errNoFastlyHeader.Error())), float64(1))
+	assertEqual(t, testutil.ToFloat64(labels("400", errBadAddrFormat.Error())), float64(1))
+	assertEqual(t, testutil.ToFloat64(labels("400", errNoAddrHeader.Error())), float64(1))
 
 	// Make sure that the total number of metrics (which is different from the
 	// total number of HTTP requests) is correct.
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	envKafkaInputTopic    = "KAFKA_INPUT_TOPIC"
+	envKafkaConsumerGroup = "KAFKA_CONSUMER_GROUP"
+	defaultConsumerGroup  = "tokenizer"
+)
+
+var errNoInputTopic = errors.New("Kafka receiver requires an input topic")
+
+// kafkaReader defines an interface that's implemented by kafka-go's
+// kafka.Reader (which we use in production) and by dummyKafkaReader (which we
+// use for tests).
+type kafkaReader interface {
+	FetchMessage(ctx context.Context) (kafka.Message, error)
+	CommitMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// kafkaReceiver implements a receiver that consumes client requests from a
+// Kafka topic, which allows for inserting tokenizer into existing streaming
+// pipelines without an HTTP hop.  Each Kafka message must contain a
+// JSON-encoded client request, e.g.:
+//
+//	{"wallet": "68a7deb0-615c-4f26-bf87-6b122732d8e9", "addr": "1.1.1.1"}
+//
+// We commit a message's offset once the aggregator processed it, i.e., we
+// provide at-least-once semantics.
+type kafkaReceiver struct {
+	sync.RWMutex
+	wg     sync.WaitGroup
+	conf   *kafkaConfig
+	reader kafkaReader
+	in     chan serializer
+	cancel context.CancelFunc
+}
+
+func newKafkaReceiver() receiver {
+	return &kafkaReceiver{
+		in:     make(chan serializer),
+		cancel: func() {},
+	}
+}
+
+func (k *kafkaReceiver) setConfig(c *config) {
+	k.Lock()
+	defer k.Unlock()
+
+	k.conf = c.kafkaConfig
+}
+
+func (k *kafkaReceiver) inbox() chan serializer {
+	return k.in
+}
+
+func (k *kafkaReceiver) start() {
+	k.Lock()
+	defer k.Unlock()
+
+	if k.reader == nil {
+		if k.conf == nil {
+			l.Println("Kafka receiver has no config.  Not starting.")
+			return
+		}
+		k.reader = newKafkaReader(k.conf)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	k.cancel = cancel
+
+	k.wg.Add(1)
+	go func() {
+		defer k.wg.Done()
+		for {
+			msg, err := k.reader.FetchMessage(ctx)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				err = wrapError(ErrDownstream, err)
+				countErr(err)
+				l.Printf("Failed to fetch Kafka message: %s", errFields(err))
+				time.Sleep(time.Second)
+				continue
+			}
+			k.process(ctx, msg)
+		}
+	}()
+}
+
+// process hands the given Kafka message over to the aggregator and commits
+// the message once the aggregator is done with it.  We also commit messages
+// that we cannot process because retrying them wouldn't help.
+func (k *kafkaReceiver) process(ctx context.Context, msg kafka.Message) {
+	req, err := parseJSONRequest(msg.Value)
+	if err != nil {
+		m.numConsumed.With(prometheus.Labels{outcome: failBecause(err)}).Inc()
+		countErr(err)
+	} else {
+		req.ack = make(chan error, 1)
+		select {
+		case k.in <- req:
+		case <-ctx.Done():
+			return
+		}
+		select {
+		case err := <-req.ack:
+			if err != nil {
+				m.numConsumed.With(prometheus.Labels{outcome: failBecause(errNotProcessed)}).Inc()
+			} else {
+				m.numConsumed.With(prometheus.Labels{outcome: success}).Inc()
+			}
+		case <-ctx.Done():
+			// Leave the message uncommitted, so it's redelivered.
+			return
+		}
+	}
+
+	if err := k.reader.CommitMessages(ctx, msg); err != nil && ctx.Err() == nil {
+		l.Printf("Failed to commit Kafka message: %v", err)
+	}
+}
+
+func (k *kafkaReceiver) stop() {
+	k.Lock()
+	defer k.Unlock()
+
+	k.cancel()
+	k.wg.Wait()
+	if k.reader != nil {
+		if err := k.reader.Close(); err != nil {
+			l.Printf("Failed to close Kafka reader: %v", err)
+		}
+	}
+}
+
+func newKafkaReader(conf *kafkaConfig) *kafka.Reader {
+	r := kafka.NewReader(kafka.ReaderConfig{
+		Brokers: []string{conf.broker.String()},
+		GroupID: conf.consumerGroup,
+		Topic:   conf.inputTopic,
+		Dialer: &kafka.Dialer{
+			Timeout:   10 * time.Second,
+			DualStack: true,
+			TLS:       newKafkaTLSConfig(conf),
+		},
+	})
+	l.Printf("Created Kafka reader for %q using topic %q.", conf.broker, conf.inputTopic)
+	return r
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+)
+
+type dummyKafkaReader struct {
+	sync.Mutex
+	msgs      chan kafka.Message
+	committed []kafka.Message
+}
+
+func newDummyKafkaReader() *dummyKafkaReader {
+	return &dummyKafkaReader{msgs: make(chan kafka.Message)}
+}
+
+func (d *dummyKafkaReader) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	select {
+	case msg := <-d.msgs:
+		return msg, nil
+	case <-ctx.Done():
+		return kafka.Message{}, ctx.Err()
+	}
+}
+
+func (d *dummyKafkaReader) CommitMessages(ctx context.Context, msgs ...kafka.Message) error {
+	d.Lock()
+	defer d.Unlock()
+	d.committed = append(d.committed, msgs...)
+	return nil
+}
+
+func (d *dummyKafkaReader) Close() error {
+	return nil
+}
+
+func (d *dummyKafkaReader) numCommitted() int {
+	d.Lock()
+	defer d.Unlock()
+	return len(d.committed)
+}
+
+func TestKafkaReceiver(t *testing.T) {
+	reader := newDummyKafkaReader()
+	k := newKafkaReceiver().(*kafkaReceiver)
+	k.reader = reader
+	k.start()
+	defer k.stop()
+
+	// A valid message must reach the inbox and be committed once the
+	// aggregator acknowledged it.
+	reader.msgs <- kafka.Message{Value: []byte(
+		`{"wallet": "68a7deb0-615c-4f26-bf87-6b122732d8e9", "addr": "1.1.1.1"}`,
+	)}
+	req := (<-k.inbox()).(*clientRequest)
+	assertEqual(t, req.Addr.String(), "1.1.1.1")
+	assertEqual(t, req.Wallet.String(), "68a7deb0-615c-4f26-bf87-6b122732d8e9")
+	req.acknowledge(nil)
+
+	// Messages that the aggregator fails to process are committed anyway.
+	reader.msgs <- kafka.Message{Value: []byte(
+		`{"wallet": "68a7deb0-615c-4f26-bf87-6b122732d8e9", "addr": "2.2.2.2"}`,
+	)}
+	req = (<-k.inbox()).(*clientRequest)
+	req.acknowledge(errors.New("foo"))
+
+	// Malformed messages must not reach the inbox but must be committed.
+	reader.msgs <- kafka.Message{Value: []byte("foo")}
+	reader.msgs <- kafka.Message{Value: []byte(`{"wallet": "68a7deb0-615c-4f26-bf87-6b122732d8e9"}`)}
+
+	// Sending one more message guarantees that the receiver is done with all
+	// previous messages.
+	reader.msgs <- kafka.Message{Value: []byte(
+		`{"wallet": "68a7deb0-615c-4f26-bf87-6b122732d8e9", "addr": "3.3.3.3"}`,
+	)}
+	req = (<-k.inbox()).(*clientRequest)
+	if n := reader.numCommitted(); n != 4 {
+		t.Fatalf("Expected 4 committed messages but got %d.", n)
+	}
+	req.acknowledge(nil)
+}
+
+func TestKafkaReceiverWithoutConfig(t *testing.T) {
+	k := newKafkaReceiver()
+	k.setConfig(&config{})
+	// Without a config, the receiver must neither start nor crash.
+	k.start()
+	k.stop()
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// multiReceiver implements a receiver that runs several receivers at once,
+// e.g., the Web receiver and the Kafka receiver, and fans their data into a
+// single inbox.  That way, all receivers feed the same aggregator.
+type multiReceiver struct {
+	wg        sync.WaitGroup
+	names     []string
+	receivers []receiver
+	in        chan serializer
+	sends     *sendTimer
+	done      chan empty
+}
+
+// newMultiReceiver returns a receiver that runs the receivers with the given
+// names.  The given map provides a constructor for each name.
+func newMultiReceiver(names []string, newReceivers map[string]func() receiver) receiver {
+	mr := &multiReceiver{
+		names: names,
+		in:    make(chan serializer),
+		sends: newSendTimer("aggregator_inbox"),
+		done:  make(chan empty),
+	}
+	for _, name := range names {
+		mr.receivers = append(mr.receivers, newReceivers[name]())
+	}
+	return mr
+}
+
+func (mr *multiReceiver) setConfig(c *config) {
+	for _, r := range mr.receivers {
+		r.setConfig(c)
+	}
+}
+
+func (mr *multiReceiver) inbox() chan serializer {
+	return mr.in
+}
+
+func (mr *multiReceiver) start() {
+	watchChan("aggregator_inbox", mr.in)
+	for i, r := range mr.receivers {
+		watchChan(mr.names[i]+"_inbox", r.inbox())
+		mr.wg.Add(1)
+		go mr.forward(mr.names[i], r.inbox())
+		r.start()
+	}
+}
+
+// forward hands data from the given receiver's inbox over to our inbox, and
+// counts what the receiver received.  Once we're stopped, i.e., once our
+// receivers stopped, we hand over what they left in their inbox, and return.
+func (mr *multiReceiver) forward(name string, inbox chan serializer) {
+	defer mr.wg.Done()
+
+	received := m.numReceived.With(prometheus.Labels{receiverName: name})
+	send := func(s serializer) {
+		received.Inc()
+		sent := mr.sends.start()
+		mr.in <- s
+		sent()
+	}
+	for {
+		select {
+		case s := <-inbox:
+			send(s)
+		case <-mr.done:
+			for {
+				select {
+				case s := <-inbox:
+					send(s)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// stop stops our receivers before we stop forwarding their data, so that they
+// can hand their pending requests, e.g., the Web receiver's overflow buffer, to
+// the aggregator while it's still running.
+func (mr *multiReceiver) stop() {
+	for _, r := range mr.receivers {
+		r.stop()
+	}
+	close(mr.done)
+	mr.wg.Wait()
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// dummyReceiver implements a receiver whose inbox we can feed directly.
+type dummyReceiver struct {
+	in      chan serializer
+	started bool
+	stopped bool
+}
+
+func (d *dummyReceiver) setConfig(c *config)    {}
+func (d *dummyReceiver) inbox() chan serializer { return d.in }
+func (d *dummyReceiver) start()                 { d.started = true }
+func (d *dummyReceiver) stop()                  { d.stopped = true }
+
+func TestMultiReceiver(t *testing.T) {
+	foo := &dummyReceiver{in: make(chan serializer)}
+	bar := &dummyReceiver{in: make(chan serializer)}
+	r := newMultiReceiver([]string{"foo", "bar"}, map[string]func() receiver{
+		"foo": func() receiver { return foo },
+		"bar": func() receiver { return bar },
+	})
+	r.setConfig(&config{})
+	r.start()
+	assertEqual(t, foo.started && bar.started, true)
+
+	before := testutil.ToFloat64(m.numReceived.WithLabelValues("foo"))
+	// Data from either receiver must end up in the shared inbox.
+	foo.in <- blob("foo")
+	assertEqual(t, string((<-r.inbox()).bytes()), "foo")
+	bar.in <- blob("bar")
+	assertEqual(t, string((<-r.inbox()).bytes()), "bar")
+	assertEqual(t, testutil.ToFloat64(m.numReceived.WithLabelValues("foo")), before+1)
+
+	r.stop()
+	assertEqual(t, foo.stopped && bar.stopped, true)
+}
+
+func TestMultiReceiverStop(t *testing.T) {
+	w := newWebReceiver().(*webReceiver)
+	r := newMultiReceiver([]string{"web"}, map[string]func() receiver{
+		"web": func() receiver { return w },
+	})
+	r.setConfig(&config{
+		inboxSize:        2,
+		overflowDir:      t.TempDir(),
+		overflowMaxBytes: defaultOverflowMaxBytes,
+	})
+	r.start()
+
+	// The aggregator isn't reading yet, so requests pile up in the Web
+	// receiver's inbox and its overflow buffer.
+	const numOverflowed = 1500
+	w.in <- &clientRequest{Addr: net.ParseIP(ipv4Addr), Wallet: newV4(t)}
+	w.in <- &clientRequest{Addr: net.ParseIP(ipv4Addr), Wallet: newV4(t)}
+	for i := 0; i < numOverflowed; i++ {
+		assertEqual(t, w.overflow.add(&clientRequest{Addr: net.ParseIP(ipv4Addr), Wallet: newV4(t)}), true)
+	}
+
+	// Once the aggregator runs, stopping must hand it all of them.
+	received := make(chan serializer, numOverflowed+2)
+	go func() {
+		for s := range r.inbox() {
+			received <- s
+		}
+	}()
+	stopped := make(chan empty)
+	go func() {
+		r.stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected multi-receiver to stop.")
+	}
+	for i := 0; i < numOverflowed+2; i++ {
+		select {
+		case <-received:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected %d requests but got %d.", numOverflowed+2, i)
+		}
+	}
+}
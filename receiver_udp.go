@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	uuid "github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// maxDatagramSize is the largest UDP payload that we accept.
+	maxDatagramSize = 65535
+	// defaultUDPAddr makes the UDP receiver listen on loopback only: UDP
+	// senders are unauthenticated and can be spoofed.
+	defaultUDPAddr = "127.0.0.1"
+)
+
+var errBadRecord = newError(ErrValidation, "record must have format '<wallet>,<addr>'")
+
+// udpReceiver implements a receiver that accepts line-oriented records over
+// UDP, e.g., from a legacy log shipper.  Each record has the format
+// "<wallet>,<addr>", and a datagram may contain several records, separated by
+// newlines.  UDP gives us no way to tell the sender about errors, so we drop
+// bad records and count them.  Like the Web receiver's streams, we only take
+// client addresses from trusted networks, if configured.
+type udpReceiver struct {
+	sync.Mutex
+	wg    sync.WaitGroup
+	addr  string
+	port  uint16
+	addrs *addrExtractor
+	conn  net.PacketConn
+	in    chan serializer
+	done  chan empty
+}
+
+func newUDPReceiver() receiver {
+	return &udpReceiver{
+		addr:  defaultUDPAddr,
+		addrs: newAddrExtractor(),
+		in:    make(chan serializer),
+		done:  make(chan empty),
+	}
+}
+
+func (u *udpReceiver) setConfig(c *config) {
+	u.Lock()
+	defer u.Unlock()
+
+	if c.udpAddr != "" {
+		u.addr = c.udpAddr
+	}
+	u.port = c.udpPort
+	u.addrs.setConfig(c)
+}
+
+func (u *udpReceiver) inbox() chan serializer {
+	return u.in
+}
+
+func (u *udpReceiver) start() {
+	u.Lock()
+	defer u.Unlock()
+
+	conn, err := net.ListenPacket("udp", net.JoinHostPort(u.addr, strconv.Itoa(int(u.port))))
+	if err != nil {
+		fatalf(exitListener, "Failed to listen on UDP port %d: %v", u.port, err)
+	}
+	u.conn = conn
+	l.Printf("Starting UDP receiver at %s.", conn.LocalAddr())
+
+	u.wg.Add(1)
+	go func() {
+		defer u.wg.Done()
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				select {
+				case <-u.done:
+					return
+				default:
+				}
+				l.Printf("Failed to read UDP datagram: %v", err)
+				continue
+			}
+			if !u.addrs.trustsPeer(from.String()) {
+				m.numDatagramRecords.With(prometheus.Labels{outcome: failBecause(errUntrustedPeer)}).Inc()
+				countErr(errUntrustedPeer)
+				continue
+			}
+			for _, line := range bytes.Split(buf[:n], []byte("\n")) {
+				if len(bytes.TrimSpace(line)) == 0 {
+					continue
+				}
+				req, err := parseRecord(string(line), u.addrs)
+				if err != nil {
+					m.numDatagramRecords.With(prometheus.Labels{outcome: failBecause(err)}).Inc()
+					countErr(err)
+					continue
+				}
+				select {
+				case u.in <- req:
+					m.numDatagramRecords.With(prometheus.Labels{outcome: success}).Inc()
+				case <-u.done:
+					return
+				}
+			}
+		}
+	}()
+}
+
+func (u *udpReceiver) stop() {
+	close(u.done)
+	u.Lock()
+	if u.conn != nil {
+		u.conn.Close()
+	}
+	u.Unlock()
+	u.wg.Wait()
+}
+
+// parseRecord turns the given "<wallet>,<addr>" record into a client request.
+// The given extractor checks the record's address.
+func parseRecord(record string, addrs *addrExtractor) (*clientRequest, error) {
+	rawWallet, rawAddr, found := strings.Cut(strings.TrimSpace(record), ",")
+	if !found {
+		return nil, errBadRecord
+	}
+	wallet, err := uuid.Parse(strings.TrimSpace(rawWallet))
+	if err != nil {
+		return nil, errBadWalletFmt
+	}
+	addr, err := addrs.parse(rawAddr)
+	if err != nil {
+		return nil, err
+	}
+	return &clientRequest{Addr: addr, Wallet: wallet}, nil
+}
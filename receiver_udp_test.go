@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestParseRecord(t *testing.T) {
+	wallet := newV4(t)
+	addrs := newAddrExtractor()
+	req, err := parseRecord(wallet.String()+", 1.1.1.1\r", addrs)
+	if err != nil {
+		t.Fatalf("Failed to parse record: %v", err)
+	}
+	assertEqual(t, req.Wallet, wallet)
+	assertEqual(t, req.Addr.String(), "1.1.1.1")
+
+	for record, expected := range map[string]error{
+		"foo":                     errBadRecord,
+		"foo,1.1.1.1":             errBadWalletFmt,
+		wallet.String() + ",foo":  errBadAddrFormat,
+		wallet.String() + ",":     errBadAddrFormat,
+		wallet.String() + "1.1.1": errBadRecord,
+	} {
+		if _, err := parseRecord(record, addrs); err != expected {
+			t.Errorf("Expected error %v for %q but got %v.", expected, record, err)
+		}
+	}
+
+	// Records are subject to the same address checks as other requests.
+	addrs.setConfig(&config{rejectNonPublic: true})
+	if _, err := parseRecord(wallet.String()+",10.0.0.1", addrs); err != errNonPublicAddr {
+		t.Errorf("Expected error %v but got %v.", errNonPublicAddr, err)
+	}
+}
+
+func TestUDPReceiver(t *testing.T) {
+	u := newUDPReceiver().(*udpReceiver)
+	u.start()
+	defer u.stop()
+	// By default, we only listen on loopback.
+	assertEqual(t, u.conn.LocalAddr().(*net.UDPAddr).IP.IsLoopback(), true)
+
+	conn, err := net.Dial("udp", u.conn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial UDP receiver: %v", err)
+	}
+	defer conn.Close()
+
+	wallet1, wallet2 := newV4(t), newV4(t)
+	datagram := wallet1.String() + ",1.1.1.1\nfoo\n\n" + wallet2.String() + ",2.2.2.2\n"
+	if _, err := conn.Write([]byte(datagram)); err != nil {
+		t.Fatalf("Failed to send datagram: %v", err)
+	}
+
+	// The bad record must be skipped.
+	req := (<-u.inbox()).(*clientRequest)
+	assertEqual(t, req.Wallet, wallet1)
+	req = (<-u.inbox()).(*clientRequest)
+	assertEqual(t, req.Wallet, wallet2)
+	assertEqual(t, req.Addr.String(), "2.2.2.2")
+}
+
+func TestUDPReceiverUntrustedPeer(t *testing.T) {
+	u := newUDPReceiver().(*udpReceiver)
+	u.setConfig(&config{trustedNets: mustParseCIDRs("10.0.0.0/8")})
+	u.start()
+	defer u.stop()
+	untrusted := m.numDatagramRecords.With(prometheus.Labels{outcome: failBecause(errUntrustedPeer)})
+	numUntrusted := testutil.ToFloat64(untrusted)
+
+	conn, err := net.Dial("udp", u.conn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial UDP receiver: %v", err)
+	}
+	defer conn.Close()
+
+	// We drop datagrams from outside our trusted networks.
+	if _, err := conn.Write([]byte(newV4(t).String() + ",1.1.1.1\n")); err != nil {
+		t.Fatalf("Failed to send datagram: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for testutil.ToFloat64(untrusted) == numUntrusted {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected datagram from untrusted peer to be dropped.")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case req := <-u.inbox():
+		t.Fatalf("Expected no request but got %v.", req)
+	default:
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+)
+
+const (
+	// maxFrameSize is the largest frame that we accept from unix socket
+	// clients.
+	maxFrameSize = 64 * 1024
+	// defaultUnixSocket is where the unix socket receiver listens by default.
+	defaultUnixSocket = "/tmp/tokenizer.sock"
+)
+
+var errFrameTooLarge = newError(ErrValidation, "frame exceeds maximum size")
+
+// unixReceiver implements a receiver that listens on a unix domain socket, so
+// that co-located processes can submit requests without going through TCP
+// and TLS.  The protocol is simple: each request is a frame, i.e., a 4-byte
+// big-endian length followed by a JSON-encoded client request, e.g.:
+//
+//	{"wallet": "68a7deb0-615c-4f26-bf87-6b122732d8e9", "addr": "1.1.1.1"}
+//
+// We answer each request with a frame that contains an error message, or an
+// empty frame if the aggregator processed the request.  A connection may carry
+// any number of requests.
+type unixReceiver struct {
+	sync.Mutex
+	wg   sync.WaitGroup
+	path string
+	ln   net.Listener
+	in   chan serializer
+	done chan empty
+}
+
+func newUnixReceiver() receiver {
+	return &unixReceiver{
+		path: defaultUnixSocket,
+		in:   make(chan serializer),
+		done: make(chan empty),
+	}
+}
+
+func (u *unixReceiver) setConfig(c *config) {
+	u.Lock()
+	defer u.Unlock()
+
+	if c.unixSocket != "" {
+		u.path = c.unixSocket
+	}
+}
+
+func (u *unixReceiver) inbox() chan serializer {
+	return u.in
+}
+
+func (u *unixReceiver) start() {
+	u.Lock()
+	defer u.Unlock()
+
+	// Remove a stale socket that a previous run may have left behind.
+	if err := os.Remove(u.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		fatalf(exitListener, "Failed to remove stale unix socket: %v", err)
+	}
+	ln, err := net.Listen("unix", u.path)
+	if err != nil {
+		fatalf(exitListener, "Failed to listen on unix socket %s: %v", u.path, err)
+	}
+	u.ln = ln
+	l.Printf("Starting unix socket receiver at %s.", u.path)
+
+	u.wg.Add(1)
+	go func() {
+		defer u.wg.Done()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				select {
+				case <-u.done:
+					return
+				default:
+				}
+				l.Printf("Failed to accept unix socket connection: %v", err)
+				continue
+			}
+			u.wg.Add(1)
+			go u.serve(conn)
+		}
+	}()
+}
+
+// serve handles the requests of the given connection until the client hangs
+// up or we're stopped.
+func (u *unixReceiver) serve(conn net.Conn) {
+	defer u.wg.Done()
+	defer conn.Close()
+
+	// Close the connection when we're stopped, which unblocks our reads.
+	closed := make(chan empty)
+	defer close(closed)
+	go func() {
+		select {
+		case <-u.done:
+			conn.Close()
+		case <-closed:
+		}
+	}()
+
+	for {
+		frame, err := readFrame(conn)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				countErr(err)
+				l.Printf("Failed to read frame from unix socket: %s", errFields(err))
+			}
+			return
+		}
+		if err := writeFrame(conn, errToFrame(u.submit(frame))); err != nil {
+			l.Printf("Failed to write frame to unix socket: %v", err)
+			return
+		}
+	}
+}
+
+// submit hands the given request over to the aggregator and waits until the
+// aggregator processed it.
+func (u *unixReceiver) submit(frame []byte) error {
+	req, err := parseJSONRequest(frame)
+	if err != nil {
+		countErr(err)
+		return err
+	}
+	req.ack = make(chan error, 1)
+	select {
+	case u.in <- req:
+	case <-u.done:
+		return errNotProcessed
+	}
+	select {
+	case err := <-req.ack:
+		if err != nil {
+			return errNotProcessed
+		}
+		return nil
+	case <-u.done:
+		return errNotProcessed
+	}
+}
+
+func (u *unixReceiver) stop() {
+	close(u.done)
+	u.Lock()
+	if u.ln != nil {
+		u.ln.Close()
+	}
+	u.Unlock()
+	u.wg.Wait()
+}
+
+func errToFrame(err error) []byte {
+	if err == nil {
+		return nil
+	}
+	return []byte(err.Error())
+}
+
+// readFrame reads a length-prefixed frame from the given reader.
+func readFrame(r io.Reader) ([]byte, error) {
+	var size uint32
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+	if size > maxFrameSize {
+		return nil, errFrameTooLarge
+	}
+	frame := make([]byte, size)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+// writeFrame writes the given frame to the given writer, prefixed by its
+// length.
+func writeFrame(w io.Writer, frame []byte) error {
+	buf := make([]byte, 4+len(frame))
+	binary.BigEndian.PutUint32(buf, uint32(len(frame)))
+	copy(buf[4:], frame)
+	_, err := w.Write(buf)
+	return err
+}
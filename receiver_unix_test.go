@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func TestFrames(t *testing.T) {
+	buf := new(bytes.Buffer)
+	if err := writeFrame(buf, []byte("foo")); err != nil {
+		t.Fatalf("Failed to write frame: %v", err)
+	}
+	if err := writeFrame(buf, nil); err != nil {
+		t.Fatalf("Failed to write frame: %v", err)
+	}
+	frame, err := readFrame(buf)
+	if err != nil {
+		t.Fatalf("Failed to read frame: %v", err)
+	}
+	assertEqual(t, string(frame), "foo")
+	frame, err = readFrame(buf)
+	if err != nil {
+		t.Fatalf("Failed to read frame: %v", err)
+	}
+	assertEqual(t, len(frame), 0)
+
+	// Frames that exceed our maximum size must be rejected.
+	if err := writeFrame(buf, make([]byte, maxFrameSize+1)); err != nil {
+		t.Fatalf("Failed to write frame: %v", err)
+	}
+	if _, err := readFrame(buf); !errors.Is(err, errFrameTooLarge) {
+		t.Fatalf("Expected error %v but got %v.", errFrameTooLarge, err)
+	}
+}
+
+func TestUnixReceiver(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokenizer.sock")
+	u := newUnixReceiver()
+	u.setConfig(&config{unixSocket: path})
+	u.start()
+	defer u.stop()
+
+	// Play aggregator by acknowledging requests.
+	go func() {
+		for s := range u.inbox() {
+			req := s.(*clientRequest)
+			if req.Addr.String() == "2.2.2.2" {
+				req.acknowledge(errors.New("foo"))
+			} else {
+				req.acknowledge(nil)
+			}
+		}
+	}()
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("Failed to connect to unix socket: %v", err)
+	}
+	defer conn.Close()
+
+	wallet := newV4(t).String()
+	for req, resp := range map[string]string{
+		`{"wallet": "` + wallet + `", "addr": "1.1.1.1"}`: "",
+		`{"wallet": "` + wallet + `", "addr": "2.2.2.2"}`: errNotProcessed.Error(),
+		`{"wallet": "` + wallet + `"}`:                    errBadJSONReq.Error(),
+	} {
+		if err := writeFrame(conn, []byte(req)); err != nil {
+			t.Fatalf("Failed to write frame: %v", err)
+		}
+		frame, err := readFrame(conn)
+		if err != nil {
+			t.Fatalf("Failed to read frame: %v", err)
+		}
+		assertEqual(t, string(frame), resp)
+	}
+}
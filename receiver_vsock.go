@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// vsockReceiver implements a receiver that serves the Web receiver's API over
+// AF_VSOCK instead of TCP.  This is meant for deployments in which our parent
+// instance terminates edge traffic and forwards it to us, so neither TLS nor
+// TCP is needed.  Note that vsock peers have no IP address, so the
+// -trusted-cidrs flag cannot be used with this receiver.
+type vsockReceiver struct {
+	*webReceiver
+	// listen returns a listener for the given vsock port.  Tests replace it
+	// with an in-memory listener, so they don't depend on Linux's vsock
+	// support.
+	listen func(port uint32) (net.Listener, error)
+}
+
+func newVsockReceiver() receiver {
+	return &vsockReceiver{
+		webReceiver: newWebReceiver().(*webReceiver),
+		listen:      listenVsock,
+	}
+}
+
+func (v *vsockReceiver) start() {
+	if v.port == 0 {
+		l.Println("Vsock receiver has no port.  Not starting.")
+		return
+	}
+	ln, err := v.listen(uint32(v.port))
+	if err != nil {
+		fatalf(exitListener, "Failed to listen on vsock port %d: %v", v.port, err)
+	}
+	srv := v.newServer()
+	v.srv = srv
+
+	go func() {
+		l.Printf("Starting Web server at vsock port %d.", v.port)
+		if err := srv.Serve(ln); err != http.ErrServerClosed {
+			fatalf(exitListener, "Failed to serve at vsock port %d: %v", v.port, err)
+		}
+	}()
+}
+
+// vsockAddr implements net.Addr for AF_VSOCK addresses, which consist of a
+// context ID and a port.
+type vsockAddr struct {
+	cid  uint32
+	port uint32
+}
+
+func (a *vsockAddr) Network() string {
+	return "vsock"
+}
+
+func (a *vsockAddr) String() string {
+	return fmt.Sprintf("vm(%d):%d", a.cid, a.port)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+func TestVsockAddr(t *testing.T) {
+	a := &vsockAddr{cid: 3, port: 8080}
+	assertEqual(t, a.Network(), "vsock")
+	assertEqual(t, a.String(), "vm(3):8080")
+}
+
+func TestVsockListener(t *testing.T) {
+	ln, err := listenVsock(8080)
+	if err != nil {
+		t.Skipf("Vsock is unavailable: %v", err)
+	}
+	assertEqual(t, ln.Addr().String(), "vm(4294967295):8080")
+	if err := ln.Close(); err != nil {
+		t.Fatalf("Failed to close vsock listener: %v", err)
+	}
+	// Closing the listener must unblock Accept.
+	if _, err := ln.Accept(); err == nil {
+		t.Fatal("Expected Accept on closed listener to fail.")
+	}
+}
+
+// memListener implements an in-memory net.Listener whose connections are
+// backed by net.Pipe.  It lets us test the vsock receiver on platforms without
+// vsock support.
+type memListener struct {
+	conns  chan net.Conn
+	closed chan empty
+	once   sync.Once
+}
+
+func newMemListener() *memListener {
+	return &memListener{
+		conns:  make(chan net.Conn),
+		closed: make(chan empty),
+	}
+}
+
+func (m *memListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-m.conns:
+		return c, nil
+	case <-m.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (m *memListener) Close() error {
+	m.once.Do(func() { close(m.closed) })
+	return nil
+}
+
+func (m *memListener) Addr() net.Addr {
+	return &vsockAddr{cid: 3, port: 8080}
+}
+
+// dial returns the client side of a new connection to the listener.
+func (m *memListener) dial(ctx context.Context, _, _ string) (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case m.conns <- server:
+		return client, nil
+	case <-m.closed:
+		return nil, net.ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestVsockReceiver(t *testing.T) {
+	ln := newMemListener()
+	v := newVsockReceiver().(*vsockReceiver)
+	v.listen = func(port uint32) (net.Listener, error) {
+		assertEqual(t, port, uint32(8080))
+		return ln, nil
+	}
+	v.setConfig(&config{port: 8080, addrHeader: fastlyClientIP})
+	v.start()
+	defer v.stop()
+
+	go func() {
+		(<-v.inbox()).(*clientRequest).acknowledge(nil)
+	}()
+	client := &http.Client{Transport: &http.Transport{DialContext: ln.dial}}
+	req, err := http.NewRequest(http.MethodGet,
+		fmt.Sprintf("http://vsock/v3/confirmation/token/%s", newV4(t)), nil)
+	if err != nil {
+		t.Fatalf("Failed to create HTTP request: %v", err)
+	}
+	req.Header.Set(fastlyClientIP, ipv4Addr)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to make HTTP request: %v", err)
+	}
+	resp.Body.Close()
+	assertEqual(t, resp.StatusCode, http.StatusOK)
+}
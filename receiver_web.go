@@ -1,11 +1,15 @@
 package main
 
 import (
-	"errors"
+	"context"
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
+	"math"
 	"net"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	uuid "github.com/google/uuid"
@@ -17,66 +21,168 @@ const (
 	// https://developer.fastly.com/reference/http/http-headers/Fastly-Client-IP/
 	// (retrieved on 2021-11-29)
 	fastlyClientIP = "Fastly-Client-IP"
-	indexPage      = "This request is handled by tokenizer."
+	// defaultAckTimeout determines how long we wait for the aggregator to
+	// process a client request before giving up.
+	defaultAckTimeout = time.Second * 10
+	// shutdownTimeout determines how long we wait for in-flight requests to
+	// finish when shutting down.
+	shutdownTimeout = defaultAckTimeout + time.Second*5
+
+	// Our default HTTP timeouts and header limit.  Our write timeout must
+	// exceed the time that we wait for the aggregator.
+	defaultReadHeaderTimeout = time.Second * 5
+	defaultReadTimeout       = time.Second * 10
+	defaultWriteTimeout      = defaultAckTimeout + time.Second*5
+	defaultMaxHeaderBytes    = 1 << 16
+
+	// defaultInboxSize is the number of requests that may wait for the
+	// aggregator before we turn clients away.
+	defaultInboxSize = 1000
+	// overloadRetryAfter tells clients when to retry if we're overloaded.
+	overloadRetryAfter = time.Second
 )
 
 var (
-	errBadApiVersion       = errors.New("invalid ads API version")
-	errBadWalletFmt        = errors.New("wallet ID has bad format")
-	errNoFastlyHeader      = fmt.Errorf("found no %q header", fastlyClientIP)
-	errBadFastlyAddrFormat = fmt.Errorf("bad IP address format in %q header", fastlyClientIP)
+	errBadApiVersion = newError(ErrValidation, "invalid ads API version")
+	errBadWalletFmt  = newError(ErrValidation, "wallet ID has bad format")
+	errNotProcessed  = newError(ErrDownstream, "failed to process request")
+	errAckTimeout    = newError(ErrOverloaded, "timed out waiting for request to be processed")
+	errBadJSONReq    = newError(ErrValidation, "not a valid JSON-encoded client request")
+	errOverloaded    = newError(ErrOverloaded, "too many pending requests")
 )
 
 // clientRequest represents a client's confirmation token request.  It contains
-// the client's IP address and wallet ID.
+// the client's IP address, wallet ID, and optional metadata.  If the request
+// carries an ack channel, the aggregator uses it to tell us if it processed the
+// request.
 type clientRequest struct {
-	Addr   net.IP    `json:"addr"`
-	Wallet uuid.UUID `json:"wallet"`
+	Addr   net.IP       `json:"addr"`
+	Wallet uuid.UUID    `json:"wallet"`
+	Meta   *requestMeta `json:"meta,omitempty"`
+	// ApiVersion is the ads API version of the request, or 0 if unknown.
+	ApiVersion int `json:"api_version,omitempty"`
+	// RequestID lets us trace the request, or is empty if unknown.
+	RequestID string `json:"request_id,omitempty"`
+	ack       chan error
+	// pseudonym is the anonymized address, and dequeued is when the
+	// aggregator picked up the request.  The aggregator sets both before
+	// acknowledging the request.
+	pseudonym string
+	dequeued  time.Time
 }
 
 func (c *clientRequest) bytes() []byte {
 	return c.Addr
 }
 
+// parseJSONRequest turns the given JSON-encoded client request into a
+// clientRequest.  Receivers that take JSON, e.g., the Kafka receiver, use it.
+func parseJSONRequest(b []byte) (*clientRequest, error) {
+	req := &clientRequest{}
+	if err := json.Unmarshal(b, req); err != nil || req.Addr == nil {
+		return nil, errBadJSONReq
+	}
+	return req, nil
+}
+
+// acknowledge reports the outcome of processing the request to whoever is
+// waiting for it.  Requests without an ack channel are fire-and-forget.
+func (c *clientRequest) acknowledge(err error) {
+	if c.ack != nil {
+		c.ack <- err
+	}
+}
+
 // webReceiver implements a receiver that exposes an HTTP API to receive data.
 type webReceiver struct {
-	done   chan empty
-	in     chan serializer
-	router *chi.Mux
-	port   uint16
+	done          chan empty
+	in            chan serializer
+	addrs         *addrExtractor
+	auth          *edgeAuthenticator
+	limiter       *walletLimiter
+	dedup         *dedupCache
+	sunsets       *sunsetPolicy
+	csrf          *csrfGuard
+	overflow      *overflowBuffer
+	version       *versionInfo
+	diag          *connDiagnostics
+	router        *chi.Mux
+	port          uint16
+	tlsConf       *tls.Config
+	tuning        httpTuning
+	srv           *http.Server
+	ackTimeout    time.Duration
+	streamTimeout time.Duration
+	echoWallet    uuid.UUID
 }
 
 func newWebReceiver() receiver {
 	w := &webReceiver{
-		in:   make(chan serializer),
-		done: make(chan empty),
+		in:            make(chan serializer, defaultInboxSize),
+		done:          make(chan empty),
+		addrs:         newAddrExtractor(),
+		auth:          newEdgeAuthenticator(),
+		limiter:       newWalletLimiter(),
+		dedup:         newDedupCache(),
+		sunsets:       newSunsetPolicy(),
+		csrf:          newCSRFGuard(),
+		overflow:      newOverflowBuffer(),
+		version:       newVersionInfo("", nil),
+		diag:          newConnDiagnostics(),
+		ackTimeout:    defaultAckTimeout,
+		streamTimeout: defaultStreamTimeout,
 	}
-	w.router = newRouter(w.in)
+	w.router = newRouter(w)
 
 	return w
 }
 
 // isValidApiVersion returns true if we're dealing with ads API version 1, 2,
-// 3, or 4.  As of 2023-05-05, version 1 and 2 are outdated, 3 is live, and 4
-// is not yet in the works.  For the sake of being future-proof, we do however
-// accept version 4 already.
+// 3, 4, or 5.  As of 2023-05-05, version 1 and 2 are outdated, 3 is live, and
+// 4 is not yet in the works.  For the sake of being future-proof, we do
+// however accept version 4 already.  Version 5 adds optional metadata.
 func isValidApiVersion(v string) bool {
 	num, err := strconv.ParseUint(v, 10, 0)
 	if err != nil {
 		return false
 	}
-	return num >= 1 && num <= 4
+	return num >= 1 && num <= 5
 }
 
-func newRouter(inbox chan serializer) *chi.Mux {
+func newRouter(w *webReceiver) *chi.Mux {
 	r := chi.NewRouter()
-	r.Get("/v{version}/confirmation/token/{walletID}", getConfTokenHandler(inbox))
-	r.Get("/", indexHandler)
+	r.Use(withRequestID, rejections.sample, measureLatency, recoverer, limitRequestSize)
+	r.With(w.csrf.protect(routeToken)).
+		Get("/v{version}/confirmation/token/{walletID}", w.getConfTokenHandler)
+	r.Post(streamRoute, w.streamHandler)
+	r.With(w.csrf.protect(routeVersion)).Get("/version", w.versionHandler)
+	r.Get("/healthz", healthzHandler)
+	r.Get("/readyz", readyzHandler)
 	return r
 }
 
+// setConfig sets the given configuration.  It must be called before the
+// receiver's inbox is connected to the aggregator because it may replace the
+// inbox.
 func (w *webReceiver) setConfig(c *config) {
+	if c.inboxSize > 0 && c.inboxSize != cap(w.in) {
+		w.in = make(chan serializer, c.inboxSize)
+	}
 	w.port = c.port
+	w.tlsConf = c.webTLSConfig
+	w.tuning = c.httpTuning
+	w.echoWallet = c.echoWallet
+	w.addrs.setConfig(c)
+	w.auth.setConfig(c)
+	w.limiter.setConfig(c)
+	w.dedup.setConfig(c)
+	w.sunsets.setConfig(c)
+	w.csrf.setConfig(c)
+	w.overflow.setConfig(c)
+	w.version = newVersionInfo(c.tokenizer, c.expectedPCRs)
+	if c.flushSigner != nil {
+		w.version.SigningKey = c.flushSigner.publicKey()
+	}
 }
 
 func (w *webReceiver) inbox() chan serializer {
@@ -84,61 +190,213 @@ func (w *webReceiver) inbox() chan serializer {
 }
 
 func (w *webReceiver) start() {
+	srv := w.newServer()
+	ln, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		fatalf(exitListener, "Failed to listen on %s: %v", srv.Addr, err)
+	}
+	if w.tuning.listenBacklog > 0 {
+		if err := setListenBacklog(ln, w.tuning.listenBacklog); err != nil {
+			fatalf(exitListener, "Failed to set listen backlog: %v", err)
+		}
+	}
+
+	w.srv = srv
+	if w.overflow.enabled() {
+		w.overflow.run(w.in)
+	}
+
 	go func() {
 		l.Printf("Starting Web server at :%d.", w.port)
-		srv := &http.Server{
-			Addr:    fmt.Sprintf(":%d", w.port),
-			Handler: w.router,
+		if w.tlsConf != nil {
+			// Our certificate and key are part of the TLS config.
+			err = srv.ServeTLS(ln, "", "")
+		} else {
+			err = srv.Serve(ln)
+		}
+		if err != http.ErrServerClosed {
+			fatalf(exitListener, "Failed to serve at :%d: %v", w.port, err)
 		}
-		l.Fatal(srv.ListenAndServe())
 	}()
 }
 
+// applyTimeouts sets the given server's timeouts and header limit.
+func (t httpTuning) applyTimeouts(srv *http.Server) {
+	srv.ReadHeaderTimeout = t.readHeaderTimeout
+	srv.ReadTimeout = t.readTimeout
+	srv.WriteTimeout = t.writeTimeout
+	srv.IdleTimeout = t.idleTimeout
+	srv.MaxHeaderBytes = t.maxHeaderBytes
+}
+
+// newServer returns the Web receiver's HTTP server, tuned according to our
+// configuration.
+func (w *webReceiver) newServer() *http.Server {
+	srv := &http.Server{
+		Addr:      fmt.Sprintf(":%d", w.port),
+		Handler:   w.router,
+		TLSConfig: w.tlsConf,
+	}
+	w.tuning.applyTimeouts(srv)
+	w.diag.instrument(srv)
+	if w.tuning.disableHTTP2 {
+		// A non-nil, empty map disables net/http's built-in HTTP/2 support.
+		srv.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	}
+	srv.SetKeepAlivesEnabled(!w.tuning.disableKeepAlives)
+	return srv
+}
+
+// stop stops accepting new connections and waits for in-flight requests to
+// finish.
 func (w *webReceiver) stop() {
 	close(w.done)
+	if w.srv == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := w.srv.Shutdown(ctx); err != nil {
+		l.Printf("Failed to shut down Web server gracefully: %v", err)
+	}
+	// Our caller keeps handing our inbox to the aggregator until we
+	// return, so the aggregator gets to process the requests that are left
+	// in our overflow buffer.
+	if w.overflow.enabled() {
+		w.overflow.stop(w.in)
+	}
+	l.Println("Stopped Web server.")
 }
 
-func indexHandler(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintln(w, indexPage)
+func (w *webReceiver) versionHandler(rw http.ResponseWriter, r *http.Request) {
+	w.version.handler(rw, r)
 }
 
-func getConfTokenHandler(inbox chan serializer) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		errAndReport := func(body string, code int) {
-			http.Error(w, body, code)
-			m.webResponses.With(prometheus.Labels{
-				httpCode: fmt.Sprintf("%d", code),
-				httpBody: body,
-			}).Inc()
-		}
+// writeErr responds with the given error and status code, and accounts for
+// the error in our metrics and our sample of rejected requests.
+func writeErr(rw http.ResponseWriter, err error, code int) {
+	http.Error(rw, err.Error(), code)
+	recordRejection(rw, err, code)
+	m.webResponses.With(prometheus.Labels{
+		httpCode: fmt.Sprintf("%d", code),
+		httpBody: err.Error(),
+	}).Inc()
+	countErr(err)
+}
 
-		if !isValidApiVersion(chi.URLParam(r, "version")) {
-			errAndReport(errBadApiVersion.Error(), http.StatusBadRequest)
-			return
-		}
-		// Make sure that the wallet ID is a valid UUID.
-		rawWalletID := chi.URLParam(r, "walletID")
+func (w *webReceiver) getConfTokenHandler(rw http.ResponseWriter, r *http.Request) {
+	errAndReport := func(err error) {
+		writeErr(rw, err, httpStatus(err))
+	}
 
-		walletID, err := uuid.Parse(rawWalletID)
-		if err != nil {
-			errAndReport(errBadWalletFmt.Error(), http.StatusBadRequest)
+	// Make sure that the request was signed by our edge.
+	if err := w.auth.verify(r); err != nil {
+		errAndReport(err)
+		return
+	}
+
+	rawVersion := chi.URLParam(r, "version")
+	if !isValidApiVersion(rawVersion) {
+		errAndReport(errBadApiVersion)
+		return
+	}
+	version, _ := strconv.Atoi(rawVersion)
+	if err := w.sunsets.check(rw, version); err != nil {
+		errAndReport(err)
+		return
+	}
+	// Newer API versions may carry metadata.
+	var meta *requestMeta
+	if version >= metaApiVersion {
+		var err error
+		if meta, err = parseRequestMeta(r); err != nil {
+			errAndReport(err)
 			return
 		}
+	}
+	// Make sure that the wallet ID is a valid UUID.
+	rawWalletID := chi.URLParam(r, "walletID")
+
+	walletID, err := uuid.Parse(rawWalletID)
+	if err != nil {
+		errAndReport(errBadWalletFmt)
+		return
+	}
+
+	// Fetch the client's IP address from the configured header.
+	addr, err := w.addrs.extract(r)
+	if err != nil {
+		errAndReport(err)
+		return
+	}
 
-		rawAddr := r.Header.Get(fastlyClientIP)
-		if rawAddr == "" {
-			errAndReport(errNoFastlyHeader.Error(), http.StatusBadRequest)
+	// Make sure that the wallet isn't exceeding its rate limit.
+	if ok, retryAfter := w.limiter.allow(walletID); !ok {
+		secs := int(math.Ceil(retryAfter.Seconds()))
+		rw.Header().Set("Retry-After", strconv.Itoa(secs))
+		errAndReport(errRateLimited)
+		return
+	}
+
+	// Requests of the debug echo wallet are answered with the anonymized
+	// address, so they must always reach the aggregator.
+	echo := w.echoWallet != uuid.Nil && walletID == w.echoWallet
+
+	// Skip requests that we recently handed over to the aggregator.  As far
+	// as the client is concerned, its request succeeded.
+	if !echo && w.dedup.contains(walletID, addr) {
+		m.numDeduplicated.Inc()
+		m.webResponses.With(prometheus.Labels{httpCode: "200", httpBody: ""}).Inc()
+		return
+	}
+
+	// Hand the request over to the aggregator and wait until it tells us if
+	// it was able to process the request.
+	req := &clientRequest{
+		Addr:       addr,
+		Wallet:     walletID,
+		Meta:       meta,
+		ApiVersion: version,
+		RequestID:  requestID(r.Context()),
+		ack:        make(chan error, 1),
+	}
+	// If the aggregator cannot keep up, we buffer the request in our
+	// overflow buffer (if enabled) and don't wait for the aggregator.  If the
+	// buffer is full, too, we turn clients away rather than piling up
+	// handler goroutines.
+	enqueued := time.Now()
+	select {
+	case w.in <- req:
+	default:
+		if !echo && w.overflow.add(req) {
+			w.dedup.add(walletID, addr)
+			m.webResponses.With(prometheus.Labels{httpCode: "200", httpBody: ""}).Inc()
 			return
 		}
-
-		// Fetch the client's IP address from Fastly's proprietary header.
-		addr := net.ParseIP(rawAddr)
-		if addr == nil {
-			errAndReport(errBadFastlyAddrFormat.Error(), http.StatusBadRequest)
+		m.numOverloaded.Inc()
+		secs := int(math.Ceil(overloadRetryAfter.Seconds()))
+		rw.Header().Set("Retry-After", strconv.Itoa(secs))
+		errAndReport(errOverloaded)
+		return
+	}
+	select {
+	case err := <-req.ack:
+		if !req.dequeued.IsZero() {
+			m.webInboxWait.With(latencyLabels(r)).Observe(req.dequeued.Sub(enqueued).Seconds())
+		}
+		if err != nil {
+			errAndReport(errNotProcessed)
 			return
 		}
-
-		m.webResponses.With(prometheus.Labels{httpCode: "200", httpBody: ""}).Inc()
-		inbox <- &clientRequest{Addr: addr, Wallet: walletID}
+	case <-time.After(w.ackTimeout):
+		errAndReport(errAckTimeout)
+		return
+	case <-r.Context().Done():
+		return
+	}
+	w.dedup.add(walletID, addr)
+	m.webResponses.With(prometheus.Labels{httpCode: "200", httpBody: ""}).Inc()
+	if echo {
+		fmt.Fprintln(rw, req.pseudonym)
 	}
 }
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// xForwardedFor contains a comma-separated list of addresses, one for
+	// each proxy that the request traversed.  Each proxy appends the address
+	// of the host it received the request from, i.e., the left-most address
+	// is (supposedly) the client's address:
+	// https://developer.mozilla.org/en-US/docs/Web/HTTP/Headers/X-Forwarded-For
+	// (retrieved on 2024-06-11)
+	xForwardedFor = "X-Forwarded-For"
+)
+
+var (
+	errNoAddrHeader  = newError(ErrValidation, "found no header containing client's IP address")
+	errBadAddrFormat = newError(ErrValidation, "bad IP address format in header")
+	errBadAddrPort   = newError(ErrValidation, "bad port in header's IP address")
+	errZonedAddr     = newError(ErrValidation, "IPv6 zones are not allowed in header's IP address")
+	errTooFewHops    = newError(ErrValidation, fmt.Sprintf("too few hops in %q header", xForwardedFor))
+	errUntrustedPeer = newError(ErrForbidden, "request did not come from a trusted proxy")
+	errNonPublicAddr = newError(ErrValidation, "client's IP address is not publicly routable")
+
+	// bogonNets contains reserved networks that are neither covered by the
+	// net.IP's Is* methods nor publicly routable:
+	// https://www.team-cymru.com/bogon-reference
+	// (retrieved on 2024-06-11)
+	bogonNets = mustParseCIDRs("0.0.0.0/8,100.64.0.0/10,192.0.0.0/24,192.0.2.0/24," +
+		"198.18.0.0/15,198.51.100.0/24,203.0.113.0/24,240.0.0.0/4,2001:db8::/32")
+)
+
+// addrExtractor extracts a client's IP address from the headers of an HTTP
+// request.  By default, we trust Fastly's proprietary header but deployments
+// behind other CDNs or load balancers may configure a different header, or
+// fall back to X-Forwarded-For.
+type addrExtractor struct {
+	sync.RWMutex
+	header          string
+	trustedProxies  int
+	trustedNets     []*net.IPNet
+	rejectNonPublic bool
+}
+
+func newAddrExtractor() *addrExtractor {
+	return &addrExtractor{header: fastlyClientIP}
+}
+
+// setConfig sets the header to extract the client's IP address from and the
+// number of trusted proxies in front of us.  An empty header means that we
+// stick to Fastly's header.
+func (e *addrExtractor) setConfig(c *config) {
+	e.Lock()
+	defer e.Unlock()
+
+	e.header = fastlyClientIP
+	if c.addrHeader != "" {
+		e.header = http.CanonicalHeaderKey(c.addrHeader)
+	}
+	e.trustedProxies = c.trustedProxies
+	e.trustedNets = c.trustedNets
+	e.rejectNonPublic = c.rejectNonPublic
+}
+
+// extract returns the client's IP address.  If the configured header is set,
+// we use it.  If it's not, and we know of trusted proxies in front of us, we
+// fall back to X-Forwarded-For.  Either way, we only trust the headers if the
+// request came from a trusted network, if configured.
+func (e *addrExtractor) extract(r *http.Request) (net.IP, error) {
+	e.RLock()
+	defer e.RUnlock()
+
+	addr, err := e.extractFromHeaders(r)
+	if err != nil {
+		return nil, err
+	}
+	return e.checkPublic(addr)
+}
+
+// parse returns the given client's IP address, e.g., from a stream event.  The
+// caller must make sure that the address came from a trusted peer.
+func (e *addrExtractor) parse(rawAddr string) (net.IP, error) {
+	e.RLock()
+	defer e.RUnlock()
+
+	addr, err := parseAddr(rawAddr)
+	if err != nil {
+		return nil, err
+	}
+	return e.checkPublic(addr)
+}
+
+// trustsPeer returns true if we may take client addresses from the given
+// peer.
+func (e *addrExtractor) trustsPeer(remoteAddr string) bool {
+	e.RLock()
+	defer e.RUnlock()
+
+	return e.isTrustedPeer(remoteAddr)
+}
+
+// checkPublic returns the given address, or an error if it's not publicly
+// routable and we reject such addresses.
+func (e *addrExtractor) checkPublic(addr net.IP) (net.IP, error) {
+	if e.rejectNonPublic && !isPublicAddr(addr) {
+		m.numNonPublicAddrs.Inc()
+		return nil, errNonPublicAddr
+	}
+	return addr, nil
+}
+
+// extractFromHeaders returns the client's IP address from the request's
+// headers.
+func (e *addrExtractor) extractFromHeaders(r *http.Request) (net.IP, error) {
+	if !e.isTrustedPeer(r.RemoteAddr) {
+		return nil, errUntrustedPeer
+	}
+	if e.header == xForwardedFor {
+		return e.fromForwardedFor(r.Header.Values(xForwardedFor))
+	}
+	if rawAddr := r.Header.Get(e.header); rawAddr != "" {
+		return parseAddr(rawAddr)
+	}
+	if e.trustedProxies > 0 {
+		if hops := r.Header.Values(xForwardedFor); len(hops) > 0 {
+			return e.fromForwardedFor(hops)
+		}
+	}
+	return nil, errNoAddrHeader
+}
+
+// isTrustedPeer returns true if the given address of our direct peer is in
+// one of our trusted networks, or if we have no trusted networks configured,
+// in which case anyone can set the client's IP address.
+func (e *addrExtractor) isTrustedPeer(remoteAddr string) bool {
+	if len(e.trustedNets) == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	peer := net.ParseIP(host)
+	if peer == nil {
+		return false
+	}
+	for _, n := range e.trustedNets {
+		if n.Contains(peer) {
+			return true
+		}
+	}
+	return false
+}
+
+// fromForwardedFor returns the client's IP address from the given
+// X-Forwarded-For header values.  The right-most addresses were added by our
+// trusted proxies, so we skip all but the outermost of them; anything to the
+// left of that may have been forged by the client.  Without trusted proxies,
+// we have to take the client's word and use the left-most address.
+func (e *addrExtractor) fromForwardedFor(values []string) (net.IP, error) {
+	var hops []string
+	for _, v := range values {
+		for _, hop := range strings.Split(v, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	if len(hops) == 0 || (len(hops) == 1 && hops[0] == "") {
+		return nil, errNoAddrHeader
+	}
+	if e.trustedProxies == 0 {
+		return parseAddr(hops[0])
+	}
+	if len(hops) < e.trustedProxies {
+		return nil, errTooFewHops
+	}
+	return parseAddr(hops[len(hops)-e.trustedProxies])
+}
+
+// isPublicAddr returns true if the given address is publicly routable, i.e.,
+// it's neither private, nor loopback, nor link-local, nor otherwise reserved.
+func isPublicAddr(addr net.IP) bool {
+	if addr.IsPrivate() ||
+		addr.IsLoopback() ||
+		addr.IsLinkLocalUnicast() ||
+		addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() ||
+		addr.IsMulticast() ||
+		addr.IsUnspecified() {
+		return false
+	}
+	for _, n := range bogonNets {
+		if n.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseAddr turns the given string into an IP address.
+//
+// Besides bare addresses, we accept bracketed IPv6 addresses (e.g.,
+// "[2001:db8::1]") and addresses with a port (e.g., "1.2.3.4:443" or
+// "[2001:db8::1]:443"), which some CDNs use.  We drop the brackets and the
+// port.  We reject addresses with an IPv6 zone (e.g., "fe80::1%eth0") because
+// zones only make sense for link-local addresses, which are never a client's
+// address.
+func parseAddr(rawAddr string) (net.IP, error) {
+	s := strings.TrimSpace(rawAddr)
+	if host, port, err := net.SplitHostPort(s); err == nil {
+		if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			return nil, errBadAddrPort
+		}
+		s = host
+	} else if strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]") {
+		s = s[1 : len(s)-1]
+	}
+	if strings.Contains(s, "%") {
+		return nil, errZonedAddr
+	}
+	addr := net.ParseIP(s)
+	if addr == nil {
+		return nil, errBadAddrFormat
+	}
+	return addr, nil
+}
+
+// parseCIDRs turns the given comma-separated list of networks in CIDR
+// notation, e.g., "10.0.0.0/8,2001:db8::/32", into a slice of networks.
+func parseCIDRs(s string) ([]*net.IPNet, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var nets []*net.IPNet
+	for _, rawNet := range strings.Split(s, ",") {
+		_, n, err := net.ParseCIDR(strings.TrimSpace(rawNet))
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// mustParseCIDRs is like parseCIDRs but panics if the networks cannot be
+// parsed.  It simplifies the initialization of global variables.
+func mustParseCIDRs(s string) []*net.IPNet {
+	nets, err := parseCIDRs(s)
+	if err != nil {
+		panic(err)
+	}
+	return nets
+}
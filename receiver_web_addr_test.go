@@ -0,0 +1,241 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestExtractAddr(t *testing.T) {
+	tests := []struct {
+		name           string
+		header         string
+		trustedProxies int
+		reqHeader      http.Header
+		addr           string
+		err            error
+	}{
+		{
+			name:      "Fastly header",
+			reqHeader: http.Header{fastlyClientIP: []string{"1.1.1.1"}},
+			addr:      "1.1.1.1",
+		},
+		{
+			name:      "no header",
+			reqHeader: http.Header{},
+			err:       errNoAddrHeader,
+		},
+		{
+			name:      "bad address",
+			reqHeader: http.Header{fastlyClientIP: []string{"foo"}},
+			err:       errBadAddrFormat,
+		},
+		{
+			name:      "custom header",
+			header:    "cloudfront-viewer-address",
+			reqHeader: http.Header{"Cloudfront-Viewer-Address": []string{"2.2.2.2"}},
+			addr:      "2.2.2.2",
+		},
+		{
+			name:      "no fallback without trusted proxies",
+			reqHeader: http.Header{xForwardedFor: []string{"1.1.1.1"}},
+			err:       errNoAddrHeader,
+		},
+		{
+			name:           "fallback to X-Forwarded-For",
+			trustedProxies: 1,
+			reqHeader:      http.Header{xForwardedFor: []string{"6.6.6.6, 1.1.1.1"}},
+			addr:           "1.1.1.1",
+		},
+		{
+			name:           "configured header takes precedence",
+			trustedProxies: 1,
+			reqHeader: http.Header{
+				fastlyClientIP: []string{"2.2.2.2"},
+				xForwardedFor:  []string{"1.1.1.1"},
+			},
+			addr: "2.2.2.2",
+		},
+		{
+			name:           "X-Forwarded-For with two trusted proxies",
+			header:         xForwardedFor,
+			trustedProxies: 2,
+			reqHeader:      http.Header{xForwardedFor: []string{"6.6.6.6, 1.1.1.1", "3.3.3.3"}},
+			addr:           "1.1.1.1",
+		},
+		{
+			name:      "X-Forwarded-For without trusted proxies",
+			header:    xForwardedFor,
+			reqHeader: http.Header{xForwardedFor: []string{"1.1.1.1,2.2.2.2"}},
+			addr:      "1.1.1.1",
+		},
+		{
+			name:           "too few hops",
+			header:         xForwardedFor,
+			trustedProxies: 3,
+			reqHeader:      http.Header{xForwardedFor: []string{"1.1.1.1, 2.2.2.2"}},
+			err:            errTooFewHops,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := newAddrExtractor()
+			e.setConfig(&config{addrHeader: test.header, trustedProxies: test.trustedProxies})
+
+			// Add headers one by one, so they get canonicalized.
+			req := &http.Request{Header: http.Header{}}
+			for key, values := range test.reqHeader {
+				for _, v := range values {
+					req.Header.Add(key, v)
+				}
+			}
+			addr, err := e.extract(req)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("Expected error %v but got %v.", test.err, err)
+			}
+			if test.err == nil && !addr.Equal(net.ParseIP(test.addr)) {
+				t.Fatalf("Expected address %s but got %s.", test.addr, addr)
+			}
+		})
+	}
+}
+
+func TestParseAddr(t *testing.T) {
+	tests := []struct {
+		raw  string
+		addr string
+		err  error
+	}{
+		{raw: "1.2.3.4", addr: "1.2.3.4"},
+		{raw: " 1.2.3.4 ", addr: "1.2.3.4"},
+		{raw: "2001:db8::1", addr: "2001:db8::1"},
+		{raw: "[2001:db8::1]", addr: "2001:db8::1"},
+		{raw: "1.2.3.4:443", addr: "1.2.3.4"},
+		{raw: "[2001:db8::1]:443", addr: "2001:db8::1"},
+		{raw: "[::ffff:1.2.3.4]", addr: "1.2.3.4"},
+		{raw: "1.2.3.4:", err: errBadAddrPort},
+		{raw: "1.2.3.4:foo", err: errBadAddrPort},
+		{raw: "[2001:db8::1]:65536", err: errBadAddrPort},
+		{raw: "fe80::1%eth0", err: errZonedAddr},
+		{raw: "[fe80::1%eth0]", err: errZonedAddr},
+		{raw: "[fe80::1%25eth0]:443", err: errZonedAddr},
+		{raw: "[2001:db8::1", err: errBadAddrFormat},
+		{raw: "2001:db8::1]", err: errBadAddrFormat},
+		{raw: "[]", err: errBadAddrFormat},
+		{raw: "", err: errBadAddrFormat},
+		{raw: "foo:443", err: errBadAddrFormat},
+	}
+	for _, test := range tests {
+		addr, err := parseAddr(test.raw)
+		if !errors.Is(err, test.err) {
+			t.Errorf("%q: Expected error %v but got %v.", test.raw, test.err, err)
+			continue
+		}
+		if err == nil && addr.String() != test.addr {
+			t.Errorf("%q: Expected address %s but got %s.", test.raw, test.addr, addr)
+		}
+	}
+}
+
+func TestTrustedPeer(t *testing.T) {
+	nets, err := parseCIDRs("10.0.0.0/8, 2001:db8::/32")
+	if err != nil {
+		t.Fatalf("Failed to parse networks: %v", err)
+	}
+	e := newAddrExtractor()
+	e.setConfig(&config{trustedNets: nets})
+
+	req := &http.Request{Header: http.Header{}}
+	req.Header.Set(fastlyClientIP, "1.1.1.1")
+
+	for remoteAddr, trusted := range map[string]bool{
+		"10.1.2.3:1234":         true,
+		"[2001:db8::1]:1234":    true,
+		"10.1.2.3":              true,
+		"11.1.2.3:1234":         false,
+		"[2001:db9::1]:1234":    false,
+		"not an address at all": false,
+	} {
+		req.RemoteAddr = remoteAddr
+		_, err := e.extract(req)
+		if trusted && err != nil {
+			t.Fatalf("Expected %s to be trusted but got error: %v", remoteAddr, err)
+		}
+		if !trusted && !errors.Is(err, errUntrustedPeer) {
+			t.Fatalf("Expected error %v for %s but got %v.", errUntrustedPeer, remoteAddr, err)
+		}
+	}
+
+	// Without trusted networks, we trust everyone.
+	e.setConfig(&config{})
+	req.RemoteAddr = "11.1.2.3:1234"
+	if _, err := e.extract(req); err != nil {
+		t.Fatalf("Expected no error but got: %v", err)
+	}
+}
+
+func TestParseCIDRs(t *testing.T) {
+	nets, err := parseCIDRs("")
+	assertEqual(t, err, nil)
+	assertEqual(t, len(nets), 0)
+
+	nets, err = parseCIDRs("1.1.1.0/24,10.0.0.0/8")
+	assertEqual(t, err, nil)
+	assertEqual(t, len(nets), 2)
+
+	if _, err = parseCIDRs("1.1.1.1"); err == nil {
+		t.Fatal("Expected error for network without prefix length but got none.")
+	}
+}
+
+func TestIsPublicAddr(t *testing.T) {
+	for rawAddr, isPublic := range map[string]bool{
+		"1.1.1.1":         true,
+		"2606:4700::1111": true,
+		"10.1.2.3":        false,
+		"172.16.0.1":      false,
+		"192.168.1.1":     false,
+		"127.0.0.1":       false,
+		"169.254.1.1":     false,
+		"0.0.0.0":         false,
+		"100.64.1.1":      false,
+		"192.0.2.1":       false,
+		"224.0.0.1":       false,
+		"255.255.255.255": false,
+		"::1":             false,
+		"::":              false,
+		"fe80::1":         false,
+		"fc00::1":         false,
+		"2001:db8::1":     false,
+		"ff02::1":         false,
+	} {
+		assertEqual(t, isPublicAddr(net.ParseIP(rawAddr)), isPublic)
+	}
+}
+
+func TestRejectNonPublic(t *testing.T) {
+	e := newAddrExtractor()
+	req := &http.Request{Header: http.Header{}}
+	req.Header.Set(fastlyClientIP, "10.0.0.1")
+
+	// By default, we accept non-public addresses.
+	if _, err := e.extract(req); err != nil {
+		t.Fatalf("Expected no error but got %v.", err)
+	}
+
+	e.setConfig(&config{rejectNonPublic: true})
+	before := testutil.ToFloat64(m.numNonPublicAddrs)
+	if _, err := e.extract(req); !errors.Is(err, errNonPublicAddr) {
+		t.Fatalf("Expected error %v but got %v.", errNonPublicAddr, err)
+	}
+	assertEqual(t, testutil.ToFloat64(m.numNonPublicAddrs), before+1)
+
+	req.Header.Set(fastlyClientIP, "1.1.1.1")
+	if _, err := e.extract(req); err != nil {
+		t.Fatalf("Expected no error but got %v.", err)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	envEdgeSecret = "EDGE_HMAC_SECRET"
+	// The edge sets the following two headers.  The signature is the
+	// hex-encoded HMAC-SHA256 over the timestamp, the request path (which
+	// contains the wallet ID), and the value of the header that carries
+	// the client's address, separated by newlines, e.g.,
+	// "1700000000\n/v3/confirmation/token/...\n1.2.3.4".
+	edgeTimestamp = "X-Tokenizer-Timestamp"
+	edgeSignature = "X-Tokenizer-Signature"
+	// We reject signatures that are older (or further in the future) than
+	// the following duration, to limit the window for replay attacks.
+	defaultMaxSignatureAge = time.Minute * 5
+)
+
+var (
+	errNoSignature    = newError(ErrUnauthorized, "found no edge signature")
+	errBadSignature   = newError(ErrUnauthorized, "edge signature is invalid")
+	errBadTimestamp   = newError(ErrUnauthorized, "edge timestamp has bad format")
+	errStaleSignature = newError(ErrUnauthorized, "edge signature is too old")
+)
+
+// edgeAuthConfig contains the shared secret that our edge uses to sign
+// requests.
+type edgeAuthConfig struct {
+	secret []byte
+	maxAge time.Duration
+}
+
+// edgeAuthenticator verifies that requests carry a valid signature, computed
+// by our edge (e.g., Fastly) over a shared secret.  This prevents anyone but
+// our edge from injecting wallet/address pairs.  If no secret is configured,
+// all requests are accepted.
+type edgeAuthenticator struct {
+	sync.RWMutex
+	conf       *edgeAuthConfig
+	addrHeader string
+	now        func() time.Time
+}
+
+func newEdgeAuthenticator() *edgeAuthenticator {
+	return &edgeAuthenticator{now: time.Now}
+}
+
+func (e *edgeAuthenticator) setConfig(c *config) {
+	e.Lock()
+	defer e.Unlock()
+
+	e.conf = c.edgeAuth
+	e.addrHeader = fastlyClientIP
+	if c.addrHeader != "" {
+		e.addrHeader = http.CanonicalHeaderKey(c.addrHeader)
+	}
+}
+
+// sign returns the hex-encoded signature over the given timestamp, path, and
+// client address.
+func (c *edgeAuthConfig) sign(timestamp, path, addr string) string {
+	mac := hmac.New(sha256.New, c.secret)
+	fmt.Fprintf(mac, "%s\n%s\n%s", timestamp, path, addr)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verify returns an error if the given request doesn't carry a fresh and
+// valid signature.
+func (e *edgeAuthenticator) verify(r *http.Request) error {
+	e.RLock()
+	defer e.RUnlock()
+
+	if e.conf == nil {
+		return nil
+	}
+	rawTimestamp, rawSignature := r.Header.Get(edgeTimestamp), r.Header.Get(edgeSignature)
+	if rawTimestamp == "" || rawSignature == "" {
+		return errNoSignature
+	}
+	ts, err := strconv.ParseInt(rawTimestamp, 10, 64)
+	if err != nil {
+		return errBadTimestamp
+	}
+	age := e.now().Sub(time.Unix(ts, 0))
+	if age > e.conf.maxAge || age < -e.conf.maxAge {
+		return errStaleSignature
+	}
+	// The signature covers the client's address, so that a captured
+	// signature can't be replayed with a different address.  Compare the
+	// signatures in constant time.
+	expected := e.conf.sign(rawTimestamp, r.URL.Path, r.Header.Get(e.addrHeader))
+	if !hmac.Equal([]byte(expected), []byte(rawSignature)) {
+		return errBadSignature
+	}
+	return nil
+}
+
+// loadEdgeAuthConfig loads the edge's shared secret from the environment.  If
+// the environment variable is unset, we don't authenticate requests.
+func loadEdgeAuthConfig() (*edgeAuthConfig, error) {
+	secret, exists := os.LookupEnv(envEdgeSecret)
+	if !exists {
+		return nil, nil
+	}
+	if secret == "" {
+		return nil, fmt.Errorf("environment variable %s is empty", envEdgeSecret)
+	}
+	l.Println("Loaded edge authentication secret.")
+	return &edgeAuthConfig{
+		secret: []byte(secret),
+		maxAge: defaultMaxSignatureAge,
+	}, nil
+}
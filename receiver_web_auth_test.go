@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestEdgeAuth(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	conf := &edgeAuthConfig{secret: []byte("foobar"), maxAge: time.Minute}
+	path := fmt.Sprintf("/v3/confirmation/token/%s", newV4(t))
+	ts := fmt.Sprintf("%d", now.Unix())
+	oldTs := fmt.Sprintf("%d", now.Add(-time.Hour).Unix())
+
+	tests := []struct {
+		name      string
+		timestamp string
+		signature string
+		addr      string
+		err       error
+	}{
+		{"valid signature", ts, conf.sign(ts, path, ipv4Addr), ipv4Addr, nil},
+		{"no signature", ts, "", ipv4Addr, errNoSignature},
+		{"no timestamp", "", conf.sign(ts, path, ipv4Addr), ipv4Addr, errNoSignature},
+		{"bad timestamp", "foo", conf.sign("foo", path, ipv4Addr), ipv4Addr, errBadTimestamp},
+		{"stale signature", oldTs, conf.sign(oldTs, path, ipv4Addr), ipv4Addr, errStaleSignature},
+		{"wrong path", ts, conf.sign(ts, "/", ipv4Addr), ipv4Addr, errBadSignature},
+		{"wrong address", ts, conf.sign(ts, path, ipv4Addr), "5.6.7.8", errBadSignature},
+		{"no address", ts, conf.sign(ts, path, ipv4Addr), "", errBadSignature},
+		{"wrong secret", ts, (&edgeAuthConfig{secret: []byte("foo")}).sign(ts, path, ipv4Addr), ipv4Addr, errBadSignature},
+	}
+
+	e := newEdgeAuthenticator()
+	e.now = func() time.Time { return now }
+	e.setConfig(&config{edgeAuth: conf})
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, path, nil)
+			r.Header.Set(edgeTimestamp, test.timestamp)
+			r.Header.Set(edgeSignature, test.signature)
+			if test.addr != "" {
+				r.Header.Set(fastlyClientIP, test.addr)
+			}
+			if err := e.verify(r); !errors.Is(err, test.err) {
+				t.Fatalf("Expected error %v but got %v.", test.err, err)
+			}
+		})
+	}
+
+	// If configured, the signature covers a different address header.
+	e.setConfig(&config{edgeAuth: conf, addrHeader: "x-real-ip"})
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	r.Header.Set(edgeTimestamp, ts)
+	r.Header.Set(edgeSignature, conf.sign(ts, path, ipv4Addr))
+	r.Header.Set("X-Real-IP", ipv4Addr)
+	if err := e.verify(r); err != nil {
+		t.Fatalf("Expected no error but got %v.", err)
+	}
+	r.Header.Set("X-Real-IP", "5.6.7.8")
+	if err := e.verify(r); !errors.Is(err, errBadSignature) {
+		t.Fatalf("Expected error %v but got %v.", errBadSignature, err)
+	}
+
+	// Without a secret, we accept any request.
+	e.setConfig(&config{})
+	if err := e.verify(httptest.NewRequest(http.MethodGet, path, nil)); err != nil {
+		t.Fatalf("Expected no error but got %v.", err)
+	}
+}
+
+func TestUnauthenticatedRequest(t *testing.T) {
+	w := newWebReceiver().(*webReceiver)
+	w.setConfig(&config{edgeAuth: &edgeAuthConfig{secret: []byte("foo"), maxAge: time.Minute}})
+	srv := httptest.NewServer(w.router)
+	defer srv.Close()
+	path := fmt.Sprintf("/v3/confirmation/token/%s", newV4(t))
+
+	resp := makeReq(t, srv, http.MethodGet, path, http.Header{fastlyClientIP: []string{ipv4Addr}})
+	assertEqual(t, resp.StatusCode, http.StatusUnauthorized)
+}
+
+func TestLoadEdgeAuthConfig(t *testing.T) {
+	os.Unsetenv(envEdgeSecret)
+	conf, err := loadEdgeAuthConfig()
+	if err != nil || conf != nil {
+		t.Fatalf("Expected neither config nor error but got %v and %v.", conf, err)
+	}
+
+	t.Setenv(envEdgeSecret, "")
+	if _, err = loadEdgeAuthConfig(); err == nil {
+		t.Fatal("Expected error for empty secret but got none.")
+	}
+
+	t.Setenv(envEdgeSecret, "foo")
+	conf, err = loadEdgeAuthConfig()
+	if err != nil {
+		t.Fatalf("Failed to load edge authentication config: %v", err)
+	}
+	assertEqual(t, string(conf.secret), "foo")
+}
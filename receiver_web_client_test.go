@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/brave/tokenizer/client"
+)
+
+// TestClient makes sure that our client package keeps up with our Web
+// receiver.
+func TestClient(t *testing.T) {
+	assertEqual(t, client.RequestIDHeader, requestIDHeader)
+	assertEqual(t, client.CountryHeader, metaCountryHeader)
+	assertEqual(t, client.ConfTypeHeader, metaConfTypeHdr)
+	assertEqual(t, isValidApiVersion("5"), true)
+
+	inbox := make(chan serializer, 1)
+	router := newTestRouter(inbox)
+	// Play edge by setting the client's address.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Set(fastlyClientIP, ipv4Addr)
+		router.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	go func() {
+		req := (<-inbox).(*clientRequest)
+		req.acknowledge(nil)
+		inbox <- req
+	}()
+
+	walletID := newV4(t)
+	c := client.New(srv.URL, nil)
+	if err := c.Submit(context.Background(), walletID, &client.Meta{Country: "US", ConfType: "view"}); err != nil {
+		t.Fatalf("Failed to submit request: %v", err)
+	}
+	req := (<-inbox).(*clientRequest)
+	assertEqual(t, req.Wallet, walletID)
+	assertEqual(t, req.Addr.Equal(net.ParseIP(ipv4Addr)), true)
+	assertEqual(t, req.ApiVersion, client.DefaultApiVersion)
+	assertEqual(t, *req.Meta, requestMeta{Country: "US", ConfType: "view"})
+	assertEqual(t, len(req.RequestID), 32)
+}
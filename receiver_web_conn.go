@@ -0,0 +1,141 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// Reasons for why an inbound connection died.
+	dropTLSHandshake = "tls_handshake"
+	dropTimeout      = "timeout"
+	dropReset        = "reset"
+	dropOverLimit    = "over_limit"
+	dropNoRequest    = "no_request"
+	dropOther        = "other"
+
+	// We log one in dropLogSampleRate connection drops per reason, so that a
+	// misconfigured edge cannot flood our logs.
+	dropLogSampleRate = 100
+
+	// The prefixes of the log messages that net/http emits for failed
+	// connections.
+	tlsHandshakeErrPrefix = "http: TLS handshake error from "
+	acceptErrPrefix       = "http: Accept error: "
+)
+
+// connDiagnostics keeps track of why inbound connections to our Web server
+// die, which helps us tell apart a misconfigured edge (e.g., failing TLS
+// handshakes) from an overloaded tokenizer (e.g., timeouts and file descriptor
+// exhaustion).  It hooks into http.Server via its ConnState callback and its
+// ErrorLog.
+type connDiagnostics struct {
+	sync.Mutex
+	// conns maps open connections to whether they ever carried a request.
+	conns map[net.Conn]bool
+	// drops counts connection drops per reason, for log sampling.
+	drops map[string]uint64
+}
+
+func newConnDiagnostics() *connDiagnostics {
+	return &connDiagnostics{
+		conns: make(map[net.Conn]bool),
+		drops: make(map[string]uint64),
+	}
+}
+
+// instrument makes the given server report to our diagnostics.
+func (d *connDiagnostics) instrument(srv *http.Server) {
+	srv.ConnState = d.connState
+	srv.ErrorLog = log.New(d, "", 0)
+}
+
+// connState tracks the number of open connections and counts connections
+// that were closed before carrying a single request.
+func (d *connDiagnostics) connState(c net.Conn, state http.ConnState) {
+	d.Lock()
+	defer d.Unlock()
+
+	switch state {
+	case http.StateNew:
+		d.conns[c] = false
+		m.numOpenConns.Inc()
+	case http.StateActive:
+		d.conns[c] = true
+	case http.StateHijacked, http.StateClosed:
+		sawRequest, exists := d.conns[c]
+		if !exists {
+			return
+		}
+		delete(d.conns, c)
+		m.numOpenConns.Dec()
+		if state == http.StateClosed && !sawRequest {
+			d.record(dropNoRequest, c.RemoteAddr().String(), "closed before first request")
+		}
+	}
+}
+
+// Write implements io.Writer, so we can serve as the Web server's error log.
+// Each call carries exactly one log message.
+func (d *connDiagnostics) Write(p []byte) (int, error) {
+	msg := strings.TrimSpace(string(p))
+	reason, remote, errMsg := classifyServerErr(msg)
+
+	d.Lock()
+	d.record(reason, remote, errMsg)
+	d.Unlock()
+
+	return len(p), nil
+}
+
+// record counts the given connection drop and logs it if it's sampled.  The
+// caller must hold the lock.
+func (d *connDiagnostics) record(reason, remote, errMsg string) {
+	m.connDrops.With(prometheus.Labels{dropReason: reason}).Inc()
+	if d.drops[reason]%dropLogSampleRate == 0 {
+		l.Printf("conn_drop reason=%s remote=%s count=%d err=%q",
+			reason, remote, d.drops[reason]+1, errMsg)
+	}
+	d.drops[reason]++
+}
+
+// classifyServerErr parses the given error message of net/http's server and
+// returns the reason for the connection drop, the remote address (if known),
+// and the underlying error.
+func classifyServerErr(msg string) (string, string, string) {
+	switch {
+	case strings.HasPrefix(msg, tlsHandshakeErrPrefix):
+		rest := strings.TrimPrefix(msg, tlsHandshakeErrPrefix)
+		remote, errMsg, found := strings.Cut(rest, ": ")
+		if !found {
+			return dropTLSHandshake, "", rest
+		}
+		if reason := classifyNetErr(errMsg); reason != dropOther {
+			return reason, remote, errMsg
+		}
+		return dropTLSHandshake, remote, errMsg
+	case strings.HasPrefix(msg, acceptErrPrefix):
+		errMsg := strings.TrimPrefix(msg, acceptErrPrefix)
+		return classifyNetErr(errMsg), "", errMsg
+	}
+	return classifyNetErr(msg), "", msg
+}
+
+// classifyNetErr returns the drop reason for the given network error message.
+func classifyNetErr(errMsg string) string {
+	switch {
+	case strings.Contains(errMsg, "i/o timeout"):
+		return dropTimeout
+	case strings.Contains(errMsg, "connection reset by peer"),
+		strings.Contains(errMsg, "broken pipe"):
+		return dropReset
+	case strings.Contains(errMsg, "too many open files"):
+		return dropOverLimit
+	}
+	return dropOther
+}
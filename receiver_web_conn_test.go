@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestClassifyServerErr(t *testing.T) {
+	tests := []struct {
+		msg    string
+		reason string
+		remote string
+	}{
+		{"http: TLS handshake error from 1.1.1.1:1234: tls: first record does not look like a TLS handshake", dropTLSHandshake, "1.1.1.1:1234"},
+		{"http: TLS handshake error from [::1]:1234: read tcp [::1]:443->[::1]:1234: i/o timeout", dropTimeout, "[::1]:1234"},
+		{"http: TLS handshake error from 1.1.1.1:1234: read tcp 1.1.1.1:1234: read: connection reset by peer", dropReset, "1.1.1.1:1234"},
+		{"http: TLS handshake error from 1.1.1.1:1234: EOF", dropTLSHandshake, "1.1.1.1:1234"},
+		{"http: Accept error: accept tcp [::]:8080: accept4: too many open files; retrying in 5ms", dropOverLimit, ""},
+		{"http: superfluous response.WriteHeader call", dropOther, ""},
+	}
+	for _, test := range tests {
+		reason, remote, _ := classifyServerErr(test.msg)
+		assertEqual(t, reason, test.reason)
+		assertEqual(t, remote, test.remote)
+	}
+}
+
+func TestConnDiagnostics(t *testing.T) {
+	d := newConnDiagnostics()
+	srv := httptest.NewUnstartedServer(http.NotFoundHandler())
+	d.instrument(srv.Config)
+	srv.StartTLS()
+	defer srv.Close()
+
+	before := testutil.ToFloat64(m.connDrops.WithLabelValues(dropTLSHandshake))
+	beforeNoReq := testutil.ToFloat64(m.connDrops.WithLabelValues(dropNoRequest))
+
+	// Speak plain text to our TLS server, which must fail the handshake.
+	c, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	_, _ = c.Write([]byte("GET / HTTP/1.1\r\nHost: foo\r\n\r\n"))
+	_, _ = c.Read(make([]byte, 1024))
+	c.Close()
+
+	// The server records the drop asynchronously.
+	deadline := time.Now().Add(5 * time.Second)
+	for testutil.ToFloat64(m.connDrops.WithLabelValues(dropNoRequest)) == beforeNoReq {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for connection drop to be recorded.")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assertEqual(t, testutil.ToFloat64(m.connDrops.WithLabelValues(dropTLSHandshake)), before+1)
+}
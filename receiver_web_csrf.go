@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+const (
+	// Double-submit protection requires browsers to send the same token in
+	// the following cookie and header.  Cross-site attackers can make a
+	// browser send the cookie, but they can neither read it nor set the
+	// header.
+	csrfCookie = "__Host-csrf"
+	csrfHeader = "X-CSRF-Token"
+	// secFetchSite tells us if a browser considers a request cross-site:
+	// https://www.w3.org/TR/fetch-metadata/
+	secFetchSite = "Sec-Fetch-Site"
+
+	// Names of the routes that CSRF protection can be enabled for.
+	routeToken   = "token"
+	routeVersion = "version"
+)
+
+var (
+	errBadOrigin    = newError(ErrForbidden, "origin is not allowed")
+	errBadCSRFToken = newError(ErrForbidden, "CSRF token is missing or does not match")
+	errBadCSRFRoute = errors.New("unknown route for CSRF protection")
+	errBadOriginFmt = errors.New("origin must have format '<scheme>://<host>[:<port>]'")
+)
+
+// csrfRoutes contains the routes for which CSRF protection can be enabled.
+var csrfRoutes = map[string]bool{
+	routeToken:   true,
+	routeVersion: true,
+}
+
+// csrfConfig determines how we protect routes from cross-site requests,
+// should browsers ever call them directly.
+type csrfConfig struct {
+	// origins contains the origins that may make requests.  If empty, we
+	// don't check origins.
+	origins map[string]bool
+	// doubleSubmit requires requests to carry the same token in csrfCookie
+	// and csrfHeader.
+	doubleSubmit bool
+	// routes contains the names of the protected routes.
+	routes map[string]bool
+}
+
+// csrfGuard protects routes from cross-site requests that would otherwise let
+// any Web site stuff our dataset via its visitors' browsers.  Our edge doesn't
+// send Origin or Sec-Fetch-Site headers, so its requests pass the origin
+// check, but it must forward the double-submit cookie and header if enabled.
+// If no configuration is set, all requests are accepted.
+type csrfGuard struct {
+	sync.RWMutex
+	conf *csrfConfig
+}
+
+func newCSRFGuard() *csrfGuard {
+	return &csrfGuard{}
+}
+
+func (g *csrfGuard) setConfig(c *config) {
+	g.Lock()
+	defer g.Unlock()
+
+	g.conf = c.csrf
+}
+
+// protect returns a middleware that checks the given route's requests, if
+// the route is protected.
+func (g *csrfGuard) protect(route string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if err := g.verify(route, r); err != nil {
+				writeErr(w, err, httpStatus(err))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// verify returns an error if the given request of the given route may be a
+// cross-site request.
+func (g *csrfGuard) verify(route string, r *http.Request) error {
+	g.RLock()
+	defer g.RUnlock()
+
+	if g.conf == nil || !g.conf.routes[route] {
+		return nil
+	}
+	if len(g.conf.origins) > 0 {
+		// Browsers don't send an Origin header for simple cross-site GET
+		// requests (e.g., images), but they do mark them as cross-site.
+		origin := r.Header.Get("Origin")
+		if origin == "" && r.Header.Get(secFetchSite) == "cross-site" {
+			return errBadOrigin
+		}
+		if origin != "" && !g.conf.origins[strings.ToLower(origin)] {
+			return errBadOrigin
+		}
+	}
+	if g.conf.doubleSubmit {
+		cookie, err := r.Cookie(csrfCookie)
+		if err != nil || cookie.Value == "" {
+			return errBadCSRFToken
+		}
+		token := r.Header.Get(csrfHeader)
+		if subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(token)) != 1 {
+			return errBadCSRFToken
+		}
+	}
+	return nil
+}
+
+// parseCSRFConfig turns the given comma-separated lists of origins and route
+// names into a CSRF configuration.  It returns nil if neither origin checking
+// nor double-submit tokens are enabled.
+func parseCSRFConfig(origins string, doubleSubmit bool, routes string) (*csrfConfig, error) {
+	if origins == "" && !doubleSubmit {
+		return nil, nil
+	}
+	c := &csrfConfig{
+		origins:      make(map[string]bool),
+		doubleSubmit: doubleSubmit,
+		routes:       make(map[string]bool),
+	}
+	if origins != "" {
+		for _, rawOrigin := range strings.Split(origins, ",") {
+			origin := strings.ToLower(strings.TrimSpace(rawOrigin))
+			u, err := url.Parse(origin)
+			if err != nil || u.Scheme == "" || u.Host == "" || u.Scheme+"://"+u.Host != origin {
+				return nil, errBadOriginFmt
+			}
+			c.origins[origin] = true
+		}
+	}
+	for _, rawRoute := range strings.Split(routes, ",") {
+		route := strings.TrimSpace(rawRoute)
+		if !csrfRoutes[route] {
+			return nil, errBadCSRFRoute
+		}
+		c.routes[route] = true
+	}
+	return c, nil
+}
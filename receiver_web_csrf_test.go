@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCSRFGuard(t *testing.T) {
+	conf, err := parseCSRFConfig("https://Example.com, http://localhost:8080", true, routeVersion)
+	if err != nil {
+		t.Fatalf("Failed to parse CSRF config: %v", err)
+	}
+	w := newWebReceiver().(*webReceiver)
+	w.setConfig(&config{csrf: conf})
+	srv := httptest.NewServer(w.router)
+	defer srv.Close()
+
+	tests := []struct {
+		name   string
+		header http.Header
+		code   int
+	}{
+		{"no token", nil, http.StatusForbidden},
+		{"good token", http.Header{
+			"Cookie":   []string{csrfCookie + "=foo"},
+			csrfHeader: []string{"foo"},
+		}, http.StatusOK},
+		{"mismatching token", http.Header{
+			"Cookie":   []string{csrfCookie + "=foo"},
+			csrfHeader: []string{"bar"},
+		}, http.StatusForbidden},
+		{"good origin", http.Header{
+			"Cookie":   []string{csrfCookie + "=foo"},
+			csrfHeader: []string{"foo"},
+			"Origin":   []string{"https://example.com"},
+		}, http.StatusOK},
+		{"bad origin", http.Header{
+			"Cookie":   []string{csrfCookie + "=foo"},
+			csrfHeader: []string{"foo"},
+			"Origin":   []string{"https://evil.com"},
+		}, http.StatusForbidden},
+		{"cross-site without origin", http.Header{
+			"Cookie":     []string{csrfCookie + "=foo"},
+			csrfHeader:   []string{"foo"},
+			secFetchSite: []string{"cross-site"},
+		}, http.StatusForbidden},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp := makeReq(t, srv, http.MethodGet, "/version", test.header)
+			assertEqual(t, resp.StatusCode, test.code)
+		})
+	}
+
+	// Routes that aren't protected don't need a token.
+	resp := makeReq(t, srv, http.MethodGet, "/healthz", nil)
+	assertEqual(t, resp.StatusCode, http.StatusOK)
+}
+
+func TestParseCSRFConfig(t *testing.T) {
+	conf, err := parseCSRFConfig("", false, routeToken)
+	assertEqual(t, err, nil)
+	assertEqual(t, conf, (*csrfConfig)(nil))
+
+	conf, err = parseCSRFConfig("https://example.com:8443", false, routeToken+","+routeVersion)
+	assertEqual(t, err, nil)
+	assertEqual(t, conf.origins["https://example.com:8443"], true)
+	assertEqual(t, conf.routes[routeToken], true)
+	assertEqual(t, conf.routes[routeVersion], true)
+
+	for _, origin := range []string{"example.com", "https://example.com/", "https://example.com/foo"} {
+		if _, err := parseCSRFConfig(origin, false, routeToken); err != errBadOriginFmt {
+			t.Fatalf("Expected error %v for %q but got %v.", errBadOriginFmt, origin, err)
+		}
+	}
+	if _, err := parseCSRFConfig("", true, "foo"); err != errBadCSRFRoute {
+		t.Fatalf("Expected error %v but got %v.", errBadCSRFRoute, err)
+	}
+}
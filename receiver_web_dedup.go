@@ -0,0 +1,113 @@
+package main
+
+import (
+	"container/list"
+	"net"
+	"sync"
+	"time"
+
+	uuid "github.com/google/uuid"
+)
+
+// walletAddr represents a wallet/address pair.  We represent all addresses as
+// 16 bytes, so the struct can be used as a map key.
+type walletAddr struct {
+	wallet uuid.UUID
+	addr   [net.IPv6len]byte
+}
+
+type seenPair struct {
+	pair walletAddr
+	seen time.Time
+}
+
+// dedupCache remembers the wallet/address pairs that the Web receiver
+// recently handed over to the aggregator.  Browsers often retry confirmation
+// token requests, so we can skip identical requests that arrive within a
+// short window.  The cache is bounded: once it's full, we forget the oldest
+// pairs first.
+type dedupCache struct {
+	sync.Mutex
+	window  time.Duration
+	maxSize int
+	pairs   map[walletAddr]*list.Element
+	order   *list.List
+	now     func() time.Time
+}
+
+func newDedupCache() *dedupCache {
+	return &dedupCache{
+		pairs: make(map[walletAddr]*list.Element),
+		order: list.New(),
+		now:   time.Now,
+	}
+}
+
+// setConfig sets the deduplication window and the maximum number of pairs
+// that we remember.  A window of zero disables deduplication.
+func (d *dedupCache) setConfig(c *config) {
+	d.Lock()
+	defer d.Unlock()
+
+	d.window = c.dedupWindow
+	d.maxSize = c.dedupSize
+	d.pairs = make(map[walletAddr]*list.Element)
+	d.order = list.New()
+}
+
+func newWalletAddr(wallet uuid.UUID, addr net.IP) walletAddr {
+	p := walletAddr{wallet: wallet}
+	copy(p.addr[:], addr.To16())
+	return p
+}
+
+// contains returns true if we have seen the given wallet/address pair within
+// our deduplication window.
+func (d *dedupCache) contains(wallet uuid.UUID, addr net.IP) bool {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.window == 0 {
+		return false
+	}
+	d.expire()
+	_, exists := d.pairs[newWalletAddr(wallet, addr)]
+	return exists
+}
+
+// add remembers the given wallet/address pair.
+func (d *dedupCache) add(wallet uuid.UUID, addr net.IP) {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.window == 0 {
+		return
+	}
+	pair := newWalletAddr(wallet, addr)
+	if e, exists := d.pairs[pair]; exists {
+		d.order.Remove(e)
+	}
+	d.pairs[pair] = d.order.PushBack(&seenPair{pair: pair, seen: d.now()})
+
+	for d.order.Len() > d.maxSize {
+		d.remove(d.order.Front())
+	}
+}
+
+// expire forgets all pairs that are older than our deduplication window.
+// Pairs are ordered by the time we saw them, so we only need to look at the
+// front of the list.
+func (d *dedupCache) expire() {
+	cutoff := d.now().Add(-d.window)
+	for e := d.order.Front(); e != nil; e = d.order.Front() {
+		if e.Value.(*seenPair).seen.After(cutoff) {
+			return
+		}
+		d.remove(e)
+	}
+}
+
+func (d *dedupCache) remove(e *list.Element) {
+	delete(d.pairs, e.Value.(*seenPair).pair)
+	d.order.Remove(e)
+}
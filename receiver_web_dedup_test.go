@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDedupCache(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	d := newDedupCache()
+	d.now = func() time.Time { return now }
+	d.setConfig(&config{dedupWindow: time.Minute, dedupSize: 2})
+	wallet := newV4(t)
+	addr1, addr2, addr3 := net.ParseIP("1.1.1.1"), net.ParseIP("2.2.2.2"), net.ParseIP("3.3.3.3")
+
+	assertEqual(t, d.contains(wallet, addr1), false)
+	d.add(wallet, addr1)
+	assertEqual(t, d.contains(wallet, addr1), true)
+	// IPv4 and IPv4-mapped IPv6 addresses are the same.
+	assertEqual(t, d.contains(wallet, addr1.To4()), true)
+	assertEqual(t, d.contains(newV4(t), addr1), false)
+
+	// Exceed the cache's size, which evicts the oldest pair.
+	now = now.Add(time.Second)
+	d.add(wallet, addr2)
+	d.add(wallet, addr3)
+	assertEqual(t, d.contains(wallet, addr1), false)
+	assertEqual(t, d.contains(wallet, addr2), true)
+	assertEqual(t, d.contains(wallet, addr3), true)
+
+	// Once the window has passed, we forget all pairs.
+	now = now.Add(time.Minute)
+	assertEqual(t, d.contains(wallet, addr2), false)
+	assertEqual(t, d.contains(wallet, addr3), false)
+	assertEqual(t, d.order.Len(), 0)
+}
+
+func TestDisabledDedupCache(t *testing.T) {
+	d := newDedupCache()
+	d.setConfig(&config{})
+	wallet, addr := newV4(t), net.ParseIP(ipv4Addr)
+	d.add(wallet, addr)
+	assertEqual(t, d.contains(wallet, addr), false)
+}
+
+func TestDuplicateRequest(t *testing.T) {
+	inbox := make(chan serializer, 10) // We're using a buffered channel to prevent a deadlock.
+	w := newWebReceiver().(*webReceiver)
+	w.in = inbox
+	w.setConfig(&config{dedupWindow: time.Minute, dedupSize: 10})
+	srv := httptest.NewServer(w.router)
+	defer srv.Close()
+	path := fmt.Sprintf("/v3/confirmation/token/%s", newV4(t))
+	header := http.Header{fastlyClientIP: []string{ipv4Addr}}
+
+	go func() {
+		(<-inbox).(*clientRequest).acknowledge(nil)
+	}()
+	resp := makeReq(t, srv, http.MethodGet, path, header)
+	assertEqual(t, resp.StatusCode, http.StatusOK)
+
+	// The duplicate request succeeds without reaching the inbox.
+	resp = makeReq(t, srv, http.MethodGet, path, header)
+	assertEqual(t, resp.StatusCode, http.StatusOK)
+	assertEqual(t, len(inbox), 0)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// Label keys of our latency histograms.
+	routeName  = "route"
+	apiVersion = "api_version"
+
+	// unmatchedRoute labels requests for which we have no route, so that
+	// clients cannot inflate our metrics' cardinality.
+	unmatchedRoute = "unmatched"
+)
+
+// latencyLabels returns the route and API version labels of the given
+// request.  They are only known after chi routed the request.
+func latencyLabels(r *http.Request) prometheus.Labels {
+	route, version := unmatchedRoute, ""
+	if rctx := chi.RouteContext(r.Context()); rctx != nil {
+		if pattern := rctx.RoutePattern(); pattern != "" {
+			route = pattern
+		}
+		if v := rctx.URLParam("version"); isValidApiVersion(v) {
+			version = v
+		}
+	}
+	return prometheus.Labels{routeName: route, apiVersion: version}
+}
+
+// measureLatency is a middleware that records how long our handlers take,
+// per route and API version.
+func measureLatency(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		begin := time.Now()
+		next.ServeHTTP(w, r)
+		elapsed := time.Since(begin)
+		labels := latencyLabels(r)
+		// A stream's duration says nothing about our latency.
+		if labels[routeName] == streamRoute {
+			return
+		}
+		m.webLatency.With(labels).Observe(elapsed.Seconds())
+		// Our profiler only cares about the latency of confirmation token
+		// requests, i.e., the requests that carry an API version.
+		if labels[apiVersion] != "" {
+			latencies.add(elapsed)
+		}
+	})
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestLatencyHistograms(t *testing.T) {
+	inbox := make(chan serializer, 10) // We're using a buffered channel to prevent a deadlock.
+	srv := httptest.NewServer(newTestRouter(inbox))
+	defer srv.Close()
+
+	go func() {
+		for req := range inbox {
+			r := req.(*clientRequest)
+			r.dequeued = time.Now()
+			r.acknowledge(nil)
+		}
+	}()
+	defer close(inbox)
+
+	tokenRoute := prometheus.Labels{routeName: "/v{version}/confirmation/token/{walletID}", apiVersion: "3"}
+	unmatched := prometheus.Labels{routeName: unmatchedRoute, apiVersion: ""}
+	latency, wait := m.webLatency.With(tokenRoute), m.webInboxWait.With(tokenRoute)
+	numLatency, numWait := sampleCount(t, latency), sampleCount(t, wait)
+	numUnmatched := sampleCount(t, m.webLatency.With(unmatched))
+
+	path := fmt.Sprintf("/v3/confirmation/token/%s", newV4(t))
+	resp := makeReq(t, srv, http.MethodGet, path, http.Header{fastlyClientIP: []string{ipv4Addr}})
+	assertEqual(t, resp.StatusCode, http.StatusOK)
+	assertEqual(t, sampleCount(t, latency), numLatency+1)
+	assertEqual(t, sampleCount(t, wait), numWait+1)
+
+	// Requests that never reach the inbox only count towards latency.
+	resp = makeReq(t, srv, http.MethodGet, path, http.Header{})
+	assertEqual(t, resp.StatusCode, http.StatusBadRequest)
+	assertEqual(t, sampleCount(t, latency), numLatency+2)
+	assertEqual(t, sampleCount(t, wait), numWait+1)
+
+	// Unknown paths share a single label value.
+	resp = makeReq(t, srv, http.MethodGet, "/foo", nil)
+	assertEqual(t, resp.StatusCode, http.StatusNotFound)
+	assertEqual(t, sampleCount(t, m.webLatency.With(unmatched)), numUnmatched+1)
+}
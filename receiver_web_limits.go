@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"runtime/debug"
+)
+
+const (
+	// Our API takes neither long URLs nor request bodies, so we can afford
+	// tight limits.
+	maxURLLength = 2048
+	maxBodyBytes = 4096
+)
+
+var (
+	errURLTooLong   = newError(ErrTooLarge, "request URL is too long")
+	errBodyTooLarge = newError(ErrTooLarge, "request body is too large")
+	errPanic        = errors.New("internal server error")
+)
+
+// recoverer is a middleware that turns a panicking handler into a 500
+// response, so that a single bad request cannot take down tokenizer.  We log
+// the panic's stack trace, so we can fix the underlying bug.
+func recoverer(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			rvr := recover()
+			if rvr == nil {
+				return
+			}
+			// net/http uses ErrAbortHandler to abort a response on
+			// purpose, so we let it through.
+			if rvr == http.ErrAbortHandler {
+				panic(rvr)
+			}
+			m.numPanics.Inc()
+			l.Printf("Recovered from panic in handler (request ID %q): %v\n%s",
+				requestID(r.Context()), rvr, debug.Stack())
+			writeErr(w, errPanic, http.StatusInternalServerError)
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limitRequestSize is a middleware that rejects requests whose URL or body
+// exceeds our limits.  Bodies without a declared length are cut off at the
+// limit, so handlers never read more than maxBodyBytes.
+func limitRequestSize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.URL.RequestURI()) > maxURLLength {
+			writeErr(w, errURLTooLong, http.StatusRequestURITooLong)
+			return
+		}
+		// Streams are long-lived, and limit the size of each event
+		// instead.
+		if isStream(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.ContentLength > maxBodyBytes {
+			writeErr(w, errBodyTooLarge, httpStatus(errBodyTooLarge))
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
+		next.ServeHTTP(w, r)
+	})
+}
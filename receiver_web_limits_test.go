@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRequestLimits(t *testing.T) {
+	srv := httptest.NewServer(newTestRouter(make(chan serializer)))
+	defer srv.Close()
+
+	resp := makeReq(t, srv, http.MethodGet, "/?q="+strings.Repeat("a", maxURLLength), nil)
+	assertEqual(t, resp.StatusCode, http.StatusRequestURITooLong)
+	body, _ := io.ReadAll(resp.Body)
+	assertEqual(t, strings.TrimSpace(string(body)), errURLTooLong.Error())
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/version", bytes.NewReader(make([]byte, maxBodyBytes+1)))
+	if err != nil {
+		t.Fatalf("Failed to create HTTP request: %v", err)
+	}
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to make HTTP request: %v", err)
+	}
+	assertEqual(t, resp.StatusCode, http.StatusRequestEntityTooLarge)
+
+	// Requests within our limits are fine.
+	resp = makeReq(t, srv, http.MethodGet, "/version", nil)
+	assertEqual(t, resp.StatusCode, http.StatusOK)
+}
+
+func TestBodyLimitWithoutLength(t *testing.T) {
+	r := chi.NewRouter()
+	r.Use(limitRequestSize)
+	r.Post("/", func(w http.ResponseWriter, r *http.Request) {
+		if _, err := io.ReadAll(r.Body); err != nil {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+		}
+	})
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	// A chunked body doesn't declare its length, so it's cut off once it
+	// exceeds our limit.
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/",
+		io.MultiReader(bytes.NewReader(make([]byte, maxBodyBytes)), strings.NewReader("x")))
+	if err != nil {
+		t.Fatalf("Failed to create HTTP request: %v", err)
+	}
+	req.ContentLength = -1
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to make HTTP request: %v", err)
+	}
+	assertEqual(t, resp.StatusCode, http.StatusRequestEntityTooLarge)
+}
+
+func TestRecoverer(t *testing.T) {
+	r := chi.NewRouter()
+	r.Use(withRequestID, recoverer)
+	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		panic("foo")
+	})
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	before := testutil.ToFloat64(m.numPanics)
+	resp := makeReq(t, srv, http.MethodGet, "/", nil)
+	assertEqual(t, resp.StatusCode, http.StatusInternalServerError)
+	body, _ := io.ReadAll(resp.Body)
+	assertEqual(t, strings.TrimSpace(string(body)), errPanic.Error())
+	assertEqual(t, testutil.ToFloat64(m.numPanics), before+1)
+
+	// The server survived the panic.
+	resp = makeReq(t, srv, http.MethodGet, "/", nil)
+	assertEqual(t, resp.StatusCode, http.StatusInternalServerError)
+}
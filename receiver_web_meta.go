@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+)
+
+const (
+	// metaApiVersion is the first ads API version whose requests may carry
+	// metadata.
+	metaApiVersion = 5
+
+	// Clients provide metadata either in query parameters or in headers.  If
+	// both are present, the query parameter wins.
+	metaCountryParam  = "country"
+	metaConfTypeParam = "type"
+	metaCountryHeader = "X-Ads-Country"
+	metaConfTypeHdr   = "X-Ads-Confirmation-Type"
+)
+
+var (
+	errBadCountry  = newError(ErrValidation, "country code has bad format")
+	errBadConfType = newError(ErrValidation, "confirmation type has bad format")
+
+	// Country codes are ISO 3166-1 alpha-2 codes, e.g., "US".
+	countryFmt = regexp.MustCompile(`^[A-Z]{2}$`)
+	// Confirmation types are short lowercase identifiers, e.g., "view".
+	confTypeFmt = regexp.MustCompile(`^[a-z_]{1,32}$`)
+)
+
+// requestMeta represents optional metadata that accompanies a client's
+// confirmation token request.
+type requestMeta struct {
+	Country  string `json:"country,omitempty"`
+	ConfType string `json:"conf_type,omitempty"`
+}
+
+// parseRequestMeta returns the metadata of the given request, or nil if the
+// request carries no metadata.
+func parseRequestMeta(r *http.Request) (*requestMeta, error) {
+	get := func(param, header string) string {
+		if v := r.URL.Query().Get(param); v != "" {
+			return v
+		}
+		return r.Header.Get(header)
+	}
+
+	return newRequestMeta(get(metaCountryParam, metaCountryHeader), get(metaConfTypeParam, metaConfTypeHdr))
+}
+
+// newRequestMeta returns the given metadata, or nil if it's empty.
+func newRequestMeta(country, confType string) (*requestMeta, error) {
+	meta := &requestMeta{Country: country, ConfType: confType}
+	if meta.Country != "" && !countryFmt.MatchString(meta.Country) {
+		return nil, errBadCountry
+	}
+	if meta.ConfType != "" && !confTypeFmt.MatchString(meta.ConfType) {
+		return nil, errBadConfType
+	}
+	if *meta == (requestMeta{}) {
+		return nil, nil
+	}
+	return meta, nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseRequestMeta(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  string
+		header http.Header
+		meta   *requestMeta
+		err    error
+	}{
+		{"no metadata", "", http.Header{}, nil, nil},
+		{"query", "?country=US&type=view", http.Header{},
+			&requestMeta{Country: "US", ConfType: "view"}, nil},
+		{"headers", "", http.Header{metaCountryHeader: {"DE"}, metaConfTypeHdr: {"click"}},
+			&requestMeta{Country: "DE", ConfType: "click"}, nil},
+		{"query wins", "?country=US", http.Header{metaCountryHeader: {"DE"}},
+			&requestMeta{Country: "US"}, nil},
+		{"bad country", "?country=usa", http.Header{}, nil, errBadCountry},
+		{"bad type", "?type=View!", http.Header{}, nil, errBadConfType},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/v5/confirmation/token/foo"+test.query, nil)
+			for key, values := range test.header {
+				r.Header[http.CanonicalHeaderKey(key)] = values
+			}
+			meta, err := parseRequestMeta(r)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("Expected error %v but got %v.", test.err, err)
+			}
+			if (meta == nil) != (test.meta == nil) || (meta != nil && *meta != *test.meta) {
+				t.Fatalf("Expected metadata %+v but got %+v.", test.meta, meta)
+			}
+		})
+	}
+}
+
+func TestRequestMeta(t *testing.T) {
+	inbox := make(chan serializer, 10) // We're using a buffered channel to prevent a deadlock.
+	srv := httptest.NewServer(newTestRouter(inbox))
+	defer srv.Close()
+	header := http.Header{fastlyClientIP: []string{ipv4Addr}}
+	wallet := newV4(t)
+
+	for version, expected := range map[int]*requestMeta{
+		// Older API versions ignore metadata.
+		3: nil,
+		5: {Country: "US", ConfType: "view"},
+	} {
+		path := fmt.Sprintf("/v%d/confirmation/token/%s?country=US&type=view", version, wallet)
+		processed := make(chan *clientRequest, 1)
+		go func() {
+			req := (<-inbox).(*clientRequest)
+			req.acknowledge(nil)
+			processed <- req
+		}()
+		resp := makeReq(t, srv, http.MethodGet, path, header)
+		assertEqual(t, resp.StatusCode, http.StatusOK)
+
+		meta := (<-processed).Meta
+		if (meta == nil) != (expected == nil) || (meta != nil && *meta != *expected) {
+			t.Fatalf("v%d: Expected metadata %+v but got %+v.", version, expected, meta)
+		}
+	}
+
+	path := fmt.Sprintf("/v5/confirmation/token/%s?country=foo", wallet)
+	resp := makeReq(t, srv, http.MethodGet, path, header)
+	assertEqual(t, resp.StatusCode, http.StatusBadRequest)
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultOverflowMaxBytes is the default size limit of the overflow
+	// buffer.
+	defaultOverflowMaxBytes = 64 << 20
+	// overflowSegmentRecords is the number of requests after which we start
+	// a new segment.
+	overflowSegmentRecords = 1000
+	// overflowDrainInterval determines how often we check if the inbox has
+	// room for buffered requests.
+	overflowDrainInterval = time.Millisecond * 100
+	// overflowChunkBytes is the size of the compressed chunks that we
+	// encrypt one at a time.
+	overflowChunkBytes = 64 << 10
+	// Overflow segments are named "overflow-<start>-<sequence number>".
+	overflowSegmentPrefix = "overflow-"
+)
+
+var errOverflowCorrupt = errors.New("overflow segment is corrupt")
+
+// overflowBuffer absorbs short bursts of requests that exceed the Web
+// receiver's inbox.  Instead of turning clients away, we append their
+// requests to gzip-compressed segments in a directory that should be on a
+// tmpfs.  Like spill queues, segments are encrypted with a key that only
+// exists in our memory, so that client addresses are useless outside the
+// enclave even if the directory isn't on a tmpfs.  Once the aggregator has
+// caught up, i.e., the inbox is less than half full, we feed the buffered
+// requests back into the inbox, oldest segment first.  If the buffer reaches
+// its size limit, we turn clients away again.
+type overflowBuffer struct {
+	sync.Mutex
+	wg       sync.WaitGroup
+	done     chan empty
+	dir      string
+	maxBytes int64
+	start    int64
+	seq      uint64
+	aead     cipher.AEAD
+	// size is the number of bytes of requests that we buffered, before
+	// compression, so it bounds the size of our segments.
+	size int64
+	// cur is the segment that we're appending to, and sealed contains the
+	// segments that are ready to be drained, oldest first.
+	cur    *overflowSegment
+	sealed []*overflowSegment
+}
+
+// overflowSegment is a file of JSON-encoded requests, one per line, that are
+// gzip-compressed and then encrypted in chunks.
+type overflowSegment struct {
+	path    string
+	f       *os.File
+	zw      *gzip.Writer
+	sw      *sealingWriter
+	bytes   int64
+	records int
+}
+
+// sealingWriter encrypts what we write to it in chunks of up to
+// overflowChunkBytes.  It writes each chunk to its underlying writer as a
+// 4-byte big-endian length, followed by the chunk's nonce and ciphertext.  A
+// chunk's index is its additional data, so that chunks cannot be reordered.
+type sealingWriter struct {
+	w     io.Writer
+	aead  cipher.AEAD
+	buf   []byte
+	chunk uint64
+}
+
+func (s *sealingWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		free := overflowChunkBytes - len(s.buf)
+		if free > len(p) {
+			free = len(p)
+		}
+		s.buf = append(s.buf, p[:free]...)
+		p = p[free:]
+		if len(s.buf) == overflowChunkBytes {
+			if err := s.flush(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// flush encrypts and writes what's left of the current chunk.
+func (s *sealingWriter) flush() error {
+	if len(s.buf) == 0 {
+		return nil
+	}
+	nonce := make([]byte, s.aead.NonceSize(), s.aead.NonceSize()+len(s.buf)+s.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	chunk := s.aead.Seal(nonce, nonce, s.buf, binary.BigEndian.AppendUint64(nil, s.chunk))
+	s.chunk++
+	s.buf = s.buf[:0]
+	if _, err := s.w.Write(binary.BigEndian.AppendUint32(nil, uint32(len(chunk)))); err != nil {
+		return err
+	}
+	_, err := s.w.Write(chunk)
+	return err
+}
+
+// openingReader decrypts the chunks that a sealingWriter wrote.
+type openingReader struct {
+	r     io.Reader
+	aead  cipher.AEAD
+	buf   []byte
+	chunk uint64
+}
+
+func (o *openingReader) Read(p []byte) (int, error) {
+	for len(o.buf) == 0 {
+		var length [4]byte
+		if _, err := io.ReadFull(o.r, length[:]); err != nil {
+			return 0, err
+		}
+		n := int(binary.BigEndian.Uint32(length[:]))
+		if n < o.aead.NonceSize() || n > o.aead.NonceSize()+overflowChunkBytes+o.aead.Overhead() {
+			return 0, errOverflowCorrupt
+		}
+		chunk := make([]byte, n)
+		if _, err := io.ReadFull(o.r, chunk); err != nil {
+			return 0, errOverflowCorrupt
+		}
+		nonce, ciphertext := chunk[:o.aead.NonceSize()], chunk[o.aead.NonceSize():]
+		plaintext, err := o.aead.Open(ciphertext[:0], nonce, ciphertext, binary.BigEndian.AppendUint64(nil, o.chunk))
+		if err != nil {
+			return 0, errOverflowCorrupt
+		}
+		o.chunk++
+		o.buf = plaintext
+	}
+	n := copy(p, o.buf)
+	o.buf = o.buf[n:]
+	return n, nil
+}
+
+func newOverflowBuffer() *overflowBuffer {
+	return &overflowBuffer{
+		done:     make(chan empty),
+		maxBytes: defaultOverflowMaxBytes,
+		start:    time.Now().UnixNano(),
+	}
+}
+
+func (o *overflowBuffer) setConfig(c *config) {
+	o.Lock()
+	defer o.Unlock()
+
+	o.dir = c.overflowDir
+	if c.overflowMaxBytes > 0 {
+		o.maxBytes = c.overflowMaxBytes
+	}
+}
+
+func (o *overflowBuffer) enabled() bool {
+	o.Lock()
+	defer o.Unlock()
+
+	return o.dir != ""
+}
+
+// add appends the given request to the buffer.  It returns false if the
+// buffer is disabled or full, or if we failed to write the request.
+func (o *overflowBuffer) add(req *clientRequest) bool {
+	o.Lock()
+	defer o.Unlock()
+
+	if o.dir == "" {
+		return false
+	}
+	b, err := json.Marshal(req)
+	if err != nil {
+		l.Printf("Failed to marshal request for overflow buffer: %v", err)
+		return false
+	}
+	b = append(b, '\n')
+	// gzip only writes to our segment once in a while, so we count the
+	// request's size before compression.
+	if o.size+int64(len(b)) > o.maxBytes {
+		return false
+	}
+	if o.cur == nil {
+		if o.cur, err = o.newSegment(); err != nil {
+			l.Printf("Failed to create overflow segment: %v", err)
+			return false
+		}
+	}
+	if _, err := o.cur.zw.Write(b); err != nil {
+		l.Printf("Failed to write to overflow segment: %v", err)
+		return false
+	}
+	o.cur.records++
+	o.cur.bytes += int64(len(b))
+	o.addBytes(int64(len(b)))
+	if o.cur.records >= overflowSegmentRecords {
+		o.seal()
+	}
+	m.numSpilled.Inc()
+	return true
+}
+
+// newSegment creates a new segment.  We create our key along with our first
+// segment.  The caller must hold the lock.
+func (o *overflowBuffer) newSegment() (*overflowSegment, error) {
+	if o.aead == nil {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		if o.aead, err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+	}
+	o.seq++
+	path := filepath.Join(o.dir, fmt.Sprintf("%s%d-%010d", overflowSegmentPrefix, o.start, o.seq))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	sw := &sealingWriter{w: f, aead: o.aead}
+	return &overflowSegment{path: path, f: f, zw: gzip.NewWriter(sw), sw: sw}, nil
+}
+
+// seal finishes the current segment, which makes it ready to be drained.  The
+// caller must hold the lock.
+func (o *overflowBuffer) seal() {
+	if o.cur == nil {
+		return
+	}
+	if err := o.cur.zw.Close(); err != nil {
+		l.Printf("Failed to finish overflow segment: %v", err)
+	}
+	if err := o.cur.sw.flush(); err != nil {
+		l.Printf("Failed to finish overflow segment: %v", err)
+	}
+	if err := o.cur.f.Close(); err != nil {
+		l.Printf("Failed to close overflow segment: %v", err)
+	}
+	o.sealed = append(o.sealed, o.cur)
+	o.cur = nil
+}
+
+// addBytes accounts for the given number of bytes.  The caller must hold the
+// lock.
+func (o *overflowBuffer) addBytes(n int64) {
+	o.size += n
+	m.spillBytes.Set(float64(o.size))
+}
+
+// next returns the oldest segment, and removes it from the buffer.  If there
+// are no sealed segments, we seal the current segment.  The second return
+// value is false if the buffer is empty.
+func (o *overflowBuffer) next() (*overflowSegment, bool) {
+	o.Lock()
+	defer o.Unlock()
+
+	if len(o.sealed) == 0 {
+		o.seal()
+	}
+	if len(o.sealed) == 0 {
+		return nil, false
+	}
+	seg := o.sealed[0]
+	o.sealed = o.sealed[1:]
+	return seg, true
+}
+
+// drainSegment sends the requests in the given segment to the given inbox,
+// and removes the segment.
+func (o *overflowBuffer) drainSegment(seg *overflowSegment, inbox chan serializer) {
+	defer func() {
+		if err := os.Remove(seg.path); err != nil {
+			l.Printf("Failed to remove overflow segment: %v", err)
+		}
+		o.Lock()
+		o.addBytes(-seg.bytes)
+		o.Unlock()
+	}()
+
+	f, err := os.Open(seg.path)
+	if err != nil {
+		l.Printf("Failed to open overflow segment: %v", err)
+		return
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(&openingReader{r: bufio.NewReader(f), aead: o.aead})
+	if err != nil {
+		l.Printf("Failed to read overflow segment: %v", err)
+		return
+	}
+	s := bufio.NewScanner(zr)
+	for s.Scan() {
+		req, err := parseJSONRequest(s.Bytes())
+		if err != nil {
+			l.Printf("Failed to parse buffered request: %v", err)
+			continue
+		}
+		inbox <- req
+	}
+	if err := s.Err(); err != nil {
+		l.Printf("Failed to read overflow segment to the end: %v", err)
+	}
+}
+
+// run feeds buffered requests back into the given inbox, whenever the inbox
+// is less than half full.
+func (o *overflowBuffer) run(inbox chan serializer) {
+	o.wg.Add(1)
+	go func() {
+		defer o.wg.Done()
+		ticker := time.NewTicker(overflowDrainInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-o.done:
+				return
+			case <-ticker.C:
+				for len(inbox) < cap(inbox)/2 {
+					seg, ok := o.next()
+					if !ok {
+						break
+					}
+					o.drainSegment(seg, inbox)
+				}
+			}
+		}
+	}()
+}
+
+// stop stops draining in the background, and then sends all remaining
+// buffered requests to the given inbox.  The caller must make sure that no
+// more requests are added, and that someone keeps reading from the inbox.
+func (o *overflowBuffer) stop(inbox chan serializer) {
+	close(o.done)
+	o.wg.Wait()
+	for {
+		seg, ok := o.next()
+		if !ok {
+			return
+		}
+		o.drainSegment(seg, inbox)
+	}
+}
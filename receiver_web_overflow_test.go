@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	uuid "github.com/google/uuid"
+)
+
+func newTestOverflowBuffer(dir string, maxBytes int64) *overflowBuffer {
+	o := newOverflowBuffer()
+	o.setConfig(&config{overflowDir: dir, overflowMaxBytes: maxBytes})
+	return o
+}
+
+func TestOverflowBuffer(t *testing.T) {
+	dir := t.TempDir()
+	o := newTestOverflowBuffer(dir, defaultOverflowMaxBytes)
+	_, ok := o.next()
+	assertEqual(t, ok, false)
+
+	wallets := []uuid.UUID{newV4(t), newV4(t), newV4(t)}
+	for _, w := range wallets {
+		req := &clientRequest{Addr: net.ParseIP(ipv4Addr), Wallet: w}
+		assertEqual(t, o.add(req), true)
+	}
+
+	// Draining seals the current segment and feeds its requests to the
+	// inbox, in order.
+	inbox := make(chan serializer, len(wallets))
+	seg, ok := o.next()
+	assertEqual(t, ok, true)
+	o.drainSegment(seg, inbox)
+	assertEqual(t, len(inbox), len(wallets))
+	for _, w := range wallets {
+		req := (<-inbox).(*clientRequest)
+		assertEqual(t, req.Wallet, w)
+		assertEqual(t, req.Addr.String(), ipv4Addr)
+	}
+	_, err := os.Stat(seg.path)
+	assertEqual(t, os.IsNotExist(err), true)
+	assertEqual(t, o.size, int64(0))
+	_, ok = o.next()
+	assertEqual(t, ok, false)
+}
+
+func TestOverflowBufferFull(t *testing.T) {
+	req := &clientRequest{Addr: net.ParseIP(ipv4Addr), Wallet: newV4(t)}
+	b, err := json.Marshal(req)
+	if err != nil {
+		t.Fatalf("Failed to marshal request: %v", err)
+	}
+	// We count requests before compression, so the buffer is full after
+	// the first request, although gzip didn't write it yet.
+	size := int64(len(b) + 1)
+	o := newTestOverflowBuffer(t.TempDir(), size+1)
+	assertEqual(t, o.add(req), true)
+	assertEqual(t, o.size, size)
+	assertEqual(t, o.add(req), false)
+
+	// Disabled buffers don't take requests.
+	assertEqual(t, newOverflowBuffer().add(req), false)
+}
+
+func TestOverflowBufferKey(t *testing.T) {
+	dir := t.TempDir()
+	req := &clientRequest{Addr: net.ParseIP(ipv4Addr), Wallet: newV4(t)}
+	o := newTestOverflowBuffer(dir, defaultOverflowMaxBytes)
+	assertEqual(t, o.add(req), true)
+	seg, ok := o.next()
+	assertEqual(t, ok, true)
+
+	// Segments are useless without the key of the buffer that wrote them,
+	// e.g., to our next incarnation.
+	other := newTestOverflowBuffer(dir, defaultOverflowMaxBytes)
+	assertEqual(t, other.add(req), true)
+	inbox := make(chan serializer, 1)
+	other.drainSegment(seg, inbox)
+	assertEqual(t, len(inbox), 0)
+}
+
+func TestSealingWriter(t *testing.T) {
+	block, err := aes.NewCipher(make([]byte, 32))
+	if err != nil {
+		t.Fatalf("Failed to create cipher: %v", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatalf("Failed to create AEAD: %v", err)
+	}
+	plaintext := make([]byte, overflowChunkBytes*2+1)
+	if _, err := rand.Read(plaintext); err != nil {
+		t.Fatalf("Failed to create plaintext: %v", err)
+	}
+
+	// What we write spans several chunks.
+	var buf bytes.Buffer
+	sw := &sealingWriter{w: &buf, aead: aead}
+	if _, err := sw.Write(plaintext); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	if err := sw.flush(); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+	assertEqual(t, sw.chunk, uint64(3))
+	b, err := io.ReadAll(&openingReader{r: &buf, aead: aead})
+	if err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+	assertEqual(t, bytes.Equal(b, plaintext), true)
+}
+
+func TestOverflowingInbox(t *testing.T) {
+	inbox := make(chan serializer, 1)
+	w := newWebReceiver().(*webReceiver)
+	w.in = inbox
+	w.overflow.setConfig(&config{overflowDir: t.TempDir()})
+	srv := httptest.NewServer(w.router)
+	defer srv.Close()
+
+	// The aggregator isn't reading from our inbox, which is already full,
+	// so the request ends up in the overflow buffer.
+	inbox <- &clientRequest{}
+	path := fmt.Sprintf("/v2/confirmation/token/%s", newV4(t))
+	resp := makeReq(t, srv, http.MethodGet, path, http.Header{fastlyClientIP: []string{ipv4Addr}})
+	assertEqual(t, resp.StatusCode, http.StatusOK)
+
+	// Once the aggregator caught up, the request is fed back to it.
+	<-inbox
+	w.overflow.stop(inbox)
+	assertEqual(t, len(inbox), 1)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	uuid "github.com/google/uuid"
+)
+
+const (
+	// We periodically forget about wallets whose buckets are full again, so
+	// our map of buckets doesn't grow without bounds.
+	bucketPurgeInterval = time.Minute
+)
+
+var errRateLimited = newError(ErrRateLimited, "too many requests for wallet")
+
+// bucket represents a token bucket.  Tokens are fractional because they refill
+// continuously.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// walletLimiter implements a token bucket rate limiter that's keyed by wallet
+// ID.  Each wallet may make up to burst requests in a row, after which it may
+// make rate requests per second.  This prevents a single misbehaving client
+// from dominating our batches.
+type walletLimiter struct {
+	sync.Mutex
+	rate      float64
+	burst     int
+	buckets   map[uuid.UUID]*bucket
+	lastPurge time.Time
+	now       func() time.Time
+}
+
+func newWalletLimiter() *walletLimiter {
+	return &walletLimiter{
+		buckets: make(map[uuid.UUID]*bucket),
+		now:     time.Now,
+	}
+}
+
+// setConfig sets the limiter's rate and burst.  A rate of zero disables rate
+// limiting.
+func (w *walletLimiter) setConfig(c *config) {
+	w.Lock()
+	defer w.Unlock()
+
+	w.rate = c.walletRate
+	w.burst = c.walletBurst
+	if w.burst < 1 {
+		w.burst = 1
+	}
+	w.buckets = make(map[uuid.UUID]*bucket)
+}
+
+// allow returns true if the given wallet may make another request.  If it
+// may not, allow also returns the duration after which the wallet may try
+// again.
+func (w *walletLimiter) allow(wallet uuid.UUID) (bool, time.Duration) {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.rate <= 0 {
+		return true, 0
+	}
+	now := w.now()
+	w.maybePurge(now)
+
+	b, exists := w.buckets[wallet]
+	if !exists {
+		b = &bucket{tokens: float64(w.burst), last: now}
+		w.buckets[wallet] = b
+	}
+	b.tokens = math.Min(float64(w.burst), b.tokens+now.Sub(b.last).Seconds()*w.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		missing := 1 - b.tokens
+		return false, time.Duration(missing / w.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// maybePurge deletes the buckets of all wallets that haven't made a request
+// in long enough for their bucket to be full again.  Those wallets are
+// indistinguishable from wallets that we have never seen.
+func (w *walletLimiter) maybePurge(now time.Time) {
+	if now.Sub(w.lastPurge) < bucketPurgeInterval {
+		return
+	}
+	w.lastPurge = now
+	for wallet, b := range w.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*w.rate >= float64(w.burst) {
+			delete(w.buckets, wallet)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWalletLimiter(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	w := newWalletLimiter()
+	w.now = func() time.Time { return now }
+	w.setConfig(&config{walletRate: 1, walletBurst: 2})
+	wallet1, wallet2 := newV4(t), newV4(t)
+
+	// The first two requests are covered by the burst.
+	ok, _ := w.allow(wallet1)
+	assertEqual(t, ok, true)
+	ok, _ = w.allow(wallet1)
+	assertEqual(t, ok, true)
+	ok, retryAfter := w.allow(wallet1)
+	assertEqual(t, ok, false)
+	assertEqual(t, retryAfter, time.Second)
+
+	// Other wallets are unaffected.
+	ok, _ = w.allow(wallet2)
+	assertEqual(t, ok, true)
+
+	// Half a second later, we're still rate-limited.
+	now = now.Add(time.Millisecond * 500)
+	ok, retryAfter = w.allow(wallet1)
+	assertEqual(t, ok, false)
+	assertEqual(t, retryAfter, time.Millisecond*500)
+
+	// After a second, we have a token again.
+	now = now.Add(time.Millisecond * 500)
+	ok, _ = w.allow(wallet1)
+	assertEqual(t, ok, true)
+
+	// After a while, the wallets' buckets are full again and get purged.
+	now = now.Add(bucketPurgeInterval)
+	ok, _ = w.allow(newV4(t))
+	assertEqual(t, ok, true)
+	assertEqual(t, len(w.buckets), 1)
+}
+
+func TestDisabledWalletLimiter(t *testing.T) {
+	w := newWalletLimiter()
+	w.setConfig(&config{})
+	wallet := newV4(t)
+	for i := 0; i < 100; i++ {
+		if ok, _ := w.allow(wallet); !ok {
+			t.Fatal("Expected disabled limiter to allow all requests.")
+		}
+	}
+}
+
+func TestRateLimitedRequest(t *testing.T) {
+	inbox := make(chan serializer, 10) // We're using a buffered channel to prevent a deadlock.
+	w := newWebReceiver().(*webReceiver)
+	w.in = inbox
+	w.setConfig(&config{walletRate: 0.001, walletBurst: 1})
+	srv := httptest.NewServer(w.router)
+	defer srv.Close()
+	path := fmt.Sprintf("/v3/confirmation/token/%s", newV4(t))
+	header := http.Header{fastlyClientIP: []string{ipv4Addr}}
+
+	go func() {
+		(<-inbox).(*clientRequest).acknowledge(nil)
+	}()
+	resp := makeReq(t, srv, http.MethodGet, path, header)
+	assertEqual(t, resp.StatusCode, http.StatusOK)
+
+	resp = makeReq(t, srv, http.MethodGet, path, header)
+	assertEqual(t, resp.StatusCode, http.StatusTooManyRequests)
+	assertEqual(t, resp.Header.Get("Retry-After"), "1000")
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// We sample up to rejectionSampleBurst rejected requests in a row, and
+	// rejectionSampleRate per second after that.
+	rejectionSampleRate  = 1.0
+	rejectionSampleBurst = 10
+	// maxRejectionSamples is the number of samples that we keep.  Once we
+	// have that many, new samples replace the oldest ones.
+	maxRejectionSamples = 100
+)
+
+// rejections keeps a sample of the Web receiver's rejected requests.  Our
+// privileged endpoints expose it.
+var rejections = newRejectionSampler()
+
+// rejectionSample describes a rejected request without revealing who made it:
+// it contains neither the client's address nor its wallet ID, and only the
+// names of the request's headers.
+type rejectionSample struct {
+	Time       time.Time `json:"time"`
+	Method     string    `json:"method"`
+	Route      string    `json:"route"`
+	ApiVersion string    `json:"api_version,omitempty"`
+	Status     int       `json:"status"`
+	Class      string    `json:"class"`
+	Headers    []string  `json:"headers"`
+}
+
+// rejectionSampler keeps a small, rate-limited sample of rejected requests,
+// so that we can debug sudden spikes in errors without logging requests.
+type rejectionSampler struct {
+	sync.Mutex
+	samples []rejectionSample
+	// next is the index of the sample that the next sample replaces, once
+	// we have maxRejectionSamples.
+	next   int
+	bucket bucket
+	now    func() time.Time
+}
+
+func newRejectionSampler() *rejectionSampler {
+	return &rejectionSampler{
+		bucket: bucket{tokens: rejectionSampleBurst},
+		now:    time.Now,
+	}
+}
+
+// rejectionWriter remembers the error that a handler responded with.
+type rejectionWriter struct {
+	http.ResponseWriter
+	err    error
+	status int
+}
+
+func (w *rejectionWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// recordRejection tells the sampler (if any) that we responded to the request
+// with the given error and status code.
+func recordRejection(rw http.ResponseWriter, err error, code int) {
+	if w, ok := rw.(*rejectionWriter); ok {
+		w.err, w.status = err, code
+	}
+}
+
+// sample is a middleware that samples the requests that we reject.
+func (s *rejectionSampler) sample(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rw := &rejectionWriter{ResponseWriter: w}
+		next.ServeHTTP(rw, r)
+		if rw.err != nil {
+			s.add(r, rw.err, rw.status)
+		}
+	})
+}
+
+// add adds the given rejected request to our sample, unless we exceeded our
+// sampling rate.
+func (s *rejectionSampler) add(r *http.Request, err error, status int) {
+	s.Lock()
+	defer s.Unlock()
+
+	now := s.now()
+	if !s.bucket.last.IsZero() {
+		s.bucket.tokens = math.Min(rejectionSampleBurst,
+			s.bucket.tokens+now.Sub(s.bucket.last).Seconds()*rejectionSampleRate)
+	}
+	s.bucket.last = now
+	if s.bucket.tokens < 1 {
+		return
+	}
+	s.bucket.tokens--
+
+	headers := make([]string, 0, len(r.Header))
+	for name := range r.Header {
+		headers = append(headers, name)
+	}
+	sort.Strings(headers)
+	labels := latencyLabels(r)
+	sample := rejectionSample{
+		Time:       now.UTC().Truncate(time.Second),
+		Method:     r.Method,
+		Route:      labels[routeName],
+		ApiVersion: labels[apiVersion],
+		Status:     status,
+		Class:      errClass(err),
+		Headers:    headers,
+	}
+	if len(s.samples) < maxRejectionSamples {
+		s.samples = append(s.samples, sample)
+		return
+	}
+	s.samples[s.next] = sample
+	s.next = (s.next + 1) % maxRejectionSamples
+}
+
+// get returns our samples, oldest first.
+func (s *rejectionSampler) get() []rejectionSample {
+	s.Lock()
+	defer s.Unlock()
+
+	samples := make([]rejectionSample, 0, len(s.samples))
+	samples = append(samples, s.samples[s.next:]...)
+	return append(samples, s.samples[:s.next]...)
+}
+
+func (s *rejectionSampler) handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.get()); err != nil {
+		l.Printf("Failed to encode rejected requests: %v", err)
+	}
+}
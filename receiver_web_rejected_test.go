@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestRejectionSampler(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := newRejectionSampler()
+	s.now = func() time.Time { return now }
+
+	r := chi.NewRouter()
+	r.Use(s.sample)
+	r.Get("/v{version}/foo", func(w http.ResponseWriter, r *http.Request) {
+		writeErr(w, errBadWalletFmt, httpStatus(errBadWalletFmt))
+	})
+	r.Get("/ok", func(w http.ResponseWriter, r *http.Request) {})
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	// Successful requests aren't sampled.
+	makeReq(t, srv, http.MethodGet, "/ok", nil)
+	assertEqual(t, len(s.get()), 0)
+
+	// We sample a burst of rejected requests, and then stop.
+	header := http.Header{fastlyClientIP: []string{ipv4Addr}, "X-Foo": []string{"bar"}}
+	for i := 0; i < rejectionSampleBurst+5; i++ {
+		makeReq(t, srv, http.MethodGet, "/v3/foo", header)
+	}
+	samples := s.get()
+	assertEqual(t, len(samples), rejectionSampleBurst)
+	sample := samples[0]
+	assertEqual(t, sample.Route, "/v{version}/foo")
+	assertEqual(t, sample.ApiVersion, "3")
+	assertEqual(t, sample.Status, http.StatusBadRequest)
+	assertEqual(t, sample.Class, ErrValidation.Error())
+	assertEqual(t, sample.Time, now)
+	// We keep header names, but no values.
+	headers := strings.Join(sample.Headers, ",")
+	assertEqual(t, strings.Contains(headers, http.CanonicalHeaderKey(fastlyClientIP)), true)
+	assertEqual(t, strings.Contains(headers, "X-Foo"), true)
+	b, _ := json.Marshal(sample)
+	assertEqual(t, strings.Contains(string(b), ipv4Addr), false)
+
+	// Once time passes, we sample again.
+	now = now.Add(time.Second)
+	makeReq(t, srv, http.MethodGet, "/v3/foo", header)
+	assertEqual(t, len(s.get()), rejectionSampleBurst+1)
+}
+
+func TestRejectionSamplerWrapsAround(t *testing.T) {
+	now := time.Now()
+	s := newRejectionSampler()
+	s.now = func() time.Time { return now }
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	for i := 0; i < maxRejectionSamples+1; i++ {
+		// Give the sampler enough time to sample each request.
+		now = now.Add(time.Second)
+		s.add(req, fmt.Errorf("error %d", i), i)
+	}
+	samples := s.get()
+	assertEqual(t, len(samples), maxRejectionSamples)
+	assertEqual(t, samples[0].Status, 1)
+	assertEqual(t, samples[maxRejectionSamples-1].Status, maxRejectionSamples)
+}
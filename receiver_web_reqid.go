@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+
+	uuid "github.com/google/uuid"
+)
+
+// requestIDHeader carries the ID that lets us trace a request from our edge,
+// through tokenizer, and into Kafka.
+const requestIDHeader = "X-Request-ID"
+
+type requestIDKey struct{}
+
+// We honor request IDs that are reasonably short and harmless to log.
+var requestIDFmt = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// withRequestID is a middleware that adds a request ID to each request's
+// context and to the response.  We use the ID in the X-Request-ID header if
+// the client (typically our edge) provided one, and generate one otherwise.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !requestIDFmt.MatchString(id) {
+			id = uuid.NewString()
+		}
+		w.Header().Set(requestIDHeader, id)
+		ctx := context.WithValue(r.Context(), requestIDKey{}, id)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// requestID returns the request ID in the given context, or the empty string
+// if there is none.
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	uuid "github.com/google/uuid"
+)
+
+func TestRequestID(t *testing.T) {
+	inbox := make(chan serializer, 10) // We're using a buffered channel to prevent a deadlock.
+	srv := httptest.NewServer(newTestRouter(inbox))
+	defer srv.Close()
+	path := fmt.Sprintf("/v3/confirmation/token/%s", newV4(t))
+
+	ids := make(chan string, 1)
+	go func() {
+		for req := range inbox {
+			r := req.(*clientRequest)
+			ids <- r.RequestID
+			r.acknowledge(nil)
+		}
+	}()
+	defer close(inbox)
+
+	// We honor the request ID that our edge provides and hand it over to
+	// the aggregator.
+	header := http.Header{fastlyClientIP: []string{ipv4Addr}, requestIDHeader: []string{"edge-1234"}}
+	resp := makeReq(t, srv, http.MethodGet, path, header)
+	assertEqual(t, resp.StatusCode, http.StatusOK)
+	assertEqual(t, resp.Header.Get(requestIDHeader), "edge-1234")
+	assertEqual(t, <-ids, "edge-1234")
+
+	// Without a request ID, or with a malformed one, we generate our own.
+	for _, id := range []string{"", "foo bar", url.QueryEscape("\n")} {
+		header = http.Header{fastlyClientIP: []string{ipv4Addr}, requestIDHeader: []string{id}}
+		resp = makeReq(t, srv, http.MethodGet, path, header)
+		assertEqual(t, resp.StatusCode, http.StatusOK)
+		generated := resp.Header.Get(requestIDHeader)
+		if _, err := uuid.Parse(generated); err != nil {
+			t.Errorf("Expected generated UUID but got %q.", generated)
+		}
+		assertEqual(t, <-ids, generated)
+	}
+
+	// Responses of failed requests carry the request ID, too.
+	resp = makeReq(t, srv, http.MethodGet, path, http.Header{requestIDHeader: []string{"edge-5678"}})
+	assertEqual(t, resp.StatusCode, http.StatusBadRequest)
+	assertEqual(t, resp.Header.Get(requestIDHeader), "edge-5678")
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	uuid "github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// streamRoute lets our edge submit many confirmation token requests
+	// over a single, long-lived HTTP/2 stream.
+	streamRoute = "/v{version}/confirmation/stream"
+	// streamAckEvents is the maximum number of events that we acknowledge
+	// at once.  We acknowledge smaller batches if no further events are
+	// waiting.
+	streamAckEvents = 100
+	// maxStreamEventBytes is the maximum size of an event, i.e., a line.
+	maxStreamEventBytes = maxBodyBytes
+	// defaultStreamTimeout determines how long a stream may go without
+	// events before we close it.
+	defaultStreamTimeout = time.Minute
+	// ndjsonType is the content type of streams and their acks.
+	ndjsonType = "application/x-ndjson"
+)
+
+var (
+	errStreamHTTP1     = newError(ErrValidation, "streams require HTTP/2")
+	errBadStreamEvent  = newError(ErrValidation, "not a valid stream event")
+	errStreamEventSize = newError(ErrTooLarge, "stream event is too large")
+)
+
+// streamEvent is a confirmation token request that our edge sends over a
+// stream.  Unlike requests to our confirmation endpoint, events carry the
+// client's IP address and metadata in fields rather than headers.
+type streamEvent struct {
+	Wallet    string `json:"wallet"`
+	Addr      string `json:"addr"`
+	Country   string `json:"country,omitempty"`
+	ConfType  string `json:"conf_type,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// streamAck acknowledges a batch of events.  Seq is the number of events that
+// we processed since the stream began, including the batch.  Rejected lists
+// the batch's events that we rejected, by their index in the stream, starting
+// at 0.  We accepted all other events, so the edge must not resend them.
+type streamAck struct {
+	Seq      int               `json:"seq"`
+	Rejected []streamRejection `json:"rejected,omitempty"`
+}
+
+type streamRejection struct {
+	Index int    `json:"index"`
+	Error string `json:"error"`
+}
+
+// streamLine is a line that we read from a stream, or the error that ended
+// the stream.
+type streamLine struct {
+	b   []byte
+	err error
+}
+
+// isStream returns true if the given request is for our stream route.  Our
+// middleware needs to know before chi routed the request.
+func isStream(r *http.Request) bool {
+	return r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/confirmation/stream")
+}
+
+// streamHandler takes newline-delimited JSON events, and responds with a
+// newline-delimited JSON ack for each batch of events, for as long as our
+// edge keeps the stream open.  Streams require HTTP/2: Go's HTTP/1 server
+// cannot write a response while it's still reading the request.
+func (w *webReceiver) streamHandler(rw http.ResponseWriter, r *http.Request) {
+	errAndReport := func(err error) {
+		writeErr(rw, err, httpStatus(err))
+	}
+
+	if r.ProtoMajor < 2 {
+		writeErr(rw, errStreamHTTP1, http.StatusHTTPVersionNotSupported)
+		return
+	}
+	if err := w.auth.verify(r); err != nil {
+		errAndReport(err)
+		return
+	}
+	rawVersion := chi.URLParam(r, "version")
+	if !isValidApiVersion(rawVersion) {
+		errAndReport(errBadApiVersion)
+		return
+	}
+	version, _ := strconv.Atoi(rawVersion)
+	if err := w.sunsets.check(rw, version); err != nil {
+		errAndReport(err)
+		return
+	}
+	// Events carry client addresses, which we only take from trusted
+	// proxies.
+	if !w.addrs.trustsPeer(r.RemoteAddr) {
+		errAndReport(errUntrustedPeer)
+		return
+	}
+
+	rc := http.NewResponseController(rw)
+	rw.Header().Set("Content-Type", ndjsonType)
+	rw.WriteHeader(http.StatusOK)
+	m.webResponses.With(prometheus.Labels{httpCode: "200", httpBody: ""}).Inc()
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	lines := make(chan streamLine)
+	quit := make(chan empty)
+	defer close(quit)
+	go readStream(r, lines, quit)
+
+	seq := 0
+	for {
+		setDeadline(rc.SetReadDeadline, w.streamTimeout)
+		var batch []streamLine
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				return
+			}
+			batch = append(batch, line)
+		case <-w.done:
+			return
+		case <-r.Context().Done():
+			return
+		}
+		// Take what's waiting, up to a full batch.  If the stream ended,
+		// we acknowledge the batch before we return.
+		ended := false
+	collect:
+		for len(batch) < streamAckEvents && batch[len(batch)-1].err == nil {
+			select {
+			case line, ok := <-lines:
+				if !ok {
+					ended = true
+					break collect
+				}
+				batch = append(batch, line)
+			default:
+				break collect
+			}
+		}
+
+		ack := w.processEvents(r, version, seq, batch)
+		seq = ack.Seq
+		setDeadline(rc.SetWriteDeadline, defaultWriteTimeout)
+		if err := json.NewEncoder(rw).Encode(ack); err != nil {
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+		if ended || batch[len(batch)-1].err != nil {
+			return
+		}
+	}
+}
+
+// readStream sends the lines of the given request's body to the given
+// channel, until the body ends or quit is closed.  If a line is too long, we
+// send the error.  Either way, we close the channel once the body ends, e.g.,
+// because of EOF, or because our read deadline passed while the stream was
+// idle.
+func readStream(r *http.Request, lines chan streamLine, quit chan empty) {
+	defer close(lines)
+
+	s := bufio.NewScanner(r.Body)
+	s.Buffer(make([]byte, 0, 1024), maxStreamEventBytes)
+	for s.Scan() {
+		if len(s.Bytes()) == 0 {
+			continue
+		}
+		line := streamLine{b: append([]byte(nil), s.Bytes()...)}
+		select {
+		case lines <- line:
+		case <-quit:
+			return
+		}
+	}
+	if err := s.Err(); errors.Is(err, bufio.ErrTooLong) {
+		select {
+		case lines <- streamLine{err: errStreamEventSize}:
+		case <-quit:
+		}
+	}
+}
+
+// setDeadline extends a stream's deadline by the given duration.  Long-lived
+// streams would otherwise run into our server's timeouts.
+func setDeadline(set func(time.Time) error, d time.Duration) {
+	if err := set(time.Now().Add(d)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		l.Printf("Failed to extend stream deadline: %v", err)
+	}
+}
+
+// processEvents hands the given batch of events to the aggregator, waits until
+// it processed them, and returns the batch's ack.  seq is the number of events
+// that we processed before the batch.
+func (w *webReceiver) processEvents(r *http.Request, version, seq int, batch []streamLine) *streamAck {
+	ack := &streamAck{Seq: seq + len(batch)}
+	reject := func(i int, err error) {
+		ack.Rejected = append(ack.Rejected, streamRejection{Index: seq + i, Error: err.Error()})
+		m.numStreamEvents.With(prometheus.Labels{outcome: errClass(err)}).Inc()
+		countErr(err)
+	}
+	accept := func() {
+		m.numStreamEvents.With(prometheus.Labels{outcome: success}).Inc()
+	}
+
+	// We hand over all events before waiting for the aggregator, so that
+	// it can process the batch in one go.
+	pending := make(map[int]*clientRequest)
+	for i, line := range batch {
+		if line.err != nil {
+			reject(i, line.err)
+			continue
+		}
+		req, err := w.parseEvent(line.b, version)
+		if err != nil {
+			reject(i, err)
+			continue
+		}
+		if ok, _ := w.limiter.allow(req.Wallet); !ok {
+			reject(i, errRateLimited)
+			continue
+		}
+		if w.dedup.contains(req.Wallet, req.Addr) {
+			m.numDeduplicated.Inc()
+			accept()
+			continue
+		}
+		select {
+		case w.in <- req:
+			pending[i] = req
+		default:
+			if w.overflow.add(req) {
+				w.dedup.add(req.Wallet, req.Addr)
+				accept()
+				continue
+			}
+			m.numOverloaded.Inc()
+			reject(i, errOverloaded)
+		}
+	}
+
+	timeout := time.NewTimer(w.ackTimeout)
+	defer timeout.Stop()
+	for i := 0; i < len(batch); i++ {
+		req, exists := pending[i]
+		if !exists {
+			continue
+		}
+		select {
+		case err := <-req.ack:
+			if err != nil {
+				reject(i, errNotProcessed)
+				continue
+			}
+			w.dedup.add(req.Wallet, req.Addr)
+			accept()
+		case <-timeout.C:
+			// Our timer fired, so the remaining events time out right
+			// away.
+			timeout.Reset(0)
+			reject(i, errAckTimeout)
+		case <-r.Context().Done():
+			reject(i, errAckTimeout)
+		}
+	}
+	return ack
+}
+
+// parseEvent turns the given event into a client request.
+func (w *webReceiver) parseEvent(b []byte, version int) (*clientRequest, error) {
+	var e streamEvent
+	if err := json.Unmarshal(b, &e); err != nil {
+		return nil, errBadStreamEvent
+	}
+	walletID, err := uuid.Parse(e.Wallet)
+	if err != nil {
+		return nil, errBadWalletFmt
+	}
+	addr, err := w.addrs.parse(e.Addr)
+	if err != nil {
+		return nil, err
+	}
+	var meta *requestMeta
+	if version >= metaApiVersion {
+		if meta, err = newRequestMeta(e.Country, e.ConfType); err != nil {
+			return nil, err
+		}
+	}
+	requestID := e.RequestID
+	if !requestIDFmt.MatchString(requestID) {
+		requestID = uuid.NewString()
+	}
+	return &clientRequest{
+		Addr:       addr,
+		Wallet:     walletID,
+		Meta:       meta,
+		ApiVersion: version,
+		RequestID:  requestID,
+		ack:        make(chan error, 1),
+	}, nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// newStreamServer returns an HTTP/2 server for a new Web receiver whose
+// aggregator acknowledges all requests, and the channel that the aggregator
+// hands the requests to.  The receiver closes idle streams after the given
+// timeout.
+func newStreamServer(t *testing.T, timeout time.Duration) (*httptest.Server, chan *clientRequest) {
+	t.Helper()
+
+	w := newWebReceiver().(*webReceiver)
+	w.streamTimeout = timeout
+	processed := make(chan *clientRequest, 100)
+	go func() {
+		for req := range w.in {
+			req.(*clientRequest).acknowledge(nil)
+			processed <- req.(*clientRequest)
+		}
+	}()
+	srv := httptest.NewUnstartedServer(w.router)
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	t.Cleanup(func() {
+		srv.Close()
+		close(w.in)
+	})
+	return srv, processed
+}
+
+// openStream opens a stream, and returns the writer that sends events and
+// the scanner that reads acks.
+func openStream(t *testing.T, srv *httptest.Server) (*io.PipeWriter, *bufio.Scanner) {
+	t.Helper()
+
+	body, events := io.Pipe()
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/v5/confirmation/stream", body)
+	if err != nil {
+		t.Fatalf("Failed to create HTTP request: %v", err)
+	}
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	assertEqual(t, resp.StatusCode, http.StatusOK)
+	assertEqual(t, resp.Header.Get("Content-Type"), ndjsonType)
+	t.Cleanup(func() { resp.Body.Close() })
+	return events, bufio.NewScanner(resp.Body)
+}
+
+func readAck(t *testing.T, acks *bufio.Scanner) *streamAck {
+	t.Helper()
+
+	if !acks.Scan() {
+		t.Fatalf("Expected ack but stream ended: %v", acks.Err())
+	}
+	var ack streamAck
+	if err := json.Unmarshal(acks.Bytes(), &ack); err != nil {
+		t.Fatalf("Failed to decode ack: %v", err)
+	}
+	return &ack
+}
+
+func TestStream(t *testing.T) {
+	srv, processed := newStreamServer(t, defaultStreamTimeout)
+	events, acks := openStream(t, srv)
+	accepted := m.numStreamEvents.WithLabelValues(success)
+	numAccepted := testutil.ToFloat64(accepted)
+
+	walletID := newV4(t)
+	fmt.Fprintf(events, `{"wallet":%q,"addr":%q,"country":"US","request_id":"foo"}`+"\n", walletID, ipv4Addr)
+	ack := readAck(t, acks)
+	assertEqual(t, ack.Seq, 1)
+	assertEqual(t, len(ack.Rejected), 0)
+	req := <-processed
+	assertEqual(t, req.Wallet, walletID)
+	assertEqual(t, req.Addr.String(), ipv4Addr)
+	assertEqual(t, req.Meta.Country, "US")
+	assertEqual(t, req.RequestID, "foo")
+	assertEqual(t, req.ApiVersion, 5)
+
+	// The stream stays open, and rejects bad events individually.
+	fmt.Fprintf(events, "{\"wallet\":%q,\"addr\":%q}\nfoo\n{\"wallet\":\"bar\",\"addr\":%q}\n",
+		newV4(t), ipv4Addr, ipv4Addr)
+	var rejected []streamRejection
+	for seq := 1; seq < 4; {
+		ack := readAck(t, acks)
+		seq = ack.Seq
+		rejected = append(rejected, ack.Rejected...)
+	}
+	assertEqual(t, len(rejected), 2)
+	assertEqual(t, rejected[0], streamRejection{Index: 2, Error: errBadStreamEvent.Error()})
+	assertEqual(t, rejected[1], streamRejection{Index: 3, Error: errBadWalletFmt.Error()})
+	assertEqual(t, testutil.ToFloat64(accepted), numAccepted+2)
+
+	// An event that exceeds our size limit ends the stream.
+	fmt.Fprintf(events, "%s\n", strings.Repeat("x", maxStreamEventBytes+1))
+	ack = readAck(t, acks)
+	assertEqual(t, ack.Seq, 5)
+	assertEqual(t, ack.Rejected[0].Error, errStreamEventSize.Error())
+	assertEqual(t, acks.Scan(), false)
+	events.Close()
+}
+
+func TestStreamEOF(t *testing.T) {
+	srv, processed := newStreamServer(t, defaultStreamTimeout)
+	events, acks := openStream(t, srv)
+
+	// We acknowledge the events that precede the end of the stream, and
+	// then end our response.
+	fmt.Fprintf(events, `{"wallet":%q,"addr":%q}`+"\n", newV4(t), ipv4Addr)
+	events.Close()
+	ack := readAck(t, acks)
+	assertEqual(t, ack.Seq, 1)
+	assertEqual(t, len(ack.Rejected), 0)
+	<-processed
+	assertEqual(t, acks.Scan(), false)
+}
+
+func TestStreamIdleTimeout(t *testing.T) {
+	srv, _ := newStreamServer(t, time.Millisecond*100)
+	events, acks := openStream(t, srv)
+	defer events.Close()
+
+	// We close streams that go without events for too long.
+	ended := make(chan bool)
+	go func() { ended <- !acks.Scan() }()
+	select {
+	case ok := <-ended:
+		assertEqual(t, ok, true)
+	case <-time.After(time.Second * 5):
+		t.Fatal("Expected idle stream to end.")
+	}
+}
+
+func TestStreamRequiresHTTP2(t *testing.T) {
+	srv := httptest.NewServer(newTestRouter(make(chan serializer)))
+	defer srv.Close()
+
+	resp, err := http.Post(srv.URL+"/v5/confirmation/stream", ndjsonType, strings.NewReader("{}\n"))
+	if err != nil {
+		t.Fatalf("Failed to make HTTP request: %v", err)
+	}
+	assertEqual(t, resp.StatusCode, http.StatusHTTPVersionNotSupported)
+}
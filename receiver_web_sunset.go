@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// The headers that tell clients when an API version goes away:
+	// https://www.rfc-editor.org/rfc/rfc8594
+	sunsetHeader      = "Sunset"
+	deprecationHeader = "Deprecation"
+	// sunsetDateFmt is the format of sunset dates in our configuration.
+	sunsetDateFmt = "2006-01-02"
+)
+
+var (
+	errRetiredApiVersion = newError(ErrGone, "ads API version has been retired")
+	errBadSunset         = errors.New("sunset must have format '<version>=<YYYY-MM-DD>'")
+)
+
+// sunsetPolicy keeps track of the ads API versions that we're retiring.  Until
+// its sunset, a deprecated version keeps working, but its responses tell the
+// client when the version goes away.  From its sunset on, we respond with 410.
+// Either way, we count the version's requests, so we know who's still using
+// it.
+type sunsetPolicy struct {
+	sync.RWMutex
+	sunsets map[int]time.Time
+	now     func() time.Time
+}
+
+func newSunsetPolicy() *sunsetPolicy {
+	return &sunsetPolicy{now: time.Now}
+}
+
+func (s *sunsetPolicy) setConfig(c *config) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.sunsets = c.sunsets
+}
+
+// check sets the sunset headers for the given API version, if it's
+// deprecated, and returns errRetiredApiVersion if its sunset has passed.
+func (s *sunsetPolicy) check(rw http.ResponseWriter, version int) error {
+	s.RLock()
+	defer s.RUnlock()
+
+	sunset, exists := s.sunsets[version]
+	if !exists {
+		return nil
+	}
+	m.numDeprecated.WithLabelValues(strconv.Itoa(version)).Inc()
+	rw.Header().Set(sunsetHeader, sunset.Format(http.TimeFormat))
+	rw.Header().Set(deprecationHeader, "true")
+	if s.now().Before(sunset) {
+		return nil
+	}
+	return errRetiredApiVersion
+}
+
+// parseSunsets turns the given comma-separated list of sunsets, e.g.,
+// "1=2024-01-01,2=2024-06-30", into a map from API version to sunset.
+// Sunsets are at midnight UTC.
+func parseSunsets(s string) (map[int]time.Time, error) {
+	if s == "" {
+		return nil, nil
+	}
+	sunsets := make(map[int]time.Time)
+	for _, rawSunset := range strings.Split(s, ",") {
+		rawVersion, rawDate, found := strings.Cut(strings.TrimSpace(rawSunset), "=")
+		if !found || !isValidApiVersion(rawVersion) {
+			return nil, errBadSunset
+		}
+		date, err := time.Parse(sunsetDateFmt, rawDate)
+		if err != nil {
+			return nil, errBadSunset
+		}
+		version, _ := strconv.Atoi(rawVersion)
+		sunsets[version] = date
+	}
+	return sunsets, nil
+}
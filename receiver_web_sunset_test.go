@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestParseSunsets(t *testing.T) {
+	sunsets, err := parseSunsets("1=2024-01-01, 2=2024-06-30")
+	if err != nil {
+		t.Fatalf("Failed to parse sunsets: %v", err)
+	}
+	assertEqual(t, len(sunsets), 2)
+	assertEqual(t, sunsets[2], time.Date(2024, 6, 30, 0, 0, 0, 0, time.UTC))
+
+	for _, s := range []string{"1", "1=", "foo=2024-01-01", "9=2024-01-01", "1=2024-13-01", "1=2024-01-01,"} {
+		if _, err := parseSunsets(s); err == nil {
+			t.Errorf("%q: Expected error but got none.", s)
+		}
+	}
+	sunsets, err = parseSunsets("")
+	assertEqual(t, err, nil)
+	assertEqual(t, len(sunsets), 0)
+}
+
+func TestSunsetApiVersion(t *testing.T) {
+	inbox := make(chan serializer, 10) // We're using a buffered channel to prevent a deadlock.
+	w := newWebReceiver().(*webReceiver)
+	w.in = inbox
+	sunset := time.Date(2024, 6, 30, 0, 0, 0, 0, time.UTC)
+	w.setConfig(&config{sunsets: map[int]time.Time{2: sunset}})
+	srv := httptest.NewServer(w.router)
+	defer srv.Close()
+	header := http.Header{fastlyClientIP: []string{ipv4Addr}}
+	path := fmt.Sprintf("/v2/confirmation/token/%s", newV4(t))
+	deprecated := m.numDeprecated.WithLabelValues("2")
+	before := testutil.ToFloat64(deprecated)
+
+	go func() {
+		(<-inbox).(*clientRequest).acknowledge(nil)
+	}()
+	// Before its sunset, a deprecated version keeps working.
+	w.sunsets.now = func() time.Time { return sunset.Add(-time.Second) }
+	resp := makeReq(t, srv, http.MethodGet, path, header)
+	assertEqual(t, resp.StatusCode, http.StatusOK)
+	assertEqual(t, resp.Header.Get(sunsetHeader), "Sun, 30 Jun 2024 00:00:00 GMT")
+	assertEqual(t, resp.Header.Get(deprecationHeader), "true")
+
+	// From its sunset on, it's gone.
+	w.sunsets.now = func() time.Time { return sunset }
+	resp = makeReq(t, srv, http.MethodGet, path, header)
+	assertEqual(t, resp.StatusCode, http.StatusGone)
+	assertEqual(t, resp.Header.Get(sunsetHeader), "Sun, 30 Jun 2024 00:00:00 GMT")
+	assertEqual(t, testutil.ToFloat64(deprecated), before+2)
+
+	// Other versions are unaffected.
+	go func() {
+		(<-inbox).(*clientRequest).acknowledge(nil)
+	}()
+	resp = makeReq(t, srv, http.MethodGet, fmt.Sprintf("/v3/confirmation/token/%s", newV4(t)), header)
+	assertEqual(t, resp.StatusCode, http.StatusOK)
+	assertEqual(t, resp.Header.Get(sunsetHeader), "")
+}
@@ -1,13 +1,19 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"runtime"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
 )
 
 const (
@@ -28,50 +34,144 @@ func makeReq(t *testing.T, s *httptest.Server, method, path string, h http.Heade
 	return resp
 }
 
-func TestIndexRequest(t *testing.T) {
-	inbox := make(chan serializer, 10) // We're using a buffered channel to prevent a deadlock.
-	srv := httptest.NewServer(newRouter(inbox))
+// newTestRouter returns the router of a new Web receiver whose inbox is the
+// given channel.
+func newTestRouter(inbox chan serializer) *chi.Mux {
+	w := newWebReceiver().(*webReceiver)
+	w.in = inbox
+	return w.router
+}
+
+func TestVersionRequest(t *testing.T) {
+	srv := httptest.NewServer(newTestRouter(make(chan serializer)))
 	defer srv.Close()
 
-	resp := makeReq(t, srv, http.MethodGet, "/", nil)
-	if resp.StatusCode != http.StatusOK {
-		t.Fatalf("Expected HTTP status code %d but got %d.", http.StatusOK, resp.StatusCode)
-	}
-	body, _ := io.ReadAll(resp.Body)
-	if strings.TrimSpace(string(body)) != indexPage {
-		t.Fatalf("Expected body %q but got %q.", indexPage, string(body))
+	resp := makeReq(t, srv, http.MethodGet, "/version", nil)
+	assertEqual(t, resp.StatusCode, http.StatusOK)
+	assertEqual(t, resp.Header.Get("Content-Type"), "application/json")
+	var v versionInfo
+	if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+		t.Fatalf("Failed to decode version information: %v", err)
 	}
+	assertEqual(t, v.GoVersion, runtime.Version())
+
+	// The static index page is gone.
+	resp = makeReq(t, srv, http.MethodGet, "/", nil)
+	assertEqual(t, resp.StatusCode, http.StatusNotFound)
 }
 
 func TestGoodRequest(t *testing.T) {
 	walletID := newV4(t)
 	expected := clientRequest{
-		Addr:   net.ParseIP(ipv4Addr),
-		Wallet: walletID,
+		Addr:       net.ParseIP(ipv4Addr),
+		Wallet:     walletID,
+		ApiVersion: 2,
 	}
 	inbox := make(chan serializer, 10) // We're using a buffered channel to prevent a deadlock.
 	path := fmt.Sprintf("/v2/confirmation/token/%s", walletID)
-	srv := httptest.NewServer(newRouter(inbox))
+	srv := httptest.NewServer(newTestRouter(inbox))
 	defer srv.Close()
 
+	// Play aggregator by acknowledging the request.
+	processed := make(chan *clientRequest, 1)
+	go func() {
+		req := (<-inbox).(*clientRequest)
+		req.acknowledge(nil)
+		processed <- req
+	}()
 	resp := makeReq(t, srv, http.MethodGet, path, http.Header{fastlyClientIP: []string{ipv4Addr}})
 
 	if resp.StatusCode != http.StatusOK {
 		t.Fatalf("Expected HTTP status code %d but got %d.", http.StatusOK, resp.StatusCode)
 	}
 
-	r := <-inbox
-	received := r.(*clientRequest)
+	received := <-processed
 	if !net.IP.Equal(received.Addr, expected.Addr) {
 		t.Fatalf("Expected address %q but got %q.", expected.Addr, received.Addr)
 	}
 	if received.Wallet != expected.Wallet {
 		t.Fatalf("Expected wallet %q but got %q.", expected.Wallet, received.Wallet)
 	}
+	assertEqual(t, received.ApiVersion, expected.ApiVersion)
+}
+
+func TestUnprocessedRequest(t *testing.T) {
+	inbox := make(chan serializer, 10) // We're using a buffered channel to prevent a deadlock.
+	w := newWebReceiver().(*webReceiver)
+	w.in = inbox
+	w.ackTimeout = time.Millisecond * 10
+	srv := httptest.NewServer(w.router)
+	defer srv.Close()
+	path := fmt.Sprintf("/v2/confirmation/token/%s", newV4(t))
+	header := http.Header{fastlyClientIP: []string{ipv4Addr}}
+
+	// The aggregator failed to process our request.
+	go func() {
+		(<-inbox).(*clientRequest).acknowledge(errors.New("foo"))
+	}()
+	resp := makeReq(t, srv, http.MethodGet, path, header)
+	assertEqual(t, resp.StatusCode, http.StatusInternalServerError)
+
+	// The aggregator never got back to us.
+	resp = makeReq(t, srv, http.MethodGet, path, header)
+	assertEqual(t, resp.StatusCode, http.StatusServiceUnavailable)
+	body, _ := io.ReadAll(resp.Body)
+	assertEqual(t, strings.TrimSpace(string(body)), errAckTimeout.Error())
+}
+
+func TestDebugEcho(t *testing.T) {
+	inbox := make(chan serializer, 10) // We're using a buffered channel to prevent a deadlock.
+	echoWallet := newV4(t)
+	w := newWebReceiver().(*webReceiver)
+	w.in = inbox
+	w.setConfig(&config{echoWallet: echoWallet, dedupWindow: time.Minute, dedupSize: 10})
+	srv := httptest.NewServer(w.router)
+	defer srv.Close()
+	header := http.Header{fastlyClientIP: []string{ipv4Addr}}
+
+	go func() {
+		for req := range inbox {
+			r := req.(*clientRequest)
+			r.pseudonym = "5.6.7.8"
+			r.acknowledge(nil)
+		}
+	}()
+	defer close(inbox)
+
+	// Requests of the echo wallet get the anonymized address, even if they
+	// are duplicates.
+	for i := 0; i < 2; i++ {
+		resp := makeReq(t, srv, http.MethodGet, "/v3/confirmation/token/"+echoWallet.String(), header)
+		assertEqual(t, resp.StatusCode, http.StatusOK)
+		body, _ := io.ReadAll(resp.Body)
+		assertEqual(t, strings.TrimSpace(string(body)), "5.6.7.8")
+	}
+
+	// Other wallets' requests don't.
+	resp := makeReq(t, srv, http.MethodGet, "/v3/confirmation/token/"+newV4(t).String(), header)
+	assertEqual(t, resp.StatusCode, http.StatusOK)
+	body, _ := io.ReadAll(resp.Body)
+	assertEqual(t, string(body), "")
+}
+
+func TestOverloadedInbox(t *testing.T) {
+	inbox := make(chan serializer, 1)
+	srv := httptest.NewServer(newTestRouter(inbox))
+	defer srv.Close()
+	path := fmt.Sprintf("/v2/confirmation/token/%s", newV4(t))
+	header := http.Header{fastlyClientIP: []string{ipv4Addr}}
+
+	// The aggregator isn't reading from our inbox, which is already full.
+	inbox <- &clientRequest{}
+	resp := makeReq(t, srv, http.MethodGet, path, header)
+	assertEqual(t, resp.StatusCode, http.StatusServiceUnavailable)
+	assertEqual(t, resp.Header.Get("Retry-After"), "1")
+	body, _ := io.ReadAll(resp.Body)
+	assertEqual(t, strings.TrimSpace(string(body)), errOverloaded.Error())
 }
 
 func TestBadWalletId(t *testing.T) {
-	srv := httptest.NewServer(newRouter(make(chan serializer)))
+	srv := httptest.NewServer(newTestRouter(make(chan serializer)))
 	defer srv.Close()
 	badPath := "/v2/confirmation/token/foobar"
 
@@ -88,7 +188,7 @@ func TestBadWalletId(t *testing.T) {
 }
 
 func TestNoFastlyHeader(t *testing.T) {
-	srv := httptest.NewServer(newRouter(make(chan serializer)))
+	srv := httptest.NewServer(newTestRouter(make(chan serializer)))
 	defer srv.Close()
 	path := fmt.Sprintf("/v2/confirmation/token/%s", newV4(t))
 
@@ -98,14 +198,14 @@ func TestNoFastlyHeader(t *testing.T) {
 	}
 	body, _ := io.ReadAll(resp.Body)
 	received := strings.TrimSpace(string(body))
-	expected := errNoFastlyHeader.Error()
+	expected := errNoAddrHeader.Error()
 	if received != expected {
 		t.Fatalf("Expected error %q but got %q.", expected, received)
 	}
 }
 
 func TestBadFastlyAddr(t *testing.T) {
-	srv := httptest.NewServer(newRouter(make(chan serializer)))
+	srv := httptest.NewServer(newTestRouter(make(chan serializer)))
 	defer srv.Close()
 	path := fmt.Sprintf("/v2/confirmation/token/%s", newV4(t))
 
@@ -115,7 +215,7 @@ func TestBadFastlyAddr(t *testing.T) {
 	}
 	body, _ := io.ReadAll(resp.Body)
 	received := strings.TrimSpace(string(body))
-	expected := errBadFastlyAddrFormat.Error()
+	expected := errBadAddrFormat.Error()
 	if received != expected {
 		t.Fatalf("Expected error %q but got %q.", expected, received)
 	}
@@ -126,11 +226,68 @@ func TestIsValidApiVersion(t *testing.T) {
 	assertEqual(t, isValidApiVersion("2"), true)
 	assertEqual(t, isValidApiVersion("3"), true)
 	assertEqual(t, isValidApiVersion("4"), true)
+	assertEqual(t, isValidApiVersion("5"), true)
 
 	assertEqual(t, isValidApiVersion("0"), false)
-	assertEqual(t, isValidApiVersion("5"), false)
+	assertEqual(t, isValidApiVersion("6"), false)
 	assertEqual(t, isValidApiVersion("99"), false)
 	assertEqual(t, isValidApiVersion("-1"), false)
 	assertEqual(t, isValidApiVersion("1.1"), false)
 	assertEqual(t, isValidApiVersion("foo"), false)
 }
+
+func TestHTTPTuning(t *testing.T) {
+	w := newWebReceiver().(*webReceiver)
+	srv := w.newServer()
+	if srv.TLSNextProto != nil {
+		t.Fatal("Expected HTTP/2 to be enabled by default.")
+	}
+
+	w.setConfig(&config{httpTuning: httpTuning{
+		disableHTTP2:      true,
+		idleTimeout:       time.Second,
+		readHeaderTimeout: 2 * time.Second,
+		maxHeaderBytes:    1024,
+	}})
+	srv = w.newServer()
+	if srv.TLSNextProto == nil || len(srv.TLSNextProto) != 0 {
+		t.Fatal("Expected HTTP/2 to be disabled.")
+	}
+	assertEqual(t, srv.IdleTimeout, time.Second)
+	assertEqual(t, srv.ReadHeaderTimeout, 2*time.Second)
+	assertEqual(t, srv.MaxHeaderBytes, 1024)
+}
+
+func TestSlowHeaders(t *testing.T) {
+	srv := httptest.NewUnstartedServer(newTestRouter(make(chan serializer)))
+	httpTuning{readHeaderTimeout: 50 * time.Millisecond}.applyTimeouts(srv.Config)
+	srv.Start()
+	defer srv.Close()
+
+	c, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	defer c.Close()
+
+	// Send an incomplete request and never finish it.  The server must close
+	// our connection.
+	if _, err := c.Write([]byte("GET / HTTP/1.1\r\nHost: foo\r\n")); err != nil {
+		t.Fatalf("Failed to write request: %v", err)
+	}
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadAll(c); err != nil {
+		t.Fatalf("Expected server to close connection but got: %v", err)
+	}
+}
+
+func TestListenBacklog(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+	if err := setListenBacklog(ln, 16); err != nil {
+		t.Fatalf("Failed to set listen backlog: %v", err)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+)
+
+var (
+	errNoServerCert  = errors.New("client authentication requires a server certificate and key")
+	errBadClientCA   = errors.New("failed to parse client CA certificate")
+	errIncompleteTLS = errors.New("server certificate and key must be provided together")
+)
+
+// loadWebTLSConfig returns the TLS configuration of the Web receiver, given
+// the paths to the server's certificate and key, and the path to a bundle of
+// CA certificates.  If the CA bundle is set, clients must present a
+// certificate that's signed by one of the CAs, i.e., we use mutual TLS.  If
+// none of the paths are set, the Web receiver speaks plain HTTP and we return
+// nil.
+func loadWebTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	if certFile == "" && keyFile == "" {
+		if clientCAFile != "" {
+			return nil, errNoServerCert
+		}
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, errIncompleteTLS
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	conf := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCAFile == "" {
+		return conf, nil
+	}
+
+	rawCAs, err := os.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	clientCAs := x509.NewCertPool()
+	if ok := clientCAs.AppendCertsFromPEM(rawCAs); !ok {
+		return nil, errBadClientCA
+	}
+	conf.ClientCAs = clientCAs
+	conf.ClientAuth = tls.RequireAndVerifyClientCert
+	l.Println("Loaded client CAs.  Requiring client certificates.")
+
+	return conf, nil
+}
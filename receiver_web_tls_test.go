@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+// newTestCert creates a certificate for the given common name.  The
+// certificate is signed by the given parent or self-signed if the parent is
+// nil.  The function returns the PEM-encoded certificate and key.
+func newTestCert(t *testing.T, cn string, parent *tls.Certificate) ([]byte, []byte) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+	}
+	signerCert, signerKey := tmpl, any(key)
+	if parent != nil {
+		signerCert = parent.Leaf
+		signerKey = parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signerCert, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	rawKey, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: rawKey})
+}
+
+func loadTestKeyPair(t *testing.T, cert, key []byte) tls.Certificate {
+	t.Helper()
+
+	pair, err := tls.X509KeyPair(cert, key)
+	if err != nil {
+		t.Fatalf("Failed to load key pair: %v", err)
+	}
+	pair.Leaf, err = x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		t.Fatalf("Failed to parse certificate: %v", err)
+	}
+	return pair
+}
+
+func TestLoadWebTLSConfig(t *testing.T) {
+	cert, key := newTestCert(t, "server", nil)
+	pathCert := writeFile(t, cert, "server.crt")
+	defer os.Remove(pathCert)
+	pathKey := writeFile(t, key, "server.key")
+	defer os.Remove(pathKey)
+	pathBadCA := writeFile(t, []byte("foo"), "ca.crt")
+	defer os.Remove(pathBadCA)
+
+	conf, err := loadWebTLSConfig("", "", "")
+	if conf != nil || err != nil {
+		t.Fatalf("Expected neither config nor error but got %v and %v.", conf, err)
+	}
+	_, err = loadWebTLSConfig("", "", pathCert)
+	assertEqual(t, err, errNoServerCert)
+	_, err = loadWebTLSConfig(pathCert, "", "")
+	assertEqual(t, err, errIncompleteTLS)
+	_, err = loadWebTLSConfig(pathCert, pathKey, pathBadCA)
+	assertEqual(t, err, errBadClientCA)
+
+	conf, err = loadWebTLSConfig(pathCert, pathKey, "")
+	if err != nil {
+		t.Fatalf("Failed to load TLS config: %v", err)
+	}
+	assertEqual(t, conf.ClientAuth, tls.NoClientCert)
+
+	conf, err = loadWebTLSConfig(pathCert, pathKey, pathCert)
+	if err != nil {
+		t.Fatalf("Failed to load TLS config: %v", err)
+	}
+	assertEqual(t, conf.ClientAuth, tls.RequireAndVerifyClientCert)
+}
+
+func TestMutualTLS(t *testing.T) {
+	caCert, caKey := newTestCert(t, "ca", nil)
+	ca := loadTestKeyPair(t, caCert, caKey)
+	serverCert, serverKey := newTestCert(t, "server", &ca)
+	clientCert, clientKey := newTestCert(t, "client", &ca)
+
+	pathCA := writeFile(t, caCert, "ca.crt")
+	defer os.Remove(pathCA)
+	pathCert := writeFile(t, serverCert, "server.crt")
+	defer os.Remove(pathCert)
+	pathKey := writeFile(t, serverKey, "server.key")
+	defer os.Remove(pathKey)
+	conf, err := loadWebTLSConfig(pathCert, pathKey, pathCA)
+	if err != nil {
+		t.Fatalf("Failed to load TLS config: %v", err)
+	}
+
+	srv := httptest.NewUnstartedServer(newTestRouter(make(chan serializer)))
+	srv.TLS = conf
+	srv.StartTLS()
+	defer srv.Close()
+
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(ca.Leaf)
+
+	// A client without a certificate must be turned away.
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: rootCAs},
+	}}
+	if _, err := client.Get(srv.URL); err == nil {
+		t.Fatal("Expected request without client certificate to fail.")
+	}
+
+	// A client with a certificate must be let in.
+	client = &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{
+			RootCAs:      rootCAs,
+			Certificates: []tls.Certificate{loadTestKeyPair(t, clientCert, clientKey)},
+		},
+	}}
+	resp, err := client.Get(srv.URL + "/version")
+	if err != nil {
+		t.Fatalf("Expected request with client certificate to succeed but got: %v", err)
+	}
+	assertEqual(t, resp.StatusCode, http.StatusOK)
+}
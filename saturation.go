@@ -0,0 +1,94 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// sendSampleRate determines how many channel sends we time: one in
+// sendSampleRate.  Timing every send would be wasteful.
+const sendSampleRate = 16
+
+// saturation reports the length and capacity of the channels that connect
+// our components, so that dashboards can show back-pressure building before
+// requests start failing.
+var saturation = newChanGauges()
+
+// chanGauges implements a Prometheus collector that reads the length and
+// capacity of the channels it watches at scrape time.
+type chanGauges struct {
+	sync.Mutex
+	chans   map[string]func() (int, int)
+	lenDesc *prometheus.Desc
+	capDesc *prometheus.Desc
+}
+
+func newChanGauges() *chanGauges {
+	return &chanGauges{
+		chans: make(map[string]func() (int, int)),
+		lenDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(ns, "", "channel_length"),
+			"The number of elements that wait in a channel, by channel",
+			[]string{chanName}, nil,
+		),
+		capDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(ns, "", "channel_capacity"),
+			"The capacity of a channel, by channel",
+			[]string{chanName}, nil,
+		),
+	}
+}
+
+// watchChan makes us report the given channel's length and capacity under the
+// given name.  Watching a new channel under an existing name replaces the old
+// channel.
+func watchChan[T any](name string, ch chan T) {
+	saturation.Lock()
+	defer saturation.Unlock()
+
+	saturation.chans[name] = func() (int, int) {
+		return len(ch), cap(ch)
+	}
+}
+
+func (c *chanGauges) Describe(descs chan<- *prometheus.Desc) {
+	descs <- c.lenDesc
+	descs <- c.capDesc
+}
+
+func (c *chanGauges) Collect(metrics chan<- prometheus.Metric) {
+	c.Lock()
+	defer c.Unlock()
+
+	for name, lenCap := range c.chans {
+		length, capacity := lenCap()
+		metrics <- prometheus.MustNewConstMetric(c.lenDesc, prometheus.GaugeValue, float64(length), name)
+		metrics <- prometheus.MustNewConstMetric(c.capDesc, prometheus.GaugeValue, float64(capacity), name)
+	}
+}
+
+// sendTimer measures how long sends to a channel block, for one in
+// sendSampleRate sends.
+type sendTimer struct {
+	channel string
+	n       atomic.Uint64
+}
+
+func newSendTimer(channel string) *sendTimer {
+	return &sendTimer{channel: channel}
+}
+
+// start returns a function that, once called after the send, records how
+// long the send blocked, if the send is sampled.
+func (s *sendTimer) start() func() {
+	if s.n.Add(1)%sendSampleRate != 1 {
+		return func() {}
+	}
+	begin := time.Now()
+	return func() {
+		m.chanSendSeconds.With(prometheus.Labels{chanName: s.channel}).Observe(time.Since(begin).Seconds())
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestChanGauges(t *testing.T) {
+	c := newChanGauges()
+	saturation, c = c, saturation
+	defer func() { saturation = c }()
+
+	ch := make(chan int, 4)
+	ch <- 1
+	ch <- 2
+	watchChan("foo", ch)
+
+	expected := `
+# HELP tokenizer_channel_capacity The capacity of a channel, by channel
+# TYPE tokenizer_channel_capacity gauge
+tokenizer_channel_capacity{channel="foo"} 4
+# HELP tokenizer_channel_length The number of elements that wait in a channel, by channel
+# TYPE tokenizer_channel_length gauge
+tokenizer_channel_length{channel="foo"} 2
+`
+	if err := testutil.CollectAndCompare(saturation, strings.NewReader(expected)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSendTimer(t *testing.T) {
+	s := newSendTimer("test")
+	for i := 0; i < 2*sendSampleRate; i++ {
+		s.start()()
+	}
+
+	// Only one in sendSampleRate sends is timed.
+	assertEqual(t, sampleCount(t, m.chanSendSeconds.WithLabelValues("test")), uint64(2))
+}
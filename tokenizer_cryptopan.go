@@ -3,7 +3,6 @@ package main
 import (
 	"crypto/rand"
 	"crypto/sha256"
-	"errors"
 	"sync"
 
 	"github.com/Yawning/cryptopan"
@@ -17,8 +16,8 @@ const (
 )
 
 var (
-	errNoKey      = errors.New("key has not been initialized yet")
-	errBadBlobLen = errors.New("blob length not supported")
+	errNoKey      = newError(ErrCrypto, "key has not been initialized yet")
+	errBadBlobLen = newError(ErrCrypto, "blob length not supported")
 )
 
 // cryptoPAnTokenizer implements a tokenizer that uses Crypto-PAn to anonymize
@@ -71,6 +70,17 @@ func (c *cryptoPAnTokenizer) tokenizeAndKeyID(s serializer) (token, *keyID, erro
 	return token(c.cryptoPAn.Anonymize(blob)), c.keyID(), nil
 }
 
+// ready returns nil once our key has been initialized.
+func (c *cryptoPAnTokenizer) ready() error {
+	c.RLock()
+	defer c.RUnlock()
+
+	if len(c.key) == 0 {
+		return errNoKey
+	}
+	return nil
+}
+
 func (c *cryptoPAnTokenizer) keyID() *keyID {
 	c.RLock()
 	defer c.RUnlock()
@@ -86,15 +96,20 @@ func (c *cryptoPAnTokenizer) resetKey() error {
 	c.Lock()
 	defer c.Unlock()
 
-	var err error
-	c.key = make([]byte, cryptopan.Size)
-	if _, err = rand.Read(c.key); err != nil {
+	key := make([]byte, cryptopan.Size)
+	if _, err := rand.Read(key); err != nil {
 		return err
 	}
-	c.cryptoPAn, err = cryptopan.New(c.key)
+	return c.setKey(key)
+}
+
+// setKey sets the given key.  The caller must hold our lock.
+func (c *cryptoPAnTokenizer) setKey(key []byte) error {
+	cp, err := cryptopan.New(key)
 	if err != nil {
 		return err
 	}
+	c.key, c.cryptoPAn = key, cp
 	return nil
 }
 
@@ -2,6 +2,7 @@ package main
 
 import (
 	"errors"
+	"net"
 	"testing"
 )
 
@@ -47,3 +48,13 @@ func BenchmarkCryptoPAn(b *testing.B) {
 		_, _ = c.tokenize(v)
 	}
 }
+
+func BenchmarkCryptoPAnIPv6(b *testing.B) {
+	c := newCryptoPAnTokenizer()
+	_ = c.resetKey()
+	v := blob(net.ParseIP("2001:db8::1"))
+
+	for i := 0; i < b.N; i++ {
+		_, _ = c.tokenize(v)
+	}
+}
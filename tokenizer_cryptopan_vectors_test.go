@@ -0,0 +1,38 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const cryptoPAnVectorsFile = "testdata/cryptopan/vectors.json"
+
+func TestCryptoPAnVectors(t *testing.T) {
+	n, err := verifyCryptoPAnVectors(cryptoPAnVectorsFile)
+	if err != nil {
+		t.Fatalf("Failed to verify test vectors: %v", err)
+	}
+	assertEqual(t, n, 70)
+}
+
+func TestCryptoPAnVectorsMismatch(t *testing.T) {
+	raw, err := os.ReadFile(cryptoPAnVectorsFile)
+	if err != nil {
+		t.Fatalf("Failed to read test vectors: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "vectors.json")
+	tampered := strings.Replace(string(raw), "135.242.180.132", "135.242.180.133", 1)
+	if err := os.WriteFile(path, []byte(tampered), 0o600); err != nil {
+		t.Fatalf("Failed to write test vectors: %v", err)
+	}
+
+	_, err = verifyCryptoPAnVectors(path)
+	if err == nil {
+		t.Fatal("Expected error but got none.")
+	}
+	if !strings.Contains(err.Error(), "128.11.68.132: expected 135.242.180.133 but got 135.242.180.132") {
+		t.Fatalf("Got unexpected error: %v", err)
+	}
+}
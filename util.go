@@ -2,10 +2,22 @@ package main
 
 import (
 	"syscall"
+	"time"
 
 	"github.com/linkedin/goavro/v2"
 )
 
+// truncateTime returns the given time, rounded down to a multiple of the given
+// precision, e.g., to the hour.  Multiples are counted from the zero time, so
+// precisions of up to a day align with UTC.  A precision of 0 leaves the time
+// untouched.
+func truncateTime(t time.Time, precision time.Duration) time.Time {
+	if precision <= 0 {
+		return t
+	}
+	return t.Truncate(precision)
+}
+
 func avroEncode(codec *goavro.Codec, blob []byte) ([]byte, error) {
 	native, _, err := codec.NativeFromTextual(blob)
 	if err != nil {
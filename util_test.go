@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/json"
 	"testing"
+	"time"
 )
 
 func TestAvroEncode(t *testing.T) {
@@ -47,3 +48,13 @@ func TestAvroEncode(t *testing.T) {
 func TestMaxSoftFdLimit(t *testing.T) {
 	assertEqual(t, maxSoftFdLimit(), nil)
 }
+
+func TestTruncateTime(t *testing.T) {
+	ts := time.Date(2024, 1, 1, 12, 34, 56, 789, time.UTC)
+	assertEqual(t, truncateTime(ts, 0), ts)
+	assertEqual(t, truncateTime(ts, time.Hour), time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	assertEqual(t, truncateTime(ts, 24*time.Hour), time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	// Precisions align with UTC, no matter the time's location.
+	local := ts.In(time.FixedZone("UTC+5:30", 5*60*60+30*60))
+	assertEqual(t, truncateTime(local, time.Hour).UTC(), time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+// gitCommit and buildTime describe the build.  Our Makefile and Dockerfile set
+// them via -ldflags "-X main.gitCommit=... -X main.buildTime=...".  Note that
+// buildTime is the commit's timestamp rather than the current time, so that
+// builds remain reproducible.
+var (
+	gitCommit string
+	buildTime string
+)
+
+var (
+	errBadPCRs = errors.New("expected PCRs must have format '<index>=<hex SHA-384 digest>'")
+
+	// Nitro Enclaves have PCRs 0 to 8.
+	pcrIndexFmt = regexp.MustCompile(`^[0-8]$`)
+)
+
+// versionInfo tells operators and auditors which build of tokenizer is
+// running, so they can compare it to the reproducible build that they expect.
+type versionInfo struct {
+	Commit    string `json:"commit"`
+	BuildTime string `json:"build_time"`
+	GoVersion string `json:"go_version"`
+	Tokenizer string `json:"tokenizer"`
+	// ExpectedPCRs maps PCR indices to the values that the operator expects
+	// our enclave image to have.  Our attestation documents contain the
+	// actual values.
+	ExpectedPCRs map[string]string `json:"expected_pcrs,omitempty"`
+	// SigningKey is the base64-encoded Ed25519 public key that we sign
+	// flushed payloads with, if we do.
+	SigningKey string `json:"signing_key,omitempty"`
+}
+
+// newVersionInfo returns our version information.  If our build didn't set
+// gitCommit and buildTime, we fall back to the version control information
+// that the Go toolchain embeds, if any.
+func newVersionInfo(tokenizer string, expectedPCRs map[string]string) *versionInfo {
+	v := &versionInfo{
+		Commit:       gitCommit,
+		BuildTime:    buildTime,
+		GoVersion:    runtime.Version(),
+		Tokenizer:    tokenizer,
+		ExpectedPCRs: expectedPCRs,
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			switch {
+			case s.Key == "vcs.revision" && v.Commit == "":
+				v.Commit = s.Value
+			case s.Key == "vcs.time" && v.BuildTime == "":
+				v.BuildTime = s.Value
+			}
+		}
+	}
+	return v
+}
+
+func (v *versionInfo) handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		l.Printf("Failed to encode version information: %v", err)
+	}
+}
+
+// parsePCRs turns the given comma-separated list of PCRs, e.g.,
+// "0=<hex>,1=<hex>,2=<hex>", into a map from PCR index to lowercase hex
+// digest.
+func parsePCRs(s string) (map[string]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	pcrs := make(map[string]string)
+	for _, rawPCR := range strings.Split(s, ",") {
+		index, digest, found := strings.Cut(strings.TrimSpace(rawPCR), "=")
+		if !found || !pcrIndexFmt.MatchString(index) {
+			return nil, errBadPCRs
+		}
+		b, err := hex.DecodeString(digest)
+		if err != nil || len(b) != 48 {
+			return nil, errBadPCRs
+		}
+		pcrs[index] = hex.EncodeToString(b)
+	}
+	return pcrs, nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParsePCRs(t *testing.T) {
+	digest := strings.Repeat("ab", 48)
+	pcrs, err := parsePCRs("0=" + strings.ToUpper(digest) + ", 2=" + digest)
+	if err != nil {
+		t.Fatalf("Failed to parse PCRs: %v", err)
+	}
+	assertEqual(t, len(pcrs), 2)
+	assertEqual(t, pcrs["0"], digest)
+	assertEqual(t, pcrs["2"], digest)
+
+	pcrs, err = parsePCRs("")
+	assertEqual(t, err, nil)
+	assertEqual(t, len(pcrs), 0)
+
+	for _, s := range []string{
+		"0",
+		"9=" + digest,
+		"0=" + digest[2:],
+		"0=" + strings.Repeat("zz", 48),
+	} {
+		if _, err := parsePCRs(s); err != errBadPCRs {
+			t.Fatalf("Expected error %v for %q but got %v.", errBadPCRs, s, err)
+		}
+	}
+}
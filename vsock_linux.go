@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// vsockListener implements net.Listener for AF_VSOCK sockets.  The standard
+// library doesn't know about vsock, so we manage the socket ourselves but let
+// the runtime's network poller wait for connections.
+type vsockListener struct {
+	f    *os.File
+	rc   syscall.RawConn
+	addr *vsockAddr
+}
+
+// vsockConn implements net.Conn for AF_VSOCK sockets.  Reads, writes, and
+// deadlines are handled by the embedded file.
+type vsockConn struct {
+	*os.File
+	local, remote *vsockAddr
+}
+
+func (c *vsockConn) LocalAddr() net.Addr  { return c.local }
+func (c *vsockConn) RemoteAddr() net.Addr { return c.remote }
+
+// listenVsock listens for connections on the given vsock port, from any
+// context ID.
+func listenVsock(port uint32) (net.Listener, error) {
+	fd, err := unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	sa := &unix.SockaddrVM{CID: unix.VMADDR_CID_ANY, Port: port}
+	if err := unix.Bind(fd, sa); err != nil {
+		unix.Close(fd)
+		return nil, os.NewSyscallError("bind", err)
+	}
+	if err := unix.Listen(fd, unix.SOMAXCONN); err != nil {
+		unix.Close(fd)
+		return nil, os.NewSyscallError("listen", err)
+	}
+
+	f := os.NewFile(uintptr(fd), "vsock")
+	rc, err := f.SyscallConn()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &vsockListener{
+		f:    f,
+		rc:   rc,
+		addr: &vsockAddr{cid: unix.VMADDR_CID_ANY, port: port},
+	}, nil
+}
+
+func (v *vsockListener) Accept() (net.Conn, error) {
+	var (
+		nfd       int
+		sa        unix.Sockaddr
+		acceptErr error
+	)
+	err := v.rc.Read(func(fd uintptr) bool {
+		nfd, sa, acceptErr = unix.Accept4(int(fd), unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC)
+		return acceptErr != unix.EAGAIN
+	})
+	if err != nil {
+		return nil, err
+	}
+	if acceptErr != nil {
+		return nil, os.NewSyscallError("accept4", acceptErr)
+	}
+
+	remote := &vsockAddr{}
+	if vm, ok := sa.(*unix.SockaddrVM); ok {
+		remote.cid, remote.port = vm.CID, vm.Port
+	}
+	return &vsockConn{
+		File:   os.NewFile(uintptr(nfd), "vsock-conn"),
+		local:  v.addr,
+		remote: remote,
+	}, nil
+}
+
+func (v *vsockListener) Close() error {
+	return v.f.Close()
+}
+
+func (v *vsockListener) Addr() net.Addr {
+	return v.addr
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+func listenVsock(port uint32) (net.Listener, error) {
+	return nil, errors.New("vsock is only supported on Linux")
+}